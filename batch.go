@@ -54,9 +54,32 @@ type BatchDeleteEntitiesInput struct {
 type BatchDeleteEntitiesOutput struct{ Body []types.BatchResult }
 
 type BatchCreateCommandsInput struct {
-	Body []types.BatchCommandItem `doc:"List of (plugin_id, device_id, entity_id, payload) items to send as commands"`
+	IdempotencyKey string                   `header:"Idempotency-Key" doc:"Client-chosen key. Repeating the batch with the same key within the idempotency window returns the original results instead of creating the commands again."`
+	Body           []types.BatchCommandItem `doc:"List of (plugin_id, device_id, entity_id, payload) items to send as commands"`
+
+	headers map[string]string
+}
+
+func (i *BatchCreateCommandsInput) Resolve(ctx huma.Context) []error {
+	i.headers = policyHeaders(ctx.Header)
+	return nil
+}
+
+type BatchCreateCommandsOutput struct {
+	Replayed string `header:"Idempotent-Replayed" doc:"\"true\" when the results are for an earlier request with the same Idempotency-Key"`
+	Body     []types.BatchCommandResult
+}
+
+// BatchCommandRef identifies a gateway command to cancel.
+type BatchCommandRef struct {
+	PluginID  string `json:"plugin_id"`
+	CommandID string `json:"command_id"`
+}
+
+type BatchCancelCommandsInput struct {
+	Body []BatchCommandRef `doc:"List of (plugin_id, command_id) pairs to cancel"`
 }
-type BatchCreateCommandsOutput struct{ Body []types.BatchCommandResult }
+type BatchCancelCommandsOutput struct{ Body []types.BatchCommandResult }
 
 // ---------------------------------------------------------------------------
 // Route registration
@@ -71,7 +94,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Fetches specific devices by (plugin_id, device_id). Groups requests by plugin for efficiency.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchGetDevicesInput) (*BatchGetDevicesOutput, error) {
-		return &BatchGetDevicesOutput{Body: batchGetDevices(input.Body)}, nil
+		return &BatchGetDevicesOutput{Body: batchGetDevices(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -82,7 +105,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Creates multiple devices across plugins in a single call.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchCreateDevicesInput) (*BatchCreateDevicesOutput, error) {
-		return &BatchCreateDevicesOutput{Body: batchCreateDevices(input.Body)}, nil
+		return &BatchCreateDevicesOutput{Body: batchCreateDevices(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -93,7 +116,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Updates multiple devices across plugins in a single call.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchUpdateDevicesInput) (*BatchUpdateDevicesOutput, error) {
-		return &BatchUpdateDevicesOutput{Body: batchUpdateDevices(input.Body)}, nil
+		return &BatchUpdateDevicesOutput{Body: batchUpdateDevices(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -104,7 +127,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Deletes multiple devices across plugins. Pass device refs in the request body.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchDeleteDevicesInput) (*BatchDeleteDevicesOutput, error) {
-		return &BatchDeleteDevicesOutput{Body: batchDeleteDevices(input.Body)}, nil
+		return &BatchDeleteDevicesOutput{Body: batchDeleteDevices(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -115,7 +138,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Fetches specific entities by (plugin_id, device_id, entity_id). Groups requests by device for efficiency.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchGetEntitiesInput) (*BatchGetEntitiesOutput, error) {
-		return &BatchGetEntitiesOutput{Body: batchGetEntities(input.Body)}, nil
+		return &BatchGetEntitiesOutput{Body: batchGetEntities(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -126,7 +149,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Creates multiple entities across plugins in a single call.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchCreateEntitiesInput) (*BatchCreateEntitiesOutput, error) {
-		return &BatchCreateEntitiesOutput{Body: batchCreateEntities(input.Body)}, nil
+		return &BatchCreateEntitiesOutput{Body: batchCreateEntities(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -137,7 +160,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Updates multiple entities across plugins in a single call.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchUpdateEntitiesInput) (*BatchUpdateEntitiesOutput, error) {
-		return &BatchUpdateEntitiesOutput{Body: batchUpdateEntities(input.Body)}, nil
+		return &BatchUpdateEntitiesOutput{Body: batchUpdateEntities(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -148,7 +171,7 @@ func registerBatchRoutes(api huma.API) {
 		Description: "Deletes multiple entities across plugins. Pass entity refs in the request body.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchDeleteEntitiesInput) (*BatchDeleteEntitiesOutput, error) {
-		return &BatchDeleteEntitiesOutput{Body: batchDeleteEntities(input.Body)}, nil
+		return &BatchDeleteEntitiesOutput{Body: batchDeleteEntities(ctx, input.Body)}, nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -156,10 +179,39 @@ func registerBatchRoutes(api huma.API) {
 		Method:      http.MethodPost,
 		Path:        "/api/batch/commands",
 		Summary:     "Create commands",
-		Description: "Sends multiple commands across plugins in a single call. Returns one result per item in input order.",
+		Description: "Queues multiple commands across plugins in a single call on the bulk priority lane. Each payload accepts the same gateway-only options as send-command (priority, coalesce, execute_at, delay, retry_policy). Returns one result per item in input order. A result carries the gateway command ID (gcmd-*) and its state when queued (pending, or scheduled for deferred commands), not the plugin's final status; poll get-command-status for completion. An item that cannot be queued, because its entity is not found, its payload is invalid, a policy denies it or its plugin's queue is full, reports the reason in its error without affecting the other items. With an Idempotency-Key header, a repeated batch within the idempotency window returns the original results, with current command states, instead of creating the commands again; reusing a key for a different batch returns 409.",
 		Tags:        []string{"batch"},
 	}, func(ctx context.Context, input *BatchCreateCommandsInput) (*BatchCreateCommandsOutput, error) {
-		return &BatchCreateCommandsOutput{Body: batchCreateCommands(input.Body)}, nil
+		key := input.IdempotencyKey
+		if key == "" {
+			return &BatchCreateCommandsOutput{Body: batchCreateCommands(ctx, input.Body, input.headers)}, nil
+		}
+		keys := commandService.IdempotencyKeys()
+		stored, replay, err := keys.Begin(batchCommandsIdempotencyScope, key, idempotencyFingerprint(input.Body))
+		if err != nil {
+			return nil, conflictErr(err.Error())
+		}
+		if replay {
+			var results []types.BatchCommandResult
+			if err := json.Unmarshal(stored, &results); err != nil {
+				return nil, pluginErr("stored idempotent response is unreadable")
+			}
+			return &BatchCreateCommandsOutput{Replayed: "true", Body: refreshBatchCommandResults(results)}, nil
+		}
+		results := batchCreateCommands(ctx, input.Body, input.headers)
+		keys.Complete(batchCommandsIdempotencyScope, key, results)
+		return &BatchCreateCommandsOutput{Body: results}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "batch-cancel-commands",
+		Method:      http.MethodDelete,
+		Path:        "/api/batch/commands",
+		Summary:     "Cancel commands",
+		Description: "Cancels multiple gateway commands that have not been dispatched yet. Pass command refs in the request body. Returns one result per item in input order.",
+		Tags:        []string{"batch"},
+	}, func(ctx context.Context, input *BatchCancelCommandsInput) (*BatchCancelCommandsOutput, error) {
+		return &BatchCancelCommandsOutput{Body: batchCancelCommands(input.Body)}, nil
 	})
 }
 
@@ -167,7 +219,7 @@ func registerBatchRoutes(api huma.API) {
 // Handlers (logic unchanged from original batch.go)
 // ---------------------------------------------------------------------------
 
-func batchGetDevices(refs []types.BatchDeviceRef) []types.BatchResult {
+func batchGetDevices(ctx context.Context, refs []types.BatchDeviceRef) []types.BatchResult {
 	byPlugin := map[string][]string{}
 	for _, ref := range refs {
 		byPlugin[ref.PluginID] = append(byPlugin[ref.PluginID], ref.DeviceID)
@@ -175,7 +227,7 @@ func batchGetDevices(refs []types.BatchDeviceRef) []types.BatchResult {
 	index := map[string]types.Device{}
 	pluginErr := map[string]string{}
 	for pluginID, ids := range byPlugin {
-		resp := routeRPC(pluginID, "devices/list", nil)
+		resp := routeRPCContext(ctx, pluginID, "devices/list", nil)
 		if resp.Error != nil {
 			for _, id := range ids {
 				pluginErr[pluginID+"|"+id] = resp.Error.Message
@@ -210,11 +262,11 @@ func batchGetDevices(refs []types.BatchDeviceRef) []types.BatchResult {
 	return results
 }
 
-func batchCreateDevices(items []types.BatchDeviceItem) []types.BatchResult {
+func batchCreateDevices(ctx context.Context, items []types.BatchDeviceItem) []types.BatchResult {
 	results := make([]types.BatchResult, len(items))
 	for i, item := range items {
 		r := types.BatchResult{PluginID: item.PluginID, DeviceID: item.Device.ID}
-		resp := routeRPC(item.PluginID, "devices/create", item.Device)
+		resp := routeRPCContext(ctx, item.PluginID, "devices/create", item.Device)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -226,11 +278,11 @@ func batchCreateDevices(items []types.BatchDeviceItem) []types.BatchResult {
 	return results
 }
 
-func batchUpdateDevices(items []types.BatchDeviceItem) []types.BatchResult {
+func batchUpdateDevices(ctx context.Context, items []types.BatchDeviceItem) []types.BatchResult {
 	results := make([]types.BatchResult, len(items))
 	for i, item := range items {
 		r := types.BatchResult{PluginID: item.PluginID, DeviceID: item.Device.ID}
-		resp := routeRPC(item.PluginID, "devices/update", item.Device)
+		resp := routeRPCContext(ctx, item.PluginID, "devices/update", item.Device)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -242,11 +294,11 @@ func batchUpdateDevices(items []types.BatchDeviceItem) []types.BatchResult {
 	return results
 }
 
-func batchDeleteDevices(refs []types.BatchDeviceRef) []types.BatchResult {
+func batchDeleteDevices(ctx context.Context, refs []types.BatchDeviceRef) []types.BatchResult {
 	results := make([]types.BatchResult, len(refs))
 	for i, ref := range refs {
 		r := types.BatchResult{PluginID: ref.PluginID, DeviceID: ref.DeviceID}
-		resp := routeRPC(ref.PluginID, "devices/delete", ref.DeviceID)
+		resp := routeRPCContext(ctx, ref.PluginID, "devices/delete", ref.DeviceID)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -257,7 +309,7 @@ func batchDeleteDevices(refs []types.BatchDeviceRef) []types.BatchResult {
 	return results
 }
 
-func batchGetEntities(refs []types.BatchEntityRef) []types.BatchResult {
+func batchGetEntities(ctx context.Context, refs []types.BatchEntityRef) []types.BatchResult {
 	type deviceKey struct{ pluginID, deviceID string }
 	byDevice := map[deviceKey][]string{}
 	for _, ref := range refs {
@@ -267,7 +319,7 @@ func batchGetEntities(refs []types.BatchEntityRef) []types.BatchResult {
 	index := map[string]types.Entity{}
 	deviceErr := map[string]string{}
 	for k := range byDevice {
-		resp := routeRPC(k.pluginID, "entities/list", map[string]string{"device_id": k.deviceID})
+		resp := routeRPCContext(ctx, k.pluginID, "entities/list", map[string]string{"device_id": k.deviceID})
 		entities, err := parseEntities(resp)
 		if err != nil {
 			deviceErr[k.pluginID+"|"+k.deviceID] = err.Error()
@@ -294,12 +346,12 @@ func batchGetEntities(refs []types.BatchEntityRef) []types.BatchResult {
 	return results
 }
 
-func batchCreateEntities(items []types.BatchEntityItem) []types.BatchResult {
+func batchCreateEntities(ctx context.Context, items []types.BatchEntityItem) []types.BatchResult {
 	results := make([]types.BatchResult, len(items))
 	for i, item := range items {
 		item.Entity.DeviceID = item.DeviceID
 		r := types.BatchResult{PluginID: item.PluginID, DeviceID: item.DeviceID, EntityID: item.Entity.ID}
-		resp := routeRPC(item.PluginID, "entities/create", item.Entity)
+		resp := routeRPCContext(ctx, item.PluginID, "entities/create", item.Entity)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -311,12 +363,12 @@ func batchCreateEntities(items []types.BatchEntityItem) []types.BatchResult {
 	return results
 }
 
-func batchUpdateEntities(items []types.BatchEntityItem) []types.BatchResult {
+func batchUpdateEntities(ctx context.Context, items []types.BatchEntityItem) []types.BatchResult {
 	results := make([]types.BatchResult, len(items))
 	for i, item := range items {
 		item.Entity.DeviceID = item.DeviceID
 		r := types.BatchResult{PluginID: item.PluginID, DeviceID: item.DeviceID, EntityID: item.Entity.ID}
-		resp := routeRPC(item.PluginID, "entities/update", item.Entity)
+		resp := routeRPCContext(ctx, item.PluginID, "entities/update", item.Entity)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -328,12 +380,12 @@ func batchUpdateEntities(items []types.BatchEntityItem) []types.BatchResult {
 	return results
 }
 
-func batchDeleteEntities(refs []types.BatchEntityRef) []types.BatchResult {
+func batchDeleteEntities(ctx context.Context, refs []types.BatchEntityRef) []types.BatchResult {
 	results := make([]types.BatchResult, len(refs))
 	for i, ref := range refs {
 		r := types.BatchResult{PluginID: ref.PluginID, DeviceID: ref.DeviceID, EntityID: ref.EntityID}
 		params := map[string]string{"device_id": ref.DeviceID, "entity_id": ref.EntityID}
-		resp := routeRPC(ref.PluginID, "entities/delete", params)
+		resp := routeRPCContext(ctx, ref.PluginID, "entities/delete", params)
 		if resp.Error != nil {
 			r.Error = resp.Error.Message
 		} else {
@@ -344,7 +396,7 @@ func batchDeleteEntities(refs []types.BatchEntityRef) []types.BatchResult {
 	return results
 }
 
-func batchCreateCommands(items []types.BatchCommandItem) []types.BatchCommandResult {
+func batchCreateCommands(ctx context.Context, items []types.BatchCommandItem, headers map[string]string) []types.BatchCommandResult {
 	results := make([]types.BatchCommandResult, len(items))
 	for i, item := range items {
 		r := types.BatchCommandResult{
@@ -352,21 +404,22 @@ func batchCreateCommands(items []types.BatchCommandItem) []types.BatchCommandRes
 			DeviceID: item.DeviceID,
 			EntityID: item.EntityID,
 		}
-		params := map[string]any{
-			"command_id": nextID("gcmd"),
-			"device_id":  item.DeviceID,
-			"entity_id":  item.EntityID,
-			"payload":    item.Payload,
-		}
-		resp := routeRPC(item.PluginID, "entities/commands/create", params)
-		if resp.Error != nil {
-			r.Error = resp.Error.Message
+		payload, opts, err := splitCommandOptions(item.Payload)
+		if err != nil {
+			r.Error = err.Error()
 			results[i] = r
 			continue
 		}
-		var status types.CommandStatus
-		if err := json.Unmarshal(resp.Result, &status); err != nil {
+		if opts.Priority == "" {
+			opts.Priority = CommandPriorityBulk
+		}
+		opts.Headers = headers
+		opts.CorrelationID = correlationIDFrom(ctx)
+		status, err := commandService.SubmitWithOptions(item.PluginID, item.DeviceID, item.EntityID, payload, opts)
+		if err != nil {
 			r.Error = err.Error()
+			r.CommandID = status.CommandID
+			r.State = status.State
 			results[i] = r
 			continue
 		}
@@ -377,3 +430,38 @@ func batchCreateCommands(items []types.BatchCommandItem) []types.BatchCommandRes
 	}
 	return results
 }
+
+const batchCommandsIdempotencyScope = "batch-create-commands"
+
+// refreshBatchCommandResults updates replayed batch results with the current
+// state of each command that is still tracked.
+func refreshBatchCommandResults(results []types.BatchCommandResult) []types.BatchCommandResult {
+	for i, r := range results {
+		if r.CommandID == "" {
+			continue
+		}
+		if status, ok := commandService.GetStatus(r.CommandID); ok {
+			results[i].State = status.State
+		}
+	}
+	return results
+}
+
+func batchCancelCommands(refs []BatchCommandRef) []types.BatchCommandResult {
+	results := make([]types.BatchCommandResult, len(refs))
+	for i, ref := range refs {
+		r := types.BatchCommandResult{PluginID: ref.PluginID, CommandID: ref.CommandID}
+		status, err := cancelCommand(ref.PluginID, ref.CommandID)
+		if err != nil {
+			r.Error = err.Error()
+			results[i] = r
+			continue
+		}
+		r.OK = true
+		r.DeviceID = status.DeviceID
+		r.EntityID = status.EntityID
+		r.State = status.State
+		results[i] = r
+	}
+	return results
+}
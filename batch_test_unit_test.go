@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestBatchCreateCommands_QueuesOnBulkLaneWithPerItemErrors(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	svc.resolver = &Resolver{lookup: fakeAddressLookup{"bulb": {ID: "bulb", PluginID: "p", DeviceID: "d", Domain: "light"}}}
+	// A queue with no workers and room for one command keeps the first item
+	// queued and rejects the next one as overloaded.
+	svc.dispatcher.queues["p"] = newPluginQueue("p", 1, 0)
+	prev := commandService
+	commandService = svc
+	defer func() { commandService = prev }()
+
+	turnOn := json.RawMessage(`{"type":"turn_on"}`)
+	results := batchCreateCommands(context.Background(), []types.BatchCommandItem{
+		{PluginID: "p", DeviceID: "d", EntityID: "ghost", Payload: turnOn},
+		{PluginID: "p", DeviceID: "d", EntityID: "bulb", Payload: turnOn},
+		{PluginID: "p", DeviceID: "d", EntityID: "bulb", Payload: turnOn},
+	}, nil)
+	if len(results) != 3 {
+		t.Fatalf("expected one result per item, got %d", len(results))
+	}
+
+	if r := results[0]; r.OK || r.EntityID != "ghost" || !strings.Contains(r.Error, "not found") {
+		t.Errorf("expected the unknown entity to fail on its own, got %+v", r)
+	}
+	queued := results[1]
+	if !queued.OK || queued.Error != "" || !strings.HasPrefix(queued.CommandID, "gcmd-") || queued.State != types.CommandPending {
+		t.Errorf("expected a pending gateway command, got %+v", queued)
+	}
+	if st, ok := svc.GetStatus(queued.CommandID); !ok || st.State != types.CommandPending {
+		t.Errorf("expected the queued command to be pollable, got %+v (found=%v)", st, ok)
+	}
+	if lanes := svc.dispatcher.queues["p"].stats().Lanes; lanes[string(CommandPriorityBulk)] != 1 {
+		t.Errorf("expected the command on the bulk lane, got %+v", lanes)
+	}
+	if r := results[2]; r.OK || !strings.Contains(r.Error, "is full") {
+		t.Errorf("expected the item over capacity to report the full queue, got %+v", r)
+	}
+}
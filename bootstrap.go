@@ -55,6 +55,24 @@ func run() {
 			slog.Warn("history close error", "error", err)
 		}
 	}()
+	if err := rpcTimeouts.Load(dataDir); err != nil {
+		slog.Warn("failed to load rpc timeouts", "error", err)
+	}
+	if err := commandService.RetryPolicies().Load(dataDir); err != nil {
+		slog.Warn("failed to load command retry policies", "error", err)
+	}
+	if err := commandService.Policies().Load(dataDir); err != nil {
+		slog.Warn("failed to load command policies", "error", err)
+	}
+	if err := commandService.IdempotencyKeys().Load(dataDir); err != nil {
+		slog.Warn("failed to load idempotency keys", "error", err)
+	}
+	if err := commandService.LoadScheduled(dataDir); err != nil {
+		slog.Warn("failed to load scheduled commands", "error", err)
+	}
+	if err := commandService.Rehydrate(historyService); err != nil {
+		slog.Warn("failed to rehydrate command statuses", "error", err)
+	}
 	gatewayRT = gatewayRuntimeInfo{NATSURL: natsURL, Version: getenv("APP_VERSION")}
 
 	gatewayID := strings.TrimPrefix(rpcSubject, types.SubjectRPCPrefix)
@@ -109,7 +127,7 @@ func run() {
 	}
 
 	_, err = js.AddStream(&nats.StreamConfig{
-		Name:     "EVENTS",
+		Name:     eventsStreamName,
 		Subjects: []string{types.SubjectEntityEvents},
 		Storage:  nats.FileStorage,
 		MaxMsgs:  5000,
@@ -129,11 +147,12 @@ func run() {
 	}
 
 	historyCtx, stopHistory := context.WithCancel(context.Background())
+	historyService.SetInsertObserver(metrics.ObserveHistoryInsert)
 	historyService.Start(historyCtx, nc, js)
 	startGatewayDiagnostics()
 
 	dynamicEventService = newDynamicEventService()
-	if err := dynamicEventService.Start(nc); err != nil {
+	if err := dynamicEventService.Start(nc, js); err != nil {
 		slog.Error("failed to start dynamic event service", "error", err)
 		os.Exit(1)
 	}
@@ -142,6 +161,8 @@ func run() {
 	subscribeRegistry()
 	selfRegister(rpcSubject)
 	startDiscoveryProbe(historyCtx)
+	startPluginLivenessChecker(historyCtx, pluginLiveness)
+	commandService.StartScheduled()
 
 	r, humaAPI := buildRouter()
 	srv := &http.Server{
@@ -158,7 +179,12 @@ func run() {
 
 	// MCP bridge over Stdio — tools are generated directly from the OpenAPI spec,
 	// so every REST route is automatically available to AI agents.
-	mcpBridge := gatewaymcp.New(humaAPI, "http://"+apiHost+":"+apiPort)
+	// Plugin RPC methods advertised later are added and removed as they change.
+	var mcpBridge *gatewaymcp.Bridge
+	pluginRPCDocs.watch(func() rpcMethodWatcher {
+		mcpBridge = gatewaymcp.New(humaAPI, "http://"+apiHost+":"+apiPort)
+		return mcpBridge
+	})
 	go mcpBridge.Serve()
 
 	waitForShutdownSignal()
@@ -183,16 +209,11 @@ func subscribeRegistry() {
 			return
 		}
 
-		for _, schema := range reg.Manifest.Schemas {
-			types.RegisterDomain(schema)
-		}
-		regMu.Lock()
-		registry[reg.Manifest.ID] = pluginRecord{
-			Registration: reg,
-			Valid:        true,
-		}
-		regMu.Unlock()
+		events := pluginRegistered(reg, m.Data, time.Now())
 		slog.Debug("plugin registered", "plugin_id", reg.Manifest.ID)
+		for _, ev := range events {
+			publishPluginLifecycle(ev)
+		}
 	})
 }
 
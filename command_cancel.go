@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Cancel withdraws a gateway command that has not been dispatched yet:
+// scheduled commands are unscheduled, queued commands and commands waiting to
+// retry are removed from their plugin queue, and group commands stop
+// dispatching their remaining leaves.
+// Commands whose RPC is already in flight, or that have finished, cannot be
+// cancelled.
+func (s *Command) Cancel(commandID string) (GatewayCommandStatus, error) {
+	status, ok := s.statuses.Get(commandID)
+	if !ok {
+		return GatewayCommandStatus{}, commandErr(CommandErrNotFound, "command not found", nil)
+	}
+	if isTerminalCommandState(status.State) {
+		return status, commandErr(CommandErrNotCancellable, fmt.Sprintf("command already %s", status.State), nil)
+	}
+
+	if status.State == CommandScheduled {
+		if st, ok := s.CancelScheduled(commandID); ok {
+			return st, nil
+		}
+	}
+
+	s.mu.RLock()
+	run, isGroup := s.runs[commandID]
+	s.mu.RUnlock()
+	if isGroup {
+		status = run.cancel()
+		status.State = CommandCancelled
+		status.LastUpdatedAt = time.Now().UTC()
+		s.updateStatus(status)
+		slog.Info("group command cancelled", "command_id", commandID)
+		return status, nil
+	}
+
+	if st, ok := s.dispatcher.Cancel(status.PluginID, commandID); ok {
+		return st, nil
+	}
+	return status, commandErr(CommandErrNotCancellable, "command is already being dispatched", nil)
+}
@@ -1,38 +1,82 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/slidebolt/sdk-types"
 )
 
-type Dispatcher struct{}
+// Dispatcher executes commands from per-plugin bounded queues (see
+// command_queue.go), each served by its own worker pool.
+type Dispatcher struct {
+	retry *retryPolicyStore
+	cfg   dispatchConfig
+
+	mu       sync.Mutex
+	queues   map[string]*pluginQueue
+	retrying map[string]*pendingRetry
+	closed   bool
+}
+
+// pendingRetry is a job waiting out its retry backoff. It holds no worker
+// while it waits.
+type pendingRetry struct {
+	job   commandJob
+	timer *time.Timer
+}
 
 func CommandDispatcher() *Dispatcher {
-	return &Dispatcher{}
+	return &Dispatcher{
+		retry:    newRetryPolicyStore(),
+		cfg:      dispatchConfigFromEnv(),
+		queues:   make(map[string]*pluginQueue),
+		retrying: make(map[string]*pendingRetry),
+	}
 }
 
+// Execute makes one attempt to send the command to its plugin. An RPC failure
+// that the resolved RetryPolicy allows to be retried is reported through
+// job.onAttempt, so it is published and recorded in history, and the job is
+// re-queued once its backoff has passed rather than waiting on the worker.
 func (d *Dispatcher) Execute(job commandJob) {
 	t := job.target
-	rpcStart := time.Now()
-	slog.Info("execute start", "command_id", job.rootStatus.CommandID, "plugin_id", job.rootStatus.PluginID, "device_id", job.rootStatus.DeviceID, "entity_id", job.rootStatus.EntityID)
+	if job.cancelled != nil && job.cancelled() {
+		completeCancelled(job)
+		return
+	}
+	policy := d.retry.Resolve(t.PluginID, job.retry)
+	attempt := job.rootStatus.Attempts + 1
+	slog.Info("execute start", "command_id", job.rootStatus.CommandID, "plugin_id", job.rootStatus.PluginID, "device_id", job.rootStatus.DeviceID, "entity_id", job.rootStatus.EntityID, "attempt", attempt, "max_attempts", policy.MaxAttempts)
 
-	resp := routeRPC(t.PluginID, "entities/commands/create", map[string]any{
+	rpcStart := time.Now()
+	resp := routeRPCContext(withCorrelationID(context.Background(), job.rootStatus.CorrelationID), t.PluginID, "entities/commands/create", map[string]any{
 		"command_id": job.rootStatus.CommandID,
 		"device_id":  t.DeviceID,
 		"entity_id":  t.EntityID,
 		"payload":    job.payload,
 	})
-
+	job.rootStatus.Attempts = attempt
 	job.rootStatus.LastUpdatedAt = time.Now().UTC()
-
 	if resp.Error != nil {
-		slog.Warn("execute rpc failed", "command_id", job.rootStatus.CommandID, "plugin_id", t.PluginID, "device_id", t.DeviceID, "entity_id", t.EntityID, "duration_ms", time.Since(rpcStart).Milliseconds(), "error", resp.Error.Message)
-		job.rootStatus.State = types.CommandFailed
-		job.rootStatus.Error = resp.Error.Message
-		job.onComplete(job.rootStatus)
+		job.rootStatus.LastError = resp.Error.Message
+		if attempt >= policy.MaxAttempts || !policy.retryable(resp.Error.Code) {
+			slog.Warn("execute rpc failed", "command_id", job.rootStatus.CommandID, "plugin_id", t.PluginID, "device_id", t.DeviceID, "entity_id", t.EntityID, "attempt", attempt, "duration_ms", time.Since(rpcStart).Milliseconds(), "error", resp.Error.Message)
+			job.rootStatus.State = types.CommandFailed
+			job.rootStatus.Error = resp.Error.Message
+			job.onComplete(job.rootStatus)
+			return
+		}
+
+		delay := policy.backoff(attempt)
+		slog.Info("execute rpc retrying", "command_id", job.rootStatus.CommandID, "plugin_id", t.PluginID, "attempt", attempt, "max_attempts", policy.MaxAttempts, "backoff_ms", delay.Milliseconds(), "error", resp.Error.Message)
+		if job.onAttempt != nil {
+			job.onAttempt(job.rootStatus)
+		}
+		d.retryAfter(job, delay)
 		return
 	}
 
@@ -45,7 +89,7 @@ func (d *Dispatcher) Execute(job commandJob) {
 		return
 	}
 
-	slog.Info("execute rpc ok", "command_id", job.rootStatus.CommandID, "downstream_command_id", st.CommandID, "state", st.State, "duration_ms", time.Since(rpcStart).Milliseconds())
+	slog.Info("execute rpc ok", "command_id", job.rootStatus.CommandID, "downstream_command_id", st.CommandID, "state", st.State, "attempts", job.rootStatus.Attempts, "duration_ms", time.Since(rpcStart).Milliseconds())
 
 	if st.State == types.CommandFailed {
 		job.rootStatus.State = types.CommandFailed
@@ -56,3 +100,42 @@ func (d *Dispatcher) Execute(job commandJob) {
 	job.onComplete(job.rootStatus)
 	slog.Info("execute complete", "command_id", job.rootStatus.CommandID, "state", job.rootStatus.State, "error", job.rootStatus.Error)
 }
+
+// retryAfter re-queues job once delay has passed. Until then the job can be
+// withdrawn by Cancel, and Close fails it.
+func (d *Dispatcher) retryAfter(job commandJob, delay time.Duration) {
+	id := job.rootStatus.CommandID
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		failDispatcherClosed(job)
+		return
+	}
+	r := &pendingRetry{job: job}
+	r.timer = time.AfterFunc(delay, func() { d.resume(id, r) })
+	d.retrying[id] = r
+	d.mu.Unlock()
+}
+
+// resume puts a job whose backoff has passed back on its plugin's queue. It
+// does nothing if the retry was cancelled or the dispatcher closed meanwhile.
+func (d *Dispatcher) resume(id string, r *pendingRetry) {
+	d.mu.Lock()
+	if d.retrying[id] != r {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.retrying, id)
+	d.mu.Unlock()
+
+	job := r.job
+	if job.cancelled != nil && job.cancelled() {
+		completeCancelled(job)
+		return
+	}
+	// A retry must not take the place of a newer queued command.
+	job.coalesce = false
+	if err := d.EnqueueWait(job); err != nil {
+		failDispatcherClosed(job)
+	}
+}
@@ -12,6 +12,9 @@ const (
 	CommandErrProjectionUnavailable CommandErrorCode = "projection_unavailable"
 	CommandErrInvalidPayload        CommandErrorCode = "invalid_payload"
 	CommandErrUnsupportedAction     CommandErrorCode = "unsupported_action"
+	CommandErrOverloaded            CommandErrorCode = "overloaded"
+	CommandErrNotCancellable        CommandErrorCode = "not_cancellable"
+	CommandErrPolicyDenied          CommandErrorCode = "policy_denied"
 )
 
 type CommandError struct {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// CommandExplainOutcome says what a command would do at one entity.
+type CommandExplainOutcome string
+
+const (
+	// ExplainDispatch: the command would be queued for the entity's plugin.
+	ExplainDispatch CommandExplainOutcome = "dispatch"
+	// ExplainFanOut: the entity is a group and the command would fan out to
+	// the entities matching its CommandQuery.
+	ExplainFanOut CommandExplainOutcome = "fan_out"
+	// ExplainUnsupportedAction: the entity does not list the action.
+	ExplainUnsupportedAction CommandExplainOutcome = "skipped_unsupported_action"
+	// ExplainGatewayOwned: fan-out skips leaves owned by the gateway itself.
+	ExplainGatewayOwned CommandExplainOutcome = "skipped_gateway_owned"
+	// ExplainCycle: the entity is already an ancestor in the tree.
+	ExplainCycle CommandExplainOutcome = "cycle_cut"
+	// ExplainDuplicate: the entity was already reached through another group.
+	ExplainDuplicate CommandExplainOutcome = "skipped_duplicate"
+	// ExplainPolicyDenied: a command policy rule would reject the command.
+	ExplainPolicyDenied CommandExplainOutcome = "denied_by_policy"
+	// ExplainInvalidPayload: the payload does not match the entity's schema.
+	ExplainInvalidPayload CommandExplainOutcome = "invalid_payload"
+)
+
+// CommandExplainNode is one entity in a command's resolution tree.
+type CommandExplainNode struct {
+	PluginID     string                 `json:"plugin_id"`
+	DeviceID     string                 `json:"device_id"`
+	EntityID     string                 `json:"entity_id"`
+	Domain       string                 `json:"domain,omitempty"`
+	Outcome      CommandExplainOutcome  `json:"outcome" enum:"dispatch,fan_out,skipped_unsupported_action,skipped_gateway_owned,cycle_cut,skipped_duplicate,denied_by_policy,invalid_payload"`
+	Reason       string                 `json:"reason,omitempty"`
+	CommandQuery *types.SearchQuery     `json:"command_query,omitempty" doc:"Query a fanning-out group resolves its members with"`
+	Policy       *CommandPolicyDecision `json:"policy,omitempty"`
+	Payload      json.RawMessage        `json:"payload,omitempty" doc:"Payload that would be sent, when a policy transform changed it"`
+	Children     []CommandExplainNode   `json:"children,omitempty"`
+}
+
+// CommandExplanation is the result of a dry run: the full resolution tree and
+// a count of entities per outcome.
+type CommandExplanation struct {
+	Action string                        `json:"action"`
+	Root   CommandExplainNode            `json:"root"`
+	Counts map[CommandExplainOutcome]int `json:"counts"`
+}
+
+// Explain resolves a command the way SubmitWithOptions and fanOut would,
+// including policy rules and payload validation, without creating a command
+// or dispatching anything.
+func (s *Command) Explain(pluginID, deviceID, entityID string, payload json.RawMessage, opts commandOptions) (CommandExplanation, error) {
+	action, _ := parseActionType(payload)
+	ent, err := s.resolver.lookup.FindEntity(pluginID, deviceID, entityID)
+	if err != nil {
+		return CommandExplanation{}, commandErr(CommandErrNotFound, "entity not found", errCommandTargetNotFound)
+	}
+	x := commandExplainer{
+		s:       s,
+		search:  performEntitySearch,
+		action:  action,
+		opts:    opts,
+		now:     time.Now(),
+		visited: map[string]bool{entityVisitKey(pluginID, deviceID, entityID): true},
+		path:    map[string]bool{},
+		counts:  map[CommandExplainOutcome]int{},
+	}
+	root := x.entity(ent, payload, true)
+	return CommandExplanation{Action: action, Root: root, Counts: x.counts}, nil
+}
+
+// commandExplainer walks a fan-out tree in the same order, and with the same
+// shared visited set, as fanOut.
+type commandExplainer struct {
+	s       *Command
+	search  func(types.SearchQuery) []types.Entity
+	action  string
+	opts    commandOptions
+	now     time.Time
+	visited map[string]bool
+	path    map[string]bool
+	counts  map[CommandExplainOutcome]int
+}
+
+func (x *commandExplainer) node(ent types.Entity, outcome CommandExplainOutcome, reason string) CommandExplainNode {
+	x.counts[outcome]++
+	return CommandExplainNode{
+		PluginID: ent.PluginID,
+		DeviceID: ent.DeviceID,
+		EntityID: ent.ID,
+		Domain:   ent.Domain,
+		Outcome:  outcome,
+		Reason:   reason,
+	}
+}
+
+func (x *commandExplainer) entity(ent types.Entity, payload json.RawMessage, root bool) CommandExplainNode {
+	if ent.CommandQuery == nil && len(ent.Actions) > 0 && !containsAction(ent.Actions, x.action) {
+		return x.node(ent, ExplainUnsupportedAction, "entity supports "+strings.Join(ent.Actions, ", "))
+	}
+
+	out, decision, err := x.s.policies.Evaluate(ent, x.action, payload, x.opts.Headers, x.now)
+	if err != nil {
+		n := x.node(ent, ExplainPolicyDenied, err.Error())
+		n.Policy = decision
+		return n
+	}
+	transformed := decision != nil && decision.OriginalPayload != nil
+	payload = out
+
+	var n CommandExplainNode
+	if ent.CommandQuery != nil && commandMatchesFilter(x.action, ent.CommandFilter) {
+		n = x.node(ent, ExplainFanOut, "")
+		q := *ent.CommandQuery
+		n.CommandQuery = &q
+		key := entityVisitKey(ent.PluginID, ent.DeviceID, ent.ID)
+		x.path[key] = true
+		n.Children = x.fanOut(q, payload)
+		delete(x.path, key)
+	} else if verr := validateEntityCommand(ent, x.action, payload); verr != nil {
+		n = x.node(ent, ExplainInvalidPayload, verr.Error())
+	} else {
+		reason := ""
+		if ent.CommandQuery != nil {
+			reason = "command_filter does not include the action; sent to the plugin directly"
+		}
+		if !root && isGatewayOwned(ent.PluginID) {
+			n = x.node(ent, ExplainGatewayOwned, reason)
+		} else {
+			n = x.node(ent, ExplainDispatch, reason)
+		}
+	}
+	n.Policy = decision
+	if transformed {
+		n.Payload = payload
+	}
+	return n
+}
+
+func (x *commandExplainer) fanOut(query types.SearchQuery, payload json.RawMessage) []CommandExplainNode {
+	var children []CommandExplainNode
+	for _, ent := range x.search(query) {
+		key := entityVisitKey(ent.PluginID, ent.DeviceID, ent.ID)
+		if x.visited[key] {
+			if x.path[key] {
+				children = append(children, x.node(ent, ExplainCycle, "entity is an ancestor of this group"))
+			} else {
+				children = append(children, x.node(ent, ExplainDuplicate, "entity already reached through another group"))
+			}
+			continue
+		}
+		x.visited[key] = true
+		children = append(children, x.entity(ent, payload, false))
+	}
+	return children
+}
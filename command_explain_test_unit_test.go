@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestCommandExplainer_WalksFanOutTree(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	lights := &types.SearchQuery{Labels: map[string][]string{"Room": {"Kitchen"}}}
+	upstairs := &types.SearchQuery{Labels: map[string][]string{"Floor": {"1"}}}
+	root := types.Entity{ID: "all", PluginID: "plugin-groups", DeviceID: "groups", CommandQuery: upstairs}
+	kitchen := types.Entity{ID: "kitchen", PluginID: "plugin-groups", DeviceID: "groups", CommandQuery: lights}
+	filtered := types.Entity{ID: "scene", PluginID: "plugin-groups", DeviceID: "groups", CommandQuery: lights, CommandFilter: []string{"turn_on"}}
+	lamp := types.Entity{ID: "lamp", PluginID: "plugin-hue", DeviceID: "d1", Domain: "light", Actions: []string{"turn_on", "turn_off"}}
+	lock := types.Entity{ID: "lock", PluginID: "plugin-zwave", DeviceID: "d2", Domain: "lock", Actions: []string{"lock", "unlock"}}
+	virtual := types.Entity{ID: "virtual", PluginID: gatewayPluginID, DeviceID: "d3", Domain: "switch"}
+
+	members := map[string][]types.Entity{
+		"Floor": {kitchen, filtered, root, lamp},
+		"Room":  {lamp, lock, virtual},
+	}
+	x := commandExplainer{
+		s: svc,
+		search: func(q types.SearchQuery) []types.Entity {
+			for k := range q.Labels {
+				return members[k]
+			}
+			return nil
+		},
+		action:  "turn_off",
+		now:     time.Now(),
+		visited: map[string]bool{entityVisitKey(root.PluginID, root.DeviceID, root.ID): true},
+		path:    map[string]bool{},
+		counts:  map[CommandExplainOutcome]int{},
+	}
+	tree := x.entity(root, json.RawMessage(`{"type":"turn_off"}`), true)
+
+	if tree.Outcome != ExplainFanOut || len(tree.Children) != 4 {
+		t.Fatalf("expected root to fan out to 4 entities, got %+v", tree)
+	}
+	k := tree.Children[0]
+	if k.Outcome != ExplainFanOut || len(k.Children) != 3 {
+		t.Fatalf("expected kitchen to fan out to 3 entities, got %+v", k)
+	}
+	want := []CommandExplainOutcome{ExplainDispatch, ExplainUnsupportedAction, ExplainGatewayOwned}
+	for i, w := range want {
+		if k.Children[i].Outcome != w {
+			t.Errorf("kitchen child %s: got %s, want %s", k.Children[i].EntityID, k.Children[i].Outcome, w)
+		}
+	}
+	if tree.Children[1].Outcome != ExplainDispatch || tree.Children[1].Reason == "" {
+		t.Errorf("expected filtered group to be sent directly with a reason, got %+v", tree.Children[1])
+	}
+	if tree.Children[2].Outcome != ExplainCycle {
+		t.Errorf("expected root reference to be cut as a cycle, got %s", tree.Children[2].Outcome)
+	}
+	if tree.Children[3].Outcome != ExplainDuplicate {
+		t.Errorf("expected lamp reached twice to be skipped, got %s", tree.Children[3].Outcome)
+	}
+	if x.counts[ExplainDispatch] != 2 || x.counts[ExplainFanOut] != 2 {
+		t.Errorf("unexpected counts %v", x.counts)
+	}
+}
+
+func TestCommandExplainer_ReportsPolicyDecisions(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	if err := svc.Policies().Set(CommandPolicies{Rules: []CommandPolicyRule{
+		{ID: "no-locks", Effect: CommandPolicyDeny, Match: CommandPolicyMatch{Entity: &types.SearchQuery{Domain: "lock"}}},
+	}}); err != nil {
+		t.Fatalf("set policies: %v", err)
+	}
+	x := commandExplainer{s: svc, search: performEntitySearch, action: "lock", now: time.Now(), visited: map[string]bool{}, path: map[string]bool{}, counts: map[CommandExplainOutcome]int{}}
+	n := x.entity(types.Entity{ID: "lock", PluginID: "p", Domain: "lock"}, json.RawMessage(`{"type":"lock"}`), true)
+	if n.Outcome != ExplainPolicyDenied || n.Policy == nil || n.Policy.Rules[0] != "no-locks" {
+		t.Fatalf("expected policy denial, got %+v", n)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// groupFanOutMetaKey is the entity meta key holding a group's
+// groupFanOutSettings, e.g. {"concurrency": 8, "stagger_ms": 150}.
+const groupFanOutMetaKey = "fanout"
+
+// defaultFanOutConcurrency bounds how many leaves of one group command may be
+// queued or executing at once. Override with GATEWAY_FANOUT_CONCURRENCY.
+const defaultFanOutConcurrency = 16
+
+// groupFanOutSettings control how a group command dispatches its leaves.
+// Zero fields inherit from the enclosing group, or the gateway default.
+type groupFanOutSettings struct {
+	Concurrency int `json:"concurrency,omitempty"`
+	StaggerMS   int `json:"stagger_ms,omitempty"`
+}
+
+func groupFanOutSettingsFromEnv() groupFanOutSettings {
+	g := groupFanOutSettings{Concurrency: defaultFanOutConcurrency}
+	if v := strings.TrimSpace(getenv("GATEWAY_FANOUT_CONCURRENCY")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			g.Concurrency = n
+		} else {
+			slog.Warn("invalid GATEWAY_FANOUT_CONCURRENCY, using default", "value", v, "default", g.Concurrency)
+		}
+	}
+	return g
+}
+
+// groupFanOutSettingsFor reads the settings stored in a group entity's meta.
+func groupFanOutSettingsFor(ent types.Entity) groupFanOutSettings {
+	var g groupFanOutSettings
+	raw, ok := ent.Meta[groupFanOutMetaKey]
+	if !ok {
+		return g
+	}
+	if err := json.Unmarshal(raw, &g); err != nil {
+		slog.Warn("invalid group fan-out settings in entity meta", "plugin_id", ent.PluginID, "device_id", ent.DeviceID, "entity_id", ent.ID, "error", err)
+		return groupFanOutSettings{}
+	}
+	return g
+}
+
+// fanOutPacer spaces out leaf dispatches by a fixed interval. It is only used
+// from the goroutine walking the fan-out tree.
+type fanOutPacer struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (p *fanOutPacer) wait() {
+	if p == nil || p.interval <= 0 {
+		return
+	}
+	if !p.last.IsZero() {
+		if d := p.interval - time.Since(p.last); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	p.last = time.Now()
+}
+
+// CommandPartiallyFailed is the terminal state of a group command when some,
+// but not all, of its children failed.
+const CommandPartiallyFailed types.CommandState = "partially_failed"
+
+// CommandChildSummary counts the outcomes of a group command's direct
+// children. Nested groups count according to their own derived state.
+type CommandChildSummary struct {
+	Total           int                 `json:"total"`
+	Succeeded       int                 `json:"succeeded"`
+	Failed          int                 `json:"failed"`
+	PartiallyFailed int                 `json:"partially_failed,omitempty"`
+	Cancelled       int                 `json:"cancelled,omitempty"`
+	Superseded      int                 `json:"superseded,omitempty"`
+	Errors          []CommandChildError `json:"errors,omitempty" doc:"Failed children and their errors"`
+}
+
+type CommandChildError struct {
+	CommandID string `json:"command_id"`
+	PluginID  string `json:"plugin_id"`
+	DeviceID  string `json:"device_id"`
+	EntityID  string `json:"entity_id"`
+	Error     string `json:"error"`
+}
+
+func (c *CommandChildSummary) add(st GatewayCommandStatus) {
+	c.Total++
+	switch st.State {
+	case types.CommandSucceeded:
+		c.Succeeded++
+	case types.CommandFailed:
+		c.Failed++
+		c.Errors = append(c.Errors, CommandChildError{
+			CommandID: st.CommandID,
+			PluginID:  st.PluginID,
+			DeviceID:  st.DeviceID,
+			EntityID:  st.EntityID,
+			Error:     st.Error,
+		})
+	case CommandPartiallyFailed:
+		c.PartiallyFailed++
+	case CommandCancelled:
+		c.Cancelled++
+	case CommandSuperseded:
+		c.Superseded++
+	}
+}
+
+// state derives a group's state from its children: failed when every child
+// that ran failed, partially_failed when only some did, succeeded otherwise.
+// Cancelled and superseded children do not count as failures.
+func (c *CommandChildSummary) state() types.CommandState {
+	switch {
+	case c.PartiallyFailed > 0, c.Failed > 0 && c.Succeeded > 0:
+		return CommandPartiallyFailed
+	case c.Failed > 0:
+		return types.CommandFailed
+	default:
+		return types.CommandSucceeded
+	}
+}
+
+// fanOutRun tracks one group command while its fan-out tree is being walked.
+// Nested groups get their own run linked to their parent, so cancelling any
+// group stops dispatch beneath it.
+type fanOutRun struct {
+	id        string
+	parent    *fanOutRun
+	cancelled atomic.Bool
+
+	// slots bounds the leaves in flight; pacer staggers their dispatch. Both
+	// are shared with nested groups that do not configure their own.
+	slots chan struct{}
+	pacer *fanOutPacer
+
+	mu       sync.Mutex
+	status   GatewayCommandStatus
+	children []string
+	summary  CommandChildSummary
+}
+
+func (r *fanOutRun) acquire() { r.slots <- struct{}{} }
+func (r *fanOutRun) release() { <-r.slots }
+
+func (r *fanOutRun) isCancelled() bool {
+	for ; r != nil; r = r.parent {
+		if r.cancelled.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// cancel marks the run cancelled and returns its status with the children
+// dispatched so far. It takes r.mu so that it is ordered against
+// publishFanOutProgress, which checks for cancellation under the same lock.
+func (r *fanOutRun) cancel() GatewayCommandStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancelled.Store(true)
+	status := r.status
+	status.Children = append([]string(nil), r.children...)
+	return status
+}
+
+func (r *fanOutRun) addChild(commandID string) {
+	r.mu.Lock()
+	r.children = append(r.children, commandID)
+	r.mu.Unlock()
+}
+
+// record notes the final status of a child command.
+func (r *fanOutRun) record(st GatewayCommandStatus) {
+	r.mu.Lock()
+	r.summary.add(st)
+	r.mu.Unlock()
+}
+
+// startFanOut registers a run for the group command status targeting ent.
+func (s *Command) startFanOut(status GatewayCommandStatus, ent types.Entity, parent *fanOutRun) *fanOutRun {
+	run := &fanOutRun{id: status.CommandID, parent: parent, status: status}
+	settings := groupFanOutSettingsFor(ent)
+	switch {
+	case settings.Concurrency > 0:
+		run.slots = make(chan struct{}, settings.Concurrency)
+	case parent != nil:
+		run.slots = parent.slots
+	default:
+		run.slots = make(chan struct{}, s.groupDefaults.Concurrency)
+	}
+	switch {
+	case settings.StaggerMS > 0:
+		run.pacer = &fanOutPacer{interval: time.Duration(settings.StaggerMS) * time.Millisecond}
+	case parent != nil:
+		run.pacer = parent.pacer
+	}
+	s.mu.Lock()
+	s.runs[run.id] = run
+	s.mu.Unlock()
+	return run
+}
+
+// publishFanOutProgress records the children of a group command once all of
+// them have been dispatched, so they can be polled while still running. The
+// status is written under run.mu so a concurrent cancel is never overwritten
+// by it.
+func (s *Command) publishFanOutProgress(run *fanOutRun) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.isCancelled() {
+		return
+	}
+	status := run.status
+	status.Children = append([]string(nil), run.children...)
+	status.LastUpdatedAt = time.Now().UTC()
+	s.updateStatus(status)
+}
+
+// finishFanOut records the final state of a group command once all of its
+// children have completed and returns it.
+func (s *Command) finishFanOut(run *fanOutRun) GatewayCommandStatus {
+	s.mu.Lock()
+	delete(s.runs, run.id)
+	s.mu.Unlock()
+
+	run.mu.Lock()
+	status := run.status
+	status.Children = append([]string(nil), run.children...)
+	summary := run.summary
+	run.mu.Unlock()
+
+	metrics.fanOutSize.Observe(float64(len(status.Children)))
+
+	status.Summary = &summary
+	status.State = summary.state()
+	status.Error = ""
+	if status.State != types.CommandSucceeded {
+		status.Error = "one or more child commands failed"
+	}
+	if run.isCancelled() {
+		status.State = CommandCancelled
+		status.Error = ""
+	}
+	status.LastUpdatedAt = time.Now().UTC()
+	s.updateStatus(status)
+	return status
+}
+
+// CommandStatusTree is a command status together with the statuses of the
+// commands it fanned out to.
+type CommandStatusTree struct {
+	Status   GatewayCommandStatus `json:"status"`
+	Children []CommandStatusTree  `json:"children,omitempty"`
+}
+
+// StatusTree returns the fan-out tree rooted at commandID. Children whose
+// statuses have already been evicted are omitted.
+func (s *Command) StatusTree(commandID string) (CommandStatusTree, bool) {
+	status, ok := s.statuses.Get(commandID)
+	if !ok {
+		return CommandStatusTree{}, false
+	}
+	return s.statusTree(status, map[string]bool{commandID: true}), true
+}
+
+func (s *Command) statusTree(status GatewayCommandStatus, seen map[string]bool) CommandStatusTree {
+	node := CommandStatusTree{Status: status}
+	for _, id := range status.Children {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		child, ok := s.statuses.Get(id)
+		if !ok {
+			continue
+		}
+		node.Children = append(node.Children, s.statusTree(child, seen))
+	}
+	return node
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const idempotencyKeysFile = "idempotency_keys.jsonl"
+
+// maxIdempotencyKeys caps how many keys are remembered at once.
+const maxIdempotencyKeys = 10000
+
+// idempotencyCompactSlack is how many stale journal lines are tolerated before
+// a compaction, so a nearly empty store is not rewritten on every tick.
+const idempotencyCompactSlack = 64
+
+// defaultIdempotencyWindow is how long an Idempotency-Key is remembered.
+// Override with GATEWAY_IDEMPOTENCY_WINDOW.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyFlushInterval is how often expired keys are pruned and the
+// journal is compacted or, after a failed append, rewritten.
+const idempotencyFlushInterval = time.Second
+
+var (
+	errIdempotencyKeyMismatch = errors.New("Idempotency-Key was already used for a different request")
+	errIdempotencyKeyInFlight = errors.New("a request with this Idempotency-Key is still being processed")
+)
+
+func idempotencyWindowFromEnv() time.Duration {
+	window := defaultIdempotencyWindow
+	if v := strings.TrimSpace(getenv("GATEWAY_IDEMPOTENCY_WINDOW")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			window = d
+		} else {
+			slog.Warn("invalid GATEWAY_IDEMPOTENCY_WINDOW, using default", "value", v, "default", window)
+		}
+	}
+	return window
+}
+
+// idempotencyRecord is the stored response to a request made with an
+// Idempotency-Key. Response is empty while the request is still in flight.
+type idempotencyRecord struct {
+	Scope       string          `json:"scope"`
+	Key         string          `json:"key"`
+	Fingerprint string          `json:"fingerprint"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// idempotencyStore remembers the responses to keyed requests for a window and
+// persists completed ones to the gateway data dir, so a restart does not let a
+// retried request dispatch again. The file is a journal with one compact JSON
+// record per line: Complete appends and syncs its record before it returns, so
+// a key is on disk before its response is sent, and Flush rewrites the file
+// without expired or superseded lines once it has grown to twice the live
+// records. At most maxIdempotencyKeys records are kept; beyond that the oldest
+// completed ones are forgotten early.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	records map[string]idempotencyRecord
+	path    string
+	// lines is how many records the file holds, live or not; dirty is set
+	// when an append failed, so the file is missing a completed record.
+	lines int
+	dirty bool
+
+	// writeMu orders appends and rewrites, so an append never lands in a
+	// file that a rewrite is about to replace.
+	writeMu sync.Mutex
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{window: window, records: make(map[string]idempotencyRecord)}
+}
+
+func idempotencyRecordKey(scope, key string) string { return scope + "\x00" + key }
+
+// idempotencyFingerprint identifies a request so that a key reused for a
+// different request can be told apart from a retry.
+func idempotencyFingerprint(parts ...any) string {
+	h := sha256.New()
+	for _, p := range parts {
+		data, _ := json.Marshal(p)
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Load reads unexpired records from dataDir. A line that does not decode, such
+// as one cut short by a crash mid-append, is skipped; a later line for the
+// same key replaces an earlier one.
+func (s *idempotencyStore) Load(dataDir string) error {
+	path := filepath.Join(dataDir, idempotencyKeysFile)
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	data, err := diskIO.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-s.window)
+	skipped := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		s.lines++
+		var r idempotencyRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			skipped++
+			continue
+		}
+		if r.Key == "" || len(r.Response) == 0 || r.CreatedAt.Before(cutoff) {
+			continue
+		}
+		s.records[idempotencyRecordKey(r.Scope, r.Key)] = r
+	}
+	if skipped > 0 {
+		slog.Warn("skipped undecodable idempotency key records", "path", path, "count", skipped)
+	}
+	s.evictLocked(0)
+	return nil
+}
+
+// Begin claims key within scope for a request with the given fingerprint. If
+// the key has already completed, its stored response is returned with replay
+// set. A key still in flight, or used for a different request, is an error.
+// Otherwise the caller must follow up with Complete or Abort.
+func (s *idempotencyStore) Begin(scope, key, fingerprint string) (response json.RawMessage, replay bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rk := idempotencyRecordKey(scope, key)
+	if r, ok := s.records[rk]; ok && !r.CreatedAt.Before(time.Now().Add(-s.window)) {
+		switch {
+		case r.Fingerprint != fingerprint:
+			return nil, false, errIdempotencyKeyMismatch
+		case len(r.Response) == 0:
+			return nil, false, errIdempotencyKeyInFlight
+		}
+		return r.Response, true, nil
+	}
+	s.evictLocked(1)
+	s.records[rk] = idempotencyRecord{Scope: scope, Key: key, Fingerprint: fingerprint, CreatedAt: time.Now().UTC()}
+	return nil, false, nil
+}
+
+// Complete stores the response for a key claimed with Begin and appends it to
+// the journal before returning. If the append fails the record is kept in
+// memory and the whole file is rewritten by the next Flush.
+func (s *idempotencyStore) Complete(scope, key string, response any) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		s.Abort(scope, key)
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	rk := idempotencyRecordKey(scope, key)
+	r, ok := s.records[rk]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	r.Response = data
+	s.records[rk] = r
+	path := s.path
+	s.mu.Unlock()
+	if path == "" {
+		return
+	}
+
+	line, _ := json.Marshal(r)
+	err = diskIO.AppendFile(path, append(line, '\n'), 0o644)
+	s.mu.Lock()
+	if err != nil {
+		s.dirty = true
+	} else {
+		s.lines++
+	}
+	s.mu.Unlock()
+	if err != nil {
+		slog.Warn("failed to persist idempotency key", "path", path, "error", err)
+	}
+}
+
+// Abort releases a key claimed with Begin whose request failed, so it can be
+// retried.
+func (s *idempotencyStore) Abort(scope, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, idempotencyRecordKey(scope, key))
+}
+
+func (s *idempotencyStore) pruneLocked(now time.Time) {
+	cutoff := now.Add(-s.window)
+	for k, r := range s.records {
+		if r.CreatedAt.Before(cutoff) {
+			delete(s.records, k)
+		}
+	}
+}
+
+// evictLocked forgets the oldest completed records until room more records fit
+// under maxIdempotencyKeys. Keys still in flight are never evicted.
+func (s *idempotencyStore) evictLocked(room int) {
+	over := len(s.records) + room - maxIdempotencyKeys
+	if over <= 0 {
+		return
+	}
+	completed := make([]string, 0, len(s.records))
+	for k, r := range s.records {
+		if len(r.Response) > 0 {
+			completed = append(completed, k)
+		}
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return s.records[completed[i]].CreatedAt.Before(s.records[completed[j]].CreatedAt)
+	})
+	for i := 0; i < over && i < len(completed); i++ {
+		delete(s.records, completed[i])
+	}
+}
+
+// Flush prunes expired records and rewrites the journal with only the live
+// ones when an append has failed or the file holds more than twice as many
+// lines as there are live records. The file is replaced atomically, so a
+// crash leaves either the old or the new journal. Only the snapshot is taken
+// under the store lock; writeMu is held throughout so no append is lost to
+// the rewrite.
+func (s *idempotencyStore) Flush() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	s.pruneLocked(time.Now())
+	out := make([]idempotencyRecord, 0, len(s.records))
+	for _, r := range s.records {
+		if len(r.Response) > 0 {
+			out = append(out, r)
+		}
+	}
+	if s.path == "" || (!s.dirty && s.lines <= 2*len(out)+idempotencyCompactSlack) {
+		s.mu.Unlock()
+		return
+	}
+	s.dirty = false
+	path := s.path
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	var buf bytes.Buffer
+	for _, r := range out {
+		line, _ := json.Marshal(r)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	err := diskIO.ReplaceFile(path, buf.Bytes(), 0o644)
+	s.mu.Lock()
+	if err != nil {
+		s.dirty = true
+	} else {
+		s.lines = len(out)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		slog.Warn("failed to compact idempotency keys", "path", path, "error", err)
+	}
+}
+
+// flushLoop calls Flush every interval until stop is closed.
+func (s *idempotencyStore) flushLoop(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
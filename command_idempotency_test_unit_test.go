@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore_ReplaysCompletedRequests(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+	fp := idempotencyFingerprint("p", "d", "e", map[string]any{"type": "turn_on"})
+
+	if _, replay, err := s.Begin("send-command", "k1", fp); err != nil || replay {
+		t.Fatalf("first use: replay=%v err=%v", replay, err)
+	}
+	if _, _, err := s.Begin("send-command", "k1", fp); !errors.Is(err, errIdempotencyKeyInFlight) {
+		t.Fatalf("expected in-flight error, got %v", err)
+	}
+
+	s.Complete("send-command", "k1", map[string]string{"command_id": "gcmd-1"})
+	stored, replay, err := s.Begin("send-command", "k1", fp)
+	if err != nil || !replay {
+		t.Fatalf("expected replay, got replay=%v err=%v", replay, err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(stored, &got); err != nil || got["command_id"] != "gcmd-1" {
+		t.Fatalf("unexpected stored response %s", stored)
+	}
+
+	other := idempotencyFingerprint("p", "d", "e", map[string]any{"type": "turn_off"})
+	if _, _, err := s.Begin("send-command", "k1", other); !errors.Is(err, errIdempotencyKeyMismatch) {
+		t.Fatalf("expected mismatch error, got %v", err)
+	}
+	if _, replay, err := s.Begin("batch-create-commands", "k1", other); err != nil || replay {
+		t.Fatalf("keys must be scoped per operation: replay=%v err=%v", replay, err)
+	}
+}
+
+func TestIdempotencyStore_AbortReleasesKey(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+	if _, _, err := s.Begin("send-command", "k", "fp"); err != nil {
+		t.Fatal(err)
+	}
+	s.Abort("send-command", "k")
+	if _, replay, err := s.Begin("send-command", "k", "fp"); err != nil || replay {
+		t.Fatalf("expected aborted key to be reusable: replay=%v err=%v", replay, err)
+	}
+}
+
+func TestIdempotencyStore_PersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := newIdempotencyStore(time.Hour)
+	if err := first.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	first.Begin("send-command", "done", "fp")
+	first.Complete("send-command", "done", "gcmd-1")
+	first.Begin("send-command", "pending", "fp")
+	// No Flush: Complete must have written the key before returning, so a
+	// crash right after the response cannot reopen it.
+
+	second := newIdempotencyStore(time.Hour)
+	if err := second.Load(dir); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, replay, err := second.Begin("send-command", "done", "fp"); err != nil || !replay {
+		t.Fatalf("expected completed key to survive restart: replay=%v err=%v", replay, err)
+	}
+	if _, replay, err := second.Begin("send-command", "pending", "fp"); err != nil || replay {
+		t.Fatalf("expected in-flight key not to be persisted: replay=%v err=%v", replay, err)
+	}
+
+	expired := newIdempotencyStore(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := expired.Load(dir); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, replay, _ := expired.Begin("send-command", "done", "fp"); replay {
+		t.Error("expected keys older than the window to be dropped")
+	}
+}
+
+func TestIdempotencyStore_JournalSurvivesTruncatedAppend(t *testing.T) {
+	dir := t.TempDir()
+	first := newIdempotencyStore(time.Hour)
+	if err := first.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	first.Begin("send-command", "done", "fp")
+	first.Complete("send-command", "done", "gcmd-1")
+
+	// Simulate a crash part way through the next append.
+	path := filepath.Join(dir, idempotencyKeysFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"scope":"send-command","key":"cut`)
+	f.Close()
+
+	second := newIdempotencyStore(time.Hour)
+	if err := second.Load(dir); err != nil {
+		t.Fatalf("expected a truncated line to be skipped, got %v", err)
+	}
+	if _, replay, err := second.Begin("send-command", "done", "fp"); err != nil || !replay {
+		t.Fatalf("expected the complete record to survive: replay=%v err=%v", replay, err)
+	}
+}
+
+func TestIdempotencyStore_FlushCompactsJournal(t *testing.T) {
+	dir := t.TempDir()
+	s := newIdempotencyStore(time.Hour)
+	if err := s.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	n := 2*idempotencyCompactSlack + 1
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		s.Begin("send-command", key, "fp")
+		s.Complete("send-command", key, "gcmd")
+	}
+	// Age all but one record past the window.
+	s.mu.Lock()
+	for k, r := range s.records {
+		if r.Key != "k0" {
+			r.CreatedAt = r.CreatedAt.Add(-2 * time.Hour)
+			s.records[k] = r
+		}
+	}
+	s.mu.Unlock()
+
+	s.Flush()
+	data, err := os.ReadFile(filepath.Join(dir, idempotencyKeysFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Fatalf("expected compaction to keep 1 live record, got %d lines", lines)
+	}
+	if _, replay, _ := s.Begin("send-command", "k1", "fp"); replay {
+		t.Error("expected Flush to prune expired keys")
+	}
+}
+
+func TestIdempotencyStore_CapsRecordCount(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+	s.Begin("send-command", "in-flight", "fp")
+	for i := 0; i < maxIdempotencyKeys+10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		s.Begin("send-command", key, "fp")
+		s.Complete("send-command", key, "gcmd")
+		if i == 0 {
+			s.mu.Lock()
+			r := s.records[idempotencyRecordKey("send-command", key)]
+			r.CreatedAt = r.CreatedAt.Add(-time.Minute)
+			s.records[idempotencyRecordKey("send-command", key)] = r
+			s.mu.Unlock()
+		}
+	}
+	if n := len(s.records); n > maxIdempotencyKeys {
+		t.Fatalf("expected at most %d records, got %d", maxIdempotencyKeys, n)
+	}
+	if _, replay, _ := s.Begin("send-command", "k0", "fp"); replay {
+		t.Error("expected the oldest completed key to be evicted")
+	}
+	if _, _, err := s.Begin("send-command", "in-flight", "fp"); !errors.Is(err, errIdempotencyKeyInFlight) {
+		t.Fatalf("expected in-flight keys never to be evicted, got %v", err)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+const commandPoliciesFile = "command_policies.json"
+
+// CommandPolicyEffect is what a matching policy rule does to a command.
+type CommandPolicyEffect string
+
+const (
+	// CommandPolicyAllow admits the command and skips the remaining rules.
+	CommandPolicyAllow CommandPolicyEffect = "allow"
+	// CommandPolicyDeny rejects the command before it reaches the plugin.
+	CommandPolicyDeny CommandPolicyEffect = "deny"
+	// CommandPolicyTransform rewrites the payload and evaluation continues.
+	CommandPolicyTransform CommandPolicyEffect = "transform"
+)
+
+// CommandPolicyRule is one declarative guardrail evaluated before dispatch.
+// Rules run in order; the first allow or deny that matches decides, and every
+// matching transform before it is applied to the payload.
+type CommandPolicyRule struct {
+	ID          string                        `json:"id" doc:"Unique rule ID"`
+	Description string                        `json:"description,omitempty"`
+	Disabled    bool                          `json:"disabled,omitempty"`
+	Effect      CommandPolicyEffect           `json:"effect" enum:"allow,deny,transform"`
+	Match       CommandPolicyMatch            `json:"match" doc:"Conditions that must all hold for the rule to apply"`
+	Except      *CommandPolicyMatch           `json:"except,omitempty" doc:"The rule does not apply when these conditions all hold, e.g. a request header that overrides a deny"`
+	Reason      string                        `json:"reason,omitempty" doc:"Message returned when the rule denies a command"`
+	Set         map[string]any                `json:"set,omitempty" doc:"transform: payload fields to overwrite"`
+	Clamp       map[string]CommandPolicyRange `json:"clamp,omitempty" doc:"transform: numeric payload fields to keep within bounds"`
+}
+
+// CommandPolicyMatch selects commands. Empty fields match everything.
+type CommandPolicyMatch struct {
+	Entity  *types.SearchQuery   `json:"entity,omitempty" doc:"SearchQuery-style selector on the target entity (plugin_id, device_id, entity_id, domain, pattern, labels)"`
+	Actions []string             `json:"actions,omitempty" doc:"Action names or glob patterns"`
+	Payload map[string]any       `json:"payload,omitempty" doc:"Payload fields that must have exactly these values"`
+	Headers map[string]string    `json:"headers,omitempty" doc:"Request headers that must have exactly these values"`
+	Window  *CommandPolicyWindow `json:"window,omitempty" doc:"Time of day (and optionally days of week) during which the rule applies"`
+}
+
+// CommandPolicyWindow is a daily time window. A window whose end is before
+// its start wraps past midnight, e.g. 23:00-06:00.
+type CommandPolicyWindow struct {
+	Start    string   `json:"start" doc:"Start time, HH:MM"`
+	End      string   `json:"end" doc:"End time, HH:MM (exclusive)"`
+	Days     []string `json:"days,omitempty" doc:"Days of week the window starts on (mon, tue, ...); empty means every day"`
+	Timezone string   `json:"timezone,omitempty" doc:"IANA time zone; defaults to the gateway's local time"`
+}
+
+// CommandPolicyRange bounds a numeric payload field.
+type CommandPolicyRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// CommandPolicyDecision records how the policy engine treated a command.
+type CommandPolicyDecision struct {
+	Decision        string          `json:"decision" enum:"allowed,denied,transformed"`
+	Rules           []string        `json:"rules" doc:"IDs of the rules that matched, in evaluation order"`
+	Reason          string          `json:"reason,omitempty"`
+	OriginalPayload json.RawMessage `json:"original_payload,omitempty" doc:"Payload as submitted, when a transform rewrote it"`
+}
+
+// CommandPolicies is the ordered rule set.
+type CommandPolicies struct {
+	Rules []CommandPolicyRule `json:"rules"`
+}
+
+func (r CommandPolicyRule) validate() error {
+	if strings.TrimSpace(r.ID) == "" {
+		return errors.New("id is required")
+	}
+	switch r.Effect {
+	case CommandPolicyAllow, CommandPolicyDeny:
+		if len(r.Set) > 0 || len(r.Clamp) > 0 {
+			return fmt.Errorf("only transform rules may set or clamp fields")
+		}
+	case CommandPolicyTransform:
+		if len(r.Set) == 0 && len(r.Clamp) == 0 {
+			return fmt.Errorf("transform rule must set or clamp at least one field")
+		}
+		if _, ok := r.Set["type"]; ok {
+			return fmt.Errorf("transform rule may not change the command type")
+		}
+	default:
+		return fmt.Errorf("effect must be allow, deny or transform")
+	}
+	for field, rng := range r.Clamp {
+		if rng.Min == nil && rng.Max == nil {
+			return fmt.Errorf("clamp %q needs min or max", field)
+		}
+		if rng.Min != nil && rng.Max != nil && *rng.Min > *rng.Max {
+			return fmt.Errorf("clamp %q: min is greater than max", field)
+		}
+	}
+	if err := r.Match.validate(); err != nil {
+		return fmt.Errorf("match: %w", err)
+	}
+	if r.Except != nil {
+		if err := r.Except.validate(); err != nil {
+			return fmt.Errorf("except: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m CommandPolicyMatch) validate() error {
+	if m.Window == nil {
+		return nil
+	}
+	if _, err := parseClockMinutes(m.Window.Start); err != nil {
+		return fmt.Errorf("window start: %w", err)
+	}
+	if _, err := parseClockMinutes(m.Window.End); err != nil {
+		return fmt.Errorf("window end: %w", err)
+	}
+	for _, d := range m.Window.Days {
+		if _, ok := policyWeekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("window day %q is not one of mon, tue, wed, thu, fri, sat, sun", d)
+		}
+	}
+	if m.Window.Timezone != "" {
+		if _, err := time.LoadLocation(m.Window.Timezone); err != nil {
+			return fmt.Errorf("window timezone: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p CommandPolicies) validate() error {
+	seen := make(map[string]bool, len(p.Rules))
+	for i, r := range p.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, r.ID, err)
+		}
+		if seen[r.ID] {
+			return fmt.Errorf("duplicate rule id %q", r.ID)
+		}
+		seen[r.ID] = true
+	}
+	return nil
+}
+
+// commandPolicyRequest is what the policy engine knows about a command.
+type commandPolicyRequest struct {
+	entity  types.Entity
+	action  string
+	payload map[string]any
+	headers map[string]string
+	now     time.Time
+}
+
+func (m CommandPolicyMatch) matches(req commandPolicyRequest) bool {
+	if m.Entity != nil && !entityMatchesQuery(req.entity, *m.Entity) {
+		return false
+	}
+	if len(m.Actions) > 0 {
+		ok := false
+		for _, a := range m.Actions {
+			if matchDynEventPattern(a, req.action) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for k, want := range m.Payload {
+		if got, ok := req.payload[k]; !ok || !reflect.DeepEqual(got, want) {
+			return false
+		}
+	}
+	for k, want := range m.Headers {
+		if req.headers[strings.ToLower(k)] != want {
+			return false
+		}
+	}
+	if m.Window != nil && !m.Window.contains(req.now) {
+		return false
+	}
+	return true
+}
+
+func (r CommandPolicyRule) applies(req commandPolicyRequest) bool {
+	if r.Disabled || !r.Match.matches(req) {
+		return false
+	}
+	return r.Except == nil || !r.Except.matches(req)
+}
+
+// transform applies the rule's set and clamp to payload in place.
+func (r CommandPolicyRule) transform(payload map[string]any) {
+	for k, v := range r.Set {
+		payload[k] = v
+	}
+	for k, rng := range r.Clamp {
+		n, ok := payload[k].(float64)
+		if !ok {
+			continue
+		}
+		if rng.Min != nil && n < *rng.Min {
+			n = *rng.Min
+		}
+		if rng.Max != nil && n > *rng.Max {
+			n = *rng.Max
+		}
+		payload[k] = n
+	}
+}
+
+var policyWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w CommandPolicyWindow) contains(now time.Time) bool {
+	if w.Timezone != "" {
+		if loc, err := time.LoadLocation(w.Timezone); err == nil {
+			now = now.In(loc)
+		}
+	} else {
+		now = now.Local()
+	}
+	start, err1 := parseClockMinutes(w.Start)
+	end, err2 := parseClockMinutes(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	var in bool
+	if start <= end {
+		in = m >= start && m < end
+	} else {
+		in = m >= start || m < end
+		if m < end {
+			// Past midnight: the window started the previous day.
+			day = (day + 6) % 7
+		}
+	}
+	if !in || len(w.Days) == 0 {
+		return in
+	}
+	for _, d := range w.Days {
+		if policyWeekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// entityMatchesQuery applies a SearchQuery to a single entity. Each label key
+// must be present with one of the listed values (any value if none are listed).
+func entityMatchesQuery(ent types.Entity, q types.SearchQuery) bool {
+	if q.PluginID != "" && ent.PluginID != q.PluginID {
+		return false
+	}
+	if q.DeviceID != "" && ent.DeviceID != q.DeviceID {
+		return false
+	}
+	if q.EntityID != "" && ent.ID != q.EntityID {
+		return false
+	}
+	if q.Domain != "" && !strings.EqualFold(ent.Domain, q.Domain) {
+		return false
+	}
+	if q.Pattern != "" && !matchDynEventPattern(q.Pattern, ent.ID) {
+		return false
+	}
+	for key, values := range q.Labels {
+		have, ok := ent.Labels[key]
+		if !ok {
+			return false
+		}
+		if len(values) == 0 {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			for _, h := range have {
+				if strings.EqualFold(v, h) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// commandPolicyStore guards the active rules and persists changes to the
+// gateway data dir.
+type commandPolicyStore struct {
+	mu       sync.RWMutex
+	policies CommandPolicies
+	path     string
+	// writeMu serialises edits, from read to persist, so concurrent edits are
+	// not lost and the file is written in the same order as memory.
+	writeMu sync.Mutex
+}
+
+func newCommandPolicyStore() *commandPolicyStore {
+	return &commandPolicyStore{policies: CommandPolicies{Rules: []CommandPolicyRule{}}}
+}
+
+// Load reads rules from dataDir. A missing file means no rules.
+func (s *commandPolicyStore) Load(dataDir string) error {
+	path := filepath.Join(dataDir, commandPoliciesFile)
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	data, err := diskIO.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var p CommandPolicies
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if p.Rules == nil {
+		p.Rules = []CommandPolicyRule{}
+	}
+	s.mu.Lock()
+	s.policies = p
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *commandPolicyStore) Get() CommandPolicies {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return CommandPolicies{Rules: append([]CommandPolicyRule{}, s.policies.Rules...)}
+}
+
+// Set replaces the active rules and writes them to disk when a data dir has
+// been loaded.
+func (s *commandPolicyStore) Set(p CommandPolicies) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.set(p)
+}
+
+// set is Set for callers holding writeMu.
+func (s *commandPolicyStore) set(p CommandPolicies) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.Rules == nil {
+		p.Rules = []CommandPolicyRule{}
+	}
+	s.mu.Lock()
+	s.policies = p
+	path := s.path
+	s.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(p, "", "  ")
+	if err := diskIO.WriteFile(path, data, 0o644); err != nil {
+		slog.Warn("failed to persist command policies", "path", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Put adds rule, or replaces the rule with the same ID in place.
+func (s *commandPolicyStore) Put(rule CommandPolicyRule) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	p := s.Get()
+	replaced := false
+	for i, r := range p.Rules {
+		if r.ID == rule.ID {
+			p.Rules[i] = rule
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		p.Rules = append(p.Rules, rule)
+	}
+	return s.set(p)
+}
+
+// Delete removes the rule with the given ID. It reports false if there is none.
+func (s *commandPolicyStore) Delete(id string) (bool, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	p := s.Get()
+	for i, r := range p.Rules {
+		if r.ID == id {
+			p.Rules = append(p.Rules[:i], p.Rules[i+1:]...)
+			return true, s.set(p)
+		}
+	}
+	return false, nil
+}
+
+// HeaderNames returns the lower-cased names of the request headers that any
+// rule matches on. Only these are captured from requests.
+func (s *commandPolicyStore) HeaderNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[string]bool{}
+	var names []string
+	add := func(m *CommandPolicyMatch) {
+		if m == nil {
+			return
+		}
+		for k := range m.Headers {
+			k = strings.ToLower(k)
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	for i := range s.policies.Rules {
+		add(&s.policies.Rules[i].Match)
+		add(s.policies.Rules[i].Except)
+	}
+	return names
+}
+
+// Evaluate runs the rules against a command for ent. It returns the payload to
+// dispatch (rewritten if a transform applied) and the decision, which is nil
+// when no rule matched. A deny returns a CommandErrPolicyDenied error along
+// with the decision.
+func (s *commandPolicyStore) Evaluate(ent types.Entity, action string, payload json.RawMessage, headers map[string]string, now time.Time) (json.RawMessage, *CommandPolicyDecision, error) {
+	s.mu.RLock()
+	rules := s.policies.Rules
+	s.mu.RUnlock()
+	if len(rules) == 0 {
+		return payload, nil, nil
+	}
+
+	var fields map[string]any
+	_ = json.Unmarshal(payload, &fields)
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	req := commandPolicyRequest{entity: ent, action: action, payload: fields, headers: headers, now: now}
+	var decision *CommandPolicyDecision
+	transformed := false
+	for _, r := range rules {
+		if !r.applies(req) {
+			continue
+		}
+		if decision == nil {
+			decision = &CommandPolicyDecision{Decision: "allowed"}
+		}
+		decision.Rules = append(decision.Rules, r.ID)
+		switch r.Effect {
+		case CommandPolicyTransform:
+			r.transform(fields)
+			transformed = true
+			continue
+		case CommandPolicyDeny:
+			decision.Decision = "denied"
+			decision.Reason = r.Reason
+			if decision.Reason == "" {
+				decision.Reason = "denied by policy rule " + r.ID
+			}
+			return payload, decision, commandErr(CommandErrPolicyDenied, decision.Reason, nil)
+		}
+		break
+	}
+	if !transformed {
+		return payload, decision, nil
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return payload, decision, nil
+	}
+	decision.Decision = "transformed"
+	decision.OriginalPayload = payload
+	return out, decision, nil
+}
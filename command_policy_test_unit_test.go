@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func policyFloat(v float64) *float64 { return &v }
+
+func examplePolicies() CommandPolicies {
+	return CommandPolicies{Rules: []CommandPolicyRule{
+		{
+			ID:     "maintenance",
+			Effect: CommandPolicyDeny,
+			Match:  CommandPolicyMatch{Entity: &types.SearchQuery{PluginID: "plugin-hue"}},
+			Reason: "plugin-hue is under maintenance",
+		},
+		{
+			ID:     "critical-unlock",
+			Effect: CommandPolicyDeny,
+			Match: CommandPolicyMatch{
+				Entity:  &types.SearchQuery{Labels: map[string][]string{"Security": {"Critical"}}},
+				Actions: []string{"unlock"},
+			},
+			Except: &CommandPolicyMatch{Headers: map[string]string{"X-Security-Override": "yes"}},
+		},
+		{
+			ID:     "nursery-night",
+			Effect: CommandPolicyTransform,
+			Match: CommandPolicyMatch{
+				Entity: &types.SearchQuery{Labels: map[string][]string{"Room": {"Nursery"}}},
+				Window: &CommandPolicyWindow{Start: "23:00", End: "06:00", Timezone: "UTC"},
+			},
+			Clamp: map[string]CommandPolicyRange{"brightness": {Max: policyFloat(30)}},
+		},
+	}}
+}
+
+func TestCommandPolicies_Evaluate(t *testing.T) {
+	s := newCommandPolicyStore()
+	if err := s.Set(examplePolicies()); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	lock := types.Entity{ID: "front-door", PluginID: "plugin-zwave", Domain: "lock", Labels: map[string][]string{"Security": {"Critical"}}}
+	nursery := types.Entity{ID: "nursery-lamp", PluginID: "plugin-zwave", Domain: "light", Labels: map[string][]string{"Room": {"Nursery"}}}
+	night := time.Date(2026, 1, 5, 23, 30, 0, 0, time.UTC)
+	day := time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	_, decision, err := s.Evaluate(types.Entity{ID: "e", PluginID: "plugin-hue"}, "turn_on", json.RawMessage(`{"type":"turn_on"}`), nil, day)
+	if code, _ := commandErrCode(err); code != CommandErrPolicyDenied || decision.Reason != "plugin-hue is under maintenance" {
+		t.Fatalf("expected maintenance deny, got %v %+v", err, decision)
+	}
+
+	_, decision, err = s.Evaluate(lock, "unlock", json.RawMessage(`{"type":"unlock"}`), nil, day)
+	if err == nil || decision.Decision != "denied" || decision.Rules[0] != "critical-unlock" {
+		t.Fatalf("expected critical unlock to be denied, got %v %+v", err, decision)
+	}
+	_, decision, err = s.Evaluate(lock, "unlock", json.RawMessage(`{"type":"unlock"}`), map[string]string{"x-security-override": "yes"}, day)
+	if err != nil || decision != nil {
+		t.Fatalf("expected override header to bypass the deny, got %v %+v", err, decision)
+	}
+
+	out, decision, err := s.Evaluate(nursery, "set_brightness", json.RawMessage(`{"type":"set_brightness","brightness":80}`), nil, night)
+	if err != nil || decision == nil || decision.Decision != "transformed" {
+		t.Fatalf("expected nursery brightness to be transformed at night, got %v %+v", err, decision)
+	}
+	var got map[string]any
+	_ = json.Unmarshal(out, &got)
+	if got["brightness"] != float64(30) || string(decision.OriginalPayload) != `{"type":"set_brightness","brightness":80}` {
+		t.Fatalf("unexpected transform result %s (original %s)", out, decision.OriginalPayload)
+	}
+
+	out, decision, _ = s.Evaluate(nursery, "set_brightness", json.RawMessage(`{"type":"set_brightness","brightness":80}`), nil, day)
+	if decision != nil || string(out) != `{"type":"set_brightness","brightness":80}` {
+		t.Fatalf("expected no transform during the day, got %s %+v", out, decision)
+	}
+}
+
+func TestCommandPolicies_AllowStopsEvaluation(t *testing.T) {
+	s := newCommandPolicyStore()
+	err := s.Set(CommandPolicies{Rules: []CommandPolicyRule{
+		{ID: "vip", Effect: CommandPolicyAllow, Match: CommandPolicyMatch{Entity: &types.SearchQuery{EntityID: "vip"}}},
+		{ID: "deny-all", Effect: CommandPolicyDeny},
+	}})
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if _, decision, err := s.Evaluate(types.Entity{ID: "vip"}, "turn_on", json.RawMessage(`{"type":"turn_on"}`), nil, time.Now()); err != nil || decision.Decision != "allowed" {
+		t.Fatalf("expected allow, got %v %+v", err, decision)
+	}
+	if _, _, err := s.Evaluate(types.Entity{ID: "other"}, "turn_on", json.RawMessage(`{"type":"turn_on"}`), nil, time.Now()); err == nil {
+		t.Fatal("expected deny-all to reject other entities")
+	}
+}
+
+func TestCommandPolicies_Validate(t *testing.T) {
+	bad := []CommandPolicyRule{
+		{Effect: CommandPolicyDeny},
+		{ID: "x", Effect: "maybe"},
+		{ID: "x", Effect: CommandPolicyTransform},
+		{ID: "x", Effect: CommandPolicyDeny, Set: map[string]any{"on": false}},
+		{ID: "x", Effect: CommandPolicyTransform, Set: map[string]any{"type": "turn_off"}},
+		{ID: "x", Effect: CommandPolicyDeny, Match: CommandPolicyMatch{Window: &CommandPolicyWindow{Start: "25:00", End: "06:00"}}},
+	}
+	for _, r := range bad {
+		if err := (CommandPolicies{Rules: []CommandPolicyRule{r}}).validate(); err == nil {
+			t.Errorf("expected rule %+v to be rejected", r)
+		}
+	}
+	dup := CommandPolicies{Rules: []CommandPolicyRule{{ID: "a", Effect: CommandPolicyDeny}, {ID: "a", Effect: CommandPolicyAllow}}}
+	if err := dup.validate(); err == nil {
+		t.Error("expected duplicate rule ids to be rejected")
+	}
+}
+
+func TestCommandPolicies_PersistAndEdit(t *testing.T) {
+	dir := t.TempDir()
+	s := newCommandPolicyStore()
+	if err := s.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := s.Set(examplePolicies()); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.Put(CommandPolicyRule{ID: "maintenance", Effect: CommandPolicyDeny, Disabled: true}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if found, err := s.Delete("nursery-night"); !found || err != nil {
+		t.Fatalf("delete: found=%v err=%v", found, err)
+	}
+
+	reloaded := newCommandPolicyStore()
+	if err := reloaded.Load(dir); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	rules := reloaded.Get().Rules
+	if len(rules) != 2 || rules[0].ID != "maintenance" || !rules[0].Disabled || rules[1].ID != "critical-unlock" {
+		t.Fatalf("unexpected rules after reload: %+v", rules)
+	}
+	if names := reloaded.HeaderNames(); len(names) != 1 || names[0] != "x-security-override" {
+		t.Errorf("unexpected header names %v", names)
+	}
+}
+
+func TestCommandPolicies_ConcurrentPutsAreNotLost(t *testing.T) {
+	dir := t.TempDir()
+	s := newCommandPolicyStore()
+	if err := s.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.Put(CommandPolicyRule{ID: "rule-" + strconv.Itoa(i), Effect: CommandPolicyDeny}); err != nil {
+				t.Errorf("put: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(s.Get().Rules); n != 20 {
+		t.Fatalf("expected 20 rules in memory, got %d", n)
+	}
+	reloaded := newCommandPolicyStore()
+	if err := reloaded.Load(dir); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if n := len(reloaded.Get().Rules); n != 20 {
+		t.Fatalf("expected 20 rules on disk, got %d", n)
+	}
+}
+
+func TestCommandPolicyWindow_Contains(t *testing.T) {
+	w := CommandPolicyWindow{Start: "23:00", End: "06:00", Days: []string{"fri"}, Timezone: "UTC"}
+	fri := time.Date(2026, 1, 2, 23, 30, 0, 0, time.UTC) // Friday
+	if !w.contains(fri) {
+		t.Error("expected Friday 23:30 to be inside the window")
+	}
+	if !w.contains(fri.Add(5 * time.Hour)) {
+		t.Error("expected Saturday 04:30 to belong to Friday's window")
+	}
+	if w.contains(fri.Add(24 * time.Hour)) {
+		t.Error("expected Saturday 23:30 to be outside the window")
+	}
+	if w.contains(fri.Add(-12 * time.Hour)) {
+		t.Error("expected Friday 11:30 to be outside the window")
+	}
+}
+
+// fakeAddressLookup resolves entities by ID without a registry.
+type fakeAddressLookup map[string]types.Entity
+
+func (f fakeAddressLookup) FindEntity(_, _, entityID string) (types.Entity, error) {
+	ent, ok := f[entityID]
+	if !ok {
+		return types.Entity{}, errCommandTargetNotFound
+	}
+	return ent, nil
+}
+
+func TestCommand_SubmitReturnsDeniedStatus(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	svc.resolver = &Resolver{lookup: fakeAddressLookup{"bulb": {ID: "bulb", PluginID: "plugin-hue", DeviceID: "d", Domain: "light"}}}
+	if err := svc.Policies().Set(examplePolicies()); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	status, err := svc.SubmitWithOptions("plugin-hue", "d", "bulb", json.RawMessage(`{"type":"turn_on"}`), commandOptions{})
+	if code, _ := commandErrCode(err); code != CommandErrPolicyDenied {
+		t.Fatalf("expected a policy denial, got %v", err)
+	}
+	if status.State != types.CommandFailed || status.Error == "" {
+		t.Fatalf("expected the returned status to be failed with the reason, got %+v", status)
+	}
+	if stored, ok := svc.GetStatus(status.CommandID); !ok || stored.State != status.State {
+		t.Fatalf("expected the returned status to match the stored one, got %+v", stored)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// CommandPriority selects the dispatch lane a command waits in. Workers always
+// drain higher lanes first, so interactive commands overtake script and bulk
+// traffic queued for the same plugin.
+type CommandPriority string
+
+const (
+	CommandPriorityUser   CommandPriority = "user"
+	CommandPriorityScript CommandPriority = "script"
+	CommandPriorityBulk   CommandPriority = "bulk"
+)
+
+// commandPriorityLanes lists the lanes in the order workers drain them.
+var commandPriorityLanes = []CommandPriority{CommandPriorityUser, CommandPriorityScript, CommandPriorityBulk}
+
+func (p CommandPriority) lane() int {
+	for i, lp := range commandPriorityLanes {
+		if lp == p {
+			return i
+		}
+	}
+	return 0
+}
+
+func parseCommandPriority(s string) (CommandPriority, error) {
+	p := CommandPriority(strings.ToLower(strings.TrimSpace(s)))
+	for _, lp := range commandPriorityLanes {
+		if lp == p {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid priority %q (want user, script or bulk)", s)
+}
+
+// Defaults for the per-plugin dispatch queues. Override with
+// GATEWAY_DISPATCH_WORKERS, GATEWAY_DISPATCH_QUEUE_SIZE and
+// GATEWAY_DISPATCH_PLUGIN_WORKERS (comma-separated plugin=workers pairs).
+const (
+	defaultDispatchWorkers   = 4
+	defaultDispatchQueueSize = 256
+)
+
+type dispatchConfig struct {
+	Workers       int
+	QueueSize     int
+	PluginWorkers map[string]int
+}
+
+func (c dispatchConfig) workersFor(pluginID string) int {
+	if n, ok := c.PluginWorkers[pluginID]; ok && n > 0 {
+		return n
+	}
+	return c.Workers
+}
+
+func dispatchConfigFromEnv() dispatchConfig {
+	c := dispatchConfig{
+		Workers:       defaultDispatchWorkers,
+		QueueSize:     defaultDispatchQueueSize,
+		PluginWorkers: map[string]int{},
+	}
+	if v := strings.TrimSpace(getenv("GATEWAY_DISPATCH_WORKERS")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.Workers = n
+		} else {
+			slog.Warn("invalid GATEWAY_DISPATCH_WORKERS, using default", "value", v, "default", c.Workers)
+		}
+	}
+	if v := strings.TrimSpace(getenv("GATEWAY_DISPATCH_QUEUE_SIZE")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.QueueSize = n
+		} else {
+			slog.Warn("invalid GATEWAY_DISPATCH_QUEUE_SIZE, using default", "value", v, "default", c.QueueSize)
+		}
+	}
+	for _, pair := range strings.Split(getenv("GATEWAY_DISPATCH_PLUGIN_WORKERS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		pluginID, count, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if !ok || err != nil || n <= 0 || strings.TrimSpace(pluginID) == "" {
+			slog.Warn("invalid GATEWAY_DISPATCH_PLUGIN_WORKERS entry, ignoring", "value", pair)
+			continue
+		}
+		c.PluginWorkers[strings.TrimSpace(pluginID)] = n
+	}
+	return c
+}
+
+// CommandQueueStats is a snapshot of one plugin's dispatch queue.
+type CommandQueueStats struct {
+	PluginID  string         `json:"plugin_id"`
+	Workers   int            `json:"workers" doc:"Commands this plugin may execute concurrently"`
+	Capacity  int            `json:"capacity" doc:"Maximum number of queued commands across all lanes"`
+	Depth     int            `json:"depth" doc:"Commands currently waiting for a worker"`
+	Lanes     map[string]int `json:"lanes" doc:"Queued commands per priority lane"`
+	InFlight  int            `json:"in_flight" doc:"Commands currently being executed"`
+	Enqueued  uint64         `json:"enqueued" doc:"Commands accepted since the gateway started"`
+	Completed uint64         `json:"completed" doc:"Commands that finished executing"`
+	Rejected  uint64         `json:"rejected" doc:"Commands rejected because the queue was full"`
+	Coalesced uint64         `json:"coalesced" doc:"Queued commands superseded by a newer command for the same entity and action"`
+	Cancelled uint64         `json:"cancelled" doc:"Queued commands withdrawn by a cancel request"`
+}
+
+// pluginQueue is a bounded, multi-lane FIFO served by a fixed pool of workers.
+type pluginQueue struct {
+	pluginID string
+	capacity int
+	workers  int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	lanes     [][]commandJob
+	depth     int
+	inFlight  int
+	enqueued  uint64
+	completed uint64
+	rejected  uint64
+	coalesced uint64
+	cancelled uint64
+	closed    bool
+}
+
+func newPluginQueue(pluginID string, capacity, workers int) *pluginQueue {
+	q := &pluginQueue{
+		pluginID: pluginID,
+		capacity: capacity,
+		workers:  workers,
+		lanes:    make([][]commandJob, len(commandPriorityLanes)),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds job to its lane. A coalescing job takes the place of a queued
+// coalescing job for the same entity and action in that lane, which is
+// returned as superseded. Otherwise, when the queue is full, push either
+// rejects the job or, if wait is set, blocks until space frees up. ok is false
+// if the job was not queued.
+func (q *pluginQueue) push(job commandJob, wait bool) (superseded *commandJob, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lane := job.priority.lane()
+	if job.coalesce && !q.closed {
+		for i, queued := range q.lanes[lane] {
+			if queued.coalesce && queued.coalescesWith(job) {
+				q.lanes[lane][i] = job
+				q.enqueued++
+				q.coalesced++
+				return &queued, true
+			}
+		}
+	}
+	for !q.closed && q.depth >= q.capacity {
+		if !wait {
+			q.rejected++
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	q.lanes[lane] = append(q.lanes[lane], job)
+	q.depth++
+	q.enqueued++
+	q.cond.Broadcast()
+	return nil, true
+}
+
+// coalescesWith reports whether other targets the same entity with the same
+// action, so that dispatching only the newer of the two is sufficient.
+func (j commandJob) coalescesWith(other commandJob) bool {
+	return j.action != "" && j.action == other.action && j.target == other.target
+}
+
+// pop blocks until a job is available, taking from the highest-priority lane
+// first. It returns false once the queue is closed.
+func (q *pluginQueue) pop() (commandJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && q.depth == 0 {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return commandJob{}, false
+	}
+	for i, lane := range q.lanes {
+		if len(lane) == 0 {
+			continue
+		}
+		job := lane[0]
+		lane[0] = commandJob{}
+		q.lanes[i] = lane[1:]
+		q.depth--
+		q.inFlight++
+		q.cond.Broadcast()
+		return job, true
+	}
+	return commandJob{}, false
+}
+
+// remove withdraws a queued job by command ID.
+func (q *pluginQueue) remove(commandID string) (commandJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, lane := range q.lanes {
+		for j, job := range lane {
+			if job.rootStatus.CommandID != commandID {
+				continue
+			}
+			q.lanes[i] = append(lane[:j:j], lane[j+1:]...)
+			q.depth--
+			q.cancelled++
+			q.cond.Broadcast()
+			return job, true
+		}
+	}
+	return commandJob{}, false
+}
+
+func (q *pluginQueue) done() {
+	q.mu.Lock()
+	q.inFlight--
+	q.completed++
+	q.mu.Unlock()
+}
+
+func (q *pluginQueue) run(exec func(commandJob)) {
+	for {
+		job, ok := q.pop()
+		if !ok {
+			return
+		}
+		exec(job)
+		q.done()
+	}
+}
+
+// close stops the workers and returns the jobs that were still queued.
+func (q *pluginQueue) close() []commandJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	var dropped []commandJob
+	for i, lane := range q.lanes {
+		dropped = append(dropped, lane...)
+		q.lanes[i] = nil
+	}
+	q.depth = 0
+	q.cond.Broadcast()
+	return dropped
+}
+
+func (q *pluginQueue) stats() CommandQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lanes := make(map[string]int, len(q.lanes))
+	for i, lane := range q.lanes {
+		lanes[string(commandPriorityLanes[i])] = len(lane)
+	}
+	return CommandQueueStats{
+		PluginID:  q.pluginID,
+		Workers:   q.workers,
+		Capacity:  q.capacity,
+		Depth:     q.depth,
+		Lanes:     lanes,
+		InFlight:  q.inFlight,
+		Enqueued:  q.enqueued,
+		Completed: q.completed,
+		Rejected:  q.rejected,
+		Coalesced: q.coalesced,
+		Cancelled: q.cancelled,
+	}
+}
+
+// queueFor returns the queue for pluginID, starting its workers on first use.
+func (d *Dispatcher) queueFor(pluginID string) (*pluginQueue, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, false
+	}
+	q, ok := d.queues[pluginID]
+	if !ok {
+		q = newPluginQueue(pluginID, d.cfg.QueueSize, d.cfg.workersFor(pluginID))
+		d.queues[pluginID] = q
+		for i := 0; i < q.workers; i++ {
+			go q.run(d.Execute)
+		}
+	}
+	return q, true
+}
+
+// Enqueue queues job on its plugin's queue. It returns a CommandErrOverloaded
+// error instead of blocking when the queue is full.
+func (d *Dispatcher) Enqueue(job commandJob) error {
+	q, ok := d.queueFor(job.target.PluginID)
+	if !ok {
+		return commandErr(CommandErrOverloaded, "command dispatcher is closed", nil)
+	}
+	superseded, ok := q.push(job, false)
+	if !ok {
+		slog.Warn("dispatch queue full", "plugin_id", job.target.PluginID, "command_id", job.rootStatus.CommandID, "priority", job.priority, "capacity", q.capacity)
+		return commandErr(CommandErrOverloaded, fmt.Sprintf("dispatch queue for plugin %q is full", job.target.PluginID), nil)
+	}
+	supersede(superseded, job)
+	return nil
+}
+
+// EnqueueWait is Enqueue for background producers such as group fan-out: it
+// applies backpressure by blocking until the queue has room.
+func (d *Dispatcher) EnqueueWait(job commandJob) error {
+	q, ok := d.queueFor(job.target.PluginID)
+	if !ok {
+		return commandErr(CommandErrOverloaded, "command dispatcher is closed", nil)
+	}
+	superseded, ok := q.push(job, true)
+	if !ok {
+		return commandErr(CommandErrOverloaded, "command dispatcher is closed", nil)
+	}
+	supersede(superseded, job)
+	return nil
+}
+
+// supersede completes old, which was replaced in its queue by job, with the
+// superseded state.
+func supersede(old *commandJob, job commandJob) {
+	if old == nil {
+		return
+	}
+	slog.Info("command superseded", "command_id", old.rootStatus.CommandID, "superseded_by", job.rootStatus.CommandID, "plugin_id", job.target.PluginID, "entity_id", job.target.EntityID, "action", job.action)
+	old.rootStatus.State = CommandSuperseded
+	old.rootStatus.SupersededBy = job.rootStatus.CommandID
+	old.rootStatus.LastUpdatedAt = time.Now().UTC()
+	old.onComplete(old.rootStatus)
+}
+
+// Cancel withdraws a command still waiting in pluginID's queue, or waiting
+// out a retry backoff, and completes it as cancelled. It reports false if the
+// command is neither (it may already be executing).
+func (d *Dispatcher) Cancel(pluginID, commandID string) (GatewayCommandStatus, bool) {
+	d.mu.Lock()
+	if r, ok := d.retrying[commandID]; ok {
+		delete(d.retrying, commandID)
+		d.mu.Unlock()
+		r.timer.Stop()
+		return completeCancelled(r.job), true
+	}
+	q, ok := d.queues[pluginID]
+	d.mu.Unlock()
+	if !ok {
+		return GatewayCommandStatus{}, false
+	}
+	job, ok := q.remove(commandID)
+	if !ok {
+		return GatewayCommandStatus{}, false
+	}
+	return completeCancelled(job), true
+}
+
+// completeCancelled finishes job without dispatching it.
+func completeCancelled(job commandJob) GatewayCommandStatus {
+	slog.Info("command cancelled", "command_id", job.rootStatus.CommandID, "plugin_id", job.target.PluginID, "entity_id", job.target.EntityID)
+	job.rootStatus.State = CommandCancelled
+	job.rootStatus.LastUpdatedAt = time.Now().UTC()
+	job.onComplete(job.rootStatus)
+	return job.rootStatus
+}
+
+// QueueStats returns a snapshot of every plugin queue, sorted by plugin ID.
+func (d *Dispatcher) QueueStats() []CommandQueueStats {
+	d.mu.Lock()
+	queues := make([]*pluginQueue, 0, len(d.queues))
+	for _, q := range d.queues {
+		queues = append(queues, q)
+	}
+	d.mu.Unlock()
+	out := make([]CommandQueueStats, 0, len(queues))
+	for _, q := range queues {
+		out = append(out, q.stats())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PluginID < out[j].PluginID })
+	return out
+}
+
+// Close stops all workers. Commands still waiting in a queue or for a retry
+// are completed as failed so their callers (and group fan-outs) are not left
+// waiting.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	queues := d.queues
+	retrying := d.retrying
+	d.retrying = make(map[string]*pendingRetry)
+	d.mu.Unlock()
+	for _, r := range retrying {
+		r.timer.Stop()
+		failDispatcherClosed(r.job)
+	}
+	for _, q := range queues {
+		for _, job := range q.close() {
+			failDispatcherClosed(job)
+		}
+	}
+}
+
+func failDispatcherClosed(job commandJob) {
+	job.rootStatus.State = types.CommandFailed
+	job.rootStatus.Error = "command dispatcher closed"
+	job.rootStatus.LastUpdatedAt = time.Now().UTC()
+	job.onComplete(job.rootStatus)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func queuedJob(id string, p CommandPriority) commandJob {
+	return commandJob{
+		rootStatus: GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: id}},
+		target:     commandTarget{PluginID: "p"},
+		priority:   p,
+	}
+}
+
+func TestPluginQueue_DrainsHigherPriorityLanesFirst(t *testing.T) {
+	q := newPluginQueue("p", 10, 1)
+	q.push(queuedJob("bulk-1", CommandPriorityBulk), false)
+	q.push(queuedJob("script-1", CommandPriorityScript), false)
+	q.push(queuedJob("user-1", CommandPriorityUser), false)
+	q.push(queuedJob("bulk-2", CommandPriorityBulk), false)
+	q.push(queuedJob("user-2", CommandPriorityUser), false)
+
+	want := []string{"user-1", "user-2", "script-1", "bulk-1", "bulk-2"}
+	for _, id := range want {
+		job, ok := q.pop()
+		if !ok {
+			t.Fatalf("expected %s, queue returned nothing", id)
+		}
+		if job.rootStatus.CommandID != id {
+			t.Fatalf("expected %s, got %s", id, job.rootStatus.CommandID)
+		}
+		q.done()
+	}
+}
+
+func TestPluginQueue_RejectsWhenFull(t *testing.T) {
+	q := newPluginQueue("p", 2, 1)
+	if _, ok := q.push(queuedJob("a", CommandPriorityUser), false); !ok {
+		t.Fatal("expected first job to be queued")
+	}
+	if _, ok := q.push(queuedJob("b", CommandPriorityBulk), false); !ok {
+		t.Fatal("expected second job to be queued")
+	}
+	if _, ok := q.push(queuedJob("c", CommandPriorityUser), false); ok {
+		t.Fatal("expected full queue to reject")
+	}
+
+	st := q.stats()
+	if st.Depth != 2 || st.Rejected != 1 || st.Enqueued != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	if st.Lanes["user"] != 1 || st.Lanes["bulk"] != 1 {
+		t.Errorf("unexpected lane depths: %+v", st.Lanes)
+	}
+}
+
+func TestDispatcher_EnqueueReturnsOverloadError(t *testing.T) {
+	d := &Dispatcher{
+		retry:    newRetryPolicyStore(),
+		cfg:      dispatchConfig{Workers: 1, QueueSize: 1},
+		queues:   make(map[string]*pluginQueue),
+		retrying: make(map[string]*pendingRetry),
+	}
+	// Pre-create the queue with no workers so nothing drains it during the test.
+	d.queues["p"] = newPluginQueue("p", 1, 0)
+	defer d.Close()
+
+	noop := func(GatewayCommandStatus) {}
+	first := queuedJob("a", CommandPriorityUser)
+	first.onComplete = noop
+	if err := d.Enqueue(first); err != nil {
+		t.Fatalf("first enqueue: %v", err)
+	}
+	err := d.Enqueue(queuedJob("b", CommandPriorityUser))
+	if code, ok := commandErrCode(err); !ok || code != CommandErrOverloaded {
+		t.Fatalf("expected overloaded error, got %v", err)
+	}
+}
+
+func TestParseCommandPriority(t *testing.T) {
+	if p, err := parseCommandPriority(" Bulk "); err != nil || p != CommandPriorityBulk {
+		t.Errorf("parse bulk: got %q, %v", p, err)
+	}
+	if _, err := parseCommandPriority("urgent"); err == nil {
+		t.Error("expected unknown priority to be rejected")
+	}
+}
+
+func TestDispatcher_CoalescesQueuedCommandsForSameEntityAndAction(t *testing.T) {
+	d := &Dispatcher{
+		retry:    newRetryPolicyStore(),
+		cfg:      dispatchConfig{Workers: 1, QueueSize: 2},
+		queues:   make(map[string]*pluginQueue),
+		retrying: make(map[string]*pendingRetry),
+	}
+	d.queues["p"] = newPluginQueue("p", 2, 0)
+	defer d.Close()
+
+	var completed []GatewayCommandStatus
+	record := func(st GatewayCommandStatus) { completed = append(completed, st) }
+	coalescing := func(id, action string) commandJob {
+		job := queuedJob(id, CommandPriorityUser)
+		job.target.EntityID = "light"
+		job.action = action
+		job.coalesce = true
+		job.onComplete = record
+		return job
+	}
+
+	for _, job := range []commandJob{
+		coalescing("b1", "set_brightness"),
+		coalescing("t1", "turn_off"),
+		coalescing("b2", "set_brightness"),
+		coalescing("b3", "set_brightness"),
+	} {
+		if err := d.Enqueue(job); err != nil {
+			t.Fatalf("enqueue %s: %v", job.rootStatus.CommandID, err)
+		}
+	}
+
+	if len(completed) != 2 {
+		t.Fatalf("expected 2 superseded commands, got %d", len(completed))
+	}
+	for i, want := range []struct{ id, by string }{{"b1", "b2"}, {"b2", "b3"}} {
+		st := completed[i]
+		if st.CommandID != want.id || st.State != CommandSuperseded || st.SupersededBy != want.by {
+			t.Errorf("expected %s superseded by %s, got %+v", want.id, want.by, st)
+		}
+	}
+
+	q := d.queues["p"]
+	for _, id := range []string{"b3", "t1"} {
+		job, ok := q.pop()
+		if !ok || job.rootStatus.CommandID != id {
+			t.Fatalf("expected %s next in queue, got %q", id, job.rootStatus.CommandID)
+		}
+		q.done()
+	}
+	if st := q.stats(); st.Coalesced != 2 {
+		t.Errorf("expected 2 coalesced, got %d", st.Coalesced)
+	}
+}
+
+func TestCommand_CancelQueuedCommand(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	svc.dispatcher.queues["p"] = newPluginQueue("p", 4, 0)
+
+	var completed GatewayCommandStatus
+	job := queuedJob("gcmd-q", CommandPriorityUser)
+	job.rootStatus.PluginID = "p"
+	job.rootStatus.State = types.CommandPending
+	job.onComplete = func(st GatewayCommandStatus) { completed = st }
+	svc.statuses.Put(job.rootStatus)
+	if err := svc.dispatcher.Enqueue(job); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	st, err := svc.Cancel("gcmd-q")
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if st.State != CommandCancelled || completed.State != CommandCancelled {
+		t.Errorf("expected cancelled, got returned=%s completed=%s", st.State, completed.State)
+	}
+	if stats := svc.dispatcher.queues["p"].stats(); stats.Depth != 0 || stats.Cancelled != 1 {
+		t.Errorf("expected queue to be empty after cancel, got %+v", stats)
+	}
+
+	svc.statuses.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "gcmd-done", PluginID: "p", State: types.CommandSucceeded}})
+	if _, err := svc.Cancel("gcmd-done"); err == nil {
+		t.Error("expected finished command not to be cancellable")
+	} else if code, _ := commandErrCode(err); code != CommandErrNotCancellable {
+		t.Errorf("expected not_cancellable, got %v", err)
+	}
+}
+
+func TestDispatcher_SkipsLeavesOfCancelledFanOut(t *testing.T) {
+	root := &fanOutRun{id: "root"}
+	nested := &fanOutRun{id: "nested", parent: root}
+	root.cancelled.Store(true)
+	if !nested.isCancelled() {
+		t.Fatal("expected cancelling a group to cancel its nested groups")
+	}
+
+	var completed GatewayCommandStatus
+	job := queuedJob("leaf", CommandPriorityUser)
+	job.cancelled = nested.isCancelled
+	job.onComplete = func(st GatewayCommandStatus) { completed = st }
+	CommandDispatcher().Execute(job)
+	if completed.State != CommandCancelled {
+		t.Errorf("expected leaf to complete as cancelled without an RPC, got %+v", completed)
+	}
+}
+
+func TestDispatcher_RetryBackoffFreesWorker(t *testing.T) {
+	d := &Dispatcher{
+		retry:    newRetryPolicyStore(),
+		cfg:      dispatchConfig{Workers: 1, QueueSize: 4},
+		queues:   make(map[string]*pluginQueue),
+		retrying: make(map[string]*pendingRetry),
+	}
+
+	// Plugin "p" is not registered, so every attempt fails as unavailable,
+	// which the default retryable codes cover.
+	retried := make(chan GatewayCommandStatus, 1)
+	done := make(chan GatewayCommandStatus, 2)
+	slow := queuedJob("slow", CommandPriorityUser)
+	slow.retry = &RetryPolicy{MaxAttempts: 3, InitialBackoffMS: int(time.Hour / time.Millisecond)}
+	slow.onAttempt = func(st GatewayCommandStatus) { retried <- st }
+	slow.onComplete = func(st GatewayCommandStatus) { done <- st }
+	if err := d.Enqueue(slow); err != nil {
+		t.Fatalf("enqueue slow: %v", err)
+	}
+	select {
+	case st := <-retried:
+		if st.Attempts != 1 {
+			t.Fatalf("expected the first attempt to be reported, got %+v", st)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the first attempt to fail and be retried")
+	}
+
+	fast := queuedJob("fast", CommandPriorityUser)
+	fast.onComplete = func(st GatewayCommandStatus) { done <- st }
+	if err := d.Enqueue(fast); err != nil {
+		t.Fatalf("enqueue fast: %v", err)
+	}
+	select {
+	case st := <-done:
+		if st.CommandID != "fast" {
+			t.Fatalf("expected the second command to run during the backoff, got %+v", st)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the only worker to be free while the first command backs off")
+	}
+
+	d.Close()
+	select {
+	case st := <-done:
+		if st.CommandID != "slow" || st.State != types.CommandFailed || st.Error != "command dispatcher closed" {
+			t.Fatalf("expected close to fail the pending retry, got %+v", st)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected close to complete the pending retry")
+	}
+}
+
+func TestDispatcher_CancelPendingRetry(t *testing.T) {
+	d := CommandDispatcher()
+	defer d.Close()
+
+	retried := make(chan struct{}, 1)
+	var completed GatewayCommandStatus
+	job := queuedJob("gcmd-retry", CommandPriorityUser)
+	job.retry = &RetryPolicy{MaxAttempts: 2, InitialBackoffMS: int(time.Hour / time.Millisecond)}
+	job.onAttempt = func(GatewayCommandStatus) { retried <- struct{}{} }
+	job.onComplete = func(st GatewayCommandStatus) { completed = st }
+	d.Execute(job)
+	<-retried
+
+	st, ok := d.Cancel("p", "gcmd-retry")
+	if !ok || st.State != CommandCancelled || completed.State != CommandCancelled {
+		t.Fatalf("expected the pending retry to be cancelled, got %+v (ok=%v)", st, ok)
+	}
+	if _, ok := d.Cancel("p", "gcmd-retry"); ok {
+		t.Error("expected a cancelled retry not to be cancellable again")
+	}
+}
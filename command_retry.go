@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rpcErrPluginUnavailable is the JSON-RPC error code routeRPC reports when a
+// plugin is not registered or does not answer in time.
+const rpcErrPluginUnavailable = -32000
+
+const retryPoliciesFile = "command_retry.json"
+
+// Upper bounds on retry policy values, so one policy cannot keep a dispatch
+// worker busy with a command for hours.
+const (
+	maxRetryAttempts   = 10
+	maxRetryBackoffMS  = 60_000
+	maxRetryMultiplier = 10
+)
+
+// RetryPolicy controls how often Dispatcher.Execute re-sends a command whose
+// RPC failed. Zero fields fall back to the defaults in normalize.
+type RetryPolicy struct {
+	MaxAttempts      int     `json:"max_attempts,omitempty" doc:"Total attempts including the first (1 disables retries, at most 10)"`
+	InitialBackoffMS int     `json:"initial_backoff_ms,omitempty" doc:"Delay before the first retry in milliseconds (at most 60000)"`
+	MaxBackoffMS     int     `json:"max_backoff_ms,omitempty" doc:"Upper bound for the delay between attempts in milliseconds (at most 60000)"`
+	Multiplier       float64 `json:"multiplier,omitempty" doc:"Backoff growth factor applied after each retry (at most 10)"`
+	Jitter           float64 `json:"jitter,omitempty" doc:"Random spread applied to each delay, as a fraction (0-1)"`
+	RetryableCodes   []int   `json:"retryable_codes,omitempty" doc:"JSON-RPC error codes that trigger a retry (default: plugin unavailable/timeout)"`
+}
+
+// normalize fills in defaults and clamps values to the bounds enforced by
+// validate, which policies persisted before those bounds may exceed.
+func (p RetryPolicy) normalize() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 1
+	}
+	if p.MaxAttempts > maxRetryAttempts {
+		p.MaxAttempts = maxRetryAttempts
+	}
+	if p.InitialBackoffMS <= 0 {
+		p.InitialBackoffMS = 200
+	}
+	if p.InitialBackoffMS > maxRetryBackoffMS {
+		p.InitialBackoffMS = maxRetryBackoffMS
+	}
+	if p.MaxBackoffMS <= 0 {
+		p.MaxBackoffMS = 5000
+	}
+	if p.MaxBackoffMS > maxRetryBackoffMS {
+		p.MaxBackoffMS = maxRetryBackoffMS
+	}
+	if p.MaxBackoffMS < p.InitialBackoffMS {
+		p.MaxBackoffMS = p.InitialBackoffMS
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Multiplier > maxRetryMultiplier {
+		p.Multiplier = maxRetryMultiplier
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = []int{rpcErrPluginUnavailable}
+	}
+	return p
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 || p.InitialBackoffMS < 0 || p.MaxBackoffMS < 0 {
+		return errors.New("retry policy values must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry policy jitter must be between 0 and 1")
+	}
+	if p.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("retry policy max_attempts must be at most %d", maxRetryAttempts)
+	}
+	if p.InitialBackoffMS > maxRetryBackoffMS || p.MaxBackoffMS > maxRetryBackoffMS {
+		return fmt.Errorf("retry policy backoff must be at most %d ms", maxRetryBackoffMS)
+	}
+	if p.Multiplier > maxRetryMultiplier {
+		return fmt.Errorf("retry policy multiplier must be at most %d", maxRetryMultiplier)
+	}
+	return nil
+}
+
+// retryable reports whether an RPC error with code should be retried.
+func (p RetryPolicy) retryable(code int) bool {
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay to wait after the given (1-based) failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoffMS)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if d >= float64(p.MaxBackoffMS) {
+			d = float64(p.MaxBackoffMS)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+// RetryPolicies is the persisted retry configuration: a gateway-wide default
+// plus per-plugin overrides. A policy supplied with an individual command
+// takes precedence over both.
+type RetryPolicies struct {
+	Default RetryPolicy            `json:"default"`
+	Plugins map[string]RetryPolicy `json:"plugins,omitempty"`
+}
+
+// retryPolicyStore guards the active RetryPolicies and persists changes to the
+// gateway data dir.
+type retryPolicyStore struct {
+	mu       sync.RWMutex
+	policies RetryPolicies
+	path     string
+}
+
+func newRetryPolicyStore() *retryPolicyStore {
+	return &retryPolicyStore{policies: RetryPolicies{Plugins: map[string]RetryPolicy{}}}
+}
+
+// Load reads policies from dataDir. A missing file leaves the defaults
+// (no retries) in place.
+func (s *retryPolicyStore) Load(dataDir string) error {
+	path := filepath.Join(dataDir, retryPoliciesFile)
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	data, err := diskIO.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var p RetryPolicies
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	if p.Plugins == nil {
+		p.Plugins = map[string]RetryPolicy{}
+	}
+	s.mu.Lock()
+	s.policies = p
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *retryPolicyStore) Get() RetryPolicies {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := RetryPolicies{Default: s.policies.Default, Plugins: make(map[string]RetryPolicy, len(s.policies.Plugins))}
+	for k, v := range s.policies.Plugins {
+		out.Plugins[k] = v
+	}
+	return out
+}
+
+// Set replaces the active policies and writes them to disk when a data dir
+// has been loaded.
+func (s *retryPolicyStore) Set(p RetryPolicies) error {
+	if err := p.Default.validate(); err != nil {
+		return err
+	}
+	for pluginID, pp := range p.Plugins {
+		if err := pp.validate(); err != nil {
+			return fmt.Errorf("plugin %q: %w", pluginID, err)
+		}
+	}
+	if p.Plugins == nil {
+		p.Plugins = map[string]RetryPolicy{}
+	}
+	s.mu.Lock()
+	s.policies = p
+	path := s.path
+	s.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(p, "", "  ")
+	if err := diskIO.WriteFile(path, data, 0o644); err != nil {
+		slog.Warn("failed to persist retry policies", "path", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Resolve returns the effective policy for a command to pluginID, preferring
+// the per-command override, then the plugin policy, then the default.
+func (s *retryPolicyStore) Resolve(pluginID string, override *RetryPolicy) RetryPolicy {
+	if override != nil {
+		return override.normalize()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p, ok := s.policies.Plugins[pluginID]; ok {
+		return p.normalize()
+	}
+	return s.policies.Default.normalize()
+}
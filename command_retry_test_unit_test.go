@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_BackoffGrowsAndCaps(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialBackoffMS: 100, MaxBackoffMS: 300, Multiplier: 2}.normalize()
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestRetryPolicy_JitterStaysInRange(t *testing.T) {
+	p := RetryPolicy{InitialBackoffMS: 100, Jitter: 0.5}.normalize()
+	for i := 0; i < 100; i++ {
+		d := p.backoff(1)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jittered backoff %v outside [50ms,150ms]", d)
+		}
+	}
+}
+
+func TestRetryPolicy_ValidateBounds(t *testing.T) {
+	valid := RetryPolicy{MaxAttempts: maxRetryAttempts, InitialBackoffMS: maxRetryBackoffMS, MaxBackoffMS: maxRetryBackoffMS, Multiplier: maxRetryMultiplier, Jitter: 1}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("expected policy at the limits to be valid, got %v", err)
+	}
+	for name, p := range map[string]RetryPolicy{
+		"negative":           {MaxAttempts: -1},
+		"jitter":             {Jitter: 1.5},
+		"max_attempts":       {MaxAttempts: maxRetryAttempts + 1},
+		"initial_backoff_ms": {InitialBackoffMS: maxRetryBackoffMS + 1},
+		"max_backoff_ms":     {MaxBackoffMS: maxRetryBackoffMS + 1},
+		"multiplier":         {Multiplier: maxRetryMultiplier + 0.5},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%s: expected %+v to be rejected", name, p)
+		}
+	}
+	if err := newRetryPolicyStore().Set(RetryPolicies{Default: RetryPolicy{MaxAttempts: 1000}}); err == nil {
+		t.Error("expected the store to reject an unbounded default policy")
+	}
+	// Policies persisted before the bounds existed are clamped when used.
+	if got := (RetryPolicy{MaxAttempts: 1000, MaxBackoffMS: 1 << 30, Multiplier: 100}).normalize(); got.MaxAttempts != maxRetryAttempts || got.MaxBackoffMS != maxRetryBackoffMS || got.Multiplier != maxRetryMultiplier {
+		t.Errorf("expected out-of-range values to be clamped, got %+v", got)
+	}
+}
+
+func TestRetryPolicy_DefaultRetryableCodes(t *testing.T) {
+	p := RetryPolicy{}.normalize()
+	if p.MaxAttempts != 1 {
+		t.Errorf("expected retries disabled by default, got max_attempts=%d", p.MaxAttempts)
+	}
+	if !p.retryable(rpcErrPluginUnavailable) {
+		t.Error("expected plugin unavailable to be retryable by default")
+	}
+	if p.retryable(-32700) {
+		t.Error("expected malformed responses not to be retryable by default")
+	}
+}
+
+func TestRetryPolicyStore_ResolvePrecedence(t *testing.T) {
+	s := newRetryPolicyStore()
+	if err := s.Set(RetryPolicies{
+		Default: RetryPolicy{MaxAttempts: 2},
+		Plugins: map[string]RetryPolicy{"zigbee": {MaxAttempts: 4}},
+	}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	if got := s.Resolve("wifi", nil).MaxAttempts; got != 2 {
+		t.Errorf("default policy: max_attempts = %d, want 2", got)
+	}
+	if got := s.Resolve("zigbee", nil).MaxAttempts; got != 4 {
+		t.Errorf("plugin policy: max_attempts = %d, want 4", got)
+	}
+	if got := s.Resolve("zigbee", &RetryPolicy{MaxAttempts: 7}).MaxAttempts; got != 7 {
+		t.Errorf("command override: max_attempts = %d, want 7", got)
+	}
+}
+
+func TestExtractCommandOptions_StripsRetryPolicy(t *testing.T) {
+	body := map[string]any{
+		"type":         "turn_on",
+		"retry_policy": map[string]any{"max_attempts": 3},
+	}
+	opts, err := extractCommandOptions(body)
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if _, ok := body["retry_policy"]; ok {
+		t.Error("expected retry_policy to be removed from the payload")
+	}
+	if opts.Retry == nil || opts.Retry.MaxAttempts != 3 {
+		t.Errorf("expected retry override with max_attempts=3, got %+v", opts.Retry)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+const scheduledCommandsFile = "scheduled_commands.json"
+
+// scheduledCommandStartupGrace delays commands that fell due while the gateway
+// was down, giving plugins time to re-register before they are dispatched.
+const scheduledCommandStartupGrace = 5 * time.Second
+
+// defaultScheduledMisfireLimit is how late a command that fell due while the
+// gateway was down may still be dispatched; beyond it the command is failed
+// instead. Override with GATEWAY_SCHEDULED_MISFIRE_LIMIT, where 0 disables the
+// limit.
+const defaultScheduledMisfireLimit = time.Hour
+
+// scheduledPersistRetryInterval is how often a failed write of the scheduled
+// commands is retried.
+const scheduledPersistRetryInterval = time.Second
+
+func scheduledMisfireLimitFromEnv() time.Duration {
+	limit := defaultScheduledMisfireLimit
+	if v := strings.TrimSpace(getenv("GATEWAY_SCHEDULED_MISFIRE_LIMIT")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			limit = d
+		} else {
+			slog.Warn("invalid GATEWAY_SCHEDULED_MISFIRE_LIMIT, using default", "value", v, "default", limit)
+		}
+	}
+	return limit
+}
+
+// ScheduledCommand is a command waiting for its execute_at time, together with
+// everything needed to dispatch it after a restart.
+type ScheduledCommand struct {
+	Status   GatewayCommandStatus `json:"status"`
+	Payload  json.RawMessage      `json:"payload"`
+	Retry    *RetryPolicy         `json:"retry_policy,omitempty"`
+	Priority CommandPriority      `json:"priority,omitempty"`
+	Coalesce bool                 `json:"coalesce,omitempty"`
+	// Headers are the request headers policy rules matched on at submit time,
+	// kept so the rules can be evaluated again when the command fires.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (c ScheduledCommand) options() commandOptions {
+	return commandOptions{Retry: c.Retry, Priority: c.Priority, Coalesce: c.Coalesce, Headers: c.Headers, CorrelationID: c.Status.CorrelationID}
+}
+
+func (c ScheduledCommand) executeAt() time.Time {
+	if c.Status.ExecuteAt == nil {
+		return time.Time{}
+	}
+	return *c.Status.ExecuteAt
+}
+
+// commandScheduler holds scheduled commands, arms a timer for each once
+// started, and mirrors the pending set to the gateway data dir.
+type commandScheduler struct {
+	mu      sync.Mutex
+	entries map[string]ScheduledCommand
+	timers  map[string]*time.Timer
+	path    string
+	grace   time.Duration
+	// misfireLimit is how overdue a command may be at Start and still fire;
+	// 0 means no limit.
+	misfireLimit time.Duration
+	started      bool
+	closed       bool
+	// dirty is set when the last write failed; retryLoop writes again.
+	dirty   bool
+	fire    func(ScheduledCommand)
+	misfire func(ScheduledCommand, time.Duration)
+
+	// writeMu serialises persist so snapshots reach the disk in order.
+	writeMu sync.Mutex
+}
+
+// newCommandScheduler returns a scheduler that calls fire for each command
+// that falls due, and misfire for each that is found at Start to be overdue
+// by more than the misfire limit.
+func newCommandScheduler(fire func(ScheduledCommand), misfire func(ScheduledCommand, time.Duration)) *commandScheduler {
+	return &commandScheduler{
+		entries:      make(map[string]ScheduledCommand),
+		timers:       make(map[string]*time.Timer),
+		grace:        scheduledCommandStartupGrace,
+		misfireLimit: scheduledMisfireLimitFromEnv(),
+		fire:         fire,
+		misfire:      misfire,
+	}
+}
+
+// Load reads persisted commands from dataDir and returns them. Timers are not
+// armed until Start.
+func (s *commandScheduler) Load(dataDir string) ([]ScheduledCommand, error) {
+	path := filepath.Join(dataDir, scheduledCommandsFile)
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	data, err := diskIO.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var loaded []ScheduledCommand
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range loaded {
+		if c.Status.CommandID == "" {
+			continue
+		}
+		s.entries[c.Status.CommandID] = c
+	}
+	return loaded, nil
+}
+
+// Start arms timers for all loaded commands. Commands already overdue fire
+// after the startup grace period, unless they are overdue by more than the
+// misfire limit; those are unscheduled and handed to the misfire callback.
+func (s *commandScheduler) Start() {
+	s.mu.Lock()
+	if s.started || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	now := time.Now()
+	var missed []ScheduledCommand
+	for id, c := range s.entries {
+		if s.misfireLimit > 0 && now.Sub(c.executeAt()) > s.misfireLimit {
+			delete(s.entries, id)
+			missed = append(missed, c)
+			continue
+		}
+		s.armLocked(c, s.grace)
+	}
+	s.mu.Unlock()
+	if len(missed) == 0 {
+		return
+	}
+	s.persist()
+	for _, c := range missed {
+		s.misfire(c, now.Sub(c.executeAt()))
+	}
+}
+
+// Add schedules c and persists the pending set.
+func (s *commandScheduler) Add(c ScheduledCommand) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.entries[c.Status.CommandID] = c
+	if s.started {
+		s.armLocked(c, 0)
+	}
+	s.mu.Unlock()
+	s.persist()
+}
+
+// Remove unschedules commandID. It reports false if the command is not (or no
+// longer) scheduled, which makes it safe to race a firing timer.
+func (s *commandScheduler) Remove(commandID string) (ScheduledCommand, bool) {
+	s.mu.Lock()
+	c, ok := s.entries[commandID]
+	if !ok {
+		s.mu.Unlock()
+		return ScheduledCommand{}, false
+	}
+	delete(s.entries, commandID)
+	if t, ok := s.timers[commandID]; ok {
+		t.Stop()
+		delete(s.timers, commandID)
+	}
+	s.mu.Unlock()
+	s.persist()
+	return c, true
+}
+
+// List returns the scheduled commands ordered by execute_at.
+func (s *commandScheduler) List() []ScheduledCommand {
+	s.mu.Lock()
+	out := make([]ScheduledCommand, 0, len(s.entries))
+	for _, c := range s.entries {
+		out = append(out, c)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].executeAt().Before(out[j].executeAt()) })
+	return out
+}
+
+// Close stops all timers and makes a last attempt at a write that failed.
+// Scheduled commands stay persisted for the next start.
+func (s *commandScheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for id, t := range s.timers {
+		t.Stop()
+		delete(s.timers, id)
+	}
+	dirty := s.dirty
+	s.mu.Unlock()
+	if dirty {
+		s.persist()
+	}
+}
+
+// armLocked starts the timer for c, waiting at least minDelay.
+func (s *commandScheduler) armLocked(c ScheduledCommand, minDelay time.Duration) {
+	id := c.Status.CommandID
+	delay := time.Until(c.executeAt())
+	if delay < minDelay {
+		delay = minDelay
+	}
+	s.timers[id] = time.AfterFunc(delay, func() {
+		if c, ok := s.Remove(id); ok {
+			s.fire(c)
+		}
+	})
+}
+
+// persist writes the pending set to disk, replacing the file atomically so a
+// crash leaves either the old or the new set. Only the snapshot is taken under
+// the scheduler lock, so submits, cancels and timers are not held up by disk
+// I/O; writeMu makes each write reflect at least every change before it. A
+// failed write marks the scheduler dirty for retryLoop.
+func (s *commandScheduler) persist() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	s.dirty = false
+	path := s.path
+	out := make([]ScheduledCommand, 0, len(s.entries))
+	for _, c := range s.entries {
+		out = append(out, c)
+	}
+	s.mu.Unlock()
+	if path == "" {
+		return
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].executeAt().Before(out[j].executeAt()) })
+	data, _ := json.MarshalIndent(out, "", "  ")
+	if err := diskIO.ReplaceFile(path, data, 0o644); err != nil {
+		slog.Warn("failed to persist scheduled commands", "path", path, "error", err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+// retryLoop repeats a failed persist every interval until stop is closed.
+func (s *commandScheduler) retryLoop(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			dirty := s.dirty
+			s.mu.Unlock()
+			if dirty {
+				s.persist()
+			}
+		}
+	}
+}
+
+// LoadScheduled restores scheduled commands persisted in dataDir so their
+// statuses can be polled. Call StartScheduled once plugins can be reached.
+func (s *Command) LoadScheduled(dataDir string) error {
+	loaded, err := s.scheduler.Load(dataDir)
+	for _, c := range loaded {
+		s.statuses.Put(c.Status)
+	}
+	if len(loaded) > 0 {
+		slog.Info("scheduled commands restored", "count", len(loaded))
+	}
+	return err
+}
+
+// StartScheduled arms timers for scheduled commands.
+func (s *Command) StartScheduled() {
+	s.scheduler.Start()
+}
+
+// ScheduledCommands lists commands waiting for their execute_at time.
+func (s *Command) ScheduledCommands() []ScheduledCommand {
+	return s.scheduler.List()
+}
+
+// CancelScheduled withdraws a scheduled command and marks it cancelled. It
+// reports false if the command is not scheduled.
+func (s *Command) CancelScheduled(commandID string) (GatewayCommandStatus, bool) {
+	c, ok := s.scheduler.Remove(commandID)
+	if !ok {
+		return GatewayCommandStatus{}, false
+	}
+	status := c.Status
+	status.State = CommandCancelled
+	status.LastUpdatedAt = time.Now().UTC()
+	s.updateStatus(status)
+	slog.Info("scheduled command cancelled", "command_id", commandID)
+	return status, true
+}
+
+// failMisfired marks a scheduled command failed because it fell due while the
+// gateway was down and is now too late to dispatch.
+func (s *Command) failMisfired(c ScheduledCommand, late time.Duration) {
+	status := c.Status
+	status.State = types.CommandFailed
+	status.Error = fmt.Sprintf("missed execute_at by %s, more than the misfire limit of %s", late.Round(time.Second), s.scheduler.misfireLimit)
+	status.LastUpdatedAt = time.Now().UTC()
+	s.updateStatus(status)
+	slog.Warn("scheduled command misfired", "command_id", status.CommandID, "late", late)
+}
+
+// schedule records status as scheduled for opts.ExecuteAt.
+func (s *Command) schedule(status GatewayCommandStatus, payload json.RawMessage, opts commandOptions) GatewayCommandStatus {
+	at := opts.ExecuteAt.UTC()
+	status.State = CommandScheduled
+	status.ExecuteAt = &at
+	s.updateStatus(status)
+	s.scheduler.Add(ScheduledCommand{
+		Status:   status,
+		Payload:  payload,
+		Retry:    opts.Retry,
+		Priority: opts.Priority,
+		Coalesce: opts.Coalesce,
+		Headers:  opts.Headers,
+	})
+	return status
+}
+
+// runScheduled dispatches a scheduled command that has fallen due. The target
+// is resolved again because it may have changed or disappeared meanwhile.
+func (s *Command) runScheduled(c ScheduledCommand) {
+	status := c.Status
+	action, _ := parseActionType(c.Payload)
+	payload := c.Payload
+	ent, err := s.resolver.ResolveEntity(status.PluginID, status.DeviceID, status.EntityID, action)
+	if err == nil {
+		// Policy rules are evaluated again because time windows and the rules
+		// themselves may have changed since the command was scheduled.
+		payload, status.Policy, err = s.policies.Evaluate(ent, action, payload, c.Headers, time.Now())
+		if err != nil {
+			s.denyCommand(status, err)
+			return
+		}
+		err = validateEntityCommand(ent, action, payload)
+	}
+	status.LastUpdatedAt = time.Now().UTC()
+	if err != nil {
+		slog.Warn("scheduled command rejected", "command_id", status.CommandID, "error", err)
+		status.State = types.CommandFailed
+		status.Error = err.Error()
+		s.updateStatus(status)
+		return
+	}
+	status.State = types.CommandPending
+	s.updateStatus(status)
+	if err := s.dispatch(status, ent, action, payload, c.options()); err != nil {
+		slog.Warn("scheduled command dispatch failed", "command_id", status.CommandID, "error", err)
+		return
+	}
+	slog.Info("scheduled command dispatched", "command_id", status.CommandID, "plugin_id", status.PluginID, "entity_id", status.EntityID)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func scheduledAt(id string, at time.Time) ScheduledCommand {
+	return ScheduledCommand{
+		Status: GatewayCommandStatus{
+			CommandStatus: types.CommandStatus{CommandID: id, PluginID: "p", State: CommandScheduled},
+			ExecuteAt:     &at,
+		},
+		Payload:  json.RawMessage(`{"type":"turn_off"}`),
+		Priority: CommandPriorityUser,
+	}
+}
+
+func TestCommandScheduler_PersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	later := time.Now().UTC().Add(time.Hour)
+
+	first := newCommandScheduler(func(ScheduledCommand) { t.Error("nothing should fire") }, nil)
+	if _, err := first.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	first.Start()
+	first.Add(scheduledAt("gcmd-a", later))
+	first.Add(scheduledAt("gcmd-b", later.Add(time.Minute)))
+	if _, ok := first.Remove("gcmd-b"); !ok {
+		t.Fatal("expected gcmd-b to be removable")
+	}
+	first.Close()
+
+	second := newCommandScheduler(func(ScheduledCommand) {}, nil)
+	loaded, err := second.Load(dir)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Status.CommandID != "gcmd-a" {
+		t.Fatalf("expected only gcmd-a to survive, got %+v", loaded)
+	}
+	if action, _ := parseActionType(loaded[0].Payload); !loaded[0].executeAt().Equal(later) || action != "turn_off" {
+		t.Errorf("scheduled command not restored intact: %+v", loaded[0])
+	}
+}
+
+func TestCommandScheduler_FiresOverdueCommandsOnStart(t *testing.T) {
+	fired := make(chan string, 1)
+	s := newCommandScheduler(func(c ScheduledCommand) { fired <- c.Status.CommandID }, nil)
+	s.grace = 10 * time.Millisecond
+	defer s.Close()
+
+	s.Add(scheduledAt("gcmd-due", time.Now().Add(-time.Minute)))
+	select {
+	case id := <-fired:
+		t.Fatalf("%s fired before Start", id)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	s.Start()
+	select {
+	case id := <-fired:
+		if id != "gcmd-due" {
+			t.Fatalf("unexpected command fired: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overdue command did not fire after Start")
+	}
+	if len(s.List()) != 0 {
+		t.Error("expected fired command to be removed from the schedule")
+	}
+}
+
+func TestCommandScheduler_FailsCommandsPastMisfireLimit(t *testing.T) {
+	fired := make(chan string, 2)
+	missed := make(chan string, 2)
+	s := newCommandScheduler(
+		func(c ScheduledCommand) { fired <- c.Status.CommandID },
+		func(c ScheduledCommand, late time.Duration) { missed <- c.Status.CommandID },
+	)
+	s.grace = 10 * time.Millisecond
+	s.misfireLimit = time.Hour
+	defer s.Close()
+
+	s.Add(scheduledAt("gcmd-late", time.Now().Add(-time.Minute)))
+	s.Add(scheduledAt("gcmd-stale", time.Now().Add(-2*time.Hour)))
+	s.Start()
+
+	select {
+	case id := <-missed:
+		if id != "gcmd-stale" {
+			t.Fatalf("expected gcmd-stale to misfire, got %s", id)
+		}
+	default:
+		t.Fatal("expected Start to report the misfired command")
+	}
+	select {
+	case id := <-fired:
+		if id != "gcmd-late" {
+			t.Fatalf("unexpected command fired: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("command within the misfire limit did not fire")
+	}
+	select {
+	case id := <-missed:
+		t.Fatalf("%s misfired as well", id)
+	case id := <-fired:
+		t.Fatalf("%s fired after misfiring", id)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+func TestCommand_MisfiredScheduledCommandFails(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	svc.scheduler.misfireLimit = time.Hour
+
+	c := scheduledAt("gcmd-m", time.Now().Add(-2*time.Hour))
+	svc.statuses.Put(c.Status)
+	svc.scheduler.Add(c)
+	svc.StartScheduled()
+
+	got, _ := svc.GetStatus("gcmd-m")
+	if got.State != types.CommandFailed || !strings.Contains(got.Error, "misfire limit") {
+		t.Fatalf("expected the command to fail with a misfire reason, got %+v", got)
+	}
+}
+
+func TestCommandScheduler_RetriesFailedWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	s := newCommandScheduler(func(ScheduledCommand) {}, nil)
+	s.path = filepath.Join(dir, scheduledCommandsFile)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	s.Add(scheduledAt("gcmd-r", time.Now().Add(time.Hour)))
+	if !s.dirty {
+		t.Fatal("expected a failed write to mark the scheduler dirty")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	go s.retryLoop(stop, 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(s.path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the failed write to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	loaded, err := newCommandScheduler(func(ScheduledCommand) {}, nil).Load(dir)
+	if err != nil || len(loaded) != 1 {
+		t.Fatalf("expected the retried write to hold gcmd-r, got %+v (%v)", loaded, err)
+	}
+}
+
+func TestCommand_CancelScheduled(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	c := scheduledAt("gcmd-c", time.Now().Add(time.Hour))
+	svc.statuses.Put(c.Status)
+	svc.scheduler.Add(c)
+
+	st, ok := svc.CancelScheduled("gcmd-c")
+	if !ok || st.State != CommandCancelled {
+		t.Fatalf("expected cancelled status, got %+v (ok=%v)", st, ok)
+	}
+	if got, _ := svc.GetStatus("gcmd-c"); got.State != CommandCancelled {
+		t.Errorf("expected stored status to be cancelled, got %s", got.State)
+	}
+	if _, ok := svc.CancelScheduled("gcmd-c"); ok {
+		t.Error("expected second cancel to report not scheduled")
+	}
+}
+
+func TestExtractCommandOptions_Schedule(t *testing.T) {
+	opts, err := extractCommandOptions(map[string]any{"type": "turn_off", "delay": "10m"})
+	if err != nil {
+		t.Fatalf("delay: %v", err)
+	}
+	if d := time.Until(opts.ExecuteAt); d < 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("expected execute_at about 10m from now, got %v", d)
+	}
+
+	if _, err := extractCommandOptions(map[string]any{"execute_at": "2030-01-01T00:00:00Z", "delay": "1m"}); err == nil {
+		t.Error("expected execute_at together with delay to be rejected")
+	}
+	if _, err := extractCommandOptions(map[string]any{"execute_at": "tomorrow"}); err == nil {
+		t.Error("expected invalid execute_at to be rejected")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +16,9 @@ import (
 // backing hardware.
 const gatewayPluginID = "__gateway__"
 
+// gatewayCommandPrefix starts the ID of every command issued by the gateway.
+const gatewayCommandPrefix = "gcmd-"
+
 var errCommandTargetNotFound = errors.New("entity not found")
 
 func entityVisitKey(pluginID, deviceID, entityID string) string {
@@ -27,72 +31,270 @@ type commandTarget struct {
 	EntityID string
 }
 
+// GatewayCommandStatus is the gateway's view of a command: the SDK
+// CommandStatus plus gateway-only bookkeeping. It serialises flat, so clients
+// decoding types.CommandStatus keep working.
+type GatewayCommandStatus struct {
+	types.CommandStatus
+	Attempts      int                    `json:"attempts,omitempty" doc:"Number of dispatch attempts made so far"`
+	LastError     string                 `json:"last_error,omitempty" doc:"Error returned by the most recent failed attempt"`
+	SupersededBy  string                 `json:"superseded_by,omitempty" doc:"ID of the command that replaced this one when state is superseded"`
+	ExecuteAt     *time.Time             `json:"execute_at,omitempty" doc:"Time a scheduled command is (or was) due to be dispatched"`
+	ParentID      string                 `json:"parent_id,omitempty" doc:"ID of the group command this command was fanned out from"`
+	CorrelationID string                 `json:"correlation_id,omitempty" doc:"ID shared by everything caused by the same API call or script trigger"`
+	Children      []string               `json:"children,omitempty" doc:"IDs of the commands a group command fanned out to"`
+	Summary       *CommandChildSummary   `json:"summary,omitempty" doc:"Outcome of a group command's children, once they have completed"`
+	Policy        *CommandPolicyDecision `json:"policy,omitempty" doc:"Decision of the command policy engine, when any rule matched"`
+}
+
+// commandOptions carries optional per-command settings supplied alongside the
+// payload.
+type commandOptions struct {
+	Retry    *RetryPolicy
+	Priority CommandPriority
+	// Coalesce lets a newer command for the same entity and action replace
+	// this one while it is still queued.
+	Coalesce bool
+	// ExecuteAt defers dispatch until the given time when it lies in the
+	// future; see command_scheduler.go.
+	ExecuteAt time.Time
+	// Headers are the request headers (lower-cased names) that command
+	// policy rules may match on; see command_policy.go.
+	Headers map[string]string
+	// CorrelationID ties the command to whatever caused it. When empty the
+	// command's own ID is used.
+	CorrelationID string
+}
+
 type commandJob struct {
-	rootStatus types.CommandStatus
+	rootStatus GatewayCommandStatus
 	payload    json.RawMessage
 	target     commandTarget
-	onComplete func(types.CommandStatus)
+	retry      *RetryPolicy
+	priority   CommandPriority
+	action     string
+	coalesce   bool
+	// cancelled, if set, is consulted before each attempt; the job completes
+	// as cancelled without an RPC once it reports true.
+	cancelled  func() bool
+	onAttempt  func(GatewayCommandStatus)
+	onComplete func(GatewayCommandStatus)
 }
 
 type Command struct {
-	mu         sync.RWMutex
-	statuses   map[string]types.CommandStatus
-	closed     bool
-	resolver   *Resolver
-	dispatcher *Dispatcher
+	mu            sync.RWMutex
+	statuses      commandStatusStore
+	retention     commandStatusRetention
+	closed        bool
+	stop          chan struct{}
+	resolver      *Resolver
+	dispatcher    *Dispatcher
+	scheduler     *commandScheduler
+	runs          map[string]*fanOutRun
+	groupDefaults groupFanOutSettings
+	idempotency   *idempotencyStore
+	policies      *commandPolicyStore
+	// archive holds statuses evicted from memory; see LookupStatus.
+	archive commandStatusSource
+
+	watchMu  sync.Mutex
+	watchers map[string][]commandWatcher
 }
 
 func CommandService() *Command {
-	return &Command{
-		statuses:   make(map[string]types.CommandStatus),
-		resolver:   AddressResolver(),
-		dispatcher: CommandDispatcher(),
+	retention := commandStatusRetentionFromEnv()
+	s := &Command{
+		statuses:      newMemoryStatusStore(retention),
+		retention:     retention,
+		stop:          make(chan struct{}),
+		resolver:      AddressResolver(),
+		dispatcher:    CommandDispatcher(),
+		runs:          make(map[string]*fanOutRun),
+		groupDefaults: groupFanOutSettingsFromEnv(),
+		idempotency:   newIdempotencyStore(idempotencyWindowFromEnv()),
+		policies:      newCommandPolicyStore(),
+		watchers:      make(map[string][]commandWatcher),
 	}
+	s.scheduler = newCommandScheduler(s.runScheduled, s.failMisfired)
+	go s.evictLoop(commandStatusSweepInterval)
+	go s.idempotency.flushLoop(s.stop, idempotencyFlushInterval)
+	go s.scheduler.retryLoop(s.stop, scheduledPersistRetryInterval)
+	return s
 }
 
 func (s *Command) Close() {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
 	s.closed = true
+	close(s.stop)
+	s.scheduler.Close()
+	s.dispatcher.Close()
+	s.idempotency.Flush()
+}
+
+// evictLoop periodically applies the status retention policy until Close.
+func (s *Command) evictLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if n := s.statuses.Evict(now.UTC()); n > 0 {
+				slog.Debug("command statuses evicted", "count", n, "remaining", s.statuses.Len())
+			}
+		}
+	}
+}
+
+// Rehydrate loads recent gateway command statuses from src so commands issued
+// before a restart can still be polled. Commands that were still in flight
+// when the gateway stopped are reported as failed: their dispatch did not
+// survive the restart. src is kept to look up statuses evicted later.
+func (s *Command) Rehydrate(src commandStatusSource) error {
+	s.mu.Lock()
+	s.archive = src
 	s.mu.Unlock()
+	since := time.Now().UTC().Add(-s.retention.MaxAge)
+	statuses, err := src.RecentCommandStatuses(gatewayCommandPrefix, since, s.retention.MaxCount)
+	if err != nil {
+		return err
+	}
+	for _, raw := range statuses {
+		st, ok := decodeArchivedStatus(raw)
+		if !ok {
+			continue
+		}
+		if _, ok := s.statuses.Get(st.CommandID); ok {
+			continue
+		}
+		s.statuses.Put(st)
+	}
+	s.statuses.Evict(time.Now().UTC())
+	slog.Info("command statuses rehydrated", "count", len(statuses))
+	return nil
+}
+
+// decodeArchivedStatus decodes a status recorded in history. A command that
+// is not held in memory is no longer being dispatched, so one recorded in
+// flight is reported as failed.
+func decodeArchivedStatus(raw json.RawMessage) (GatewayCommandStatus, bool) {
+	var st GatewayCommandStatus
+	if err := json.Unmarshal(raw, &st); err != nil || st.CommandID == "" {
+		return st, false
+	}
+	if !isTerminalCommandState(st.State) {
+		st.State = types.CommandFailed
+		st.Error = "interrupted by gateway restart"
+	}
+	return st, true
 }
 
+// IsGatewayCommand reports whether commandID was issued by the gateway, even
+// if its status has since been evicted.
 func (s *Command) IsGatewayCommand(commandID string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	_, ok := s.statuses[commandID]
-	return ok
+	return strings.HasPrefix(commandID, gatewayCommandPrefix)
+}
+
+func (s *Command) GetStatus(commandID string) (GatewayCommandStatus, bool) {
+	return s.statuses.Get(commandID)
 }
 
-func (s *Command) GetStatus(commandID string) (types.CommandStatus, bool) {
+// LookupStatus is GetStatus falling back to the history recorded by the
+// source passed to Rehydrate, for statuses evicted from memory.
+func (s *Command) LookupStatus(commandID string) (GatewayCommandStatus, bool) {
+	if st, ok := s.statuses.Get(commandID); ok {
+		return st, true
+	}
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	status, ok := s.statuses[commandID]
-	return status, ok
+	archive := s.archive
+	s.mu.RUnlock()
+	if archive == nil || !s.IsGatewayCommand(commandID) {
+		return GatewayCommandStatus{}, false
+	}
+	raw, found, err := archive.CommandStatus(commandID)
+	if err != nil {
+		slog.Warn("command status history lookup failed", "command_id", commandID, "error", err)
+		return GatewayCommandStatus{}, false
+	}
+	if !found {
+		return GatewayCommandStatus{}, false
+	}
+	return decodeArchivedStatus(raw)
 }
 
-func (s *Command) updateStatus(status types.CommandStatus) {
-	s.mu.Lock()
-	s.statuses[status.CommandID] = status
-	s.mu.Unlock()
+// rootCorrelation maps a correlation ID seen by a script to the one its
+// commands should carry. Plugins tag the events a command causes with the
+// command's ID, so when id names a known command the chain continues under
+// that command's correlation ID instead of starting a new one.
+func (s *Command) rootCorrelation(id string) string {
+	if st, ok := s.statuses.Get(id); ok && st.CorrelationID != "" {
+		return st.CorrelationID
+	}
+	return id
+}
+
+// RetryPolicies exposes the dispatcher's retry configuration.
+func (s *Command) RetryPolicies() *retryPolicyStore {
+	return s.dispatcher.retry
+}
+
+// IdempotencyKeys exposes the store of responses to requests made with an
+// Idempotency-Key.
+func (s *Command) IdempotencyKeys() *idempotencyStore {
+	return s.idempotency
+}
+
+// Policies exposes the command policy rules.
+func (s *Command) Policies() *commandPolicyStore {
+	return s.policies
+}
+
+// QueueStats reports the depth and throughput of each plugin dispatch queue.
+func (s *Command) QueueStats() []CommandQueueStats {
+	return s.dispatcher.QueueStats()
+}
+
+func (s *Command) updateStatus(status GatewayCommandStatus) {
+	if prev, ok := s.statuses.Put(status); !ok || prev != status.State {
+		metrics.commandsTotal.Inc(string(status.State))
+	}
 	publishCommandStatus(status)
+	s.notifyWatchers(status)
 }
 
-func publishCommandStatus(status types.CommandStatus) {
+func publishCommandStatus(status GatewayCommandStatus) {
 	data, _ := json.Marshal(status)
 	_ = nc.Publish(types.SubjectCommandStatus, data)
 }
 
-// Submit validates the target entity and queues a command for dispatch.
+// Submit validates the target entity and queues a command for dispatch on the
+// script priority lane; it is the entry point used by the scripting runtime.
 // If the entity has a CommandQuery, the command fans out to all matching
 // entities (recursively, with cycle detection) on a single background goroutine.
 func (s *Command) Submit(pluginID, deviceID, entityID string, payload json.RawMessage) (types.CommandStatus, error) {
+	status, err := s.SubmitWithOptions(pluginID, deviceID, entityID, payload, commandOptions{Priority: CommandPriorityScript})
+	return status.CommandStatus, err
+}
+
+// SubmitWithOptions is Submit with per-command options such as a retry
+// policy override or priority lane (default: user). It returns a
+// CommandErrOverloaded error when the target plugin's queue is full.
+func (s *Command) SubmitWithOptions(pluginID, deviceID, entityID string, payload json.RawMessage, opts commandOptions) (GatewayCommandStatus, error) {
 	started := time.Now()
+	if opts.Priority == "" {
+		opts.Priority = CommandPriorityUser
+	}
 
 	s.mu.RLock()
 	closed := s.closed
 	s.mu.RUnlock()
 	if closed {
-		return types.CommandStatus{}, fmt.Errorf("command service is closed")
+		return GatewayCommandStatus{}, fmt.Errorf("command service is closed")
 	}
 
 	// Extract the action type from the payload for pre-flight validation.
@@ -103,11 +305,11 @@ func (s *Command) Submit(pluginID, deviceID, entityID string, payload json.RawMe
 
 	ent, err := s.resolver.ResolveEntity(pluginID, deviceID, entityID, cmd.Type)
 	if err != nil {
-		return types.CommandStatus{}, err
+		return GatewayCommandStatus{}, err
 	}
 
 	now := time.Now().UTC()
-	status := types.CommandStatus{
+	status := GatewayCommandStatus{CommandStatus: types.CommandStatus{
 		CommandID:     nextID("gcmd"),
 		PluginID:      pluginID,
 		DeviceID:      deviceID,
@@ -116,61 +318,127 @@ func (s *Command) Submit(pluginID, deviceID, entityID string, payload json.RawMe
 		State:         types.CommandPending,
 		CreatedAt:     now,
 		LastUpdatedAt: now,
+	}, CorrelationID: opts.CorrelationID}
+	if status.CorrelationID == "" {
+		status.CorrelationID = status.CommandID
+	}
+	opts.CorrelationID = status.CorrelationID
+
+	payload, status.Policy, err = s.policies.Evaluate(ent, cmd.Type, payload, opts.Headers, now)
+	if err != nil {
+		status = s.denyCommand(status, err)
+		return status, err
+	}
+	if err := validateEntityCommand(ent, cmd.Type, payload); err != nil {
+		return GatewayCommandStatus{}, err
+	}
+
+	if opts.ExecuteAt.After(now) {
+		status = s.schedule(status, payload, opts)
+		slog.Info("submit scheduled", "command_id", status.CommandID, "plugin_id", pluginID, "device_id", deviceID, "entity_id", entityID, "execute_at", status.ExecuteAt)
+		return status, nil
 	}
-	slog.Info("submit accepted", "command_id", status.CommandID, "plugin_id", pluginID, "device_id", deviceID, "entity_id", entityID, "resolve_ms", time.Since(started).Milliseconds())
 
 	s.updateStatus(status)
-	if scriptRuntime != nil {
-		scriptRuntime.NotifyCommand(pluginID, deviceID, entityID, payload)
+	if err := s.dispatch(status, ent, cmd.Type, payload, opts); err != nil {
+		return GatewayCommandStatus{}, err
 	}
+	slog.Info("submit accepted", "command_id", status.CommandID, "plugin_id", pluginID, "device_id", deviceID, "entity_id", entityID, "priority", opts.Priority, "resolve_ms", time.Since(started).Milliseconds())
+	return status, nil
+}
 
-	if ent.CommandQuery != nil && commandMatchesFilter(cmd.Type, ent.CommandFilter) {
-		// Query-backed group entity: the entire fan-out tree runs on a single
-		// goroutine so the visited set is never touched concurrently (no races, no
-		// new goroutines spawned inside the tree). Group entities are virtual
-		// routers and can belong to any plugin; they do not receive an additional
-		// direct plugin RPC after fan-out.
+// denyCommand records status as failed because a policy rule rejected it.
+func (s *Command) denyCommand(status GatewayCommandStatus, err error) GatewayCommandStatus {
+	status.State = types.CommandFailed
+	status.Error = err.Error()
+	status.LastUpdatedAt = time.Now().UTC()
+	s.updateStatus(status)
+	slog.Info("command denied by policy", "command_id", status.CommandID, "plugin_id", status.PluginID, "device_id", status.DeviceID, "entity_id", status.EntityID, "rules", status.Policy.Rules)
+	return status
+}
+
+// dispatch starts a pending command. Query-backed group entities fan out on a
+// background goroutine; anything else is queued for its plugin. If the queue
+// rejects the command, its status is marked failed and the error returned.
+func (s *Command) dispatch(status GatewayCommandStatus, ent types.Entity, action string, payload json.RawMessage, opts commandOptions) error {
+	pluginID, deviceID, entityID := status.PluginID, status.DeviceID, status.EntityID
+
+	if ent.CommandQuery != nil && commandMatchesFilter(action, ent.CommandFilter) {
+		if scriptRuntime != nil {
+			scriptRuntime.NotifyCommand(pluginID, deviceID, entityID, payload, status.CorrelationID)
+		}
+		// Query-backed group entity: the fan-out tree is walked on a single
+		// goroutine so the visited set is never touched concurrently. Leaves are
+		// handed to their plugins' dispatch queues and run on the worker pools.
+		// Group entities are virtual routers and can belong to any plugin; they
+		// do not receive an additional direct plugin RPC after fan-out.
 		//
 		// If CommandFilter is set and the command type is not in the filter, this
 		// branch is skipped and the command falls through to direct plugin RPC.
+		run := s.startFanOut(status, ent, nil)
 		go func() {
 			visited := map[string]bool{entityVisitKey(pluginID, deviceID, entityID): true}
-			s.fanOut(visited, *ent.CommandQuery, payload)
-			status.State = types.CommandSucceeded
-			status.LastUpdatedAt = time.Now().UTC()
-			s.updateStatus(status)
+			s.fanOut(run, visited, *ent.CommandQuery, payload, opts)
+			s.finishFanOut(run)
 		}()
-		return status, nil
+		return nil
 	}
 
 	job := commandJob{
 		rootStatus: status,
 		payload:    payload,
 		target:     commandTarget{pluginID, deviceID, entityID},
+		retry:      opts.Retry,
+		priority:   opts.Priority,
+		action:     action,
+		coalesce:   opts.Coalesce,
+		onAttempt:  s.updateStatus,
 		onComplete: s.updateStatus,
 	}
-	go s.dispatcher.Execute(job)
-	return status, nil
+	if err := s.dispatcher.Enqueue(job); err != nil {
+		status.State = types.CommandFailed
+		status.Error = err.Error()
+		status.LastUpdatedAt = time.Now().UTC()
+		s.updateStatus(status)
+		return err
+	}
+	if scriptRuntime != nil {
+		scriptRuntime.NotifyCommand(pluginID, deviceID, entityID, payload, status.CorrelationID)
+	}
+	return nil
 }
 
 // fanOut resolves all entities matching query and dispatches the payload to each,
-// skipping any entity already in visited (cycle detection). It runs synchronously
-// on the caller's goroutine so the visited map is never accessed concurrently.
-func (s *Command) fanOut(visited map[string]bool, query types.SearchQuery, payload json.RawMessage) {
+// skipping any entity already in visited (cycle detection). The tree is walked
+// synchronously on the caller's goroutine so the visited map is never accessed
+// concurrently; leaf commands run in parallel on the dispatch workers, bounded
+// by the group's concurrency limit and paced by its stagger interval, and
+// fanOut returns once all of them have completed. No further leaves are
+// dispatched once run is cancelled.
+func (s *Command) fanOut(run *fanOutRun, visited map[string]bool, query types.SearchQuery, payload json.RawMessage, opts commandOptions) {
+	var pending sync.WaitGroup
 	entities := performEntitySearch(query)
 	for _, ent := range entities {
+		if run.isCancelled() {
+			slog.Info("fan-out cancelled", "command_id", run.id)
+			break
+		}
 		key := entityVisitKey(ent.PluginID, ent.DeviceID, ent.ID)
 		if visited[key] {
 			continue
 		}
 		visited[key] = true
-		s.dispatchFanOutEntity(visited, ent, payload)
+		s.dispatchFanOutEntity(run, visited, &pending, ent, payload, opts)
 	}
+	s.publishFanOutProgress(run)
+	pending.Wait()
 }
 
 // dispatchFanOutEntity handles a single entity during fan-out. If the entity is
-// itself a group it recurses synchronously before dispatching to its plugin.
-func (s *Command) dispatchFanOutEntity(visited map[string]bool, ent types.Entity, payload json.RawMessage) {
+// itself a group it recurses synchronously; otherwise the leaf command is queued
+// for its plugin and tracked in pending. Gateway-owned leaves have no plugin to
+// run them, so they are only handed to the script runtime and get no status.
+func (s *Command) dispatchFanOutEntity(run *fanOutRun, visited map[string]bool, pending *sync.WaitGroup, ent types.Entity, payload json.RawMessage, opts commandOptions) {
 	action, err := parseActionType(payload)
 	if err == nil && ent.CommandQuery == nil && len(ent.Actions) > 0 && !containsAction(ent.Actions, action) {
 		slog.Debug("fan-out skipping unsupported leaf action", "plugin_id", ent.PluginID, "device_id", ent.DeviceID, "entity_id", ent.ID, "action", action)
@@ -178,7 +446,7 @@ func (s *Command) dispatchFanOutEntity(visited map[string]bool, ent types.Entity
 	}
 
 	now := time.Now().UTC()
-	status := types.CommandStatus{
+	status := GatewayCommandStatus{CommandStatus: types.CommandStatus{
 		CommandID:     nextID("gcmd"),
 		PluginID:      ent.PluginID,
 		DeviceID:      ent.DeviceID,
@@ -187,33 +455,88 @@ func (s *Command) dispatchFanOutEntity(visited map[string]bool, ent types.Entity
 		State:         types.CommandPending,
 		CreatedAt:     now,
 		LastUpdatedAt: now,
+	}, ParentID: run.id, CorrelationID: opts.CorrelationID}
+	payload, status.Policy, err = s.policies.Evaluate(ent, action, payload, opts.Headers, now)
+	if err != nil {
+		status = s.denyCommand(status, err)
+		run.addChild(status.CommandID)
+		run.record(status)
+		return
+	}
+	// Leaves are validated before scripts are notified, as on the direct path,
+	// so scripts never see a command that is then rejected as invalid.
+	if err := validateEntityCommand(ent, action, payload); err != nil {
+		slog.Info("fan-out leaf payload invalid", "command_id", status.CommandID, "plugin_id", ent.PluginID, "entity_id", ent.ID, "error", err)
+		status.State = types.CommandFailed
+		status.Error = err.Error()
+		status.LastUpdatedAt = time.Now().UTC()
+		s.updateStatus(status)
+		run.addChild(status.CommandID)
+		run.record(status)
+		return
+	}
+	group := ent.CommandQuery != nil && commandMatchesFilter(action, ent.CommandFilter)
+	if !group && isGatewayOwned(ent.PluginID) {
+		// Nothing would ever complete a status for this leaf, so none is
+		// stored; it would otherwise stay pending and never be evicted.
+		if scriptRuntime != nil {
+			scriptRuntime.NotifyCommand(ent.PluginID, ent.DeviceID, ent.ID, payload, status.CorrelationID)
+		}
+		slog.Debug("fan-out handed gateway-owned leaf to scripts", "entity_id", ent.ID)
+		return
 	}
 	s.updateStatus(status)
 	if scriptRuntime != nil {
-		scriptRuntime.NotifyCommand(ent.PluginID, ent.DeviceID, ent.ID, payload)
+		scriptRuntime.NotifyCommand(ent.PluginID, ent.DeviceID, ent.ID, payload, status.CorrelationID)
 	}
 
-	if ent.CommandQuery != nil && commandMatchesFilter(action, ent.CommandFilter) {
+	if group {
 		// Nested query-backed group: recurse synchronously (same goroutine, shared
 		// visited set), then mark the virtual group command complete.
-		s.fanOut(visited, *ent.CommandQuery, payload)
-		status.State = types.CommandSucceeded
-		status.LastUpdatedAt = time.Now().UTC()
-		s.updateStatus(status)
+		run.addChild(status.CommandID)
+		child := s.startFanOut(status, ent, run)
+		s.fanOut(child, visited, *ent.CommandQuery, payload, opts)
+		run.record(s.finishFanOut(child))
 		return
 	}
 
-	if !isGatewayOwned(ent.PluginID) {
-		job := commandJob{
-			rootStatus: status,
-			payload:    payload,
-			target:     commandTarget{ent.PluginID, ent.DeviceID, ent.ID},
-			onComplete: s.updateStatus,
-		}
-		s.dispatcher.Execute(job)
-	} else {
-		slog.Debug("fan-out skipping gateway-owned leaf", "entity_id", ent.ID)
+	run.addChild(status.CommandID)
+	pending.Add(1)
+	complete := func(st GatewayCommandStatus) {
+		s.updateStatus(st)
+		run.record(st)
+		run.release()
+		pending.Done()
+	}
+	job := commandJob{
+		rootStatus: status,
+		payload:    payload,
+		target:     commandTarget{ent.PluginID, ent.DeviceID, ent.ID},
+		retry:      opts.Retry,
+		priority:   opts.Priority,
+		action:     action,
+		coalesce:   opts.Coalesce,
+		cancelled:  run.isCancelled,
+		onAttempt:  s.updateStatus,
+		onComplete: complete,
+	}
+	run.acquire()
+	run.pacer.wait()
+	if err := s.dispatcher.EnqueueWait(job); err != nil {
+		status.State = types.CommandFailed
+		status.Error = err.Error()
+		status.LastUpdatedAt = time.Now().UTC()
+		complete(status)
+	}
+}
+
+// validateEntityCommand validates payload against ent's domain schema unless
+// the command fans out, in which case each leaf is validated on its own.
+func validateEntityCommand(ent types.Entity, action string, payload json.RawMessage) error {
+	if ent.CommandQuery != nil && commandMatchesFilter(action, ent.CommandFilter) {
+		return nil
 	}
+	return validateCommandPayload(ent.Domain, action, payload)
 }
 
 // isGatewayOwned reports whether an entity is owned by the gateway itself
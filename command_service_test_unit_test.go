@@ -3,7 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
 )
 
 func TestCommandService_SubmitEntityNotFound(t *testing.T) {
@@ -19,3 +24,175 @@ func TestCommandService_SubmitEntityNotFound(t *testing.T) {
 		t.Fatalf("expected errCommandTargetNotFound, got %v", err)
 	}
 }
+
+func childStatus(id string, state types.CommandState) GatewayCommandStatus {
+	st := GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: id, PluginID: "p", EntityID: id, State: state}}
+	if state == types.CommandFailed {
+		st.Error = "no response"
+	}
+	return st
+}
+
+func TestCommandChildSummary_DerivesGroupState(t *testing.T) {
+	cases := []struct {
+		name     string
+		children []types.CommandState
+		want     types.CommandState
+	}{
+		{"empty group", nil, types.CommandSucceeded},
+		{"all succeeded", []types.CommandState{types.CommandSucceeded, types.CommandSucceeded}, types.CommandSucceeded},
+		{"some failed", []types.CommandState{types.CommandSucceeded, types.CommandFailed}, CommandPartiallyFailed},
+		{"all failed", []types.CommandState{types.CommandFailed, types.CommandFailed}, types.CommandFailed},
+		{"nested partial", []types.CommandState{types.CommandSucceeded, CommandPartiallyFailed}, CommandPartiallyFailed},
+		{"superseded is not a failure", []types.CommandState{types.CommandSucceeded, CommandSuperseded}, types.CommandSucceeded},
+	}
+	for _, tc := range cases {
+		var sum CommandChildSummary
+		for i, st := range tc.children {
+			sum.add(childStatus(string(rune('a'+i)), st))
+		}
+		if got := sum.state(); got != tc.want {
+			t.Errorf("%s: state = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCommand_FinishFanOutRecordsChildrenAndTree(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	root := childStatus("root", types.CommandPending)
+	svc.statuses.Put(root)
+	run := svc.startFanOut(root, types.Entity{}, nil)
+
+	nestedStatus := childStatus("nested", types.CommandPending)
+	nestedStatus.ParentID = "root"
+	svc.statuses.Put(nestedStatus)
+	run.addChild("nested")
+	nested := svc.startFanOut(nestedStatus, types.Entity{}, run)
+	for _, leaf := range []GatewayCommandStatus{childStatus("bulb-1", types.CommandSucceeded), childStatus("bulb-2", types.CommandFailed)} {
+		svc.statuses.Put(leaf)
+		nested.addChild(leaf.CommandID)
+		nested.record(leaf)
+	}
+	run.record(svc.finishFanOut(nested))
+
+	leaf := childStatus("bulb-3", types.CommandSucceeded)
+	svc.statuses.Put(leaf)
+	run.addChild(leaf.CommandID)
+	run.record(leaf)
+
+	final := svc.finishFanOut(run)
+	if final.State != CommandPartiallyFailed {
+		t.Fatalf("expected root partially_failed, got %s", final.State)
+	}
+	if len(final.Children) != 2 || final.Summary == nil || final.Summary.PartiallyFailed != 1 || final.Summary.Succeeded != 1 {
+		t.Fatalf("unexpected root children/summary: %+v %+v", final.Children, final.Summary)
+	}
+
+	tree, ok := svc.StatusTree("root")
+	if !ok || len(tree.Children) != 2 {
+		t.Fatalf("expected 2 children in tree, got %+v", tree)
+	}
+	nestedNode := tree.Children[0]
+	if nestedNode.Status.CommandID != "nested" || len(nestedNode.Children) != 2 {
+		t.Fatalf("expected nested group with 2 leaves, got %+v", nestedNode)
+	}
+	errs := nestedNode.Status.Summary.Errors
+	if len(errs) != 1 || errs[0].CommandID != "bulb-2" || errs[0].Error == "" {
+		t.Errorf("expected bulb-2 failure in nested summary, got %+v", errs)
+	}
+}
+
+func TestCommand_CancelIsNotOverwrittenByFanOutProgress(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	for i := 0; i < 200; i++ {
+		id := "group-" + strconv.Itoa(i)
+		root := childStatus(id, types.CommandPending)
+		svc.statuses.Put(root)
+		run := svc.startFanOut(root, types.Entity{}, nil)
+		run.addChild(id + "-leaf")
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			svc.publishFanOutProgress(run)
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := svc.Cancel(id); err != nil {
+				t.Errorf("cancel %s: %v", id, err)
+			}
+		}()
+		wg.Wait()
+
+		st, _ := svc.GetStatus(id)
+		if st.State != CommandCancelled {
+			t.Fatalf("expected %s to stay cancelled, got %s", id, st.State)
+		}
+		if len(st.Children) != 1 {
+			t.Fatalf("expected the cancelled status to keep its children, got %+v", st.Children)
+		}
+	}
+}
+
+func TestCommand_StartFanOutAppliesGroupSettings(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	svc.groupDefaults = groupFanOutSettings{Concurrency: 3}
+
+	root := svc.startFanOut(childStatus("root", types.CommandPending), types.Entity{}, nil)
+	if cap(root.slots) != 3 || root.pacer != nil {
+		t.Fatalf("expected default concurrency 3 and no stagger, got cap=%d pacer=%v", cap(root.slots), root.pacer)
+	}
+
+	group := types.Entity{ID: "room", Meta: map[string]json.RawMessage{
+		groupFanOutMetaKey: json.RawMessage(`{"concurrency": 2, "stagger_ms": 150}`),
+	}}
+	nested := svc.startFanOut(childStatus("nested", types.CommandPending), group, root)
+	if cap(nested.slots) != 2 || nested.pacer == nil || nested.pacer.interval != 150*time.Millisecond {
+		t.Fatalf("expected meta settings to apply, got cap=%d pacer=%+v", cap(nested.slots), nested.pacer)
+	}
+
+	inherited := svc.startFanOut(childStatus("inner", types.CommandPending), types.Entity{}, nested)
+	if inherited.slots != nested.slots || inherited.pacer != nested.pacer {
+		t.Error("expected nested group without settings to share its parent's limit and stagger")
+	}
+}
+
+func TestFanOutPacer_StaggersDispatches(t *testing.T) {
+	p := &fanOutPacer{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		p.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected at least two stagger intervals, took %v", elapsed)
+	}
+}
+
+func TestCommand_FanOutGatewayOwnedLeafDoesNotLeakStatus(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	root := childStatus("root", types.CommandPending)
+	svc.statuses.Put(root)
+	run := svc.startFanOut(root, types.Entity{}, nil)
+
+	var pending sync.WaitGroup
+	leaf := types.Entity{PluginID: gatewayPluginID, DeviceID: "virtual", ID: "scene-light", Domain: "light"}
+	svc.dispatchFanOutEntity(run, map[string]bool{}, &pending, leaf, json.RawMessage(`{"type":"turn_on"}`), commandOptions{})
+	pending.Wait()
+	svc.finishFanOut(run)
+
+	if svc.statuses.Len() != 1 {
+		t.Fatalf("expected only the group status to be stored, got %d", svc.statuses.Len())
+	}
+	svc.statuses.Evict(time.Now().UTC().Add(svc.retention.MaxAge + time.Minute))
+	if n := svc.statuses.Len(); n != 0 {
+		t.Fatalf("expected the store to drain after eviction, got %d statuses", n)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// Defaults for gateway command status retention. Override with
+// GATEWAY_COMMAND_STATUS_MAX_AGE (Go duration) and
+// GATEWAY_COMMAND_STATUS_MAX_COUNT.
+const (
+	defaultCommandStatusMaxAge   = time.Hour
+	defaultCommandStatusMaxCount = 10000
+	commandStatusSweepInterval   = 30 * time.Second
+)
+
+// commandStatusRetention bounds how many gateway command statuses are kept in
+// memory and for how long.
+type commandStatusRetention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+func commandStatusRetentionFromEnv() commandStatusRetention {
+	r := commandStatusRetention{
+		MaxAge:   defaultCommandStatusMaxAge,
+		MaxCount: defaultCommandStatusMaxCount,
+	}
+	if v := strings.TrimSpace(getenv("GATEWAY_COMMAND_STATUS_MAX_AGE")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			r.MaxAge = d
+		} else {
+			slog.Warn("invalid GATEWAY_COMMAND_STATUS_MAX_AGE, using default", "value", v, "default", r.MaxAge)
+		}
+	}
+	if v := strings.TrimSpace(getenv("GATEWAY_COMMAND_STATUS_MAX_COUNT")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			r.MaxCount = n
+		} else {
+			slog.Warn("invalid GATEWAY_COMMAND_STATUS_MAX_COUNT, using default", "value", v, "default", r.MaxCount)
+		}
+	}
+	return r
+}
+
+// commandStatusStore holds the statuses of gateway-issued (gcmd-*) commands.
+type commandStatusStore interface {
+	// Put stores status and returns the state of the status it replaced, if
+	// any.
+	Put(status GatewayCommandStatus) (previous types.CommandState, replaced bool)
+	Get(commandID string) (GatewayCommandStatus, bool)
+	Len() int
+	// CountByState returns how many statuses are held in each state.
+	CountByState() map[types.CommandState]int
+	// Evict drops statuses that fall outside the retention policy and returns
+	// how many were removed.
+	Evict(now time.Time) int
+}
+
+// commandStatusSource supplies previously recorded statuses on boot, and
+// statuses since evicted from memory when they are polled. It is satisfied by
+// *history.History.
+type commandStatusSource interface {
+	RecentCommandStatuses(idPrefix string, since time.Time, limit int) ([]json.RawMessage, error)
+	CommandStatus(commandID string) (json.RawMessage, bool, error)
+}
+
+// memoryStatusStore is a bounded in-memory commandStatusStore. Terminal
+// statuses expire after MaxAge; when the store exceeds MaxCount the oldest
+// terminal statuses are dropped. Pending and scheduled statuses are never
+// evicted, so the store may exceed MaxCount while they are in flight.
+type memoryStatusStore struct {
+	mu        sync.RWMutex
+	statuses  map[string]GatewayCommandStatus
+	retention commandStatusRetention
+}
+
+func newMemoryStatusStore(retention commandStatusRetention) *memoryStatusStore {
+	return &memoryStatusStore{
+		statuses:  make(map[string]GatewayCommandStatus),
+		retention: retention,
+	}
+}
+
+func (m *memoryStatusStore) Put(status GatewayCommandStatus) (types.CommandState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, ok := m.statuses[status.CommandID]
+	m.statuses[status.CommandID] = status
+	return prev.State, ok
+}
+
+func (m *memoryStatusStore) Get(commandID string) (GatewayCommandStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status, ok := m.statuses[commandID]
+	return status, ok
+}
+
+func (m *memoryStatusStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.statuses)
+}
+
+func (m *memoryStatusStore) CountByState() map[types.CommandState]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[types.CommandState]int)
+	for _, st := range m.statuses {
+		out[st.State]++
+	}
+	return out
+}
+
+func (m *memoryStatusStore) Evict(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	if m.retention.MaxAge > 0 {
+		cutoff := now.Add(-m.retention.MaxAge)
+		for id, st := range m.statuses {
+			if isTerminalCommandState(st.State) && st.LastUpdatedAt.Before(cutoff) {
+				delete(m.statuses, id)
+				removed++
+			}
+		}
+	}
+
+	excess := len(m.statuses) - m.retention.MaxCount
+	if m.retention.MaxCount <= 0 || excess <= 0 {
+		return removed
+	}
+	// Only terminal statuses are evicted: a pending or scheduled command is
+	// still live and must stay pollable, so the store may sit over MaxCount
+	// until enough commands finish.
+	terminal := make([]GatewayCommandStatus, 0, len(m.statuses))
+	for _, st := range m.statuses {
+		if isTerminalCommandState(st.State) {
+			terminal = append(terminal, st)
+		}
+	}
+	sort.Slice(terminal, func(i, j int) bool {
+		return terminal[i].LastUpdatedAt.Before(terminal[j].LastUpdatedAt)
+	})
+	if excess > len(terminal) {
+		excess = len(terminal)
+	}
+	for _, st := range terminal[:excess] {
+		delete(m.statuses, st.CommandID)
+		removed++
+	}
+	return removed
+}
+
+// CommandSuperseded is the terminal state of a coalescing command that was
+// replaced in its dispatch queue by a newer command for the same entity and
+// action before it was sent.
+const CommandSuperseded types.CommandState = "superseded"
+
+// Gateway-only command states for deferred dispatch. A scheduled command waits
+// for its execute_at time; a cancelled one was withdrawn before dispatch.
+const (
+	CommandScheduled types.CommandState = "scheduled"
+	CommandCancelled types.CommandState = "cancelled"
+)
+
+// isTerminalCommandState reports whether a command in state s will not change
+// again.
+func isTerminalCommandState(s types.CommandState) bool {
+	switch s {
+	case types.CommandSucceeded, types.CommandFailed, CommandPartiallyFailed, CommandSuperseded, CommandCancelled:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestMemoryStatusStore_EvictsExpiredTerminalStatuses(t *testing.T) {
+	store := newMemoryStatusStore(commandStatusRetention{MaxAge: time.Minute, MaxCount: 100})
+	now := time.Now().UTC()
+
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "old-done", State: types.CommandSucceeded, LastUpdatedAt: now.Add(-2 * time.Minute)}})
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "old-pending", State: types.CommandPending, LastUpdatedAt: now.Add(-2 * time.Minute)}})
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "fresh-done", State: types.CommandFailed, LastUpdatedAt: now}})
+
+	if n := store.Evict(now); n != 1 {
+		t.Fatalf("expected 1 eviction, got %d", n)
+	}
+	if _, ok := store.Get("old-done"); ok {
+		t.Error("expected expired terminal status to be evicted")
+	}
+	if _, ok := store.Get("old-pending"); !ok {
+		t.Error("expected in-flight status to survive age eviction")
+	}
+	if _, ok := store.Get("fresh-done"); !ok {
+		t.Error("expected fresh status to survive")
+	}
+}
+
+func TestMemoryStatusStore_EnforcesMaxCount(t *testing.T) {
+	store := newMemoryStatusStore(commandStatusRetention{MaxAge: time.Hour, MaxCount: 3})
+	now := time.Now().UTC()
+
+	for i := 0; i < 5; i++ {
+		store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{
+			CommandID:     fmt.Sprintf("cmd-%d", i),
+			State:         types.CommandSucceeded,
+			LastUpdatedAt: now.Add(time.Duration(i) * time.Second),
+		}})
+	}
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "inflight", State: types.CommandPending, LastUpdatedAt: now.Add(-time.Hour)}})
+
+	store.Evict(now)
+	if store.Len() != 3 {
+		t.Fatalf("expected 3 statuses after eviction, got %d", store.Len())
+	}
+	for _, id := range []string{"inflight", "cmd-3", "cmd-4"} {
+		if _, ok := store.Get(id); !ok {
+			t.Errorf("expected %s to be retained", id)
+		}
+	}
+}
+
+func TestMemoryStatusStore_MaxCountKeepsInFlightStatuses(t *testing.T) {
+	store := newMemoryStatusStore(commandStatusRetention{MaxAge: time.Hour, MaxCount: 2})
+	now := time.Now().UTC()
+
+	for i := 0; i < 4; i++ {
+		store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{
+			CommandID:     fmt.Sprintf("pending-%d", i),
+			State:         types.CommandPending,
+			LastUpdatedAt: now.Add(-time.Duration(i) * time.Minute),
+		}})
+	}
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "scheduled", State: CommandScheduled, LastUpdatedAt: now.Add(-time.Hour)}})
+	store.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "done", State: types.CommandSucceeded, LastUpdatedAt: now}})
+
+	if n := store.Evict(now); n != 1 {
+		t.Fatalf("expected only the terminal status to be evicted, got %d", n)
+	}
+	if store.Len() != 5 {
+		t.Fatalf("expected the store to stay over MaxCount with 5 in-flight statuses, got %d", store.Len())
+	}
+	for _, id := range []string{"pending-0", "pending-3", "scheduled"} {
+		if _, ok := store.Get(id); !ok {
+			t.Errorf("expected %s to be retained", id)
+		}
+	}
+}
+
+type fakeStatusSource struct {
+	statuses []types.CommandStatus
+	// archived are found by CommandStatus but not loaded on boot.
+	archived []types.CommandStatus
+}
+
+func (f fakeStatusSource) CommandStatus(commandID string) (json.RawMessage, bool, error) {
+	for _, st := range append(f.statuses, f.archived...) {
+		if st.CommandID == commandID {
+			raw, _ := json.Marshal(st)
+			return raw, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (f fakeStatusSource) RecentCommandStatuses(string, time.Time, int) ([]json.RawMessage, error) {
+	out := make([]json.RawMessage, 0, len(f.statuses))
+	for _, st := range f.statuses {
+		raw, _ := json.Marshal(st)
+		out = append(out, raw)
+	}
+	return out, nil
+}
+
+func TestCommand_RehydrateMarksInFlightAsFailed(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	now := time.Now().UTC()
+	err := svc.Rehydrate(fakeStatusSource{statuses: []types.CommandStatus{
+		{CommandID: "gcmd-1", PluginID: "p", State: types.CommandSucceeded, LastUpdatedAt: now},
+		{CommandID: "gcmd-2", PluginID: "p", State: types.CommandPending, LastUpdatedAt: now},
+	}})
+	if err != nil {
+		t.Fatalf("rehydrate: %v", err)
+	}
+
+	if st, ok := svc.GetStatus("gcmd-1"); !ok || st.State != types.CommandSucceeded {
+		t.Errorf("expected gcmd-1 succeeded, got %+v (found=%v)", st, ok)
+	}
+	st, ok := svc.GetStatus("gcmd-2")
+	if !ok {
+		t.Fatal("expected gcmd-2 to be rehydrated")
+	}
+	if st.State != types.CommandFailed || st.Error == "" {
+		t.Errorf("expected interrupted command to be failed with an error, got %+v", st)
+	}
+	if !svc.IsGatewayCommand("gcmd-2") {
+		t.Error("expected rehydrated command to be recognised as a gateway command")
+	}
+}
+
+func TestCommand_LookupStatusFallsBackToHistory(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+
+	if err := svc.Rehydrate(fakeStatusSource{archived: []types.CommandStatus{
+		{CommandID: "gcmd-evicted", PluginID: "p", State: types.CommandSucceeded},
+	}}); err != nil {
+		t.Fatalf("rehydrate: %v", err)
+	}
+	if _, ok := svc.GetStatus("gcmd-evicted"); ok {
+		t.Fatal("expected the status not to be held in memory")
+	}
+	st, ok := svc.LookupStatus("gcmd-evicted")
+	if !ok || st.State != types.CommandSucceeded {
+		t.Fatalf("expected the evicted status from history, got %+v (found=%v)", st, ok)
+	}
+	if _, ok := svc.LookupStatus("gcmd-unknown"); ok {
+		t.Error("expected an unknown command to stay not found")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/slidebolt/sdk-types"
+)
+
+// maxCommandWait caps how long a send-and-wait request may block.
+const maxCommandWait = 60 * time.Second
+
+// CommandWaitOutcome says how a send-and-wait request ended.
+type CommandWaitOutcome string
+
+const (
+	// CommandWaitCompleted: the command reached a terminal state and no
+	// confirmation was requested (or the command did not succeed, or it is a
+	// group command, which is never confirmed).
+	CommandWaitCompleted CommandWaitOutcome = "completed"
+	// CommandWaitConfirmed: the command succeeded and the entity reported the
+	// new state.
+	CommandWaitConfirmed CommandWaitOutcome = "confirmed"
+	// CommandWaitUnconfirmed: the command succeeded but no matching entity
+	// event arrived before the wait expired.
+	CommandWaitUnconfirmed CommandWaitOutcome = "unconfirmed"
+	// CommandWaitTimeout: the command was still running when the wait expired.
+	CommandWaitTimeout CommandWaitOutcome = "timeout"
+	// CommandDryRun: nothing was dispatched; see the explanation instead.
+	CommandDryRun CommandWaitOutcome = "dry_run"
+)
+
+// CommandWaitResult is a command status together with the outcome of waiting
+// for it and, when confirmed, the entity state reported by the device.
+type CommandWaitResult struct {
+	GatewayCommandStatus
+	Outcome        CommandWaitOutcome  `json:"outcome,omitempty" enum:"completed,confirmed,unconfirmed,timeout,dry_run" doc:"Set when the request waited for the command (?wait) or was a dry run (?dry_run)"`
+	ConfirmedState json.RawMessage     `json:"confirmed_state,omitempty" doc:"Payload of the entity event that confirmed the command"`
+	ConfirmedAt    *time.Time          `json:"confirmed_at,omitempty"`
+	Explanation    *CommandExplanation `json:"explanation,omitempty" doc:"Resolution tree of a dry run (?dry_run)"`
+}
+
+// commandWatcher receives a command's terminal status and, when all is set,
+// every update before it.
+type commandWatcher struct {
+	ch  chan GatewayCommandStatus
+	all bool
+}
+
+// followBuffer is how many updates a follower may fall behind before
+// intermediate ones are dropped; the terminal status is always delivered.
+const followBuffer = 8
+
+// watch returns a channel that receives the command's status once it becomes
+// terminal. Call the returned func to stop watching.
+func (s *Command) watch(commandID string) (<-chan GatewayCommandStatus, func()) {
+	return s.addWatcher(commandID, commandWatcher{ch: make(chan GatewayCommandStatus, 1)})
+}
+
+// follow is watch for every status update, not just the terminal one. The
+// channel is closed after the terminal status.
+func (s *Command) follow(commandID string) (<-chan GatewayCommandStatus, func()) {
+	return s.addWatcher(commandID, commandWatcher{ch: make(chan GatewayCommandStatus, followBuffer), all: true})
+}
+
+func (s *Command) addWatcher(commandID string, w commandWatcher) (<-chan GatewayCommandStatus, func()) {
+	s.watchMu.Lock()
+	s.watchers[commandID] = append(s.watchers[commandID], w)
+	s.watchMu.Unlock()
+	return w.ch, func() {
+		s.watchMu.Lock()
+		defer s.watchMu.Unlock()
+		list := s.watchers[commandID]
+		for i, c := range list {
+			if c.ch == w.ch {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(s.watchers, commandID)
+		} else {
+			s.watchers[commandID] = list
+		}
+	}
+}
+
+// notifyWatchers hands a terminal status to everyone waiting on it, and any
+// status to followers.
+func (s *Command) notifyWatchers(status GatewayCommandStatus) {
+	terminal := isTerminalCommandState(status.State)
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	list := s.watchers[status.CommandID]
+	if terminal {
+		delete(s.watchers, status.CommandID)
+	}
+	for _, w := range list {
+		switch {
+		case terminal && w.all:
+			// Make room so the terminal status is never the one dropped.
+			select {
+			case w.ch <- status:
+			default:
+				<-w.ch
+				w.ch <- status
+			}
+			close(w.ch)
+		case terminal || w.all:
+			select {
+			case w.ch <- status:
+			default:
+			}
+		}
+	}
+}
+
+// SubmitAndWait submits a command and blocks until it reaches a terminal
+// state or ctx is done. With confirm set it keeps waiting, after the command
+// succeeds, for an entity event on SubjectEntityEvents reporting the new
+// state.
+func (s *Command) SubmitAndWait(ctx context.Context, pluginID, deviceID, entityID string, payload json.RawMessage, opts commandOptions, confirm bool) (CommandWaitResult, error) {
+	var events <-chan types.EntityEventEnvelope
+	if confirm {
+		ch, stop, err := watchEntityEvents(pluginID, deviceID, entityID)
+		if err != nil {
+			return CommandWaitResult{}, err
+		}
+		defer stop()
+		events = ch
+	}
+	status, err := s.SubmitWithOptions(pluginID, deviceID, entityID, payload, opts)
+	if err != nil {
+		return CommandWaitResult{GatewayCommandStatus: status}, err
+	}
+	return s.awaitCommand(ctx, status, payload, events), nil
+}
+
+// watchEntityEvents subscribes to events for one entity. Subscribe before
+// submitting a command so a fast device cannot report its new state before
+// the gateway is listening.
+func watchEntityEvents(pluginID, deviceID, entityID string) (<-chan types.EntityEventEnvelope, func(), error) {
+	events := make(chan types.EntityEventEnvelope, 64)
+	sub, err := nc.Subscribe(types.SubjectEntityEvents, func(m *nats.Msg) {
+		var env types.EntityEventEnvelope
+		if json.Unmarshal(m.Data, &env) != nil {
+			return
+		}
+		if env.PluginID != pluginID || env.DeviceID != deviceID || env.EntityID != entityID {
+			return
+		}
+		select {
+		case events <- env:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, nil, commandErr(CommandErrProjectionUnavailable, "cannot subscribe to entity events", err)
+	}
+	return events, func() { _ = sub.Unsubscribe() }, nil
+}
+
+// awaitCommand waits for status to become terminal and, if events is non-nil,
+// for one of them to confirm the command.
+func (s *Command) awaitCommand(ctx context.Context, status GatewayCommandStatus, payload json.RawMessage, events <-chan types.EntityEventEnvelope) CommandWaitResult {
+	done, stop := s.watch(status.CommandID)
+	defer stop()
+	// The command may have finished before the watch was registered.
+	if current, ok := s.statuses.Get(status.CommandID); ok {
+		status = current
+	}
+	finished := isTerminalCommandState(status.State)
+
+	action, _ := parseActionType(payload)
+	var confirmed *types.EntityEventEnvelope
+wait:
+	for {
+		if finished && (events == nil || confirmed != nil || status.State != types.CommandSucceeded || isGroupStatus(status)) {
+			break
+		}
+		select {
+		case st := <-done:
+			status, finished = st, true
+		case env := <-events:
+			if confirmed == nil && eventConfirmsCommand(status.CommandID, status.EntityType, action, payload, env) {
+				confirmed = &env
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	res := CommandWaitResult{GatewayCommandStatus: status, Outcome: CommandWaitCompleted}
+	switch {
+	case !finished:
+		if current, ok := s.statuses.Get(status.CommandID); ok {
+			res.GatewayCommandStatus = current
+		}
+		res.Outcome = CommandWaitTimeout
+	case events == nil || status.State != types.CommandSucceeded || isGroupStatus(status):
+	case confirmed != nil:
+		res.Outcome = CommandWaitConfirmed
+		res.ConfirmedState = confirmed.Payload
+		at := confirmed.CreatedAt
+		res.ConfirmedAt = &at
+	default:
+		res.Outcome = CommandWaitUnconfirmed
+	}
+	return res
+}
+
+func isGroupStatus(status GatewayCommandStatus) bool {
+	return status.Summary != nil || len(status.Children) > 0
+}
+
+// eventConfirmsCommand reports whether env shows the entity in the state a
+// command asked for: every state field the command set must appear in the
+// event with the same value; turn_on and turn_off expect on=true and on=false.
+// This holds even for an event correlated to the command, which may report
+// that the device did something else. A command that sets no state fields is
+// confirmed by an event of the same type or one correlated to it.
+func eventConfirmsCommand(commandID, domain, action string, payload json.RawMessage, env types.EntityEventEnvelope) bool {
+	var state map[string]any
+	if err := json.Unmarshal(env.Payload, &state); err != nil {
+		return false
+	}
+	expected := expectedCommandState(domain, action, payload)
+	if len(expected) == 0 {
+		if env.CorrelationID != "" && env.CorrelationID == commandID {
+			return true
+		}
+		eventType, _ := state["type"].(string)
+		return action != "" && eventType == action
+	}
+	for k, want := range expected {
+		got, ok := state[k]
+		if !ok || !reflect.DeepEqual(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// expectedCommandState returns the entity fields a command is expected to set.
+// When domain has a registered descriptor, only payload fields its events
+// report are expected, so parameters such as transition or duration are not;
+// otherwise every payload field is.
+func expectedCommandState(domain, action string, payload json.RawMessage) map[string]any {
+	var fields map[string]any
+	_ = json.Unmarshal(payload, &fields)
+	reported, known := stateFieldNames(domain)
+	expected := make(map[string]any, len(fields)+1)
+	for k, v := range fields {
+		if k != "type" && (!known || reported[k]) {
+			expected[k] = v
+		}
+	}
+	switch action {
+	case "turn_on":
+		expected["on"] = true
+	case "turn_off":
+		expected["on"] = false
+	}
+	return expected
+}
+
+// stateFieldNames returns the names of the fields that domain's events
+// report. It reports false when the domain has no registered descriptor.
+func stateFieldNames(domain string) (map[string]bool, bool) {
+	desc, ok := types.GetDomainDescriptor(domain)
+	if !ok {
+		return nil, false
+	}
+	names := make(map[string]bool)
+	for _, evt := range desc.Events {
+		for _, f := range evt.Fields {
+			names[f.Name] = true
+		}
+	}
+	return names, true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func entityEvent(payload string) types.EntityEventEnvelope {
+	return types.EntityEventEnvelope{PluginID: "p", DeviceID: "d", EntityID: "e", Payload: json.RawMessage(payload)}
+}
+
+func TestEventConfirmsCommand(t *testing.T) {
+	cases := []struct {
+		name    string
+		action  string
+		payload string
+		event   string
+		want    bool
+	}{
+		{"turn_on sees on=true", "turn_on", `{"type":"turn_on"}`, `{"type":"turn_on","on":true}`, true},
+		{"turn_on sees on=false", "turn_on", `{"type":"turn_on"}`, `{"type":"state","on":false}`, false},
+		{"brightness matches", "set_brightness", `{"type":"set_brightness","brightness":40}`, `{"type":"state","on":true,"brightness":40}`, true},
+		{"brightness differs", "set_brightness", `{"type":"set_brightness","brightness":40}`, `{"type":"state","brightness":100}`, false},
+		{"field missing", "set_brightness", `{"type":"set_brightness","brightness":40}`, `{"type":"state","on":true}`, false},
+		{"no fields, same type", "toggle", `{"type":"toggle"}`, `{"type":"toggle","on":true}`, true},
+		{"no fields, other type", "toggle", `{"type":"toggle"}`, `{"type":"state","on":true}`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := eventConfirmsCommand("gcmd-1", "", tc.action, json.RawMessage(tc.payload), entityEvent(tc.event))
+			if got != tc.want {
+				t.Errorf("eventConfirmsCommand = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	env := entityEvent(`{"type":"state","on":false}`)
+	env.CorrelationID = "gcmd-1"
+	if eventConfirmsCommand("gcmd-1", "", "turn_on", json.RawMessage(`{"type":"turn_on"}`), env) {
+		t.Error("expected a correlated event reporting the opposite state not to confirm the command")
+	}
+	env = entityEvent(`{"type":"state","on":true}`)
+	env.CorrelationID = "gcmd-1"
+	if !eventConfirmsCommand("gcmd-1", "", "toggle", json.RawMessage(`{"type":"toggle"}`), env) {
+		t.Error("expected a correlated event to confirm a command that sets no state")
+	}
+}
+
+func TestEventConfirmsCommand_IgnoresParametersNotReportedAsState(t *testing.T) {
+	types.RegisterDomain(types.DomainDescriptor{
+		Domain: "test_wait_dimmer",
+		Commands: []types.ActionDescriptor{
+			{Action: "set_brightness", Fields: []types.FieldDescriptor{
+				{Name: "brightness", Type: "integer", Required: true},
+				{Name: "transition", Type: "number"},
+			}},
+		},
+		Events: []types.ActionDescriptor{
+			{Action: "state", Fields: []types.FieldDescriptor{
+				{Name: "on", Type: "boolean"},
+				{Name: "brightness", Type: "integer"},
+			}},
+		},
+	})
+	payload := json.RawMessage(`{"type":"set_brightness","brightness":40,"transition":2}`)
+	if !eventConfirmsCommand("gcmd-1", "test_wait_dimmer", "set_brightness", payload, entityEvent(`{"type":"state","on":true,"brightness":40}`)) {
+		t.Error("expected transition not to be required in the reported state")
+	}
+	if eventConfirmsCommand("gcmd-1", "test_wait_dimmer", "set_brightness", payload, entityEvent(`{"type":"state","on":true,"brightness":100}`)) {
+		t.Error("expected a different brightness not to confirm the command")
+	}
+}
+
+func TestCommand_AwaitCommand(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	payload := json.RawMessage(`{"type":"turn_on"}`)
+	pending := func(id string) GatewayCommandStatus {
+		st := GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: id, PluginID: "p", DeviceID: "d", EntityID: "e", State: types.CommandPending}}
+		svc.statuses.Put(st)
+		return st
+	}
+	succeed := func(st GatewayCommandStatus) {
+		st.State = types.CommandSucceeded
+		svc.updateStatus(st)
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		st := pending("gcmd-done")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			succeed(st)
+		}()
+		res := svc.awaitCommand(context.Background(), st, payload, nil)
+		if res.Outcome != CommandWaitCompleted || res.State != types.CommandSucceeded {
+			t.Fatalf("expected completed/succeeded, got %s/%s", res.Outcome, res.State)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		st := pending("gcmd-slow")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		res := svc.awaitCommand(ctx, st, payload, nil)
+		if res.Outcome != CommandWaitTimeout || res.State != types.CommandPending {
+			t.Fatalf("expected timeout/pending, got %s/%s", res.Outcome, res.State)
+		}
+	})
+
+	t.Run("confirmed before completion", func(t *testing.T) {
+		st := pending("gcmd-confirm")
+		events := make(chan types.EntityEventEnvelope, 1)
+		events <- entityEvent(`{"type":"turn_on","on":true}`)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			succeed(st)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		res := svc.awaitCommand(ctx, st, payload, events)
+		if res.Outcome != CommandWaitConfirmed || string(res.ConfirmedState) != `{"type":"turn_on","on":true}` {
+			t.Fatalf("expected confirmed with state, got %s %s", res.Outcome, res.ConfirmedState)
+		}
+	})
+
+	t.Run("unconfirmed", func(t *testing.T) {
+		st := pending("gcmd-quiet")
+		succeed(st)
+		events := make(chan types.EntityEventEnvelope, 1)
+		events <- entityEvent(`{"type":"state","on":false}`)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		res := svc.awaitCommand(ctx, st, payload, events)
+		if res.Outcome != CommandWaitUnconfirmed || res.State != types.CommandSucceeded {
+			t.Fatalf("expected unconfirmed/succeeded, got %s/%s", res.Outcome, res.State)
+		}
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		st := pending("gcmd-follow")
+		updates, stop := svc.follow(st.CommandID)
+		defer stop()
+		retrying := st
+		retrying.Attempts = 1
+		svc.updateStatus(retrying)
+		succeed(st)
+		var states []types.CommandState
+		for status := range updates {
+			states = append(states, status.State)
+		}
+		if len(states) != 2 || states[0] != types.CommandPending || states[1] != types.CommandSucceeded {
+			t.Fatalf("expected pending then succeeded before the channel closed, got %v", states)
+		}
+	})
+}
+
+func TestParseCommandWait(t *testing.T) {
+	if d, err := parseCommandWait("5s"); err != nil || d != 5*time.Second {
+		t.Fatalf("expected 5s, got %v (%v)", d, err)
+	}
+	if d, err := parseCommandWait(""); err != nil || d != 0 {
+		t.Fatalf("expected no wait, got %v (%v)", d, err)
+	}
+	for _, bad := range []string{"soon", "-1s", "2m"} {
+		if _, err := parseCommandWait(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
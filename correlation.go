@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerCorrelationID = "X-Correlation-ID"
+	headerTraceparent   = "Traceparent"
+
+	maxCorrelationIDLen = 128
+)
+
+type correlationKey struct{}
+
+// withCorrelationID returns ctx carrying id; see correlationIDFrom.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlationIDFrom returns the correlation ID carried by ctx, or "".
+func correlationIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// requestCorrelationID picks the correlation ID for an incoming request: the
+// caller's X-Correlation-ID, else the trace ID of a W3C traceparent header,
+// else a freshly generated ID in the same 32-hex-digit form.
+func requestCorrelationID(h http.Header) string {
+	if id := strings.TrimSpace(h.Get(headerCorrelationID)); validCorrelationID(id) {
+		return id
+	}
+	if traceID, ok := traceparentTraceID(h.Get(headerTraceparent)); ok {
+		return traceID
+	}
+	return newCorrelationID()
+}
+
+func newCorrelationID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLen {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// traceparentTraceID extracts the trace ID from a version-00 traceparent
+// header ("00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>").
+func traceparentTraceID(v string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	traceID := strings.ToLower(parts[1])
+	if _, err := hex.DecodeString(traceID); err != nil || traceID == strings.Repeat("0", 32) {
+		return "", false
+	}
+	return traceID, true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestRequestCorrelationID(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Correlation-ID", "client-42")
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if got := requestCorrelationID(h); got != "client-42" {
+		t.Errorf("expected X-Correlation-ID to win, got %q", got)
+	}
+
+	h.Del("X-Correlation-ID")
+	if got := requestCorrelationID(h); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected traceparent trace id, got %q", got)
+	}
+
+	h.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	h.Set("X-Correlation-ID", "bad id\n")
+	got := requestCorrelationID(h)
+	if len(got) != 32 || got == "00000000000000000000000000000000" {
+		t.Errorf("expected a generated id for invalid headers, got %q", got)
+	}
+	if requestCorrelationID(http.Header{}) == got {
+		t.Error("expected generated ids to differ")
+	}
+}
+
+func TestCorrelationIDContext(t *testing.T) {
+	if got := correlationIDFrom(context.Background()); got != "" {
+		t.Errorf("expected no correlation id, got %q", got)
+	}
+	ctx := withCorrelationID(context.Background(), "req-1")
+	if got := correlationIDFrom(ctx); got != "req-1" {
+		t.Errorf("expected req-1, got %q", got)
+	}
+}
+
+func TestRootCorrelation(t *testing.T) {
+	s := CommandService()
+	defer s.Close()
+	s.statuses.Put(GatewayCommandStatus{CommandStatus: types.CommandStatus{CommandID: "gcmd-1", State: types.CommandPending}, CorrelationID: "req-1"})
+	if got := s.rootCorrelation("gcmd-1"); got != "req-1" {
+		t.Errorf("expected a command id to map to its correlation id, got %q", got)
+	}
+	if got := s.rootCorrelation("evt-9"); got != "evt-9" {
+		t.Errorf("expected unknown ids to be kept, got %q", got)
+	}
+}
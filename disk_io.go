@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
@@ -16,6 +17,11 @@ type DiskIO interface {
 	OpenRead(path string) (io.ReadCloser, error)
 	ReadDir(path string) ([]fs.DirEntry, error)
 	WriteFile(path string, data []byte, perm fs.FileMode) error
+	// ReplaceFile writes data to a temporary file beside path and renames it
+	// over path, so a crash leaves either the old or the new content.
+	ReplaceFile(path string, data []byte, perm fs.FileMode) error
+	// AppendFile appends data to path, creating it if needed, and syncs it.
+	AppendFile(path string, data []byte, perm fs.FileMode) error
 	Truncate(path string, size int64) error
 }
 
@@ -77,6 +83,70 @@ func (OSDiskIO) WriteFile(path string, data []byte, perm fs.FileMode) error {
 	return nil
 }
 
+func (OSDiskIO) ReplaceFile(path string, data []byte, perm fs.FileMode) error {
+	slog.Debug("disk write: replace", "path", path, "bytes", len(data), "perm", perm)
+	recordDiskWrite(path, data)
+	err := replaceFile(path, data, perm)
+	if err != nil {
+		slog.Debug("disk write failed: replace", "path", path, "error", err)
+		return err
+	}
+	slog.Debug("disk write ok: replace", "path", path, "bytes", len(data))
+	return nil
+}
+
+func replaceFile(path string, data []byte, perm fs.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (OSDiskIO) AppendFile(path string, data []byte, perm fs.FileMode) error {
+	slog.Debug("disk write: append", "path", path, "bytes", len(data), "perm", perm)
+	recordDiskWrite(path, data)
+	err := appendFile(path, data, perm)
+	if err != nil {
+		slog.Debug("disk write failed: append", "path", path, "error", err)
+		return err
+	}
+	slog.Debug("disk write ok: append", "path", path, "bytes", len(data))
+	return nil
+}
+
+func appendFile(path string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func (OSDiskIO) Truncate(path string, size int64) error {
 	slog.Debug("disk write: truncate", "path", path, "size", size)
 	err := os.Truncate(path, size)
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -22,138 +26,549 @@ type EventFilter struct {
 	// Action filters on the event's "type" field inside the payload.
 	// Empty string or "*" matches all actions. Glob patterns (e.g. "state.*") are supported.
 	Action string `json:"action,omitempty"`
+
+	// SinceSeq replays stored events after this EVENTS stream sequence before
+	// live delivery starts. Pass the seq of the last event received to resume.
+	SinceSeq uint64 `json:"since_seq,omitempty" doc:"Replay stored events with a stream sequence after this one, then continue live"`
+
+	// SinceTime replays stored events published at or after this time before
+	// live delivery starts. Mutually exclusive with SinceSeq.
+	SinceTime *time.Time `json:"since_time,omitempty" doc:"Replay stored events published at or after this time, then continue live"`
+}
+
+// replays reports whether the filter asks for stored events.
+func (f EventFilter) replays() bool {
+	return f.SinceSeq > 0 || f.SinceTime != nil
+}
+
+// eventsStreamName is the JetStream stream that stores entity events.
+const eventsStreamName = "EVENTS"
+
+// ErrReplayUnavailable is returned by Subscribe when a filter asks for replay
+// but the service was started without JetStream.
+var ErrReplayUnavailable = errors.New("event replay requires JetStream")
+
+const (
+	// dynamicSubBuffer is the number of events each subscription buffers
+	// before its overflow policy applies.
+	dynamicSubBuffer = 256
+	// maxReplayPending bounds the live events held back while a subscription
+	// replays; live events beyond it are dropped and reported as a gap.
+	maxReplayPending = 4096
+	// replayIdleTimeout ends a replay that stops receiving stored events,
+	// e.g. because events were purged while it ran.
+	replayIdleTimeout = 2 * time.Second
+)
+
+// SubscriptionEvent is an event delivered to a dynamic subscription: the
+// envelope plus its sequence in the EVENTS stream, which clients pass back as
+// since_seq to resume after a reconnect. Seq is 0 without JetStream.
+//
+// When the subscription lost events, a gap marker is delivered in their
+// place: a SubscriptionEvent with only Gap set, encoded as {"gap": {...}}.
+type SubscriptionEvent struct {
+	types.EntityEventEnvelope
+	Seq uint64    `json:"seq,omitempty" doc:"Sequence of the event in the EVENTS stream"`
+	Gap *EventGap `json:"gap,omitempty" doc:"Set on gap markers, which stand in for lost events"`
 }
 
-// dynamicSub is one active dynamic subscription.
+// MarshalJSON encodes gap markers without the empty envelope.
+func (e SubscriptionEvent) MarshalJSON() ([]byte, error) {
+	if e.Gap != nil {
+		return json.Marshal(struct {
+			Gap *EventGap `json:"gap"`
+		}{e.Gap})
+	}
+	type event SubscriptionEvent
+	return json.Marshal(event(e))
+}
+
+// dynamicSub is one active dynamic subscription. Matched events queue in buf
+// until a poll, stream or socket takes them; see event_subscription_overflow.go
+// for what happens when the queue is full.
 type dynamicSub struct {
 	id        string
 	filter    EventFilter
-	ch        chan types.EntityEventEnvelope
-	closed    atomic.Bool
-	once      sync.Once
+	overflow  OverflowPolicy
 	createdAt time.Time
+	dropped   atomic.Uint64
+	// notify is signalled when events are queued or the sub closes; space
+	// when events are taken. done is closed when the sub closes.
+	notify chan struct{}
+	space  chan struct{}
+	done   chan struct{}
+
+	mu sync.Mutex
+	// buf holds at most dynamicSubBuffer events, plus gap markers.
+	buf         []SubscriptionEvent
+	queued      int
+	closed      bool
+	closeReason string
+	// While replaying, live events are held in pending and delivered once the
+	// replay has caught up.
+	replaying  bool
+	pending    []SubscriptionEvent
+	pendingGap *EventGap
+
+	// The subscription is reaped once it has been idle for longer than ttl
+	// with no stream open; see event_subscription_lease.go.
+	ttl          time.Duration
+	lastActivity atomic.Int64
+	streams      atomic.Int32
 }
 
-func (s *dynamicSub) close() {
-	s.once.Do(func() {
-		s.closed.Store(true)
-		close(s.ch)
-	})
+func newDynamicSub(filter EventFilter, opts SubscriptionOptions) *dynamicSub {
+	sub := &dynamicSub{
+		id:        nextID("dsub"),
+		filter:    filter,
+		overflow:  opts.Overflow,
+		createdAt: time.Now().UTC(),
+		notify:    make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		replaying: filter.replays(),
+		ttl:       opts.TTL,
+	}
+	if sub.overflow == "" {
+		sub.overflow = OverflowDropNewest
+	}
+	sub.touch(sub.createdAt)
+	return sub
 }
 
-// trySend delivers env to the sub's channel. Returns false if the sub is
-// closed or the buffer is full (drop).
-func (s *dynamicSub) trySend(env types.EntityEventEnvelope) bool {
-	if s.closed.Load() {
-		return false
+// wake signals ch, which has capacity 1, without blocking.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
+}
+
+// close ends the subscription. Events already queued can still be taken.
+func (s *dynamicSub) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked("")
+}
+
+func (s *dynamicSub) isClosed() bool {
 	select {
-	case s.ch <- env:
+	case <-s.done:
 		return true
 	default:
-		return false // buffer full, drop
+		return false
 	}
 }
 
+// reason returns why the overflow policy closed the sub, or "" if it is open
+// or was closed by its owner.
+func (s *dynamicSub) reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeReason
+}
+
+func (s *dynamicSub) closeLocked(reason string) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.closeReason = reason
+	close(s.done)
+	wake(s.notify)
+}
+
+// trySend queues ev, applying the overflow policy when the queue is full.
+// Returns false if ev was not queued.
+func (s *dynamicSub) trySend(ev SubscriptionEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pushLocked(ev)
+}
+
+// send queues ev, waiting for space instead of dropping anything. Returns
+// false once the sub is closed.
+func (s *dynamicSub) send(ev SubscriptionEvent) bool {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return false
+		}
+		if s.queued < dynamicSubBuffer {
+			s.appendLocked(ev)
+			s.mu.Unlock()
+			return true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.space:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+func (s *dynamicSub) appendLocked(ev SubscriptionEvent) {
+	s.buf = append(s.buf, ev)
+	if ev.Gap == nil {
+		s.queued++
+	}
+	wake(s.notify)
+}
+
+// take removes and returns everything queued. closed reports whether the sub
+// has closed, in which case nothing more will be queued.
+func (s *dynamicSub) take() (events []SubscriptionEvent, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, s.buf, s.queued = s.buf, nil, 0
+	if len(events) > 0 {
+		wake(s.space)
+	}
+	return events, s.closed
+}
+
+// next waits until events are queued, the sub closes or ctx ends, and takes
+// what is queued. ok is false once the sub is closed and drained, or ctx
+// ended.
+func (s *dynamicSub) next(ctx context.Context) (events []SubscriptionEvent, ok bool) {
+	for {
+		events, closed := s.take()
+		if len(events) > 0 {
+			return events, true
+		}
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (s *dynamicSub) buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued
+}
+
+// deliver hands a live event to the sub, holding it back while a replay is
+// still running.
+func (s *dynamicSub) deliver(ev SubscriptionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.replaying {
+		s.pushLocked(ev)
+		return
+	}
+	if len(s.pending) >= maxReplayPending {
+		s.dropped.Add(1)
+		s.pendingGap = s.pendingGap.add(ev, gapReplayBacklog)
+		return
+	}
+	s.pending = append(s.pending, ev)
+}
+
+// replayEndUnknown is passed to goLive when the replay could not learn the
+// stream's last sequence.
+const replayEndUnknown = ^uint64(0)
+
+// goLive ends the replay, which accounted for stream sequences up to
+// delivered and was meant to reach through. If it stopped short, a
+// replay_truncated gap marks the sequences in between. Held-back live events
+// after both are then delivered, followed by a gap marker if any had to be
+// dropped, and later events are queued directly.
+func (s *dynamicSub) goLive(delivered, through uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if through == replayEndUnknown {
+		// The first held-back live event bounds what the replay missed; with
+		// none, the gap is open-ended.
+		through = delivered
+		if len(s.pending) > 0 && s.pending[0].Seq > delivered+1 {
+			through = s.pending[0].Seq - 1
+		} else if len(s.pending) == 0 && !s.closed {
+			s.appendLocked(SubscriptionEvent{Gap: &EventGap{FirstSeq: delivered + 1, Reason: gapReplayTruncated}})
+		}
+	}
+	if gap := replayTruncatedGap(delivered+1, through); gap != nil && !s.closed {
+		s.appendLocked(SubscriptionEvent{Gap: gap})
+	}
+	if through > delivered {
+		delivered = through
+	}
+	for _, ev := range s.pending {
+		if ev.Seq > delivered {
+			s.pushLocked(ev)
+		}
+	}
+	if s.pendingGap != nil && !s.closed {
+		s.appendLocked(SubscriptionEvent{Gap: s.pendingGap})
+	}
+	s.pending, s.pendingGap = nil, nil
+	s.replaying = false
+}
+
 // DynamicEventService maintains dynamic event subscriptions and fans matching
-// events out to each subscriber's channel. A single NATS subscription is used
-// for all active subscriptions; filtering is done in the handler.
+// events out to each subscriber's buffer. A single NATS subscription is used
+// for all active subscriptions; filtering is done in the handler. With
+// JetStream, that subscription is an ordered consumer on the EVENTS stream so
+// every event carries its stream sequence, and subscriptions may replay
+// stored events before going live.
 type DynamicEventService struct {
 	mu      sync.RWMutex
 	subs    map[string]*dynamicSub
 	natsSub *nats.Subscription
+	js      nats.JetStreamContext
+	// dropped counts events dropped by subscriptions that have since closed;
+	// Stats adds the counts of those still active.
+	dropped atomic.Uint64
+	lease   subscriptionLeaseConfig
+	expired atomic.Uint64
+	stop    chan struct{}
+	stopped sync.Once
 }
 
 func newDynamicEventService() *DynamicEventService {
 	return &DynamicEventService{
-		subs: make(map[string]*dynamicSub),
+		subs:  make(map[string]*dynamicSub),
+		lease: subscriptionLeaseFromEnv(),
+		stop:  make(chan struct{}),
 	}
 }
 
-// Start subscribes to the entity-events NATS subject.
-// Must be called once after the NATS connection is established.
-func (s *DynamicEventService) Start(nc *nats.Conn) error {
+// Start subscribes to entity events. Must be called once after the NATS
+// connection is established. js may be nil; without it, or without the
+// EVENTS stream, events are consumed from core NATS and cannot be replayed.
+func (s *DynamicEventService) Start(nc *nats.Conn, js nats.JetStreamContext) error {
+	if js != nil {
+		sub, err := js.Subscribe(types.SubjectEntityEvents, s.handle,
+			nats.BindStream(eventsStreamName), nats.OrderedConsumer(), nats.DeliverNew())
+		if err == nil {
+			s.natsSub = sub
+			s.js = js
+			go s.runReaper()
+			return nil
+		}
+		slog.Warn("dynamic event service: JetStream unavailable, replay disabled", "error", err)
+	}
 	sub, err := nc.Subscribe(types.SubjectEntityEvents, s.handle)
 	if err != nil {
 		return err
 	}
 	s.natsSub = sub
+	go s.runReaper()
 	return nil
 }
 
-// Stop unsubscribes from NATS and closes all active subscription channels.
+// Stop unsubscribes from NATS, stops the reaper and closes all active
+// subscriptions.
 func (s *DynamicEventService) Stop() {
+	s.stopped.Do(func() { close(s.stop) })
 	if s.natsSub != nil {
 		_ = s.natsSub.Unsubscribe()
 	}
 	s.mu.Lock()
 	for _, sub := range s.subs {
+		s.dropped.Add(sub.dropped.Load())
 		sub.close()
 	}
 	s.subs = make(map[string]*dynamicSub)
 	s.mu.Unlock()
 }
 
-// Subscribe registers a new dynamic subscription and returns its ID and a
-// channel on which matching events will be delivered. The channel is buffered
-// (256 items); slow consumers drop events silently. The subscription lives
-// until Unsubscribe is called.
-func (s *DynamicEventService) Subscribe(filter EventFilter) (id string, ch <-chan types.EntityEventEnvelope) {
-	sub := &dynamicSub{
-		id:        nextID("dsub"),
-		filter:    filter,
-		ch:        make(chan types.EntityEventEnvelope, 256),
-		createdAt: time.Now().UTC(),
+// Subscribe registers a new dynamic subscription and returns its ID. Matching
+// events are buffered (256 events) until taken; when the buffer is full,
+// opts.Overflow decides whether the newest or oldest event is dropped or the
+// subscription is closed, and a gap marker records what was lost. When the
+// filter sets since_seq or since_time, matching stored events are delivered
+// first, in stream order and without drops, followed by live events with no
+// gap or duplicate; stored events the replay cannot deliver are reported by a
+// replay_truncated gap marker. The subscription lives until Unsubscribe is called, its
+// overflow policy closes it, or its lease expires: opts.TTL (0 for the
+// service default) after its last poll, keepalive or open stream.
+func (s *DynamicEventService) Subscribe(filter EventFilter, opts SubscriptionOptions) (string, error) {
+	if filter.replays() {
+		if filter.SinceSeq > 0 && filter.SinceTime != nil {
+			return "", errors.New("since_seq and since_time are mutually exclusive")
+		}
+		if s.js == nil {
+			return "", ErrReplayUnavailable
+		}
 	}
+	if !opts.Overflow.valid() {
+		return "", fmt.Errorf("unknown overflow policy %q", opts.Overflow)
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = s.lease.DefaultTTL
+	}
+	sub := newDynamicSub(filter, opts)
 	s.mu.Lock()
 	s.subs[sub.id] = sub
 	s.mu.Unlock()
-	return sub.id, sub.ch
+	if sub.replaying {
+		go s.replay(sub)
+	}
+	return sub.id, nil
+}
+
+// replay delivers the stored events matching sub's filter up to the last
+// sequence in the stream when the replay starts, then switches sub to live
+// delivery. sub is already registered, so every later event reaches it live.
+// Stored events the replay cannot deliver, because the stream has already
+// discarded them or the replay fails part way, are reported by a
+// replay_truncated gap.
+func (s *DynamicEventService) replay(sub *dynamicSub) {
+	// delivered is the last stream sequence the replay has accounted for,
+	// last the sequence it must reach.
+	delivered, last := sub.filter.SinceSeq, replayEndUnknown
+	defer func() { sub.goLive(delivered, last) }()
+
+	info, err := s.js.StreamInfo(eventsStreamName)
+	if err != nil {
+		slog.Warn("dynamic event replay: stream info failed", "subscription_id", sub.id, "error", err)
+		return
+	}
+	last = info.State.LastSeq
+	start := nats.StartSequence(sub.filter.SinceSeq + 1)
+	if sub.filter.SinceTime != nil {
+		start = nats.StartTime(*sub.filter.SinceTime)
+		if first := info.State.FirstSeq; first > 0 {
+			delivered = first - 1
+		}
+	} else if sub.filter.SinceSeq >= last {
+		return
+	} else if first := info.State.FirstSeq; sub.filter.SinceSeq+1 < first {
+		// The stream is capped; events after since_seq were discarded.
+		if !sub.send(SubscriptionEvent{Gap: replayTruncatedGap(sub.filter.SinceSeq+1, first-1)}) {
+			return
+		}
+		delivered = first - 1
+	}
+	if last == 0 {
+		return
+	}
+	jsub, err := s.js.SubscribeSync(types.SubjectEntityEvents, nats.BindStream(eventsStreamName), nats.OrderedConsumer(), start)
+	if err != nil {
+		slog.Warn("dynamic event replay: subscribe failed", "subscription_id", sub.id, "error", err)
+		return
+	}
+	defer func() { _ = jsub.Unsubscribe() }()
+	received := false
+	for !sub.isClosed() {
+		msg, err := jsub.NextMsg(replayIdleTimeout)
+		if err != nil {
+			if !errors.Is(err, nats.ErrTimeout) {
+				slog.Warn("dynamic event replay stopped", "subscription_id", sub.id, "error", err)
+			} else if sub.filter.SinceTime != nil && !received {
+				// Nothing was stored after since_time.
+				delivered = last
+			}
+			return
+		}
+		received = true
+		ev, ok := decodeSubscriptionEvent(msg)
+		if ev.Seq > last {
+			delivered = last
+			return
+		}
+		if ok && s.matchesFilter(sub.filter, ev.EntityEventEnvelope) && !sub.send(ev) {
+			return
+		}
+		if ev.Seq > delivered {
+			delivered = ev.Seq
+		}
+		if ev.Seq == last {
+			return
+		}
+	}
 }
 
-// Unsubscribe cancels a subscription by ID and closes its channel.
+// decodeSubscriptionEvent decodes an entity event message, with its stream
+// sequence when it was delivered by JetStream. The sequence is set even when
+// the payload does not decode.
+func decodeSubscriptionEvent(msg *nats.Msg) (SubscriptionEvent, bool) {
+	var ev SubscriptionEvent
+	if meta, err := msg.Metadata(); err == nil {
+		ev.Seq = meta.Sequence.Stream
+	}
+	return ev, json.Unmarshal(msg.Data, &ev.EntityEventEnvelope) == nil
+}
+
+// Unsubscribe cancels a subscription by ID and closes it.
 // It is a no-op if the ID is unknown.
 func (s *DynamicEventService) Unsubscribe(id string) {
 	s.mu.Lock()
 	sub, ok := s.subs[id]
-	if ok {
-		delete(s.subs, id)
-	}
 	s.mu.Unlock()
 	if ok {
+		s.forget(sub)
 		sub.close()
 	}
 }
 
-// Drain returns all events currently buffered for id without blocking.
-// Used for polling-style consumers (tests, non-streaming clients).
-// Returns nil if the subscription does not exist.
-func (s *DynamicEventService) Drain(id string) []types.EntityEventEnvelope {
+// lookup returns subscription id.
+func (s *DynamicEventService) lookup(id string) (*dynamicSub, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subs[id]
+	return sub, ok
+}
+
+// forget removes sub from the service, keeping its dropped count. It is a
+// no-op if sub was already removed.
+func (s *DynamicEventService) forget(sub *dynamicSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[sub.id] == sub {
+		delete(s.subs, sub.id)
+		s.dropped.Add(sub.dropped.Load())
+	}
+}
+
+// Stats returns the number of active subscriptions and how many events have
+// been dropped across all subscriptions since the service started.
+func (s *DynamicEventService) Stats() (active int, dropped uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dropped = s.dropped.Load()
+	for _, sub := range s.subs {
+		dropped += sub.dropped.Load()
+	}
+	return len(s.subs), dropped
+}
+
+// Drain returns all events currently buffered for id, including gap markers,
+// without blocking and renews the subscription's lease. Used for
+// polling-style consumers (tests, non-streaming clients). Reports false if
+// the subscription does not exist. A subscription closed by its overflow
+// policy is removed once drained.
+func (s *DynamicEventService) Drain(id string) ([]SubscriptionEvent, bool) {
 	s.mu.RLock()
 	sub, ok := s.subs[id]
 	s.mu.RUnlock()
 	if !ok {
-		return nil
+		return nil, false
 	}
-	var out []types.EntityEventEnvelope
-	for {
-		select {
-		case env, open := <-sub.ch:
-			if !open {
-				return out
-			}
-			out = append(out, env)
-		default:
-			return out
-		}
+	sub.touch(time.Now())
+	out, closed := sub.take()
+	if closed {
+		s.forget(sub)
 	}
+	if out == nil {
+		out = []SubscriptionEvent{}
+	}
+	return out, true
 }
 
 // handle is the NATS message handler. It decodes the envelope and fans it out
 // to all subscriptions whose filter matches.
 func (s *DynamicEventService) handle(msg *nats.Msg) {
-	var env types.EntityEventEnvelope
-	if json.Unmarshal(msg.Data, &env) != nil {
+	ev, ok := decodeSubscriptionEvent(msg)
+	if !ok {
 		return
 	}
 
@@ -165,8 +580,8 @@ func (s *DynamicEventService) handle(msg *nats.Msg) {
 	s.mu.RUnlock()
 
 	for _, sub := range subs {
-		if s.matchesFilter(sub.filter, env) {
-			sub.trySend(env)
+		if s.matchesFilter(sub.filter, ev.EntityEventEnvelope) {
+			sub.deliver(ev)
 		}
 	}
 }
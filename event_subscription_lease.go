@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSubscriptionTTL = 5 * time.Minute
+	// maxSubscriptionTTL bounds the lease a client may ask for.
+	maxSubscriptionTTL = 24 * time.Hour
+	// subscriptionReapInterval is how often expired subscriptions are removed.
+	subscriptionReapInterval = 10 * time.Second
+)
+
+// subscriptionLeaseConfig sets how long an idle dynamic subscription lives.
+// Override the default with GATEWAY_EVENT_SUBSCRIPTION_TTL.
+type subscriptionLeaseConfig struct {
+	DefaultTTL time.Duration
+}
+
+func subscriptionLeaseFromEnv() subscriptionLeaseConfig {
+	cfg := subscriptionLeaseConfig{DefaultTTL: defaultSubscriptionTTL}
+	v := strings.TrimSpace(getenv("GATEWAY_EVENT_SUBSCRIPTION_TTL"))
+	if v == "" {
+		return cfg
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 && d <= maxSubscriptionTTL {
+		cfg.DefaultTTL = d
+	} else {
+		slog.Warn("invalid GATEWAY_EVENT_SUBSCRIPTION_TTL, using default", "value", v, "default", cfg.DefaultTTL)
+	}
+	return cfg
+}
+
+// touch renews the lease as of now.
+func (s *dynamicSub) touch(now time.Time) {
+	s.lastActivity.Store(now.UnixNano())
+}
+
+func (s *dynamicSub) lastActive() time.Time {
+	return time.Unix(0, s.lastActivity.Load()).UTC()
+}
+
+// expired reports whether the lease has run out at now. A subscription with
+// an open stream never expires; its lease runs from when the stream closes.
+func (s *dynamicSub) expired(now time.Time) bool {
+	return s.streams.Load() == 0 && now.Sub(s.lastActive()) > s.ttl
+}
+
+// EventSubscriptionInfo describes an active dynamic subscription.
+type EventSubscriptionInfo struct {
+	ID           string         `json:"id"`
+	Filter       EventFilter    `json:"filter"`
+	CreatedAt    time.Time      `json:"created_at"`
+	AgeSeconds   float64        `json:"age_seconds"`
+	LastActivity time.Time      `json:"last_activity" doc:"Last poll, keepalive or stream activity"`
+	TTLSeconds   float64        `json:"ttl_seconds" doc:"How long the subscription may stay idle before it is removed"`
+	ExpiresAt    *time.Time     `json:"expires_at,omitempty" doc:"When the lease runs out; absent while a stream is open"`
+	Streams      int            `json:"streams" doc:"Number of open SSE streams"`
+	Replaying    bool           `json:"replaying" doc:"Whether stored events are still being replayed"`
+	Buffered     int            `json:"buffered" doc:"Events waiting to be polled or streamed"`
+	Overflow     OverflowPolicy `json:"overflow" doc:"What happens when the buffer is full"`
+	Dropped      uint64         `json:"dropped" doc:"Events dropped because the buffer or replay backlog was full"`
+	ClosedReason string         `json:"closed_reason,omitempty" doc:"Why the subscription was closed; it is removed once its remaining events are consumed"`
+}
+
+func (s *dynamicSub) info(now time.Time) EventSubscriptionInfo {
+	s.mu.Lock()
+	replaying, buffered, closedReason := s.replaying, s.queued, s.closeReason
+	s.mu.Unlock()
+	last := s.lastActive()
+	out := EventSubscriptionInfo{
+		ID:           s.id,
+		Filter:       s.filter,
+		CreatedAt:    s.createdAt,
+		AgeSeconds:   now.Sub(s.createdAt).Seconds(),
+		LastActivity: last,
+		TTLSeconds:   s.ttl.Seconds(),
+		Streams:      int(s.streams.Load()),
+		Replaying:    replaying,
+		Buffered:     buffered,
+		Overflow:     s.overflow,
+		Dropped:      s.dropped.Load(),
+		ClosedReason: closedReason,
+	}
+	if out.Streams == 0 {
+		expires := last.Add(s.ttl)
+		out.ExpiresAt = &expires
+	}
+	return out
+}
+
+// Get describes subscription id without renewing its lease.
+func (s *DynamicEventService) Get(id string) (EventSubscriptionInfo, bool) {
+	s.mu.RLock()
+	sub, ok := s.subs[id]
+	s.mu.RUnlock()
+	if !ok {
+		return EventSubscriptionInfo{}, false
+	}
+	return sub.info(time.Now().UTC()), true
+}
+
+// List describes every active subscription, oldest first.
+func (s *DynamicEventService) List() []EventSubscriptionInfo {
+	now := time.Now().UTC()
+	s.mu.RLock()
+	out := make([]EventSubscriptionInfo, 0, len(s.subs))
+	for _, sub := range s.subs {
+		out = append(out, sub.info(now))
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// KeepAlive renews the lease of subscription id.
+func (s *DynamicEventService) KeepAlive(id string) (EventSubscriptionInfo, bool) {
+	s.mu.RLock()
+	sub, ok := s.subs[id]
+	s.mu.RUnlock()
+	if !ok {
+		return EventSubscriptionInfo{}, false
+	}
+	now := time.Now().UTC()
+	sub.touch(now)
+	return sub.info(now), true
+}
+
+// openStream marks a stream open on the subscription, holding its lease until the returned
+// func is called.
+func (s *dynamicSub) openStream() (closeStream func()) {
+	s.streams.Add(1)
+	s.touch(time.Now())
+	return func() {
+		s.touch(time.Now())
+		s.streams.Add(-1)
+	}
+}
+
+// reap removes the subscriptions whose lease has run out at now and returns
+// their IDs.
+func (s *DynamicEventService) reap(now time.Time) []string {
+	var reaped []*dynamicSub
+	s.mu.Lock()
+	for id, sub := range s.subs {
+		if sub.expired(now) {
+			delete(s.subs, id)
+			s.dropped.Add(sub.dropped.Load())
+			reaped = append(reaped, sub)
+		}
+	}
+	s.mu.Unlock()
+	ids := make([]string, 0, len(reaped))
+	for _, sub := range reaped {
+		sub.close()
+		ids = append(ids, sub.id)
+	}
+	s.expired.Add(uint64(len(ids)))
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *DynamicEventService) runReaper() {
+	ticker := time.NewTicker(subscriptionReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			for _, id := range s.reap(now) {
+				slog.Info("dynamic subscription expired", "subscription_id", id)
+			}
+		}
+	}
+}
+
+// Expired returns how many subscriptions have been reaped since the service
+// started.
+func (s *DynamicEventService) Expired() uint64 {
+	return s.expired.Load()
+}
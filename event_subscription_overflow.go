@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// OverflowPolicy decides what a dynamic subscription does with a live event
+// that arrives while its buffer already holds dynamicSubBuffer events.
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest discards the arriving event. This is the default.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest buffered event to make room.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDisconnect closes the subscription, so the client resubscribes
+	// (with since_seq to replay what it missed) instead of reading on.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+func (p OverflowPolicy) valid() bool {
+	switch p {
+	case "", OverflowDropNewest, OverflowDropOldest, OverflowDisconnect:
+		return true
+	}
+	return false
+}
+
+// Gap reasons.
+const (
+	gapBufferFull    = "buffer_full"
+	gapReplayBacklog = "replay_backlog"
+	// gapReplayTruncated: stored events the replay could not deliver, because
+	// the stream no longer held them or the replay stopped early.
+	gapReplayTruncated = "replay_truncated"
+	gapDisconnected    = "disconnected"
+)
+
+// SubscriptionOptions configures a dynamic subscription.
+type SubscriptionOptions struct {
+	// TTL is the idle lease; 0 uses the service default.
+	TTL time.Duration
+	// Overflow is the buffer overflow policy; empty means drop_newest.
+	Overflow OverflowPolicy
+}
+
+// EventGap describes events a subscription lost. It is delivered as a gap
+// marker in their place so consumers know to resync, e.g. by resubscribing
+// with since_seq or refetching entity state. A replay_truncated gap spans
+// stream sequences, so Dropped may include events that did not match the
+// filter.
+type EventGap struct {
+	Dropped  uint64 `json:"dropped" doc:"Number of events lost at this point; for replay_truncated, the number of stream sequences skipped"`
+	FirstSeq uint64 `json:"first_seq,omitempty" doc:"Lowest stream sequence among the lost events"`
+	LastSeq  uint64 `json:"last_seq,omitempty" doc:"Highest stream sequence among the lost events"`
+	Reason   string `json:"reason" enum:"buffer_full,replay_backlog,replay_truncated,disconnected" doc:"Why the events were lost"`
+}
+
+// replayTruncatedGap marks stream sequences first through last as skipped by
+// a replay, or nil if the range is empty.
+func replayTruncatedGap(first, last uint64) *EventGap {
+	if first == 0 || last < first {
+		return nil
+	}
+	return &EventGap{Dropped: last - first + 1, FirstSeq: first, LastSeq: last, Reason: gapReplayTruncated}
+}
+
+// add records ev as lost, starting a new gap if g is nil.
+func (g *EventGap) add(ev SubscriptionEvent, reason string) *EventGap {
+	if ev.Gap != nil {
+		return g.merge(ev.Gap)
+	}
+	if g == nil {
+		g = &EventGap{Reason: reason}
+	}
+	g.Dropped++
+	g.span(ev.Seq, ev.Seq)
+	return g
+}
+
+// merge folds o into g. The reason of the earlier gap wins.
+func (g *EventGap) merge(o *EventGap) *EventGap {
+	if g == nil {
+		c := *o
+		return &c
+	}
+	g.Dropped += o.Dropped
+	g.span(o.FirstSeq, o.LastSeq)
+	return g
+}
+
+func (g *EventGap) span(first, last uint64) {
+	if first > 0 && (g.FirstSeq == 0 || first < g.FirstSeq) {
+		g.FirstSeq = first
+	}
+	if last > g.LastSeq {
+		g.LastSeq = last
+	}
+}
+
+// pushLocked queues a live event, applying the overflow policy when the
+// buffer is full. Reports whether ev was queued. s.mu must be held.
+func (s *dynamicSub) pushLocked(ev SubscriptionEvent) bool {
+	if s.closed {
+		return false
+	}
+	if s.queued < dynamicSubBuffer {
+		s.appendLocked(ev)
+		return true
+	}
+	s.dropped.Add(1)
+	switch s.overflow {
+	case OverflowDropOldest:
+		var gap *EventGap
+		for len(s.buf) > 0 {
+			head := s.buf[0]
+			s.buf = s.buf[1:]
+			gap = gap.add(head, gapBufferFull)
+			if head.Gap == nil {
+				s.queued--
+				break
+			}
+		}
+		s.buf = append([]SubscriptionEvent{{Gap: gap}}, s.buf...)
+		s.appendLocked(ev)
+		return true
+	case OverflowDisconnect:
+		s.buf = append(s.buf, SubscriptionEvent{Gap: (*EventGap)(nil).add(ev, gapDisconnected)})
+		s.closeLocked(fmt.Sprintf("event buffer full (%d events); resubscribe to resume", dynamicSubBuffer))
+		return false
+	default:
+		if n := len(s.buf); n > 0 && s.buf[n-1].Gap != nil && s.buf[n-1].Gap.Reason == gapBufferFull {
+			s.buf[n-1].Gap.add(ev, gapBufferFull)
+		} else {
+			s.buf = append(s.buf, SubscriptionEvent{Gap: (*EventGap)(nil).add(ev, gapBufferFull)})
+		}
+		return false
+	}
+}
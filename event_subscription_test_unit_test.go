@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestDynamicSub_ReplayHandOff(t *testing.T) {
+	sub := newDynamicSub(EventFilter{SinceSeq: 3}, SubscriptionOptions{TTL: time.Minute})
+	if !sub.replaying {
+		t.Fatal("expected a since_seq subscription to start replaying")
+	}
+	// Live events arriving mid-replay are held back; the replay covers up to
+	// sequence 5, so only 6 is still owed once it finishes.
+	sub.deliver(SubscriptionEvent{Seq: 5})
+	sub.deliver(SubscriptionEvent{Seq: 6})
+	if sub.buffered() != 0 {
+		t.Fatal("expected live events to wait for the replay")
+	}
+	sub.send(SubscriptionEvent{Seq: 4})
+	sub.send(SubscriptionEvent{Seq: 5})
+	sub.goLive(5, 5)
+	sub.deliver(SubscriptionEvent{Seq: 7})
+	sub.close()
+
+	var got []uint64
+	for {
+		events, ok := sub.next(context.Background())
+		if !ok {
+			break
+		}
+		for _, ev := range events {
+			got = append(got, ev.Seq)
+		}
+	}
+	if len(got) != 4 || got[0] != 4 || got[1] != 5 || got[2] != 6 || got[3] != 7 {
+		t.Fatalf("expected 4,5,6,7 without gaps or repeats, got %v", got)
+	}
+	if sub.send(SubscriptionEvent{Seq: 8}) {
+		t.Fatal("expected send on a closed subscription to fail")
+	}
+}
+
+func TestDynamicSub_GoLiveMarksTruncatedReplay(t *testing.T) {
+	sub := newDynamicSub(EventFilter{SinceSeq: 3}, SubscriptionOptions{TTL: time.Minute})
+	sub.deliver(SubscriptionEvent{Seq: 9})
+	sub.deliver(SubscriptionEvent{Seq: 10})
+	sub.send(SubscriptionEvent{Seq: 4})
+	// The replay stopped after 4 but had to reach 9.
+	sub.goLive(4, 9)
+
+	events, _ := sub.take()
+	if len(events) != 3 || events[0].Seq != 4 || events[2].Seq != 10 {
+		t.Fatalf("expected 4, a gap, then 10, got %+v", events)
+	}
+	want := EventGap{Dropped: 5, FirstSeq: 5, LastSeq: 9, Reason: gapReplayTruncated}
+	if g := events[1].Gap; g == nil || *g != want {
+		t.Fatalf("expected gap %+v, got %+v", want, events[1].Gap)
+	}
+}
+
+func TestDynamicEventService_ReplayReportsPurgedEvents(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: eventsStreamName, Subjects: []string{types.SubjectEntityEvents}, MaxMsgs: 3}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		data, _ := json.Marshal(types.EntityEventEnvelope{EntityID: "e1"})
+		if _, err := js.Publish(types.SubjectEntityEvents, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svc := newDynamicEventService()
+	svc.js = js
+	id, err := svc.Subscribe(EventFilter{SinceSeq: 1}, SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.mu.RLock()
+	sub := svc.subs[id]
+	svc.mu.RUnlock()
+
+	var got []SubscriptionEvent
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for len(got) < 4 {
+		events, ok := sub.next(ctx)
+		if !ok {
+			t.Fatalf("replay ended early with %+v", got)
+		}
+		got = append(got, events...)
+	}
+	want := EventGap{Dropped: 2, FirstSeq: 2, LastSeq: 3, Reason: gapReplayTruncated}
+	if g := got[0].Gap; g == nil || *g != want {
+		t.Fatalf("expected purged sequences 2-3 reported first as %+v, got %+v", want, got[0])
+	}
+	for i, seq := range []uint64{4, 5, 6} {
+		if got[i+1].Gap != nil || got[i+1].Seq != seq {
+			t.Fatalf("expected stored event %d after the gap, got %+v", seq, got[i+1])
+		}
+	}
+}
+
+func TestDynamicEventService_ReplayNeedsJetStream(t *testing.T) {
+	svc := newDynamicEventService()
+	since := time.Now()
+	if _, err := svc.Subscribe(EventFilter{SinceTime: &since}, SubscriptionOptions{}); !errors.Is(err, ErrReplayUnavailable) {
+		t.Fatalf("expected ErrReplayUnavailable, got %v", err)
+	}
+	if _, err := svc.Subscribe(EventFilter{SinceSeq: 1, SinceTime: &since}, SubscriptionOptions{}); err == nil {
+		t.Fatal("expected since_seq and since_time together to be rejected")
+	}
+	if _, err := svc.Subscribe(EventFilter{}, SubscriptionOptions{}); err != nil {
+		t.Fatalf("expected a live subscription without JetStream, got %v", err)
+	}
+}
+
+func TestDynamicEventService_LeaseExpiry(t *testing.T) {
+	svc := newDynamicEventService()
+	idle, _ := svc.Subscribe(EventFilter{Action: "turn_on"}, SubscriptionOptions{TTL: time.Minute})
+	polled, _ := svc.Subscribe(EventFilter{}, SubscriptionOptions{TTL: time.Minute})
+	streamed, _ := svc.Subscribe(EventFilter{}, SubscriptionOptions{TTL: time.Minute})
+
+	svc.mu.RLock()
+	stream := svc.subs[streamed]
+	svc.mu.RUnlock()
+	closeStream := stream.openStream()
+
+	if _, ok := svc.Drain(polled); !ok {
+		t.Fatal("expected polling an empty subscription to succeed")
+	}
+	info, ok := svc.Get(idle)
+	if !ok || info.Filter.Action != "turn_on" || info.ExpiresAt == nil || info.TTLSeconds != 60 {
+		t.Fatalf("unexpected subscription info %+v", info)
+	}
+
+	later := time.Now().Add(2 * time.Minute)
+	if reaped := svc.reap(time.Now()); len(reaped) != 0 {
+		t.Fatalf("expected no subscription to expire yet, got %v", reaped)
+	}
+	reaped := svc.reap(later)
+	if len(reaped) != 2 || svc.Expired() != 2 {
+		t.Fatalf("expected the idle and polled subscriptions to expire, got %v", reaped)
+	}
+	if list := svc.List(); len(list) != 1 || list[0].ID != streamed || list[0].Streams != 1 || list[0].ExpiresAt != nil {
+		t.Fatalf("expected only the streamed subscription to remain, got %+v", list)
+	}
+
+	// Once the stream closes, the lease runs from then.
+	closeStream()
+	if reaped := svc.reap(time.Now().Add(30 * time.Second)); len(reaped) != 0 {
+		t.Fatalf("expected the lease to restart when the stream closed, got %v", reaped)
+	}
+	if _, ok := svc.KeepAlive(streamed); !ok {
+		t.Fatal("expected keepalive to find the subscription")
+	}
+	if reaped := svc.reap(time.Now().Add(2 * time.Minute)); len(reaped) != 1 {
+		t.Fatalf("expected the subscription to expire after its lease, got %v", reaped)
+	}
+	if _, ok := svc.Drain(streamed); ok {
+		t.Fatal("expected an expired subscription to be gone")
+	}
+}
+
+func TestDynamicSub_OverflowPolicies(t *testing.T) {
+	live := func(seq int) SubscriptionEvent { return SubscriptionEvent{Seq: uint64(seq)} }
+	for _, tc := range []struct {
+		policy    OverflowPolicy
+		firstSeq  uint64
+		gapAt     int
+		gap       EventGap
+		dropped   uint64
+		wantClose bool
+	}{
+		{OverflowDropNewest, 1, dynamicSubBuffer, EventGap{Dropped: 3, FirstSeq: 257, LastSeq: 259, Reason: gapBufferFull}, 3, false},
+		{OverflowDropOldest, 4, 0, EventGap{Dropped: 3, FirstSeq: 1, LastSeq: 3, Reason: gapBufferFull}, 3, false},
+		{OverflowDisconnect, 1, dynamicSubBuffer, EventGap{Dropped: 1, FirstSeq: 257, LastSeq: 257, Reason: gapDisconnected}, 1, true},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			sub := newDynamicSub(EventFilter{}, SubscriptionOptions{TTL: time.Minute, Overflow: tc.policy})
+			for i := 1; i <= dynamicSubBuffer+3; i++ {
+				sub.deliver(live(i))
+			}
+			if got := sub.dropped.Load(); got != tc.dropped {
+				t.Fatalf("expected %d dropped, got %d", tc.dropped, got)
+			}
+			events, closed := sub.take()
+			if closed != tc.wantClose || (sub.reason() != "") != tc.wantClose {
+				t.Fatalf("expected closed=%v, got %v (reason %q)", tc.wantClose, closed, sub.reason())
+			}
+			if len(events) != dynamicSubBuffer+1 {
+				t.Fatalf("expected %d events and one gap marker, got %d", dynamicSubBuffer, len(events))
+			}
+			if g := events[tc.gapAt].Gap; g == nil || *g != tc.gap {
+				t.Fatalf("expected gap %+v at %d, got %+v", tc.gap, tc.gapAt, g)
+			}
+			first := events[0]
+			if tc.gapAt == 0 {
+				first = events[1]
+			}
+			if first.Seq != tc.firstSeq {
+				t.Fatalf("expected the first event to be %d, got %d", tc.firstSeq, first.Seq)
+			}
+		})
+	}
+}
+
+func TestDynamicEventService_OverflowDisconnect(t *testing.T) {
+	svc := newDynamicEventService()
+	if _, err := svc.Subscribe(EventFilter{}, SubscriptionOptions{Overflow: "block"}); err == nil {
+		t.Fatal("expected an unknown overflow policy to be rejected")
+	}
+	id, _ := svc.Subscribe(EventFilter{}, SubscriptionOptions{Overflow: OverflowDisconnect})
+	svc.mu.RLock()
+	sub := svc.subs[id]
+	svc.mu.RUnlock()
+	for i := 0; i <= dynamicSubBuffer; i++ {
+		sub.deliver(SubscriptionEvent{Seq: uint64(i + 1)})
+	}
+	if info, _ := svc.Get(id); info.ClosedReason == "" || info.Dropped != 1 {
+		t.Fatalf("expected the subscription to report why it closed, got %+v", info)
+	}
+	events, ok := svc.Drain(id)
+	if !ok || len(events) != dynamicSubBuffer+1 {
+		t.Fatalf("expected the buffered events and a gap marker, got %d", len(events))
+	}
+	data, _ := json.Marshal(events[len(events)-1])
+	if string(data) != `{"gap":{"dropped":1,"first_seq":257,"last_seq":257,"reason":"disconnected"}}` {
+		t.Fatalf("unexpected gap marker %s", data)
+	}
+	if _, ok := svc.Drain(id); ok {
+		t.Fatal("expected a drained, disconnected subscription to be removed")
+	}
+	if _, dropped := svc.Stats(); dropped != 1 {
+		t.Fatalf("expected the dropped count to survive removal, got %d", dropped)
+	}
+}
@@ -78,3 +78,20 @@ Feature: Dynamic event subscriptions
     And plugin "dynamic-plugin" registers a new entity "light-new" with label "Floor:Ground"
     And event "state" is ingested for entity "light-new"
     Then the subscription has 1 buffered events
+
+  # ---------------------------------------------------------------------------
+  # Pass 3 — Replay
+  # ---------------------------------------------------------------------------
+
+  Scenario: Resubscribing with since_seq replays missed events before live ones
+    Given plugin "replay-plugin" is registered
+    And plugin "replay-plugin" has entity "lamp-1" with label "Room:Den" and domain "light"
+    When I create a subscription with label query "Room:Den"
+    And event "turn_on" is ingested for entity "lamp-1"
+    Then the subscription has 1 buffered events
+    When I delete the subscription
+    And event "turn_off" is ingested for entity "lamp-1"
+    And event "state" is ingested for entity "lamp-1"
+    And I resubscribe with label query "Room:Den" since the last received event
+    And event "turn_on" is ingested for entity "lamp-1"
+    Then the subscription has received 3 events in stream order: "turn_off,state,turn_on"
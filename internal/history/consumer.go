@@ -60,7 +60,10 @@ func (h *History) consumeEvents(ctx context.Context, js nats.JetStreamContext) {
 				_ = msg.Ack()
 				continue
 			}
-			if err := h.insertEvent(meta.Sequence.Stream, meta.Timestamp.UTC(), env); err != nil {
+			started := time.Now()
+			err = h.insertEvent(meta.Sequence.Stream, meta.Timestamp.UTC(), env)
+			h.observe("history_events", started, err)
+			if err != nil {
 				log.Printf("history events insert failed (seq=%d): %v", meta.Sequence.Stream, err)
 				_ = msg.Nak()
 				continue
@@ -121,7 +124,10 @@ func (h *History) consumeCommands(ctx context.Context, js nats.JetStreamContext)
 				_ = msg.Ack()
 				continue
 			}
-			if err := h.insertCommandStatus(meta.Sequence.Stream, status); err != nil {
+			started := time.Now()
+			err = h.insertCommandStatusJSON(meta.Sequence.Stream, status, msg.Data)
+			h.observe("history_command_status", started, err)
+			if err != nil {
 				log.Printf("history commands insert failed (seq=%d): %v", meta.Sequence.Stream, err)
 				_ = msg.Nak()
 				continue
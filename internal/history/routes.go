@@ -48,6 +48,11 @@ type getAnyCommandStatusInput struct {
 }
 type commandStatusOutput struct{ Body types.CommandStatus }
 
+type correlationChainInput struct {
+	CorrelationID string `path:"correlation_id" doc:"Correlation ID, as returned in the X-Correlation-ID response header or a command's correlation_id"`
+}
+type correlationChainOutput struct{ Body correlationChain }
+
 type statsOutput struct{ Body Stats }
 
 // RegisterRoutes registers all history-related HTTP routes on the given Huma API.
@@ -172,6 +177,24 @@ func (h *History) RegisterRoutes(api huma.API) {
 		return &commandStatusOutput{Body: status}, nil
 	})
 
+	huma.Register(api, huma.Operation{
+		OperationID: "get-correlation-chain",
+		Method:      http.MethodGet,
+		Path:        "/api/correlations/{correlation_id}",
+		Summary:     "Get causal chain for a correlation ID",
+		Description: "Returns every recorded command and event caused by one API call or script trigger, in chronological order: commands carrying the correlation ID (including fan-out children and commands sent by scripts reacting to them) and the entity events those commands produced.",
+		Tags:        []string{"events"},
+	}, func(ctx context.Context, input *correlationChainInput) (*correlationChainOutput, error) {
+		chain, err := h.correlationChain(input.CorrelationID)
+		if err != nil {
+			return nil, huma.Error500InternalServerError("Failed to query correlation chain")
+		}
+		if len(chain.Entries) == 0 {
+			return nil, huma.Error404NotFound("correlation id not found", nil)
+		}
+		return &correlationChainOutput{Body: chain}, nil
+	})
+
 	huma.Register(api, huma.Operation{
 		OperationID: "history-stats",
 		Method:      http.MethodGet,
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,67 +24,226 @@ type sseMessage struct {
 	CommandID string `json:"command_id,omitempty"`
 	CreatedAt string `json:"created_at,omitempty"`
 	Seq       uint64 `json:"seq,omitempty"`
+	Dropped   uint64 `json:"dropped,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Detail    any    `json:"detail,omitempty"`
+}
+
+// Overflow policies for SSE clients that fall behind, chosen with the
+// overflow query parameter.
+const (
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+	overflowDisconnect = "disconnect"
+)
+
+// sseClientBuffer is how many messages a client may fall behind before its
+// overflow policy applies.
+const sseClientBuffer = 16
+
+// sseEntry is a queued message line, or, when gap is set, a marker for that
+// many messages lost at this point in the stream.
+type sseEntry struct {
+	line string
+	gap  uint64
+}
+
+// sseClient is one connected SSE stream. Messages the client lost are
+// recorded in its buffer where they were lost, so the gap message is written
+// in order: after the messages queued before the loss and before those after.
+type sseClient struct {
+	mu      sync.Mutex
+	buf     []sseEntry
+	queued  int // message entries in buf, excluding gaps
+	notify  chan struct{}
+	policy  string
+	dropped atomic.Uint64
+	done    chan struct{}
+	closing sync.Once
+	reason  string
+}
+
+func newSSEClient(policy string) *sseClient {
+	return &sseClient{notify: make(chan struct{}, 1), policy: policy, done: make(chan struct{})}
+}
+
+// offer queues line without blocking, applying the client's overflow policy
+// when it is behind. Returns the number of messages dropped.
+func (c *sseClient) offer(line string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.signal()
+	if c.queued < sseClientBuffer {
+		c.buf = append(c.buf, sseEntry{line: line})
+		c.queued++
+		return 0
+	}
+	c.dropped.Add(1)
+	switch c.policy {
+	case overflowDropOldest:
+		// The oldest message is lost: fold it, and any gaps ahead of it, into
+		// a gap at the head of the buffer.
+		var gap uint64
+		for len(c.buf) > 0 {
+			head := c.buf[0]
+			c.buf = c.buf[1:]
+			if head.gap > 0 {
+				gap += head.gap
+				continue
+			}
+			gap++
+			c.queued--
+			break
+		}
+		c.buf = append([]sseEntry{{gap: gap}}, c.buf...)
+		c.buf = append(c.buf, sseEntry{line: line})
+		c.queued++
+	case overflowDisconnect:
+		c.appendGapLocked()
+		c.closing.Do(func() {
+			c.reason = fmt.Sprintf("client fell %d messages behind", sseClientBuffer)
+			close(c.done)
+		})
+	default:
+		c.appendGapLocked()
+	}
+	return 1
+}
+
+// appendGapLocked records one message lost after everything queued. c.mu must
+// be held.
+func (c *sseClient) appendGapLocked() {
+	if n := len(c.buf); n > 0 && c.buf[n-1].gap > 0 {
+		c.buf[n-1].gap++
+		return
+	}
+	c.buf = append(c.buf, sseEntry{gap: 1})
+}
+
+func (c *sseClient) signal() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes everything queued for c, gaps included, in order.
+func (c *sseClient) flush(w io.Writer) {
+	c.mu.Lock()
+	buf := c.buf
+	c.buf = nil
+	c.queued = 0
+	c.mu.Unlock()
+	for _, e := range buf {
+		if e.gap > 0 {
+			line, _ := sseLine(sseMessage{Type: "gap", Dropped: e.gap, Reason: "buffer_full"})
+			fmt.Fprint(w, line)
+			continue
+		}
+		fmt.Fprint(w, e.line)
+	}
 }
 
 type sseBroker struct {
 	mu      sync.RWMutex
-	clients map[chan string]struct{}
+	clients map[*sseClient]struct{}
+	// dropped counts messages dropped across all clients since startup.
+	dropped atomic.Uint64
 }
 
 func newSSEBroker() *sseBroker {
-	return &sseBroker{clients: make(map[chan string]struct{})}
+	return &sseBroker{clients: make(map[*sseClient]struct{})}
 }
 
-func (b *sseBroker) addClient(ch chan string) {
+func (b *sseBroker) addClient(c *sseClient) {
 	b.mu.Lock()
-	b.clients[ch] = struct{}{}
+	b.clients[c] = struct{}{}
 	b.mu.Unlock()
 }
 
-func (b *sseBroker) removeClient(ch chan string) {
+func (b *sseBroker) removeClient(c *sseClient) {
 	b.mu.Lock()
-	delete(b.clients, ch)
+	delete(b.clients, c)
 	b.mu.Unlock()
 }
 
+func (b *sseBroker) clientCount() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.clients)
+}
+
 func (b *sseBroker) broadcast(msg sseMessage) {
-	data, err := json.Marshal(msg)
-	if err != nil {
+	line, ok := sseLine(msg)
+	if !ok {
 		return
 	}
-	line := "data: " + string(data) + "\n\n"
 	b.mu.RLock()
-	for ch := range b.clients {
-		select {
-		case ch <- line:
-		default:
-			// slow client, skip
-		}
+	for c := range b.clients {
+		b.dropped.Add(c.offer(line))
 	}
 	b.mu.RUnlock()
 }
 
-// SSEHandler returns a Gin handler for the Server-Sent Events stream.
+func sseLine(msg sseMessage) (string, bool) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", false
+	}
+	return "data: " + string(data) + "\n\n", true
+}
+
+// SSEClients returns the number of connected SSE clients.
+func (h *History) SSEClients() int {
+	return h.broker.clientCount()
+}
+
+// SSEDropped returns how many messages have been dropped for slow SSE
+// clients since startup.
+func (h *History) SSEDropped() uint64 {
+	return h.broker.dropped.Load()
+}
+
+// SSEHandler returns a Gin handler for the Server-Sent Events stream. The
+// overflow query parameter chooses what happens when the client falls behind:
+// drop_newest (default) or drop_oldest drop messages, and disconnect ends the
+// stream with a close message. Lost messages are reported by a gap message,
+// {"type":"gap","dropped":N}, at the point in the stream where they were
+// lost, so the client knows to refetch state.
 func (h *History) SSEHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		policy := c.DefaultQuery("overflow", overflowDropNewest)
+		switch policy {
+		case overflowDropNewest, overflowDropOldest, overflowDisconnect:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown overflow policy %q", policy)})
+			return
+		}
+
 		c.Header("Content-Type", "text/event-stream")
 		c.Header("Cache-Control", "no-cache")
 		c.Header("Connection", "keep-alive")
 		c.Header("X-Accel-Buffering", "no")
 
-		ch := make(chan string, 16)
-		h.broker.addClient(ch)
-		defer h.broker.removeClient(ch)
+		client := newSSEClient(policy)
+		h.broker.addClient(client)
+		defer h.broker.removeClient(client)
 
-		log.Printf("SSE: client connected (%s)", c.Request.RemoteAddr)
+		log.Printf("SSE: client connected (%s, overflow=%s)", c.Request.RemoteAddr, policy)
 
 		c.Stream(func(w io.Writer) bool {
 			select {
-			case msg := <-ch:
-				fmt.Fprint(w, msg)
+			case <-client.notify:
+				client.flush(w)
 				return true
+			case <-client.done:
+				client.flush(w)
+				line, _ := sseLine(sseMessage{Type: "close", Reason: client.reason})
+				fmt.Fprint(w, line)
+				log.Printf("SSE: client disconnected, %s (%s, dropped=%d)", client.reason, c.Request.RemoteAddr, client.dropped.Load())
+				return false
 			case <-c.Request.Context().Done():
-				log.Printf("SSE: client disconnected (%s)", c.Request.RemoteAddr)
+				log.Printf("SSE: client disconnected (%s, dropped=%d)", c.Request.RemoteAddr, client.dropped.Load())
 				return false
 			}
 		})
@@ -94,6 +255,13 @@ func (h *History) BroadcastDevice(pluginID, deviceID string) {
 	h.broker.broadcast(sseMessage{Type: "device", PluginID: pluginID, DeviceID: deviceID})
 }
 
+// BroadcastPlugin pushes a plugin lifecycle notification to all SSE
+// subscribers. kind is registered, updated, online, stale or offline; detail
+// carries the full lifecycle event, including any manifest diff.
+func (h *History) BroadcastPlugin(pluginID, kind, status string, detail any) {
+	h.broker.broadcast(sseMessage{Type: "plugin", Kind: kind, PluginID: pluginID, State: status, Detail: detail})
+}
+
 // BroadcastEntity pushes an entity-change notification to all SSE subscribers.
 func (h *History) BroadcastEntity(pluginID, deviceID, entityID string) {
 	h.broker.broadcast(sseMessage{Type: "entity", PluginID: pluginID, DeviceID: deviceID, EntityID: entityID})
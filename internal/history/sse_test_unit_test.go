@@ -0,0 +1,72 @@
+package history
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSEBroker_OverflowPolicies(t *testing.T) {
+	b := newSSEBroker()
+	newest := newSSEClient(overflowDropNewest)
+	oldest := newSSEClient(overflowDropOldest)
+	disconnect := newSSEClient(overflowDisconnect)
+	for _, c := range []*sseClient{newest, oldest, disconnect} {
+		b.addClient(c)
+	}
+	for i := 0; i < sseClientBuffer+2; i++ {
+		b.broadcast(sseMessage{Type: "entity", Seq: uint64(i + 1)})
+	}
+	if got := b.dropped.Load(); got != 6 {
+		t.Fatalf("expected 6 drops across clients, got %d", got)
+	}
+	if first := newest.buf[0].line; !strings.Contains(first, `"seq":1}`) {
+		t.Fatalf("drop_newest should keep the oldest messages, got %s", first)
+	}
+	if gap := oldest.buf[0].gap; gap != 2 {
+		t.Fatalf("drop_oldest should record the 2 lost messages at the head, got %+v", oldest.buf[0])
+	}
+	if first := oldest.buf[1].line; !strings.Contains(first, `"seq":3}`) {
+		t.Fatalf("drop_oldest should keep the newest messages, got %s", first)
+	}
+	select {
+	case <-disconnect.done:
+	default:
+		t.Fatal("expected the disconnect client to be closed")
+	}
+
+	var w strings.Builder
+	newest.flush(&w)
+	w.Reset()
+	newest.flush(&w)
+	if w.Len() != 0 || newest.dropped.Load() != 2 {
+		t.Fatalf("expected the gap to be reported once and the drop count kept, got %q", w.String())
+	}
+}
+
+func TestSSEClient_DropNewestGapFollowsBufferedMessages(t *testing.T) {
+	c := newSSEClient(overflowDropNewest)
+	for i := 0; i < sseClientBuffer+2; i++ {
+		line, _ := sseLine(sseMessage{Type: "entity", Seq: uint64(i + 1)})
+		c.offer(line)
+	}
+	var w strings.Builder
+	c.flush(&w)
+	c.offer("data: {\"type\":\"entity\",\"seq\":99}\n\n")
+	c.flush(&w)
+
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n\n"), "\n\n")
+	if len(lines) != sseClientBuffer+2 {
+		t.Fatalf("expected %d messages, got %d: %q", sseClientBuffer+2, len(lines), lines)
+	}
+	for i := 0; i < sseClientBuffer; i++ {
+		if strings.Contains(lines[i], `"gap"`) {
+			t.Fatalf("gap written before buffered message %d: %q", i, lines)
+		}
+	}
+	if lines[sseClientBuffer] != `data: {"type":"gap","dropped":2,"reason":"buffer_full"}` {
+		t.Fatalf("expected the gap after the buffered messages, got %q", lines[sseClientBuffer])
+	}
+	if !strings.Contains(lines[sseClientBuffer+1], `"seq":99}`) {
+		t.Fatalf("expected the next message after the gap, got %q", lines[sseClientBuffer+1])
+	}
+}
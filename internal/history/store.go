@@ -21,6 +21,9 @@ import (
 type History struct {
 	db     *sql.DB
 	broker *sseBroker
+	// observeInsert, when set, is told how long each consumed row took to
+	// write; see SetInsertObserver.
+	observeInsert func(table string, d time.Duration, err error)
 }
 
 type Stats struct {
@@ -72,6 +75,29 @@ type traceEntry struct {
 	Data     json.RawMessage `json:"data,omitempty"`
 }
 
+// chainEntry is one command or event in a correlation chain.
+type chainEntry struct {
+	Kind          string          `json:"kind"` // "event" or "command"
+	Ts            time.Time       `json:"ts"`
+	PluginID      string          `json:"plugin_id"`
+	DeviceID      string          `json:"device_id"`
+	EntityID      string          `json:"entity_id"`
+	CommandID     string          `json:"command_id,omitempty"`
+	ParentID      string          `json:"parent_id,omitempty"`
+	EventID       string          `json:"event_id,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Name          string          `json:"name,omitempty"`
+	State         string          `json:"state,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+}
+
+// correlationChain is everything recorded under one correlation ID.
+type correlationChain struct {
+	CorrelationID string       `json:"correlation_id"`
+	Entries       []chainEntry `json:"entries"`
+}
+
 type observedEvent struct {
 	Name      string    `json:"name"`
 	PluginID  string    `json:"plugin_id"`
@@ -160,6 +186,14 @@ func Open(path string) (*History, error) {
 			command_id   TEXT PRIMARY KEY,
 			payload_json TEXT NOT NULL
 		)`,
+		`ALTER TABLE history_events ADD COLUMN correlation_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE history_command_status ADD COLUMN correlation_id TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX IF NOT EXISTS idx_history_events_correlation
+			ON history_events (correlation_id) WHERE correlation_id != ''`,
+		`CREATE INDEX IF NOT EXISTS idx_history_command_correlation
+			ON history_command_status (correlation_id) WHERE correlation_id != ''`,
+		`CREATE INDEX IF NOT EXISTS idx_history_events_event_id
+			ON history_events (event_id) WHERE event_id != ''`,
 	}
 	for _, stmt := range migrations {
 		_, _ = db.Exec(stmt)
@@ -175,6 +209,18 @@ func (h *History) Start(ctx context.Context, nc *nats.Conn, js nats.JetStreamCon
 	go h.consumeCommands(ctx, js)
 }
 
+// SetInsertObserver installs fn to be called after each event or command
+// status row the JetStream consumers write. Call it before Start.
+func (h *History) SetInsertObserver(fn func(table string, d time.Duration, err error)) {
+	h.observeInsert = fn
+}
+
+func (h *History) observe(table string, started time.Time, err error) {
+	if h.observeInsert != nil {
+		h.observeInsert(table, time.Since(started), err)
+	}
+}
+
 func (h *History) Close() error {
 	if h == nil || h.db == nil {
 		return nil
@@ -206,8 +252,8 @@ func (h *History) insertEvent(streamSeq uint64, ts time.Time, env types.EntityEv
 	}
 	_, err := h.db.Exec(
 		`INSERT OR IGNORE INTO history_events
-		(stream_seq, name, plugin_id, device_id, entity_id, entity_type, event_id, created_at, payload_json)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		(stream_seq, name, plugin_id, device_id, entity_id, entity_type, event_id, created_at, payload_json, correlation_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		streamSeq,
 		classifyEventName(),
 		env.PluginID,
@@ -217,6 +263,7 @@ func (h *History) insertEvent(streamSeq uint64, ts time.Time, env types.EntityEv
 		env.EventID,
 		ts.UTC().Format(time.RFC3339Nano),
 		payloadStr,
+		env.CorrelationID,
 	)
 	return err
 }
@@ -229,10 +276,25 @@ func (h *History) insertCommandStatus(streamSeq uint64, status types.CommandStat
 	if err != nil {
 		return err
 	}
-	_, err = h.db.Exec(
+	return h.insertCommandStatusJSON(streamSeq, status, raw)
+}
+
+// insertCommandStatusJSON records status with raw as its stored payload, so
+// gateway-only fields published alongside the SDK status are preserved.
+func (h *History) insertCommandStatusJSON(streamSeq uint64, status types.CommandStatus, raw []byte) error {
+	if h == nil {
+		return nil
+	}
+	// The correlation ID is a gateway-only field, so it is read from the raw
+	// payload rather than the SDK status.
+	var corr struct {
+		CorrelationID string `json:"correlation_id"`
+	}
+	_ = json.Unmarshal(raw, &corr)
+	_, err := h.db.Exec(
 		`INSERT OR IGNORE INTO history_command_status
-		(stream_seq, command_id, plugin_id, device_id, entity_id, state, created_at, last_updated_at, payload_json)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		(stream_seq, command_id, plugin_id, device_id, entity_id, state, created_at, last_updated_at, payload_json, correlation_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		streamSeq,
 		status.CommandID,
 		status.PluginID,
@@ -242,11 +304,29 @@ func (h *History) insertCommandStatus(streamSeq uint64, status types.CommandStat
 		status.CreatedAt.UTC().Format(time.RFC3339Nano),
 		status.LastUpdatedAt.UTC().Format(time.RFC3339Nano),
 		string(raw),
+		corr.CorrelationID,
 	)
 	return err
 }
 
 func (h *History) latestCommandStatus(commandID string) (types.CommandStatus, bool, error) {
+	raw, found, err := h.CommandStatus(commandID)
+	if err != nil || !found {
+		return types.CommandStatus{}, false, err
+	}
+	var out types.CommandStatus
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return types.CommandStatus{}, false, fmt.Errorf("decode command status: %w", err)
+	}
+	return out, true, nil
+}
+
+// CommandStatus returns the latest recorded status JSON of commandID. It is
+// used to answer polls for gateway commands evicted from memory.
+func (h *History) CommandStatus(commandID string) (json.RawMessage, bool, error) {
+	if h == nil || h.db == nil {
+		return nil, false, nil
+	}
 	var raw string
 	err := h.db.QueryRow(
 		`SELECT payload_json
@@ -257,16 +337,59 @@ func (h *History) latestCommandStatus(commandID string) (types.CommandStatus, bo
 		commandID,
 	).Scan(&raw)
 	if err == sql.ErrNoRows {
-		return types.CommandStatus{}, false, nil
+		return nil, false, nil
 	}
 	if err != nil {
-		return types.CommandStatus{}, false, err
+		return nil, false, err
 	}
-	var out types.CommandStatus
-	if err := json.Unmarshal([]byte(raw), &out); err != nil {
-		return types.CommandStatus{}, false, fmt.Errorf("decode command status: %w", err)
+	return json.RawMessage(raw), true, nil
+}
+
+// RecentCommandStatuses returns the latest recorded status JSON of every command
+// whose ID starts with idPrefix and that was updated at or after since, newest
+// first. It is used to rehydrate in-memory command state after a restart.
+func (h *History) RecentCommandStatuses(idPrefix string, since time.Time, limit int) ([]json.RawMessage, error) {
+	if h == nil || h.db == nil {
+		return nil, nil
 	}
-	return out, true, nil
+	if limit <= 0 {
+		limit = 1000
+	}
+	// last_updated_at is RFC 3339 with trailing zeros trimmed, which does not
+	// sort as text within a second ("…05Z" > "…05.1Z"). Select from the start
+	// of since's second, which does compare correctly, and apply the exact
+	// cutoff and limit after parsing.
+	rows, err := h.db.Query(
+		`SELECT hcs.payload_json, hcs.last_updated_at
+		 FROM history_command_status hcs
+		 WHERE hcs.command_id LIKE ?
+		   AND hcs.last_updated_at >= ?
+		   AND hcs.stream_seq = (
+		     SELECT MAX(stream_seq) FROM history_command_status WHERE command_id = hcs.command_id
+		   )
+		 ORDER BY hcs.stream_seq DESC`,
+		idPrefix+"%", since.UTC().Format("2006-01-02T15:04:05"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rows.Close(); cerr != nil {
+			log.Printf("history: rows.Close error in RecentCommandStatuses: %v", cerr)
+		}
+	}()
+	out := make([]json.RawMessage, 0)
+	for rows.Next() && len(out) < limit {
+		var raw, updated string
+		if err := rows.Scan(&raw, &updated); err != nil {
+			return nil, err
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, updated); err == nil && ts.Before(since) {
+			continue
+		}
+		out = append(out, json.RawMessage(raw))
+	}
+	return out, rows.Err()
 }
 
 func (h *History) listEvents(pluginID, deviceID, entityID string, limit int) ([]observedEvent, error) {
@@ -670,3 +793,114 @@ func (h *History) traceSince(pluginID, deviceID, entityID string, since time.Tim
 	}
 	return entries, nil
 }
+
+// correlationChain returns, in chronological order, the commands recorded
+// with correlationID and the events caused by them: events carrying the
+// correlation ID itself or the ID of one of those commands (plugins tag the
+// events a command causes with its ID), plus the event named by correlationID
+// when a script reacted to it.
+func (h *History) correlationChain(correlationID string) (correlationChain, error) {
+	chain := correlationChain{CorrelationID: correlationID, Entries: []chainEntry{}}
+	if h == nil || correlationID == "" {
+		return chain, nil
+	}
+
+	cmdRows, err := h.db.Query(
+		`SELECT hcs.payload_json, hcs.created_at, COALESCE(hcp.payload_json, '')
+		 FROM history_command_status hcs
+		 LEFT JOIN history_command_payloads hcp ON hcs.command_id = hcp.command_id
+		 WHERE hcs.correlation_id = ?
+		   AND hcs.stream_seq = (
+		     SELECT MAX(stream_seq) FROM history_command_status WHERE command_id = hcs.command_id
+		   )
+		 ORDER BY hcs.created_at ASC
+		 LIMIT 1000`,
+		correlationID,
+	)
+	if err != nil {
+		return chain, err
+	}
+	defer cmdRows.Close()
+	for cmdRows.Next() {
+		var statusJSON, createdAt, cmdPayload string
+		if err := cmdRows.Scan(&statusJSON, &createdAt, &cmdPayload); err != nil {
+			return chain, err
+		}
+		var status struct {
+			types.CommandStatus
+			ParentID string `json:"parent_id"`
+		}
+		if err := json.Unmarshal([]byte(statusJSON), &status); err != nil {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339Nano, createdAt)
+		e := chainEntry{
+			Kind:          "command",
+			Ts:            t.UTC(),
+			PluginID:      status.PluginID,
+			DeviceID:      status.DeviceID,
+			EntityID:      status.EntityID,
+			CommandID:     status.CommandID,
+			ParentID:      status.ParentID,
+			CorrelationID: correlationID,
+			State:         string(status.State),
+			Error:         status.Error,
+		}
+		if cmdPayload != "" {
+			e.Name = payloadType(cmdPayload)
+			e.Data = json.RawMessage(cmdPayload)
+		}
+		chain.Entries = append(chain.Entries, e)
+	}
+	if err := cmdRows.Err(); err != nil {
+		return chain, err
+	}
+
+	eventRows, err := h.db.Query(
+		`SELECT event_id, plugin_id, device_id, entity_id, correlation_id, created_at, COALESCE(payload_json, '')
+		 FROM history_events
+		 WHERE correlation_id = ?
+		    OR event_id = ?
+		    OR correlation_id IN (
+		      SELECT DISTINCT command_id FROM history_command_status WHERE correlation_id = ?
+		    )
+		 ORDER BY created_at ASC, id ASC
+		 LIMIT 1000`,
+		correlationID, correlationID, correlationID,
+	)
+	if err != nil {
+		return chain, err
+	}
+	defer eventRows.Close()
+	for eventRows.Next() {
+		e := chainEntry{Kind: "event"}
+		var createdAt, payload string
+		if err := eventRows.Scan(&e.EventID, &e.PluginID, &e.DeviceID, &e.EntityID, &e.CorrelationID, &createdAt, &payload); err != nil {
+			return chain, err
+		}
+		t, _ := time.Parse(time.RFC3339Nano, createdAt)
+		e.Ts = t.UTC()
+		if payload != "" {
+			e.Name = payloadType(payload)
+			e.Data = json.RawMessage(payload)
+		}
+		chain.Entries = append(chain.Entries, e)
+	}
+	if err := eventRows.Err(); err != nil {
+		return chain, err
+	}
+
+	sort.SliceStable(chain.Entries, func(i, j int) bool { return chain.Entries[i].Ts.Before(chain.Entries[j].Ts) })
+	return chain, nil
+}
+
+// payloadType returns the "type" field of a JSON payload, or "".
+func payloadType(payload string) string {
+	var p struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal([]byte(payload), &p) != nil {
+		return ""
+	}
+	return p.Type
+}
@@ -1,6 +1,7 @@
 package history
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -308,3 +309,123 @@ func TestHistoryStore_ConcurrentAccess(t *testing.T) {
 		t.Errorf("Expected 100 events after concurrent writes, got %d", s.EventCount)
 	}
 }
+
+func TestHistoryStore_RecentCommandStatuses(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now().UTC()
+
+	inserts := []types.CommandStatus{
+		{CommandID: "gcmd-1", PluginID: "p", State: types.CommandPending, CreatedAt: now, LastUpdatedAt: now},
+		{CommandID: "gcmd-1", PluginID: "p", State: types.CommandSucceeded, CreatedAt: now, LastUpdatedAt: now},
+		{CommandID: "gcmd-old", PluginID: "p", State: types.CommandSucceeded, CreatedAt: now, LastUpdatedAt: now.Add(-2 * time.Hour)},
+		{CommandID: "plugin-cmd", PluginID: "p", State: types.CommandSucceeded, CreatedAt: now, LastUpdatedAt: now},
+	}
+	for i, st := range inserts {
+		if err := store.insertCommandStatus(uint64(i+1), st); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+
+	got, err := store.RecentCommandStatuses("gcmd-", now.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatalf("RecentCommandStatuses: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 status, got %d: %+v", len(got), got)
+	}
+	var latest types.CommandStatus
+	if err := json.Unmarshal(got[0], &latest); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if latest.CommandID != "gcmd-1" || latest.State != types.CommandSucceeded {
+		t.Errorf("expected latest gcmd-1 status succeeded, got %+v", latest)
+	}
+}
+
+func TestHistoryStore_RecentCommandStatusesCutoffWithinSecond(t *testing.T) {
+	store := openTestStore(t)
+	second := time.Now().UTC().Truncate(time.Second)
+	cutoff := second.Add(500 * time.Millisecond)
+
+	// RFC3339Nano renders the whole second as "…05Z", which sorts after
+	// "…05.5Z" as text even though it is earlier.
+	for i, at := range []struct {
+		id string
+		ts time.Time
+	}{
+		{"gcmd-whole-second", second},
+		{"gcmd-after-cutoff", second.Add(600 * time.Millisecond)},
+		{"gcmd-next-second", second.Add(time.Second)},
+	} {
+		st := types.CommandStatus{CommandID: at.id, PluginID: "p", State: types.CommandSucceeded, CreatedAt: at.ts, LastUpdatedAt: at.ts}
+		if err := store.insertCommandStatus(uint64(i+1), st); err != nil {
+			t.Fatalf("insert %s: %v", at.id, err)
+		}
+	}
+
+	got, err := store.RecentCommandStatuses("gcmd-", cutoff, 10)
+	if err != nil {
+		t.Fatalf("RecentCommandStatuses: %v", err)
+	}
+	ids := map[string]bool{}
+	for _, raw := range got {
+		var st types.CommandStatus
+		_ = json.Unmarshal(raw, &st)
+		ids[st.CommandID] = true
+	}
+	if len(ids) != 2 || !ids["gcmd-after-cutoff"] || !ids["gcmd-next-second"] {
+		t.Fatalf("expected only the statuses updated after the cutoff, got %v", ids)
+	}
+}
+
+func TestHistoryStore_CorrelationChain(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now().UTC()
+
+	statuses := []string{
+		`{"command_id":"gcmd-group","plugin_id":"p","device_id":"d","entity_id":"group","state":"succeeded","correlation_id":"req-1"}`,
+		`{"command_id":"gcmd-leaf","plugin_id":"p","device_id":"d","entity_id":"lamp","state":"pending","parent_id":"gcmd-group","correlation_id":"req-1"}`,
+		`{"command_id":"gcmd-leaf","plugin_id":"p","device_id":"d","entity_id":"lamp","state":"succeeded","parent_id":"gcmd-group","correlation_id":"req-1"}`,
+		`{"command_id":"gcmd-other","plugin_id":"p","device_id":"d","entity_id":"lamp","state":"succeeded","correlation_id":"req-2"}`,
+	}
+	for i, raw := range statuses {
+		var st types.CommandStatus
+		_ = json.Unmarshal([]byte(raw), &st)
+		st.CreatedAt, st.LastUpdatedAt = now.Add(time.Duration(i)*time.Millisecond), now
+		if err := store.insertCommandStatusJSON(uint64(i+1), st, []byte(raw)); err != nil {
+			t.Fatalf("insert status %d: %v", i, err)
+		}
+	}
+	events := []types.EntityEventEnvelope{
+		{EventID: "evt-1", PluginID: "p", DeviceID: "d", EntityID: "lamp", CorrelationID: "gcmd-leaf", Payload: []byte(`{"type":"state","on":true}`)},
+		{EventID: "evt-2", PluginID: "p", DeviceID: "d", EntityID: "lamp", CorrelationID: "gcmd-other", Payload: []byte(`{"type":"state","on":false}`)},
+		{EventID: "evt-3", PluginID: "p", DeviceID: "d", EntityID: "lamp", Payload: []byte(`{"type":"state"}`)},
+	}
+	for i, env := range events {
+		if err := store.insertEvent(uint64(i+1), now.Add(time.Second+time.Duration(i)*time.Millisecond), env); err != nil {
+			t.Fatalf("insert event %d: %v", i, err)
+		}
+	}
+
+	chain, err := store.correlationChain("req-1")
+	if err != nil {
+		t.Fatalf("correlationChain: %v", err)
+	}
+	if len(chain.Entries) != 3 {
+		t.Fatalf("expected 2 commands and 1 event, got %+v", chain.Entries)
+	}
+	if chain.Entries[1].CommandID != "gcmd-leaf" || chain.Entries[1].State != "succeeded" || chain.Entries[1].ParentID != "gcmd-group" {
+		t.Errorf("expected latest leaf status, got %+v", chain.Entries[1])
+	}
+	if chain.Entries[2].Kind != "event" || chain.Entries[2].EventID != "evt-1" || chain.Entries[2].Name != "state" {
+		t.Errorf("expected the leaf's event last, got %+v", chain.Entries[2])
+	}
+
+	chain, err = store.correlationChain("evt-3")
+	if err != nil {
+		t.Fatalf("correlationChain: %v", err)
+	}
+	if len(chain.Entries) != 1 || chain.Entries[0].EventID != "evt-3" {
+		t.Errorf("expected an event ID to match the event itself, got %+v", chain.Entries)
+	}
+}
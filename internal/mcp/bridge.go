@@ -22,6 +22,7 @@ import (
 // Bridge wraps an MCP server and proxies tool calls to the REST API.
 type Bridge struct {
 	mcpServer *server.MCPServer
+	baseURL   string
 }
 
 // New creates a Bridge populated with one MCP tool per OpenAPI operation.
@@ -29,7 +30,7 @@ func New(api huma.API, baseURL string) *Bridge {
 	s := server.NewMCPServer("SlideBolt Gateway", "1.1.0",
 		server.WithToolCapabilities(true),
 	)
-	b := &Bridge{mcpServer: s}
+	b := &Bridge{mcpServer: s, baseURL: baseURL}
 	b.buildFromOpenAPI(api, baseURL)
 	return b
 }
@@ -41,6 +42,18 @@ func (b *Bridge) Serve() {
 	}
 }
 
+// AddOperation adds, or replaces, the tool for an operation documented after
+// the bridge was built.
+func (b *Bridge) AddOperation(method, path string, op *huma.Operation) {
+	b.registerTool(method, path, op, b.baseURL)
+}
+
+// RemoveTools removes the tools of operations withdrawn from the spec, by
+// operation ID.
+func (b *Bridge) RemoveTools(names ...string) {
+	b.mcpServer.DeleteTools(names...)
+}
+
 func (b *Bridge) buildFromOpenAPI(api huma.API, baseURL string) {
 	oapi := api.OpenAPI()
 	if oapi == nil {
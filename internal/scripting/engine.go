@@ -46,6 +46,14 @@ func (e *ScriptEngine) Start(entity types.Entity, source string) (*VM, error) {
 
 const defaultDeadline = 5 * time.Second
 
+// handlerErrors counts queued event and command handlers that returned an
+// error, across all VMs.
+var handlerErrors atomic.Uint64
+
+// HandlerErrors returns how many queued event and command handlers have
+// returned an error since the process started.
+func HandlerErrors() uint64 { return handlerErrors.Load() }
+
 // VM wraps a Lua state. All Lua execution happens on the VM's own work-queue
 // goroutine, which makes it safe to deliver events from many NATS goroutines.
 type VM struct {
@@ -60,6 +68,10 @@ type VM struct {
 	done      chan struct{}
 	started   bool
 
+	// correlationID is the correlation ID of the event or command whose
+	// handler is running; only touched on the work-queue goroutine.
+	correlationID string
+
 	// runOnInit is called during start(). Defaults to a no-op; LuaVM overrides it.
 	runOnInit func() error
 
@@ -95,6 +107,8 @@ func newVM(entity types.Entity, source string, svc Services) (*VM, error) {
 		Events:   evts,
 	}
 	v.Timers = newTimerScripting(v, svc.Timers)
+	cmds.correlation = v.currentCorrelation
+	evts.correlation = v.currentCorrelation
 	v.runOnInit = func() error { return nil } // no-op default
 	return v, nil
 }
@@ -118,6 +132,18 @@ func (v *VM) start() error {
 	}
 }
 
+func (v *VM) currentCorrelation() string { return v.correlationID }
+
+// withCorrelation runs fn with id as the current correlation ID, so commands
+// and events the handler emits are tied to what triggered it. Must be called
+// on the work-queue goroutine.
+func (v *VM) withCorrelation(id string, fn func() error) error {
+	prev := v.correlationID
+	v.correlationID = id
+	defer func() { v.correlationID = prev }()
+	return fn()
+}
+
 // loop is the single goroutine that owns the Lua state.
 func (v *VM) loop() {
 	defer close(v.done)
@@ -127,6 +153,8 @@ func (v *VM) loop() {
 			err := item.fn()
 			if item.errc != nil {
 				item.errc <- err
+			} else if err != nil {
+				handlerErrors.Add(1)
 			}
 		case <-v.ctx.Done():
 			return
@@ -325,5 +353,8 @@ func (v *VM) EnqueueEvent(fn func() error) {
 	}
 }
 
+// QueueDepth returns the number of calls waiting in the VM's work queue.
+func (v *VM) QueueDepth() int { return len(v.work) }
+
 // Source returns the Lua source this VM was created with.
 func (v *VM) Source() string { return v.source }
@@ -34,6 +34,28 @@ type CommandSubmitter interface {
 	Submit(pluginID, deviceID, entityID string, payload json.RawMessage) (types.CommandStatus, error)
 }
 
+// CorrelatedSubmitter is optionally implemented by a CommandSubmitter that can
+// tag a command with the correlation ID of whatever triggered the script.
+type CorrelatedSubmitter interface {
+	SubmitCorrelated(correlationID, pluginID, deviceID, entityID string, payload json.RawMessage) (types.CommandStatus, error)
+}
+
+// CommandWaiter is optionally implemented by a CommandSubmitter that can block
+// until a command finishes and, with confirm, until the entity reports the
+// new state. The wait ends early when ctx is done. correlationID may be empty.
+type CommandWaiter interface {
+	SubmitAndWait(ctx context.Context, correlationID, pluginID, deviceID, entityID string, payload json.RawMessage, timeout time.Duration, confirm bool) (CommandWaitResult, error)
+}
+
+// CommandWaitResult is the outcome of CommandWaiter.SubmitAndWait. Outcome is
+// one of completed, confirmed, unconfirmed or timeout; State holds the
+// confirming entity event payload when confirmed.
+type CommandWaitResult struct {
+	Status  types.CommandStatus
+	Outcome string
+	State   json.RawMessage
+}
+
 // EntityFinder abstracts Registry.FindEntities / FindDevices.
 type EntityFinder interface {
 	FindEntities(q types.SearchQuery) []types.Entity
@@ -334,6 +356,9 @@ func entitySupportsAllActions(e types.Entity, required []string) bool {
 // CommandScripting provides the ergonomic Lua-facing command API.
 type CommandScripting struct {
 	commands CommandSubmitter
+	// correlation, if set, returns the correlation ID of the event or command
+	// the script is currently handling.
+	correlation func() string
 }
 
 func newCommandScripting(c CommandSubmitter) *CommandScripting {
@@ -354,13 +379,44 @@ func (c *CommandScripting) Send(e types.Entity, action string, params map[string
 	if err != nil {
 		return "", fmt.Errorf("scripting: marshal payload: %w", err)
 	}
-	status, err := c.commands.Submit(e.PluginID, e.DeviceID, e.ID, payload)
+	var status types.CommandStatus
+	if cs, ok := c.commands.(CorrelatedSubmitter); ok && c.correlationID() != "" {
+		status, err = cs.SubmitCorrelated(c.correlationID(), e.PluginID, e.DeviceID, e.ID, payload)
+	} else {
+		status, err = c.commands.Submit(e.PluginID, e.DeviceID, e.ID, payload)
+	}
 	if err != nil {
 		return "", err
 	}
 	return status.CommandID, nil
 }
 
+func (c *CommandScripting) correlationID() string {
+	if c.correlation == nil {
+		return ""
+	}
+	return c.correlation()
+}
+
+// SendAndWait is Send, but blocks for up to timeout, or until ctx is done,
+// until the command finishes and, with confirm, until the entity reports the
+// new state.
+func (c *CommandScripting) SendAndWait(ctx context.Context, e types.Entity, action string, params map[string]any, timeout time.Duration, confirm bool) (CommandWaitResult, error) {
+	waiter, ok := c.commands.(CommandWaiter)
+	if !ok {
+		return CommandWaitResult{}, fmt.Errorf("scripting: send and wait not supported")
+	}
+	if params == nil {
+		params = map[string]any{}
+	}
+	params["type"] = action
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return CommandWaitResult{}, fmt.Errorf("scripting: marshal payload: %w", err)
+	}
+	return waiter.SubmitAndWait(ctx, c.correlationID(), e.PluginID, e.DeviceID, e.ID, payload, timeout, confirm)
+}
+
 // SendTo is the fully-qualified version when you don't have an Entity object.
 func (c *CommandScripting) SendTo(pluginID, deviceID, entityID, action string, params map[string]any) (string, error) {
 	e := types.Entity{ID: entityID, PluginID: pluginID, DeviceID: deviceID}
@@ -378,6 +434,9 @@ type HandlerFunc func(env types.EntityEventEnvelope)
 type EventScripting struct {
 	bus    EventBus
 	finder EntityFinder // optional: used to resolve entity labels for label-filtered subscriptions
+	// correlation, if set, returns the correlation ID stamped on published
+	// events that do not carry one.
+	correlation func() string
 }
 
 func newEventScripting(b EventBus) *EventScripting { return &EventScripting{bus: b} }
@@ -439,6 +498,9 @@ func (e *EventScripting) OnEvent(ctx context.Context, subject string, fn Handler
 // Publish emits an EntityEventEnvelope onto SubjectEntityEvents.
 // Used by EntityBinding.SendEvent.
 func (e *EventScripting) Publish(env types.EntityEventEnvelope) error {
+	if env.CorrelationID == "" && e.correlation != nil {
+		env.CorrelationID = e.correlation()
+	}
 	data, err := json.Marshal(env)
 	if err != nil {
 		return err
@@ -452,8 +514,9 @@ func (e *EventScripting) Publish(env types.EntityEventEnvelope) error {
 
 // IncomingCommand represents a command arriving at a scripting entity.
 type IncomingCommand struct {
-	Name   string
-	Params map[string]any
+	Name          string
+	Params        map[string]any
+	CorrelationID string
 }
 
 // EntityBinding is the bespoke scripting context bound to a specific entity.
@@ -540,8 +603,13 @@ func (b *EntityBinding) OnCommand(commandName string, fn func(IncomingCommand))
 // HandleCommand delivers an incoming command to the registered per-name callback.
 // Returns ErrNoCommandHandler if no callback is registered for that command name.
 func (b *EntityBinding) HandleCommand(name string, params map[string]any) error {
-	if fn, ok := b.commandHandlers[name]; ok {
-		fn(IncomingCommand{Name: name, Params: params})
+	return b.Deliver(IncomingCommand{Name: name, Params: params})
+}
+
+// Deliver is HandleCommand for a command that carries a correlation ID.
+func (b *EntityBinding) Deliver(cmd IncomingCommand) error {
+	if fn, ok := b.commandHandlers[cmd.Name]; ok {
+		fn(cmd)
 		return nil
 	}
 	return ErrNoCommandHandler
@@ -288,8 +288,13 @@ func (lvm *LuaVM) GetGlobalTableLen(name string) (int, error) {
 
 // HandleCommand delivers a command to this VM's EntityBinding on the work queue.
 func (lvm *LuaVM) HandleCommand(name string, params map[string]any) error {
+	return lvm.DeliverCommand(IncomingCommand{Name: name, Params: params})
+}
+
+// DeliverCommand is HandleCommand for a command that carries a correlation ID.
+func (lvm *LuaVM) DeliverCommand(cmd IncomingCommand) error {
 	return lvm.VM.Exec(func() error {
-		return lvm.VM.This.HandleCommand(name, params)
+		return lvm.VM.This.Deliver(cmd)
 	})
 }
 
@@ -660,7 +665,9 @@ func (lvm *LuaVM) injectThis() {
 		this.OnCommand(cmdName, func(cmd IncomingCommand) {
 			lvm.VM.EnqueueEvent(func() error {
 				cmdTable := incomingCommandToTable(L, cmd)
-				return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, cmdTable)
+				return lvm.VM.withCorrelation(cmd.CorrelationID, func() error {
+					return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, cmdTable)
+				})
 			})
 		})
 		return 0
@@ -872,6 +879,45 @@ func (lvm *LuaVM) injectCommandService() {
 		return 1
 	}))
 
+	// CommandService.Scripting.SendAndWait(entity_table, action, params_table, opts_table) → result
+	// opts: {timeout=5, confirm=false} — timeout in seconds (default 5, capped
+	// by the gateway at 60)
+	// result: {CommandID, State, Error, Outcome, Confirmed}; Outcome is completed,
+	// confirmed, unconfirmed or timeout, Confirmed the reported entity state.
+	// The call blocks this VM's work queue, so none of its event or command
+	// handlers run until it returns; stopping the script ends the wait.
+	L.SetField(scripting, "SendAndWait", L.NewFunction(func(L *lua.LState) int {
+		eTable := L.CheckTable(1)
+		action := L.CheckString(2)
+		params := tableToMap(L, L.OptTable(3, L.NewTable()))
+		opts := L.OptTable(4, L.NewTable())
+		timeout := 5 * time.Second
+		if n, ok := opts.RawGetString("timeout").(lua.LNumber); ok && n > 0 {
+			timeout = time.Duration(float64(n) * float64(time.Second))
+		}
+		confirm := opts.RawGetString("confirm") == lua.LTrue
+
+		e := tableToEntity(L, eTable)
+		res, err := cs.SendAndWait(lvm.VM.ctx, e, action, params, timeout, confirm)
+		if err != nil {
+			L.RaiseError("CommandService.Scripting.SendAndWait: %s", err)
+			return 0
+		}
+		t := L.NewTable()
+		L.SetField(t, "CommandID", lua.LString(res.Status.CommandID))
+		L.SetField(t, "State", lua.LString(res.Status.State))
+		L.SetField(t, "Error", lua.LString(res.Status.Error))
+		L.SetField(t, "Outcome", lua.LString(res.Outcome))
+		if len(res.State) > 0 {
+			var m map[string]any
+			if json.Unmarshal(res.State, &m) == nil {
+				L.SetField(t, "Confirmed", mapToTable(L, m))
+			}
+		}
+		L.Push(t)
+		return 1
+	}))
+
 	scriptingParent := L.NewTable()
 	L.SetField(scriptingParent, "Scripting", scripting)
 	L.SetGlobal("CommandService", scriptingParent)
@@ -937,7 +983,15 @@ func (lvm *LuaVM) subscribeEventHandler(subject string, fn *lua.LFunction) {
 				"entity_id": env.EntityID,
 			})
 			envTable := envelopeToTable(lvm.L, env)
-			return lvm.L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, envTable)
+			// Commands and events the handler emits inherit the event's
+			// correlation ID, or point back at the event itself.
+			corrID := env.CorrelationID
+			if corrID == "" {
+				corrID = env.EventID
+			}
+			return lvm.VM.withCorrelation(corrID, func() error {
+				return lvm.L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, envTable)
+			})
 		})
 	})
 	if err != nil {
@@ -1300,6 +1354,9 @@ func envelopeToTable(L *lua.LState, env types.EntityEventEnvelope) *lua.LTable {
 func incomingCommandToTable(L *lua.LState, cmd IncomingCommand) *lua.LTable {
 	t := L.NewTable()
 	L.SetField(t, "Name", lua.LString(cmd.Name))
+	if cmd.CorrelationID != "" {
+		L.SetField(t, "CorrelationID", lua.LString(cmd.CorrelationID))
+	}
 	if cmd.Params != nil {
 		L.SetField(t, "Params", mapToTable(L, cmd.Params))
 	} else {
@@ -16,6 +16,8 @@ type diskWriteCounter struct {
 
 type diskWriteState struct {
 	diskWriteCounter
+	// total is never reset; it backs the disk write metrics.
+	total    diskWriteCounter
 	lastHash uint64
 	lastSize int
 	seen     bool
@@ -43,8 +45,11 @@ func recordDiskWrite(path string, data []byte) {
 	}
 	s.writes++
 	s.bytesWritten += uint64(len(data))
+	s.total.writes++
+	s.total.bytesWritten += uint64(len(data))
 	if s.seen && s.lastHash == sum && s.lastSize == len(data) {
 		s.unchangedWrite++
+		s.total.unchangedWrite++
 	}
 	s.lastHash = sum
 	s.lastSize = len(data)
@@ -63,6 +68,17 @@ func (d *logDiagnostics) snapshotAndResetDiskWrites() map[string]diskWriteCounte
 	return out
 }
 
+// diskWriteTotals returns the cumulative write counters for every file.
+func (d *logDiagnostics) diskWriteTotals() map[string]diskWriteCounter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]diskWriteCounter, len(d.diskWrites))
+	for path, state := range d.diskWrites {
+		out[path] = state.total
+	}
+	return out
+}
+
 func startGatewayDiagnostics() {
 	go func() {
 		diskTicker := time.NewTicker(10 * time.Second)
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slidebolt/sdk-types"
+
+	gwscripting "github.com/slidebolt/gateway/internal/scripting"
+)
+
+// metricsContentType is the Prometheus text exposition format, version 0.0.4.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+var (
+	// latencyBuckets suit RPC calls and SQLite inserts, in seconds.
+	latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	// fanOutBuckets suit the number of leaf commands a group fans out to.
+	fanOutBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+// metricFamily is one named metric with a fixed set of label names and a
+// series per distinct combination of label values.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// counts holds per-bucket (not cumulative) observation counts.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (f *metricFamily) seriesLocked(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to the series for labelValues.
+func (f *metricFamily) Add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	f.seriesLocked(labelValues).value += v
+	f.mu.Unlock()
+}
+
+// Inc adds one to the series for labelValues.
+func (f *metricFamily) Inc(labelValues ...string) { f.Add(1, labelValues...) }
+
+// Set replaces the value of the series for labelValues. Counters are only
+// Set by scrape-time collectors mirroring a count kept elsewhere.
+func (f *metricFamily) Set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	f.seriesLocked(labelValues).value = v
+	f.mu.Unlock()
+}
+
+// Observe records v in the histogram series for labelValues.
+func (f *metricFamily) Observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	s := f.seriesLocked(labelValues)
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	f.mu.Unlock()
+}
+
+// Reset drops every series, so a scrape-time collector can rebuild a gauge
+// without leaving stale label combinations behind.
+func (f *metricFamily) Reset() {
+	f.mu.Lock()
+	f.series = make(map[string]*metricSeries)
+	f.mu.Unlock()
+}
+
+func (f *metricFamily) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.WriteString("# HELP " + f.name + " " + escapeMetricHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + string(f.kind) + "\n")
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != metricHistogram {
+			w.WriteString(f.name + formatMetricLabels(f.labels, s.labelValues, "", "") + " " + formatMetricValue(s.value) + "\n")
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += s.counts[i]
+			w.WriteString(f.name + "_bucket" + formatMetricLabels(f.labels, s.labelValues, "le", formatMetricValue(upper)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(f.name + "_bucket" + formatMetricLabels(f.labels, s.labelValues, "le", "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString(f.name + "_sum" + formatMetricLabels(f.labels, s.labelValues, "", "") + " " + formatMetricValue(s.sum) + "\n")
+		w.WriteString(f.name + "_count" + formatMetricLabels(f.labels, s.labelValues, "", "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+func formatMetricLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name + `="` + escapeMetricLabel(value) + `"`)
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName + `="` + extraValue + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	metricHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeMetricLabel(s string) string { return metricLabelEscaper.Replace(s) }
+func escapeMetricHelp(s string) string  { return metricHelpEscaper.Replace(s) }
+
+// metricsRegistry holds metric families in registration order plus
+// collectors that refresh scrape-time values before each exposition.
+type metricsRegistry struct {
+	// scrapeMu serialises expositions so collectors resetting gauges do not
+	// race each other.
+	scrapeMu sync.Mutex
+
+	mu         sync.Mutex
+	families   []*metricFamily
+	collectors []func()
+}
+
+func (r *metricsRegistry) register(name, help string, kind metricKind, buckets []float64, labels []string) *metricFamily {
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (r *metricsRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return r.register(name, help, metricCounter, nil, labels)
+}
+
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return r.register(name, help, metricGauge, nil, labels)
+}
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return r.register(name, help, metricHistogram, buckets, labels)
+}
+
+// onScrape registers fn to run before each exposition.
+func (r *metricsRegistry) onScrape(fn func()) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, fn)
+	r.mu.Unlock()
+}
+
+// WriteText runs the collectors and writes every family in the Prometheus
+// text format.
+func (r *metricsRegistry) WriteText(out io.Writer) error {
+	r.scrapeMu.Lock()
+	defer r.scrapeMu.Unlock()
+	r.mu.Lock()
+	families := append([]*metricFamily(nil), r.families...)
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		f.write(w)
+	}
+	return w.Flush()
+}
+
+// gatewayMetrics is the gateway's metric set. Hot-path metrics are updated
+// where the work happens; the rest are read from their owners at scrape time.
+type gatewayMetrics struct {
+	registry *metricsRegistry
+
+	rpcDuration *metricFamily
+	rpcErrors   *metricFamily
+	rpcTimeouts *metricFamily
+
+	plugins               *metricFamily
+	pluginLifecycleEvents *metricFamily
+
+	commandsTotal     *metricFamily
+	commandStatuses   *metricFamily
+	fanOutSize        *metricFamily
+	queueDepth        *metricFamily
+	queueInFlight     *metricFamily
+	queueRejected     *metricFamily
+	dynamicSubs       *metricFamily
+	dynamicDropped    *metricFamily
+	dynamicExpired    *metricFamily
+	sseClients        *metricFamily
+	sseDropped        *metricFamily
+	wsConnections     *metricFamily
+	luaVMs            *metricFamily
+	luaQueued         *metricFamily
+	luaHandlerErrors  *metricFamily
+	historyInsert     *metricFamily
+	historyInsertErrs *metricFamily
+	diskWrites        *metricFamily
+	diskBytes         *metricFamily
+	diskUnchanged     *metricFamily
+}
+
+func newGatewayMetrics() *gatewayMetrics {
+	r := &metricsRegistry{}
+	m := &gatewayMetrics{
+		registry: r,
+
+		rpcDuration: r.histogram("gateway_rpc_duration_seconds", "Time from sending a plugin RPC request to receiving its answer or timing out.", latencyBuckets, "plugin", "method"),
+		rpcErrors:   r.counter("gateway_rpc_errors_total", "Plugin RPC calls that failed with a JSON-RPC error, by error code; includes calls failed without being sent.", "plugin", "method", "code"),
+		rpcTimeouts: r.counter("gateway_rpc_timeouts_total", "Plugin RPC calls that timed out without an answer.", "plugin", "method"),
+
+		plugins:               r.gauge("gateway_plugins", "Registered plugins by liveness status.", "status"),
+		pluginLifecycleEvents: r.counter("gateway_plugin_lifecycle_events_total", "Plugin registrations, manifest updates and liveness transitions.", "type"),
+
+		commandsTotal:   r.counter("gateway_commands_total", "Command state transitions, by the state entered.", "state"),
+		commandStatuses: r.gauge("gateway_command_statuses_retained", "Command statuses held in memory by state; falls as old statuses are evicted.", "state"),
+		fanOutSize:      r.histogram("gateway_command_fanout_size", "Number of child commands a group command fanned out to.", fanOutBuckets),
+		queueDepth:      r.gauge("gateway_command_queue_depth", "Commands waiting in a plugin's dispatch queue.", "plugin"),
+		queueInFlight:   r.gauge("gateway_command_queue_in_flight", "Commands being dispatched to a plugin.", "plugin"),
+		queueRejected:   r.counter("gateway_command_queue_rejected_total", "Commands rejected because a plugin's dispatch queue was full.", "plugin"),
+		dynamicSubs:     r.gauge("gateway_dynamic_subscriptions", "Active dynamic event subscriptions."),
+		dynamicDropped:  r.counter("gateway_dynamic_events_dropped_total", "Events dropped because a dynamic subscriber's buffer or replay backlog was full."),
+		dynamicExpired:  r.counter("gateway_dynamic_subscriptions_expired_total", "Dynamic event subscriptions removed because their lease ran out."),
+		sseClients:      r.gauge("gateway_sse_clients", "Connected Server-Sent Events clients."),
+		sseDropped:      r.counter("gateway_sse_dropped_total", "Server-Sent Events messages dropped because a client fell behind."),
+		wsConnections:   r.gauge("gateway_websocket_connections", "Open WebSocket API connections."),
+
+		luaVMs:           r.gauge("gateway_lua_vms", "Running Lua VMs; kind is entity for attached scripts and child for scripts started with RunScript.", "kind"),
+		luaQueued:        r.gauge("gateway_lua_queued_handlers", "Event and command handler calls waiting in Lua VM work queues."),
+		luaHandlerErrors: r.counter("gateway_lua_handler_errors_total", "Lua event and command handlers that raised an error."),
+
+		historyInsert:     r.histogram("gateway_history_insert_duration_seconds", "Time to write one history row to SQLite.", latencyBuckets, "table"),
+		historyInsertErrs: r.counter("gateway_history_insert_errors_total", "History rows that failed to write.", "table"),
+
+		diskWrites:    r.counter("gateway_disk_writes_total", "Files written to the gateway data dir.", "file"),
+		diskBytes:     r.counter("gateway_disk_written_bytes_total", "Bytes written to the gateway data dir.", "file"),
+		diskUnchanged: r.counter("gateway_disk_unchanged_writes_total", "Writes whose content matched the previous write of the same file.", "file"),
+	}
+	r.onScrape(m.collect)
+	return m
+}
+
+// observeRPC records a plugin RPC call that got an answer, which may itself
+// be a JSON-RPC error.
+func (m *gatewayMetrics) observeRPC(pluginID, method string, d time.Duration, resp types.Response) {
+	m.rpcDuration.Observe(d.Seconds(), pluginID, method)
+	if resp.Error != nil {
+		m.rpcErrors.Inc(pluginID, method, strconv.Itoa(resp.Error.Code))
+	}
+}
+
+// observeRPCTimeout records a plugin RPC call that got no answer in time.
+func (m *gatewayMetrics) observeRPCTimeout(pluginID, method string, d time.Duration) {
+	m.rpcDuration.Observe(d.Seconds(), pluginID, method)
+	m.rpcTimeouts.Inc(pluginID, method)
+}
+
+// observeRPCRejected records a plugin RPC call the gateway failed without
+// sending, e.g. because the plugin is unknown or its circuit is open.
+func (m *gatewayMetrics) observeRPCRejected(pluginID, method string, code int) {
+	m.rpcErrors.Inc(pluginID, method, strconv.Itoa(code))
+}
+
+// ObserveHistoryInsert is installed as the history store's insert observer.
+func (m *gatewayMetrics) ObserveHistoryInsert(table string, d time.Duration, err error) {
+	m.historyInsert.Observe(d.Seconds(), table)
+	if err != nil {
+		m.historyInsertErrs.Inc(table)
+	}
+}
+
+func (m *gatewayMetrics) collect() {
+	m.plugins.Reset()
+	byStatus := map[PluginStatus]int{PluginOnline: 0, PluginStale: 0, PluginOffline: 0}
+	regMu.RLock()
+	for _, rec := range registry {
+		status := rec.Status
+		if status == "" {
+			status = PluginOnline
+		}
+		byStatus[status]++
+	}
+	regMu.RUnlock()
+	for status, n := range byStatus {
+		m.plugins.Set(float64(n), string(status))
+	}
+
+	m.commandStatuses.Reset()
+	m.queueDepth.Reset()
+	m.queueInFlight.Reset()
+	if commandService != nil {
+		for state, n := range commandService.statuses.CountByState() {
+			m.commandStatuses.Set(float64(n), string(state))
+		}
+		for _, q := range commandService.QueueStats() {
+			m.queueDepth.Set(float64(q.Depth), q.PluginID)
+			m.queueInFlight.Set(float64(q.InFlight), q.PluginID)
+			m.queueRejected.Set(float64(q.Rejected), q.PluginID)
+		}
+	}
+
+	subs, dropped, expired := 0, uint64(0), uint64(0)
+	if dynamicEventService != nil {
+		subs, dropped = dynamicEventService.Stats()
+		expired = dynamicEventService.Expired()
+	}
+	m.dynamicSubs.Set(float64(subs))
+	m.dynamicDropped.Set(float64(dropped))
+	m.dynamicExpired.Set(float64(expired))
+
+	clients, sseDropped := 0, uint64(0)
+	if historyService != nil {
+		clients = historyService.SSEClients()
+		sseDropped = historyService.SSEDropped()
+	}
+	m.sseClients.Set(float64(clients))
+	m.sseDropped.Set(float64(sseDropped))
+	m.wsConnections.Set(float64(socketConnections.Load()))
+
+	var lua scriptRuntimeStats
+	if scriptRuntime != nil {
+		lua = scriptRuntime.stats()
+	}
+	m.luaVMs.Set(float64(lua.EntityVMs), "entity")
+	m.luaVMs.Set(float64(lua.ChildVMs), "child")
+	m.luaQueued.Set(float64(lua.Queued))
+	m.luaHandlerErrors.Set(float64(gwscripting.HandlerErrors()))
+
+	for path, c := range diag.diskWriteTotals() {
+		m.diskWrites.Set(float64(c.writes), path)
+		m.diskBytes.Set(float64(c.bytesWritten), path)
+		m.diskUnchanged.Set(float64(c.unchangedWrite), path)
+	}
+}
+
+// metricsHandler serves the gateway's metrics in the Prometheus text format.
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", metricsContentType)
+	c.Status(200)
+	_ = metrics.registry.WriteText(c.Writer)
+}
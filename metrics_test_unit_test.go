@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestMetricsRegistry_TextFormat(t *testing.T) {
+	r := &metricsRegistry{}
+	calls := r.counter("test_calls_total", "Calls made.", "plugin", "method")
+	depth := r.gauge("test_depth", "Queue depth.")
+	latency := r.histogram("test_latency_seconds", "Call latency.", []float64{0.1, 1}, "plugin")
+	r.onScrape(func() { depth.Set(3) })
+
+	calls.Inc("p1", "entities/list")
+	calls.Add(2, "p1", "entities/list")
+	calls.Inc(`we"ird\`, "x\ny")
+	latency.Observe(0.05, "p1")
+	latency.Observe(0.5, "p1")
+	latency.Observe(5, "p1")
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_calls_total Calls made.
+# TYPE test_calls_total counter
+test_calls_total{plugin="p1",method="entities/list"} 3
+test_calls_total{plugin="we\"ird\\",method="x\ny"} 1
+# HELP test_depth Queue depth.
+# TYPE test_depth gauge
+test_depth 3
+# HELP test_latency_seconds Call latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{plugin="p1",le="0.1"} 1
+test_latency_seconds_bucket{plugin="p1",le="1"} 2
+test_latency_seconds_bucket{plugin="p1",le="+Inf"} 3
+test_latency_seconds_sum{plugin="p1"} 5.55
+test_latency_seconds_count{plugin="p1"} 3
+`
+	if got := b.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetrics_GatewayCollectors(t *testing.T) {
+	ResetGlobals()
+	svc := newDynamicEventService()
+	dynamicEventService = svc
+	defer func() { dynamicEventService = nil }()
+
+	id, _ := svc.Subscribe(EventFilter{}, SubscriptionOptions{})
+	svc.mu.RLock()
+	sub := svc.subs[id]
+	svc.mu.RUnlock()
+	for i := 0; i < dynamicSubBuffer+2; i++ {
+		sub.trySend(SubscriptionEvent{EntityEventEnvelope: types.EntityEventEnvelope{EntityID: "e1"}})
+	}
+	recordDiskWrite("/data/state.json", []byte("{}"))
+	recordDiskWrite("/data/state.json", []byte("{}"))
+
+	m := newGatewayMetrics()
+	var b strings.Builder
+	if err := m.registry.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"gateway_dynamic_subscriptions 1",
+		"gateway_dynamic_events_dropped_total 2",
+		"gateway_sse_dropped_total 0",
+		`gateway_disk_writes_total{file="/data/state.json"} 2`,
+		`gateway_disk_unchanged_writes_total{file="/data/state.json"} 1`,
+		`gateway_lua_vms{kind="entity"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	svc.Unsubscribe(id)
+	if active, dropped := svc.Stats(); active != 0 || dropped != 2 {
+		t.Fatalf("expected drops to outlive the subscription, got active=%d dropped=%d", active, dropped)
+	}
+}
+
+func TestMetrics_CommandsTotalCountsStateTransitions(t *testing.T) {
+	svc := CommandService()
+	defer svc.Close()
+	count := func(state types.CommandState) float64 {
+		m := metrics.commandsTotal
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if s, ok := m.series[string(state)]; ok {
+			return s.value
+		}
+		return 0
+	}
+	pending, succeeded := count(types.CommandPending), count(types.CommandSucceeded)
+
+	st := childStatus("gcmd-metrics", types.CommandPending)
+	svc.updateStatus(st)
+	svc.updateStatus(st)
+	st.State = types.CommandSucceeded
+	svc.updateStatus(st)
+	svc.statuses.Evict(time.Now().UTC().Add(svc.retention.MaxAge + time.Minute))
+
+	if got := count(types.CommandPending) - pending; got != 1 {
+		t.Errorf("expected 1 pending transition, got %v", got)
+	}
+	if got := count(types.CommandSucceeded) - succeeded; got != 1 {
+		t.Errorf("expected 1 succeeded transition after eviction, got %v", got)
+	}
+}
@@ -21,6 +21,19 @@ func (rc *responseCapture) Write(b []byte) (int, error) {
 	return rc.ResponseWriter.Write(b)
 }
 
+// correlationID is a Gin middleware that assigns every request a correlation
+// ID (see requestCorrelationID), echoes it in the X-Correlation-ID response
+// header and stores it in the request context, where command submission and
+// plugin RPCs pick it up.
+func correlationID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := requestCorrelationID(c.Request.Header)
+		c.Header(headerCorrelationID, id)
+		c.Request = c.Request.WithContext(withCorrelationID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
 // requestLogger is a Gin middleware that logs every HTTP request.
 //   - 2xx / 3xx  →  METHOD path → STATUS duration
 //   - 4xx        →  METHOD path → STATUS duration
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// PayloadFieldError describes one invalid field in a command payload.
+type PayloadFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// PayloadValidationError lists every field of a command payload that does not
+// match its domain schema.
+type PayloadValidationError struct {
+	Action string
+	Fields []PayloadFieldError
+}
+
+func (e *PayloadValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	return fmt.Sprintf("invalid payload for action %q: %s", e.Action, strings.Join(parts, "; "))
+}
+
+// commandFieldSchemas returns the field definitions declared by the SDK
+// descriptor for action in domain. It reports false when the domain or action
+// is not registered, in which case the payload is not validated.
+func commandFieldSchemas(domain, action string) ([]types.FieldDescriptor, bool) {
+	desc, ok := types.GetDomainDescriptor(domain)
+	if !ok {
+		return nil, false
+	}
+	for _, cmd := range desc.Commands {
+		if cmd.Action == action {
+			return cmd.Fields, true
+		}
+	}
+	return nil, false
+}
+
+// validateCommandPayload checks payload against the schema registered for the
+// entity's domain. It returns a CommandErrInvalidPayload error wrapping a
+// *PayloadValidationError when any field is missing, mistyped, out of range or
+// not one of the allowed values.
+func validateCommandPayload(domain, action string, payload json.RawMessage) error {
+	fields, ok := commandFieldSchemas(domain, action)
+	if !ok || len(fields) == 0 {
+		return nil
+	}
+	return validatePayloadFields(action, fields, payload)
+}
+
+func validatePayloadFields(action string, fields []types.FieldDescriptor, payload json.RawMessage) error {
+	var body map[string]any
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return commandErr(CommandErrInvalidPayload, "payload must be a JSON object", err)
+	}
+	verr := &PayloadValidationError{Action: action}
+	for _, f := range fields {
+		v, present := body[f.Name]
+		if !present || v == nil {
+			if f.Required {
+				verr.Fields = append(verr.Fields, PayloadFieldError{Field: f.Name, Message: "is required"})
+			}
+			continue
+		}
+		if msg := checkPayloadField(f, v); msg != "" {
+			verr.Fields = append(verr.Fields, PayloadFieldError{Field: f.Name, Message: msg})
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return commandErr(CommandErrInvalidPayload, verr.Error(), verr)
+	}
+	return nil
+}
+
+// checkPayloadField returns a description of why v does not satisfy f, or ""
+// if it does. Unknown schema types are not type-checked.
+func checkPayloadField(f types.FieldDescriptor, v any) string {
+	switch strings.ToLower(f.Type) {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return "must be a string"
+		}
+	case "bool", "boolean":
+		if _, ok := v.(bool); !ok {
+			return "must be a boolean"
+		}
+	case "int", "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return "must be an integer"
+		}
+	case "float", "number":
+		if _, ok := v.(float64); !ok {
+			return "must be a number"
+		}
+	case "array", "list":
+		if _, ok := v.([]any); !ok {
+			return "must be an array"
+		}
+	case "object", "map":
+		if _, ok := v.(map[string]any); !ok {
+			return "must be an object"
+		}
+	}
+	if n, ok := v.(float64); ok {
+		if f.Min != nil && n < *f.Min {
+			return fmt.Sprintf("must be >= %v", *f.Min)
+		}
+		if f.Max != nil && n > *f.Max {
+			return fmt.Sprintf("must be <= %v", *f.Max)
+		}
+	}
+	if len(f.Enum) > 0 && !payloadEnumContains(f.Enum, v) {
+		return fmt.Sprintf("must be one of %v", f.Enum)
+	}
+	return ""
+}
+
+func payloadEnumContains(enum []any, v any) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
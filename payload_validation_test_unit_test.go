@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func floatPtr(v float64) *float64 { return &v }
+
+var lightFieldSchemas = []types.FieldDescriptor{
+	{Name: "brightness", Type: "integer", Required: true, Min: floatPtr(0), Max: floatPtr(100)},
+	{Name: "effect", Type: "string", Enum: []any{"none", "colorloop"}},
+	{Name: "transition", Type: "number"},
+}
+
+func TestValidatePayloadFields_AcceptsValidPayload(t *testing.T) {
+	payload := json.RawMessage(`{"type":"set_brightness","brightness":40,"effect":"colorloop","transition":0.5}`)
+	if err := validatePayloadFields("set_brightness", lightFieldSchemas, payload); err != nil {
+		t.Fatalf("expected payload to be valid, got %v", err)
+	}
+}
+
+func TestValidatePayloadFields_ReportsEachInvalidField(t *testing.T) {
+	payload := json.RawMessage(`{"type":"set_brightness","brightness":150.5,"effect":"strobe","transition":"slow"}`)
+	err := validatePayloadFields("set_brightness", lightFieldSchemas, payload)
+	if code, ok := commandErrCode(err); !ok || code != CommandErrInvalidPayload {
+		t.Fatalf("expected invalid_payload error, got %v", err)
+	}
+	var verr *PayloadValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected field details, got %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range verr.Fields {
+		got[f.Field] = f.Message
+	}
+	want := map[string]string{
+		"brightness": "must be an integer",
+		"effect":     "must be one of [none colorloop]",
+		"transition": "must be a number",
+	}
+	for field, msg := range want {
+		if got[field] != msg {
+			t.Errorf("%s: got %q, want %q", field, got[field], msg)
+		}
+	}
+}
+
+func TestValidatePayloadFields_RequiredAndRange(t *testing.T) {
+	err := validatePayloadFields("set_brightness", lightFieldSchemas, json.RawMessage(`{"type":"set_brightness"}`))
+	var verr *PayloadValidationError
+	if !errors.As(err, &verr) || len(verr.Fields) != 1 || verr.Fields[0].Message != "is required" {
+		t.Fatalf("expected missing brightness to be reported, got %v", err)
+	}
+
+	err = validatePayloadFields("set_brightness", lightFieldSchemas, json.RawMessage(`{"brightness":101}`))
+	if !errors.As(err, &verr) || verr.Fields[0].Message != "must be <= 100" {
+		t.Fatalf("expected range violation, got %v", err)
+	}
+}
+
+func TestValidateCommandPayload_UsesRegisteredDescriptor(t *testing.T) {
+	types.RegisterDomain(types.DomainDescriptor{
+		Domain: "test_dimmer",
+		Commands: []types.ActionDescriptor{
+			{Action: "set_level", Fields: []types.FieldDescriptor{
+				{Name: "level", Type: "integer", Required: true, Min: floatPtr(0), Max: floatPtr(255)},
+			}},
+		},
+	})
+
+	if err := validateCommandPayload("test_dimmer", "set_level", json.RawMessage(`{"type":"set_level","level":128}`)); err != nil {
+		t.Fatalf("expected payload to be valid, got %v", err)
+	}
+	err := validateCommandPayload("test_dimmer", "set_level", json.RawMessage(`{"type":"set_level","level":300}`))
+	if code, ok := commandErrCode(err); !ok || code != CommandErrInvalidPayload {
+		t.Fatalf("expected invalid_payload error, got %v", err)
+	}
+
+	svc := CommandService()
+	defer svc.Close()
+	svc.resolver = &Resolver{lookup: fakeAddressLookup{"dimmer": {ID: "dimmer", PluginID: "plugin-x", DeviceID: "d", Domain: "test_dimmer"}}}
+	_, err = svc.SubmitWithOptions("plugin-x", "d", "dimmer", json.RawMessage(`{"type":"set_level"}`), commandOptions{})
+	if code, ok := commandErrCode(err); !ok || code != CommandErrInvalidPayload {
+		t.Fatalf("expected submit to reject the payload as invalid_payload, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// pluginLifecycleEntityType is the entity_type of the plugin lifecycle events
+// the gateway publishes on the entity events subject. Scripts subscribe with
+// "?domain=plugin" or "<plugin_id>.plugin.offline"; dynamic subscriptions
+// with an entity_query domain of "plugin" and an action such as "plugin.*".
+const pluginLifecycleEntityType = "plugin"
+
+// Plugin lifecycle event types. Status changes use "plugin." + the status.
+const (
+	PluginEventRegistered  = "plugin.registered"
+	PluginEventUpdated     = "plugin.updated"
+	PluginEventQuarantined = "plugin.quarantined"
+	PluginEventReleased    = "plugin.released"
+)
+
+// PluginLifecycleEvent describes a change in the plugin fleet: a first
+// registration, a re-registration that changed the manifest, a liveness
+// status change, or the plugin entering or leaving quarantine.
+type PluginLifecycleEvent struct {
+	Type     string        `json:"type" doc:"plugin.registered, plugin.updated, plugin.online, plugin.stale, plugin.offline, plugin.quarantined or plugin.released"`
+	PluginID string        `json:"plugin_id"`
+	Version  string        `json:"version,omitempty"`
+	Status   PluginStatus  `json:"status"`
+	Previous PluginStatus  `json:"previous,omitempty"`
+	LastSeen time.Time     `json:"last_seen"`
+	Diff     *ManifestDiff `json:"diff,omitempty" doc:"What a plugin.updated re-registration changed"`
+	Reasons  []string      `json:"reasons,omitempty" doc:"Why a plugin.quarantined plugin failed validation"`
+}
+
+// ManifestFieldChange is the old and new value of one changed field.
+type ManifestFieldChange struct {
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// ManifestDiff is what changed between two registrations of a plugin.
+type ManifestDiff struct {
+	Fields         map[string]ManifestFieldChange `json:"fields,omitempty" doc:"Changed manifest fields other than schemas, plus rpc_subject, keyed by JSON field name"`
+	SchemasAdded   []string                       `json:"schemas_added,omitempty"`
+	SchemasRemoved []string                       `json:"schemas_removed,omitempty"`
+	SchemasChanged []string                       `json:"schemas_changed,omitempty"`
+}
+
+// registrationManifest returns the raw "manifest" object of a registration
+// message, so fields the gateway does not model still take part in diffs.
+func registrationManifest(data []byte) json.RawMessage {
+	var probe struct {
+		Manifest json.RawMessage `json:"manifest"`
+	}
+	if json.Unmarshal(data, &probe) != nil {
+		return nil
+	}
+	return probe.Manifest
+}
+
+// recordManifest returns the raw manifest stored for rec, falling back to
+// the decoded one for records created without a registration message.
+func recordManifest(rec pluginRecord) json.RawMessage {
+	if len(rec.Manifest) > 0 {
+		return rec.Manifest
+	}
+	data, _ := json.Marshal(rec.Registration.Manifest)
+	return data
+}
+
+// diffRegistrations compares two registrations of the same plugin and returns
+// nil when nothing changed.
+func diffRegistrations(oldManifest json.RawMessage, oldSubject string, newManifest json.RawMessage, newSubject string) *ManifestDiff {
+	var before, after map[string]json.RawMessage
+	_ = json.Unmarshal(oldManifest, &before)
+	_ = json.Unmarshal(newManifest, &after)
+
+	diff := &ManifestDiff{Fields: map[string]ManifestFieldChange{}}
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	for k := range keys {
+		if k == "schemas" {
+			continue
+		}
+		if from, to := canonicalJSON(before[k]), canonicalJSON(after[k]); !bytes.Equal(from, to) {
+			diff.Fields[k] = ManifestFieldChange{From: from, To: to}
+		}
+	}
+	if oldSubject != newSubject {
+		from, _ := json.Marshal(oldSubject)
+		to, _ := json.Marshal(newSubject)
+		diff.Fields["rpc_subject"] = ManifestFieldChange{From: from, To: to}
+	}
+
+	oldSchemas, newSchemas := schemasByDomain(before["schemas"]), schemasByDomain(after["schemas"])
+	for domain, schema := range newSchemas {
+		prev, ok := oldSchemas[domain]
+		switch {
+		case !ok:
+			diff.SchemasAdded = append(diff.SchemasAdded, domain)
+		case !bytes.Equal(prev, schema):
+			diff.SchemasChanged = append(diff.SchemasChanged, domain)
+		}
+	}
+	for domain := range oldSchemas {
+		if _, ok := newSchemas[domain]; !ok {
+			diff.SchemasRemoved = append(diff.SchemasRemoved, domain)
+		}
+	}
+	sort.Strings(diff.SchemasAdded)
+	sort.Strings(diff.SchemasRemoved)
+	sort.Strings(diff.SchemasChanged)
+
+	if len(diff.Fields) == 0 && len(diff.SchemasAdded) == 0 && len(diff.SchemasRemoved) == 0 && len(diff.SchemasChanged) == 0 {
+		return nil
+	}
+	if len(diff.Fields) == 0 {
+		diff.Fields = nil
+	}
+	return diff
+}
+
+// schemasByDomain indexes a raw schemas array by domain, each schema in
+// canonical form.
+func schemasByDomain(raw json.RawMessage) map[string]json.RawMessage {
+	var list []json.RawMessage
+	_ = json.Unmarshal(raw, &list)
+	out := make(map[string]json.RawMessage, len(list))
+	for _, item := range list {
+		var probe types.DomainDescriptor
+		if json.Unmarshal(item, &probe) != nil {
+			continue
+		}
+		out[strings.ToLower(probe.Domain)] = canonicalJSON(item)
+	}
+	return out
+}
+
+// canonicalJSON re-encodes raw with sorted object keys so equal values
+// compare equal byte for byte. Missing or invalid input yields nil.
+func canonicalJSON(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	out, _ := json.Marshal(v)
+	return out
+}
+
+// publishPluginLifecycle logs ev, pushes it to SSE clients and publishes it
+// as an entity event owned by the gateway.
+func publishPluginLifecycle(ev PluginLifecycleEvent) {
+	level := slog.LevelInfo
+	if ev.Status != PluginOnline || ev.Type == PluginEventQuarantined {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "plugin lifecycle", "type", ev.Type, "plugin_id", ev.PluginID, "version", ev.Version, "status", ev.Status, "previous", ev.Previous, "reasons", ev.Reasons)
+	metrics.pluginLifecycleEvents.Inc(ev.Type)
+	if historyService != nil {
+		historyService.BroadcastPlugin(ev.PluginID, strings.TrimPrefix(ev.Type, "plugin."), string(ev.Status), ev)
+	}
+	if nc == nil {
+		return
+	}
+	payload, _ := json.Marshal(ev)
+	env := types.EntityEventEnvelope{
+		EventID:    nextID("evt"),
+		PluginID:   gatewayPluginID,
+		DeviceID:   pluginLifecycleEntityType,
+		EntityID:   ev.PluginID,
+		EntityType: pluginLifecycleEntityType,
+		Payload:    payload,
+		CreatedAt:  time.Now().UTC(),
+	}
+	data, _ := json.Marshal(env)
+	_ = nc.Publish(types.SubjectEntityEvents, data)
+}
+
+// pluginRegistered validates and records a registration message from a
+// plugin and returns the lifecycle events it causes: plugin.registered the
+// first time, plugin.updated when the manifest or RPC subject changed,
+// plugin.quarantined or plugin.released when validation starts or stops
+// failing, and plugin.online when a stale or offline plugin comes back. Only
+// plugins that pass validation have their domain schemas registered.
+func pluginRegistered(reg types.Registration, data []byte, now time.Time) []PluginLifecycleEvent {
+	pluginID := reg.Manifest.ID
+	manifest := registrationManifest(data)
+
+	regMu.Lock()
+	rec, known := registry[pluginID]
+	var diff *ManifestDiff
+	if known {
+		prevSubject := rec.Registration.RPCSubject
+		if seen, ok := rec.RPCSubjects[reg.RPCSubject]; ok && now.Sub(seen) <= pluginLiveness.StaleAfter {
+			// Two processes sharing an ID alternate subjects on every
+			// registration; that is reported as a quarantine, not an update.
+			prevSubject = reg.RPCSubject
+		}
+		diff = diffRegistrations(recordManifest(rec), prevSubject, manifest, reg.RPCSubject)
+	}
+	reasons := validateRegistrationLocked(pluginID, reg, manifest, rec, now)
+	wasQuarantined := rec.Quarantine
+	subjects := map[string]time.Time{reg.RPCSubject: now}
+	for subject, seen := range rec.RPCSubjects {
+		if subject != reg.RPCSubject && now.Sub(seen) <= pluginLiveness.StaleAfter {
+			subjects[subject] = seen
+		}
+	}
+	rec.RPCSubjects = subjects
+	rec.Registration = reg
+	rec.Manifest = manifest
+	rec.Timeouts = advertisedRPCTimeouts(data)
+	rec.Methods = advertisedRPCMethods(pluginID, manifest)
+	rec.Quarantine = reasons
+	rec.Valid = rec.routable()
+	registry[pluginID] = rec
+	regMu.Unlock()
+	pluginRPCDocs.sync(pluginID)
+
+	if len(reasons) == 0 {
+		for _, schema := range reg.Manifest.Schemas {
+			types.RegisterDomain(schema)
+		}
+	}
+
+	change, changed := pluginSeen(pluginID, now)
+	base := PluginLifecycleEvent{PluginID: pluginID, Version: reg.Manifest.Version, Status: PluginOnline, LastSeen: now.UTC()}
+	var events []PluginLifecycleEvent
+	if !known {
+		ev := base
+		ev.Type = PluginEventRegistered
+		events = append(events, ev)
+	} else {
+		if diff != nil {
+			ev := base
+			ev.Type = PluginEventUpdated
+			ev.Diff = diff
+			events = append(events, ev)
+		}
+		if changed {
+			events = append(events, change)
+		}
+	}
+	switch {
+	case len(reasons) > 0 && !sameReasons(reasons, wasQuarantined):
+		ev := base
+		ev.Type = PluginEventQuarantined
+		ev.Reasons = reasons
+		events = append(events, ev)
+	case len(reasons) == 0 && len(wasQuarantined) > 0:
+		ev := base
+		ev.Type = PluginEventReleased
+		events = append(events, ev)
+	}
+	return events
+}
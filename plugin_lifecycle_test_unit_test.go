@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func registrationMsg(t *testing.T, manifest string, subject string) (types.Registration, []byte) {
+	t.Helper()
+	data := []byte(`{"manifest":` + manifest + `,"rpc_subject":"` + subject + `"}`)
+	var reg types.Registration
+	if err := json.Unmarshal(data, &reg); err != nil {
+		t.Fatal(err)
+	}
+	return reg, data
+}
+
+func TestPluginRegistered_LifecycleEvents(t *testing.T) {
+	ResetGlobals()
+	defer ResetGlobals()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reg, data := registrationMsg(t, `{"id":"p","name":"P","version":"1.0.0","schemas":[{"domain":"light","commands":[{"action":"turn_on"}]},{"domain":"switch"}]}`, "slidebolt.rpc.p")
+	events := pluginRegistered(reg, data, now)
+	if len(events) != 1 || events[0].Type != PluginEventRegistered || events[0].Version != "1.0.0" {
+		t.Fatalf("expected plugin.registered, got %+v", events)
+	}
+
+	// The discovery probe makes plugins re-register constantly; an identical
+	// registration with keys in a different order is not an update.
+	reg, data = registrationMsg(t, `{"version":"1.0.0","name":"P","id":"p","schemas":[{"commands":[{"action":"turn_on"}],"domain":"light"},{"domain":"switch"}]}`, "slidebolt.rpc.p")
+	if events := pluginRegistered(reg, data, now.Add(time.Second)); len(events) != 0 {
+		t.Fatalf("expected no events for an unchanged re-registration, got %+v", events)
+	}
+
+	reg, data = registrationMsg(t, `{"id":"p","name":"P","version":"1.1.0","schemas":[{"domain":"light","commands":[{"action":"turn_on"},{"action":"turn_off"}]},{"domain":"cover"}]}`, "slidebolt.rpc.p2")
+	// Moving to a new RPC subject once the old one has gone quiet is an update,
+	// not a duplicate registration.
+	events = pluginRegistered(reg, data, now.Add(20*time.Second))
+	if len(events) != 1 || events[0].Type != PluginEventUpdated || events[0].Diff == nil {
+		t.Fatalf("expected plugin.updated with a diff, got %+v", events)
+	}
+	diff := events[0].Diff
+	if !reflect.DeepEqual(diff.SchemasAdded, []string{"cover"}) ||
+		!reflect.DeepEqual(diff.SchemasRemoved, []string{"switch"}) ||
+		!reflect.DeepEqual(diff.SchemasChanged, []string{"light"}) {
+		t.Fatalf("unexpected schema diff %+v", diff)
+	}
+	if got := diff.Fields["version"]; string(got.From) != `"1.0.0"` || string(got.To) != `"1.1.0"` {
+		t.Fatalf("unexpected version change %+v", got)
+	}
+	if got := diff.Fields["rpc_subject"]; string(got.To) != `"slidebolt.rpc.p2"` {
+		t.Fatalf("unexpected rpc_subject change %+v", got)
+	}
+	if _, ok := diff.Fields["name"]; ok {
+		t.Fatal("unchanged fields must not appear in the diff")
+	}
+
+	cfg := livenessConfig{StaleAfter: time.Second, OfflineAfter: 2 * time.Second, HealthInterval: time.Second}
+	sweepPluginLiveness(cfg, now.Add(time.Minute))
+	events = pluginRegistered(reg, data, now.Add(time.Minute))
+	if len(events) != 1 || events[0].Type != "plugin.online" || events[0].Previous != PluginOffline {
+		t.Fatalf("expected plugin.online after coming back, got %+v", events)
+	}
+}
+
+func TestPluginLifecycle_DynamicSubscriptionFilter(t *testing.T) {
+	payload, _ := json.Marshal(PluginLifecycleEvent{Type: "plugin.offline", PluginID: "p", Status: PluginOffline})
+	env := types.EntityEventEnvelope{PluginID: gatewayPluginID, EntityID: "p", EntityType: pluginLifecycleEntityType, Payload: payload}
+	svc := newDynamicEventService()
+	if !svc.matchesFilter(EventFilter{EntityQuery: types.SearchQuery{Domain: "plugin"}, Action: "plugin.*"}, env) {
+		t.Fatal("expected lifecycle event to match a plugin-domain subscription")
+	}
+	if svc.matchesFilter(EventFilter{EntityQuery: types.SearchQuery{Domain: "light"}}, env) {
+		t.Fatal("expected lifecycle event not to match other domains")
+	}
+}
+
+func TestPluginRegistered_Quarantine(t *testing.T) {
+	ResetGlobals()
+	defer ResetGlobals()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reg, data := registrationMsg(t, `{"id":"a","schemas":[{"domain":"sprinkler","commands":[{"action":"open"}]}]}`, "slidebolt.rpc.a")
+	pluginRegistered(reg, data, now)
+
+	// A second plugin redefining the same domain differently is quarantined.
+	reg, data = registrationMsg(t, `{"id":"b","schemas":[{"domain":"sprinkler","commands":[{"action":"close"}]}]}`, "slidebolt.rpc.b")
+	events := pluginRegistered(reg, data, now)
+	if len(events) != 2 || events[1].Type != PluginEventQuarantined || len(events[1].Reasons) != 1 {
+		t.Fatalf("expected b to be quarantined, got %+v", events)
+	}
+	resp := routeRPC("b", types.RPCMethodEntitiesList, nil)
+	if resp.Error == nil || resp.Error.Message != `plugin quarantined: schema for domain "sprinkler" conflicts with plugin "a"` {
+		t.Fatalf("expected quarantined plugin not to be routable, got %+v", resp.Error)
+	}
+	if got := gatewayPluginRegistration("b", registry["b"]); !got.Quarantined || registry["b"].Valid {
+		t.Fatalf("expected quarantine to be exposed, got %+v", got)
+	}
+
+	// Fixing the manifest releases it.
+	reg, data = registrationMsg(t, `{"id":"b","schemas":[{"domain":"sprinkler","commands":[{"action":"open"}]}]}`, "slidebolt.rpc.b")
+	events = pluginRegistered(reg, data, now.Add(time.Second))
+	if last := events[len(events)-1]; last.Type != PluginEventReleased {
+		t.Fatalf("expected b to be released, got %+v", events)
+	}
+
+	// An incompatible SDK major version is quarantined.
+	reg, data = registrationMsg(t, `{"id":"c","sdk_version":"v99.0.0"}`, "slidebolt.rpc.c")
+	if events := pluginRegistered(reg, data, now); len(events) != 2 || events[1].Type != PluginEventQuarantined {
+		t.Fatalf("expected c to be quarantined for its sdk_version, got %+v", events)
+	}
+
+	// Two live subjects claiming one ID are quarantined until one goes quiet.
+	reg, data = registrationMsg(t, `{"id":"a","schemas":[{"domain":"sprinkler","commands":[{"action":"open"}]}]}`, "slidebolt.rpc.a2")
+	events = pluginRegistered(reg, data, now.Add(time.Second))
+	if last := events[len(events)-1]; last.Type != PluginEventQuarantined {
+		t.Fatalf("expected duplicate ID to be quarantined, got %+v", events)
+	}
+	reg, data = registrationMsg(t, `{"id":"a","schemas":[{"domain":"sprinkler","commands":[{"action":"open"}]}]}`, "slidebolt.rpc.a")
+	if events := pluginRegistered(reg, data, now.Add(2*time.Second)); len(events) != 0 {
+		t.Fatalf("expected flapping subjects not to be reported as updates, got %+v", events)
+	}
+	reg, data = registrationMsg(t, `{"id":"a","schemas":[{"domain":"sprinkler","commands":[{"action":"open"}]}]}`, "slidebolt.rpc.a2")
+	events = pluginRegistered(reg, data, now.Add(time.Minute))
+	if last := events[len(events)-1]; last.Type != PluginEventReleased {
+		t.Fatalf("expected duplicate quarantine to lift once the other subject went quiet, got %+v", events)
+	}
+}
+
+func TestParseSDKMajor(t *testing.T) {
+	for in, want := range map[string]int{"v1.20.10": 1, "2.0": 2, "v0.9.1": 0} {
+		if got, ok := parseSDKMajor(in); !ok || got != want {
+			t.Errorf("parseSDKMajor(%q) = %d, %v", in, got, ok)
+		}
+	}
+	if _, ok := parseSDKMajor("latest"); ok {
+		t.Error("expected non-numeric versions to be rejected")
+	}
+}
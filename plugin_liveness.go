@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// PluginStatus is the gateway's view of whether a plugin is alive.
+type PluginStatus string
+
+const (
+	// PluginOnline: the plugin registered or answered a health check within
+	// the stale grace period.
+	PluginOnline PluginStatus = "online"
+	// PluginStale: the plugin has been quiet for longer than the stale grace
+	// period and is being health-checked.
+	PluginStale PluginStatus = "stale"
+	// PluginOffline: the plugin has been quiet for longer than the offline
+	// grace period. RPCs to it fail fast until it is seen again.
+	PluginOffline PluginStatus = "offline"
+)
+
+const (
+	defaultPluginStaleAfter     = 10 * time.Second
+	defaultPluginOfflineAfter   = 30 * time.Second
+	defaultPluginHealthInterval = 5 * time.Second
+)
+
+// livenessConfig controls when quiet plugins are marked stale or offline and
+// how often they are health-checked. Override with GATEWAY_PLUGIN_STALE_AFTER,
+// GATEWAY_PLUGIN_OFFLINE_AFTER and GATEWAY_PLUGIN_HEALTH_INTERVAL.
+type livenessConfig struct {
+	StaleAfter     time.Duration
+	OfflineAfter   time.Duration
+	HealthInterval time.Duration
+}
+
+func livenessConfigFromEnv() livenessConfig {
+	cfg := livenessConfig{
+		StaleAfter:     defaultPluginStaleAfter,
+		OfflineAfter:   defaultPluginOfflineAfter,
+		HealthInterval: defaultPluginHealthInterval,
+	}
+	for _, opt := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"GATEWAY_PLUGIN_STALE_AFTER", &cfg.StaleAfter},
+		{"GATEWAY_PLUGIN_OFFLINE_AFTER", &cfg.OfflineAfter},
+		{"GATEWAY_PLUGIN_HEALTH_INTERVAL", &cfg.HealthInterval},
+	} {
+		v := strings.TrimSpace(getenv(opt.env))
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			*opt.dst = d
+		} else {
+			slog.Warn("invalid "+opt.env+", using default", "value", v, "default", *opt.dst)
+		}
+	}
+	if cfg.OfflineAfter <= cfg.StaleAfter {
+		slog.Warn("GATEWAY_PLUGIN_OFFLINE_AFTER must exceed GATEWAY_PLUGIN_STALE_AFTER, using three times the stale grace",
+			"stale_after", cfg.StaleAfter, "offline_after", cfg.OfflineAfter)
+		cfg.OfflineAfter = 3 * cfg.StaleAfter
+	}
+	return cfg
+}
+
+// status returns the status of a plugin last seen at lastSeen.
+func (c livenessConfig) status(lastSeen, now time.Time) PluginStatus {
+	switch quiet := now.Sub(lastSeen); {
+	case quiet > c.OfflineAfter:
+		return PluginOffline
+	case quiet > c.StaleAfter:
+		return PluginStale
+	}
+	return PluginOnline
+}
+
+// pluginSeen records that pluginID registered or answered a health check at
+// now and returns the resulting status change, if any. Unknown plugins are
+// ignored.
+func pluginSeen(pluginID string, now time.Time) (PluginLifecycleEvent, bool) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	rec, ok := registry[pluginID]
+	if !ok {
+		return PluginLifecycleEvent{}, false
+	}
+	rec.LastSeen = now
+	change, changed := setPluginStatusLocked(pluginID, &rec, PluginOnline, now)
+	registry[pluginID] = rec
+	return change, changed
+}
+
+func setPluginStatusLocked(pluginID string, rec *pluginRecord, status PluginStatus, now time.Time) (PluginLifecycleEvent, bool) {
+	if rec.Status == status {
+		return PluginLifecycleEvent{}, false
+	}
+	change := PluginLifecycleEvent{
+		Type:     "plugin." + string(status),
+		PluginID: pluginID,
+		Version:  rec.Registration.Manifest.Version,
+		Status:   status,
+		Previous: rec.Status,
+		LastSeen: rec.LastSeen.UTC(),
+	}
+	rec.Status = status
+	rec.StatusSince = now
+	rec.Valid = rec.routable()
+	return change, true
+}
+
+// sweepPluginLiveness re-evaluates every plugin's status at now, returning
+// the status changes and the plugins that are due a health check.
+func sweepPluginLiveness(cfg livenessConfig, now time.Time) (changes []PluginLifecycleEvent, check []string) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	for id, rec := range registry {
+		if rec.LastSeen.IsZero() {
+			continue
+		}
+		status := cfg.status(rec.LastSeen, now)
+		if change, ok := setPluginStatusLocked(id, &rec, status, now); ok {
+			changes = append(changes, change)
+			registry[id] = rec
+		}
+		if status != PluginOnline {
+			check = append(check, id)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].PluginID < changes[j].PluginID })
+	sort.Strings(check)
+	return changes, check
+}
+
+// startPluginLivenessChecker periodically marks quiet plugins stale or
+// offline and health-checks them; a plugin that answers is online again.
+func startPluginLivenessChecker(ctx context.Context, cfg livenessConfig) {
+	go func() {
+		ticker := time.NewTicker(cfg.HealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			changes, check := sweepPluginLiveness(cfg, time.Now())
+			for _, change := range changes {
+				publishPluginLifecycle(change)
+			}
+			for _, pluginID := range check {
+				if !pingPlugin(ctx, pluginID, defaultRPCTimeout) {
+					continue
+				}
+				if change, ok := pluginSeen(pluginID, time.Now()); ok {
+					publishPluginLifecycle(change)
+				}
+			}
+		}
+	}()
+}
+
+// pingPlugin sends a health check straight to pluginID's RPC subject,
+// bypassing the offline fast-fail and circuit breaker in routeRPCContext, and
+// reports whether the plugin answered.
+func pingPlugin(ctx context.Context, pluginID string, timeout time.Duration) bool {
+	regMu.RLock()
+	rec, ok := registry[pluginID]
+	regMu.RUnlock()
+	if !ok || nc == nil {
+		return false
+	}
+	id := json.RawMessage(strconv.FormatUint(rpcRequestSeq.Add(1), 10))
+	req := types.Request{JSONRPC: types.JSONRPCVersion, ID: &id, Method: types.RPCMethodHealthCheck}
+	data, _ := json.Marshal(req)
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	msg, err := nc.RequestWithContext(rctx, rec.Registration.RPCSubject, data)
+	if err != nil {
+		return false
+	}
+	var resp types.Response
+	return json.Unmarshal(msg.Data, &resp) == nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+func TestPluginLiveness_StaleOfflineOnline(t *testing.T) {
+	ResetGlobals()
+	defer ResetGlobals()
+	cfg := livenessConfig{StaleAfter: 10 * time.Second, OfflineAfter: 30 * time.Second, HealthInterval: time.Second}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	regMu.Lock()
+	registry["p"] = pluginRecord{Registration: types.Registration{Manifest: types.Manifest{ID: "p"}, RPCSubject: "slidebolt.rpc.p"}}
+	regMu.Unlock()
+	change, ok := pluginSeen("p", start)
+	if !ok || change.Status != PluginOnline || change.Previous != "" || change.Type != "plugin.online" {
+		t.Fatalf("expected first sighting to go online, got %+v ok=%v", change, ok)
+	}
+	if _, ok := pluginSeen("p", start.Add(time.Second)); ok {
+		t.Fatal("expected no change while already online")
+	}
+
+	if changes, check := sweepPluginLiveness(cfg, start.Add(5*time.Second)); len(changes) != 0 || len(check) != 0 {
+		t.Fatalf("expected nothing within the stale grace, got %+v %v", changes, check)
+	}
+	changes, check := sweepPluginLiveness(cfg, start.Add(15*time.Second))
+	if len(changes) != 1 || changes[0].Status != PluginStale || len(check) != 1 {
+		t.Fatalf("expected stale and a health check, got %+v %v", changes, check)
+	}
+	changes, _ = sweepPluginLiveness(cfg, start.Add(40*time.Second))
+	if len(changes) != 1 || changes[0].Status != PluginOffline || changes[0].Previous != PluginStale {
+		t.Fatalf("expected offline, got %+v", changes)
+	}
+	regMu.RLock()
+	rec := registry["p"]
+	regMu.RUnlock()
+	if rec.Valid {
+		t.Fatal("expected offline plugin to be excluded from plugin search")
+	}
+
+	resp := routeRPC("p", types.RPCMethodEntitiesList, nil)
+	if resp.Error == nil || resp.Error.Message != "plugin offline" {
+		t.Fatalf("expected offline plugin to fail fast, got %+v", resp.Error)
+	}
+
+	change, ok = pluginSeen("p", start.Add(41*time.Second))
+	if !ok || change.Status != PluginOnline || change.Previous != PluginOffline {
+		t.Fatalf("expected plugin to come back online, got %+v ok=%v", change, ok)
+	}
+	got := gatewayPluginRegistration("p", registry["p"])
+	if got.Status != PluginOnline || got.LastSeen == nil || !got.LastSeen.Equal(start.Add(41*time.Second)) {
+		t.Fatalf("unexpected plugin listing %+v", got)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// PluginRPCMethod is an extra RPC method a plugin advertises under
+// "rpc_methods" in its manifest. Advertised methods can be called through
+// POST /api/plugins/{plugin_id}/rpc/{method}, and each gets its own operation
+// in the OpenAPI spec and so its own MCP tool.
+type PluginRPCMethod struct {
+	Name        string          `json:"name" doc:"JSON-RPC method name, e.g. zones/rescan"`
+	Summary     string          `json:"summary,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Params      json.RawMessage `json:"params,omitempty" doc:"JSON Schema the request params must match"`
+	Result      json.RawMessage `json:"result,omitempty" doc:"JSON Schema of the method's result, for documentation only"`
+}
+
+// pluginRPCMethod is an advertised method with its schemas decoded.
+type pluginRPCMethod struct {
+	PluginRPCMethod
+	params *huma.Schema
+	result *huma.Schema
+}
+
+// reservedRPCNamespaces are the method namespaces the gateway fronts with its
+// own routes. Plugins may not advertise methods in them, so the passthrough
+// cannot bypass command tracking, policies or script storage.
+var reservedRPCNamespaces = []string{"commands/", "devices/", "entities/", "logging/", "plugin/", "scripts/", "storage/"}
+
+var rpcMethodNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*(/[A-Za-z0-9_][A-Za-z0-9_.-]*)*$`)
+
+const maxRPCMethodNameLen = 128
+
+func validateRPCMethodName(name string) error {
+	if len(name) > maxRPCMethodNameLen || !rpcMethodNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return errors.New("invalid method name")
+	}
+	for _, ns := range reservedRPCNamespaces {
+		if strings.HasPrefix(name, ns) {
+			return fmt.Errorf("the %s namespace is reserved for the gateway", strings.TrimSuffix(ns, "/"))
+		}
+	}
+	return nil
+}
+
+// advertisedRPCMethods reads the optional "rpc_methods" list from a raw
+// manifest. Entries with an invalid name or schema are logged and skipped;
+// a repeated name keeps its first entry.
+func advertisedRPCMethods(pluginID string, manifest json.RawMessage) map[string]pluginRPCMethod {
+	var probe struct {
+		RPCMethods []PluginRPCMethod `json:"rpc_methods"`
+	}
+	if json.Unmarshal(manifest, &probe) != nil || len(probe.RPCMethods) == 0 {
+		return nil
+	}
+	out := make(map[string]pluginRPCMethod, len(probe.RPCMethods))
+	for _, m := range probe.RPCMethods {
+		if _, dup := out[m.Name]; dup {
+			continue
+		}
+		if err := validateRPCMethodName(m.Name); err != nil {
+			slog.Warn("ignoring advertised rpc method", "plugin_id", pluginID, "method", m.Name, "error", err)
+			continue
+		}
+		method := pluginRPCMethod{PluginRPCMethod: m}
+		var err error
+		if method.params, err = decodeJSONSchema(m.Params); err == nil {
+			method.result, err = decodeJSONSchema(m.Result)
+		}
+		if err != nil {
+			slog.Warn("ignoring advertised rpc method", "plugin_id", pluginID, "method", m.Name, "error", err)
+			continue
+		}
+		out[m.Name] = method
+	}
+	return out
+}
+
+// decodeJSONSchema decodes a JSON Schema into huma's model and prepares it
+// for validation. $ref is not supported. A missing schema yields nil.
+func decodeJSONSchema(raw json.RawMessage) (*huma.Schema, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var s huma.Schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := precomputeSchema(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// precomputeSchema calls PrecomputeMessages on s and every nested schema,
+// which huma needs before Validate. Patterns are checked first because
+// PrecomputeMessages panics on one that does not compile.
+func precomputeSchema(s *huma.Schema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("invalid schema pattern %q: %w", s.Pattern, err)
+		}
+	}
+	s.PrecomputeMessages()
+	nested := []*huma.Schema{s.Items, s.Not}
+	for _, p := range s.Properties {
+		nested = append(nested, p)
+	}
+	nested = append(nested, s.OneOf...)
+	nested = append(nested, s.AnyOf...)
+	nested = append(nested, s.AllOf...)
+	for _, n := range nested {
+		if err := precomputeSchema(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateParams checks params against the method's params schema.
+func (m pluginRPCMethod) validateParams(params any) []PayloadFieldError {
+	if m.params == nil {
+		return nil
+	}
+	res := &huma.ValidateResult{}
+	registry := huma.NewMapRegistry("#/components/schemas/", huma.DefaultSchemaNamer)
+	huma.Validate(registry, m.params, huma.NewPathBuffer([]byte("params"), len("params")), huma.ModeWriteToServer, params, res)
+	var details []PayloadFieldError
+	for _, err := range res.Errors {
+		field, msg := "params", err.Error()
+		var detail *huma.ErrorDetail
+		if errors.As(err, &detail) {
+			field, msg = detail.Location, detail.Message
+		}
+		details = append(details, PayloadFieldError{Field: field, Message: msg})
+	}
+	return details
+}
+
+// rpcMethodWatcher is told when plugin RPC operations are added to or
+// withdrawn from the OpenAPI spec; the MCP bridge implements it.
+type rpcMethodWatcher interface {
+	AddOperation(method, path string, op *huma.Operation)
+	RemoveTools(names ...string)
+}
+
+// rpcMethodDocs keeps one OpenAPI operation per advertised plugin RPC method
+// in step with the registry. huma caches the spec it serves, so the spec
+// routes are answered by serveSpec instead, under the same lock that guards
+// changes to the spec.
+type rpcMethodDocs struct {
+	mu      sync.Mutex
+	api     huma.API
+	watcher rpcMethodWatcher
+	plugins map[string]rpcMethodDocsEntry
+}
+
+type rpcMethodDocsEntry struct {
+	fingerprint string
+	ops         []*huma.Operation
+}
+
+func newRPCMethodDocs() *rpcMethodDocs {
+	return &rpcMethodDocs{plugins: make(map[string]rpcMethodDocsEntry)}
+}
+
+var pluginRPCDocs = newRPCMethodDocs()
+
+// attach starts documenting plugin RPC methods in api, beginning with the
+// plugins already registered.
+func (d *rpcMethodDocs) attach(api huma.API) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.api = api
+	d.watcher = nil
+	d.plugins = make(map[string]rpcMethodDocsEntry)
+	regMu.RLock()
+	ids := make([]string, 0, len(registry))
+	for id := range registry {
+		ids = append(ids, id)
+	}
+	regMu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		d.syncLocked(id)
+	}
+}
+
+// watch builds a watcher under the docs lock, so it sees every operation
+// already in the spec, and then tells it about every later change.
+func (d *rpcMethodDocs) watch(build func() rpcMethodWatcher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watcher = build()
+}
+
+// sync brings pluginID's operations in line with the methods its last
+// registration advertised.
+func (d *rpcMethodDocs) sync(pluginID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.syncLocked(pluginID)
+}
+
+func (d *rpcMethodDocs) syncLocked(pluginID string) {
+	if d.api == nil {
+		return
+	}
+	regMu.RLock()
+	methods := registry[pluginID].Methods
+	regMu.RUnlock()
+
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fp, _ := json.Marshal(sortedRPCMethods(methods, names))
+	prev := d.plugins[pluginID]
+	if string(fp) == prev.fingerprint {
+		return
+	}
+
+	oapi := d.api.OpenAPI()
+	var removed []string
+	for _, op := range prev.ops {
+		delete(oapi.Paths, op.Path)
+		removed = append(removed, op.OperationID)
+	}
+	if d.watcher != nil && len(removed) > 0 {
+		d.watcher.RemoveTools(removed...)
+	}
+
+	entry := rpcMethodDocsEntry{fingerprint: string(fp)}
+	for _, name := range names {
+		op := pluginRPCOperation(pluginID, methods[name])
+		if d.operationIDTaken(op.OperationID) {
+			slog.Warn("not documenting rpc method, operation ID already in use", "plugin_id", pluginID, "method", name, "operation_id", op.OperationID)
+			continue
+		}
+		oapi.AddOperation(op)
+		entry.ops = append(entry.ops, op)
+		if d.watcher != nil {
+			d.watcher.AddOperation(op.Method, op.Path, op)
+		}
+	}
+	if len(entry.ops) == 0 && len(methods) == 0 {
+		delete(d.plugins, pluginID)
+		return
+	}
+	d.plugins[pluginID] = entry
+}
+
+func (d *rpcMethodDocs) operationIDTaken(id string) bool {
+	for _, item := range d.api.OpenAPI().Paths {
+		for _, op := range []*huma.Operation{item.Get, item.Post, item.Put, item.Patch, item.Delete} {
+			if op != nil && op.OperationID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedRPCMethods(methods map[string]pluginRPCMethod, names []string) []PluginRPCMethod {
+	out := make([]PluginRPCMethod, 0, len(names))
+	for _, name := range names {
+		out = append(out, methods[name].PluginRPCMethod)
+	}
+	return out
+}
+
+var operationIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// pluginRPCOperation documents one advertised method at its concrete path.
+func pluginRPCOperation(pluginID string, m pluginRPCMethod) *huma.Operation {
+	summary := m.Summary
+	if summary == "" {
+		summary = fmt.Sprintf("Call %s on plugin %s", m.Name, pluginID)
+	}
+	desc := m.Description
+	if desc != "" {
+		desc += "\n\n"
+	}
+	desc += fmt.Sprintf("Advertised by plugin %q. The request body is sent as the JSON-RPC params of %q and the plugin's result is returned as is.", pluginID, m.Name)
+
+	params := m.params
+	if params == nil {
+		params = &huma.Schema{Type: huma.TypeObject}
+	}
+	ok := &huma.Response{Description: "The plugin's result"}
+	if m.result != nil {
+		ok.Content = map[string]*huma.MediaType{"application/json": {Schema: m.result}}
+	}
+	return &huma.Operation{
+		OperationID: "plugin-rpc-" + strings.Trim(operationIDUnsafe.ReplaceAllString(pluginID+"-"+m.Name, "-"), "-"),
+		Method:      http.MethodPost,
+		Path:        "/api/plugins/" + pluginID + "/rpc/" + m.Name,
+		Summary:     summary,
+		Description: desc,
+		Tags:        []string{"Plugin RPC"},
+		RequestBody: &huma.RequestBody{
+			Content: map[string]*huma.MediaType{"application/json": {Schema: params}},
+		},
+		Responses: map[string]*huma.Response{"200": ok},
+	}
+}
+
+// serveSpec answers the OpenAPI spec routes from the live spec rather than
+// huma's copy, which is frozen on first request.
+func (d *rpcMethodDocs) serveSpec(c *gin.Context) {
+	if c.Request.Method != http.MethodGet {
+		return
+	}
+	var render func(*huma.OpenAPI) ([]byte, error)
+	contentType := "application/openapi+json"
+	switch c.Request.URL.Path {
+	case "/openapi.json":
+		render = func(o *huma.OpenAPI) ([]byte, error) { return json.Marshal(o) }
+	case "/openapi-3.0.json":
+		render = (*huma.OpenAPI).Downgrade
+	case "/openapi.yaml":
+		render, contentType = (*huma.OpenAPI).YAML, "application/openapi+yaml"
+	case "/openapi-3.0.yaml":
+		render, contentType = (*huma.OpenAPI).DowngradeYAML, "application/openapi+yaml"
+	default:
+		return
+	}
+	d.mu.Lock()
+	api := d.api
+	var data []byte
+	var err error
+	if api != nil {
+		data, err = render(api.OpenAPI())
+	}
+	d.mu.Unlock()
+	if api == nil {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &apiError{status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+	c.Abort()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+const zonesManifest = `{"id":"irrigation","rpc_methods":[
+	{"name":"zones/rescan","summary":"Rescan zones","params":{"type":"object","properties":{"zone":{"type":"integer","minimum":1}},"required":["zone"]}},
+	{"name":"entities/delete"},
+	{"name":"../escape"},
+	{"name":"bad/pattern","params":{"type":"string","pattern":"("}}
+]}`
+
+type recordingWatcher struct {
+	added, removed []string
+}
+
+func (w *recordingWatcher) AddOperation(method, path string, op *huma.Operation) {
+	w.added = append(w.added, op.OperationID)
+}
+
+func (w *recordingWatcher) RemoveTools(names ...string) {
+	w.removed = append(w.removed, names...)
+}
+
+func TestAdvertisedRPCMethods(t *testing.T) {
+	methods := advertisedRPCMethods("irrigation", []byte(zonesManifest))
+	if len(methods) != 1 {
+		t.Fatalf("expected only zones/rescan to be accepted, got %v", methods)
+	}
+	m, ok := methods["zones/rescan"]
+	if !ok || m.params == nil {
+		t.Fatalf("expected zones/rescan with a params schema, got %+v", methods)
+	}
+	if details := m.validateParams(map[string]any{"zone": 2.0}); len(details) != 0 {
+		t.Fatalf("expected valid params, got %+v", details)
+	}
+	details := m.validateParams(map[string]any{"zone": 0.0})
+	if len(details) != 1 || details[0].Field != "params.zone" {
+		t.Fatalf("expected a minimum violation on params.zone, got %+v", details)
+	}
+	if details := m.validateParams(map[string]any{}); len(details) != 1 {
+		t.Fatalf("expected a missing required property, got %+v", details)
+	}
+}
+
+func TestCallPluginRPC_Guards(t *testing.T) {
+	ResetGlobals()
+	defer ResetGlobals()
+	reg, data := registrationMsg(t, zonesManifest, "slidebolt.rpc.irrigation")
+	pluginRegistered(reg, data, time.Now())
+
+	var apiErr *apiError
+	if _, err := callPluginRPC(context.Background(), "missing", "zones/rescan", nil); !errors.As(err, &apiErr) || apiErr.status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown plugin, got %v", err)
+	}
+	if _, err := callPluginRPC(context.Background(), "irrigation", "entities/delete", nil); !errors.As(err, &apiErr) || apiErr.status != http.StatusNotFound {
+		t.Fatalf("expected 404 for a reserved method, got %v", err)
+	}
+	_, err := callPluginRPC(context.Background(), "irrigation", "zones/rescan", []byte(`{"zone":"north"}`))
+	if !errors.As(err, &apiErr) || apiErr.status != http.StatusBadRequest || len(apiErr.Details) != 1 {
+		t.Fatalf("expected 400 with details for invalid params, got %v", err)
+	}
+}
+
+func TestPluginRPCDocs_FollowRegistrations(t *testing.T) {
+	ResetGlobals()
+	defer ResetGlobals()
+	router, api := buildRouter()
+	watcher := &recordingWatcher{}
+	pluginRPCDocs.watch(func() rpcMethodWatcher { return watcher })
+
+	reg, data := registrationMsg(t, zonesManifest, "slidebolt.rpc.irrigation")
+	pluginRegistered(reg, data, time.Now())
+	path := "/api/plugins/irrigation/rpc/zones/rescan"
+	if item := api.OpenAPI().Paths[path]; item == nil || item.Post == nil || item.Post.OperationID != "plugin-rpc-irrigation-zones-rescan" {
+		t.Fatalf("expected an operation for zones/rescan, got %+v", item)
+	}
+	if len(watcher.added) != 1 {
+		t.Fatalf("expected the watcher to get one tool, got %v", watcher.added)
+	}
+
+	// Re-registering unchanged must not churn tools.
+	pluginRegistered(reg, data, time.Now())
+	if len(watcher.added) != 1 || len(watcher.removed) != 0 {
+		t.Fatalf("expected no changes, got added=%v removed=%v", watcher.added, watcher.removed)
+	}
+
+	// The served spec follows the registry even after it was first fetched.
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if !strings.Contains(rec.Body.String(), path) {
+		t.Fatalf("expected the spec to document %s", path)
+	}
+	reg, data = registrationMsg(t, `{"id":"irrigation"}`, "slidebolt.rpc.irrigation")
+	pluginRegistered(reg, data, time.Now())
+	if _, ok := api.OpenAPI().Paths[path]; ok {
+		t.Fatal("expected the operation to be withdrawn")
+	}
+	if len(watcher.removed) != 1 || watcher.removed[0] != "plugin-rpc-irrigation-zones-rescan" {
+		t.Fatalf("expected the tool to be removed, got %v", watcher.removed)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if strings.Contains(rec.Body.String(), path) {
+		t.Fatal("expected the served spec to drop the withdrawn operation")
+	}
+}
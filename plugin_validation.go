@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slidebolt/sdk-types"
+)
+
+// sdkModulePath is the module whose version plugins declare as "sdk_version"
+// in their manifest.
+const sdkModulePath = "github.com/slidebolt/sdk-types"
+
+// defaultSDKMajor is assumed when the gateway binary carries no build info.
+const defaultSDKMajor = 1
+
+// gatewaySDKMajor is the major version of the SDK the gateway was built with.
+// Plugins declaring another major version are quarantined.
+var gatewaySDKMajor = sdkMajorFromBuildInfo()
+
+func sdkMajorFromBuildInfo() int {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return defaultSDKMajor
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != sdkModulePath {
+			continue
+		}
+		if major, ok := parseSDKMajor(dep.Version); ok {
+			return major
+		}
+	}
+	return defaultSDKMajor
+}
+
+// parseSDKMajor returns the major version of a semantic version such as
+// "v1.20.10" or "1.4".
+func parseSDKMajor(v string) (int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	major, _, _ := strings.Cut(v, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// validateRegistrationLocked checks a registration from pluginID against the
+// rest of the fleet and returns the reasons to quarantine it, if any. It must
+// be called with regMu held and before rec is updated with reg.
+func validateRegistrationLocked(pluginID string, reg types.Registration, manifest json.RawMessage, rec pluginRecord, now time.Time) []string {
+	var reasons []string
+
+	// Two live processes registering under one ID would have their RPCs
+	// answered by whichever subject registered last.
+	live := []string{strconv.Quote(reg.RPCSubject)}
+	for subject, seen := range rec.RPCSubjects {
+		if subject != reg.RPCSubject && now.Sub(seen) <= pluginLiveness.StaleAfter {
+			live = append(live, strconv.Quote(subject))
+		}
+	}
+	if len(live) > 1 {
+		sort.Strings(live)
+		reasons = append(reasons, "duplicate plugin ID: registered from RPC subjects "+strings.Join(live, ", "))
+	}
+
+	var probe struct {
+		SDKVersion string `json:"sdk_version"`
+	}
+	_ = json.Unmarshal(manifest, &probe)
+	if probe.SDKVersion != "" {
+		major, ok := parseSDKMajor(probe.SDKVersion)
+		switch {
+		case !ok:
+			reasons = append(reasons, fmt.Sprintf("unparseable sdk_version %q", probe.SDKVersion))
+		case major != gatewaySDKMajor:
+			reasons = append(reasons, fmt.Sprintf("sdk_version %s is incompatible with the gateway's SDK major version %d", probe.SDKVersion, gatewaySDKMajor))
+		}
+	}
+
+	core := make(map[string]types.DomainDescriptor)
+	for _, d := range types.CoreDomains() {
+		core[strings.ToLower(d.Domain)] = d
+	}
+	for _, schema := range reg.Manifest.Schemas {
+		domain := strings.ToLower(schema.Domain)
+		if d, ok := core[domain]; ok {
+			if !sameDomainDescriptor(d, schema) {
+				reasons = append(reasons, fmt.Sprintf("schema for core domain %q differs from the built-in descriptor", schema.Domain))
+			}
+			continue
+		}
+		for otherID, other := range registry {
+			if otherID == pluginID || !other.routable() {
+				continue
+			}
+			for _, theirs := range other.Registration.Manifest.Schemas {
+				if strings.EqualFold(theirs.Domain, schema.Domain) && !sameDomainDescriptor(theirs, schema) {
+					reasons = append(reasons, fmt.Sprintf("schema for domain %q conflicts with plugin %q", schema.Domain, otherID))
+				}
+			}
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// sameDomainDescriptor compares two descriptors regardless of the order of
+// their commands and events.
+func sameDomainDescriptor(a, b types.DomainDescriptor) bool {
+	return strings.EqualFold(a.Domain, b.Domain) &&
+		string(canonicalActions(a.Commands)) == string(canonicalActions(b.Commands)) &&
+		string(canonicalActions(a.Events)) == string(canonicalActions(b.Events))
+}
+
+func canonicalActions(actions []types.ActionDescriptor) []byte {
+	out := make([]string, 0, len(actions))
+	for _, a := range actions {
+		data, _ := json.Marshal(a)
+		out = append(out, string(canonicalJSON(data)))
+	}
+	sort.Strings(out)
+	data, _ := json.Marshal(out)
+	return data
+}
+
+func sameReasons(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
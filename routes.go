@@ -7,9 +7,13 @@ import (
 )
 
 // apiError serialises as {"error":"message"} and satisfies huma.StatusError.
+// Validation failures also carry per-field details, and policy denials the ID
+// of the command recorded as denied.
 type apiError struct {
-	status  int
-	Message string `json:"error"`
+	status    int
+	Message   string              `json:"error"`
+	Details   []PayloadFieldError `json:"details,omitempty"`
+	CommandID string              `json:"command_id,omitempty"`
 }
 
 func (e *apiError) Error() string  { return e.Message }
@@ -20,6 +24,12 @@ func badReqErr(msg string) error   { return &apiError{status: http.StatusBadRequ
 func notFoundErr(msg string) error { return &apiError{status: http.StatusNotFound, Message: msg} }
 func conflictErr(msg string) error { return &apiError{status: http.StatusConflict, Message: msg} }
 func timeoutErr(msg string) error  { return &apiError{status: http.StatusGatewayTimeout, Message: msg} }
+func validationErr(msg string, details []PayloadFieldError) error {
+	return &apiError{status: http.StatusBadRequest, Message: msg, Details: details}
+}
+func policyDeniedErr(msg, commandID string) error {
+	return &apiError{status: http.StatusForbidden, Message: msg, CommandID: commandID}
+}
 func upstreamErr(msg string) error {
 	return &apiError{status: http.StatusServiceUnavailable, Message: msg}
 }
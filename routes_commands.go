@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/slidebolt/sdk-types"
@@ -14,12 +16,66 @@ import (
 // --- Command types ---
 
 type SendCommandInput struct {
-	PluginID string         `path:"plugin_id" doc:"Plugin ID"`
-	DeviceID string         `path:"device_id" doc:"Device ID"`
-	EntityID string         `path:"entity_id" doc:"Entity ID"`
-	Body     map[string]any `doc:"Domain-specific command payload. Must include a 'type' field (e.g. {\"type\":\"turn_on\"})."`
+	PluginID       string         `path:"plugin_id" doc:"Plugin ID"`
+	DeviceID       string         `path:"device_id" doc:"Device ID"`
+	EntityID       string         `path:"entity_id" doc:"Entity ID"`
+	Wait           string         `query:"wait" doc:"Go duration (e.g. \"5s\", at most 60s). When set, block until the command finishes or the duration elapses instead of returning immediately."`
+	Confirm        bool           `query:"confirm" doc:"With wait, also wait for an entity event confirming the new state after the command succeeds."`
+	DryRun         bool           `query:"dry_run" doc:"Resolve the command, including group fan-out, policy rules and payload validation, and return the resolution tree without dispatching anything."`
+	IdempotencyKey string         `header:"Idempotency-Key" doc:"Client-chosen key. Repeating a request with the same key within the idempotency window returns the original command instead of dispatching it again."`
+	Body           map[string]any `doc:"Domain-specific command payload. Must include a 'type' field (e.g. {\"type\":\"turn_on\"}). Optional gateway-only fields, not forwarded to the plugin: 'retry_policy' overrides the retry policy for this command; 'priority' selects the dispatch lane (user, script or bulk; default user); 'coalesce': true lets a later coalescing command of the same type for this entity replace this one while it is still queued; 'execute_at' (RFC 3339) or 'delay' (Go duration, e.g. \"10m\") schedules the command instead of dispatching it now."`
+
+	headers map[string]string
+}
+
+func (i *SendCommandInput) Resolve(ctx huma.Context) []error {
+	i.headers = policyHeaders(ctx.Header)
+	return nil
+}
+
+type CommandStatusOutput struct{ Body GatewayCommandStatus }
+
+type SendCommandOutput struct {
+	Status   int
+	Replayed string `header:"Idempotent-Replayed" doc:"\"true\" when the response is for an earlier request with the same Idempotency-Key"`
+	Body     CommandWaitResult
+}
+
+type RetryPoliciesOutput struct{ Body RetryPolicies }
+
+type SetRetryPoliciesInput struct {
+	Body RetryPolicies
+}
+
+type CommandPoliciesOutput struct{ Body CommandPolicies }
+
+type SetCommandPoliciesInput struct {
+	Body CommandPolicies
+}
+
+type CommandPolicyRuleInput struct {
+	RuleID string `path:"rule_id" doc:"Policy rule ID"`
+}
+
+type PutCommandPolicyInput struct {
+	RuleID string `path:"rule_id" doc:"Policy rule ID"`
+	Body   CommandPolicyRule
+}
+
+type CancelCommandInput struct {
+	PluginID  string `path:"plugin_id" doc:"Plugin ID"`
+	CommandID string `path:"command_id" doc:"Command ID returned by the send-command endpoint"`
+}
+
+type CommandStatusTreeOutput struct{ Body CommandStatusTree }
+
+type CommandQueuesOutput struct{ Body []CommandQueueStats }
+
+type ScheduledCommandsOutput struct{ Body []ScheduledCommand }
+
+type CancelScheduledCommandInput struct {
+	CommandID string `path:"command_id" doc:"ID of the scheduled command"`
 }
-type CommandStatusOutput struct{ Body types.CommandStatus }
 
 type GetCommandStatusInput struct {
 	PluginID  string `path:"plugin_id" doc:"Plugin ID"`
@@ -32,36 +88,74 @@ func registerCommandRoutes(api huma.API) {
 		Method:        http.MethodPost,
 		Path:          "/api/plugins/{plugin_id}/devices/{device_id}/entities/{entity_id}/commands",
 		Summary:       "Send command",
-		Description:   "Sends a domain-specific command to an entity. Returns CommandStatus with state=pending; poll get-command-status for completion.",
+		Description:   "Sends a domain-specific command to an entity. Returns CommandStatus with state=pending; poll get-command-status for completion. With ?wait=<duration> the request blocks until the command finishes and returns 200 with outcome=completed, or 202 with outcome=timeout if it is still running. Adding &confirm=true also waits for an entity event reporting the new state (e.g. on=true after turn_on): outcome=confirmed carries that state in confirmed_state, outcome=unconfirmed means the device acknowledged the command but never reported the change. With an Idempotency-Key header, a repeated request within the idempotency window returns the original command (with Idempotent-Replayed: true) instead of dispatching again; reusing a key for a different request returns 409. With ?dry_run=true nothing is dispatched; the response carries the resolution tree (every leaf, entities skipped for an unsupported action, by command_filter or as gateway-owned, cycles cut, policy decisions and payload errors) in explanation. Command policy rules are applied before dispatch: a denied command returns 403 with its command_id and is recorded as failed, and a transformed command is dispatched with the rewritten payload; either way the decision is recorded in the status's policy field. The request's correlation ID (X-Correlation-ID, else the traceparent trace ID, else a generated one; echoed in the X-Correlation-ID response header) is recorded in the status's correlation_id and carried to fan-out children and script reactions; see get-correlation-chain. Returns 400 with per-field details when the payload does not match the entity domain's command schema, and 503 when the plugin's dispatch queue is full.",
 		Tags:          []string{"commands"},
 		DefaultStatus: http.StatusAccepted,
-	}, func(ctx context.Context, input *SendCommandInput) (*CommandStatusOutput, error) {
+	}, func(ctx context.Context, input *SendCommandInput) (*SendCommandOutput, error) {
 		pluginID, deviceID, entityID := input.PluginID, input.DeviceID, input.EntityID
+		fingerprint := idempotencyFingerprint(pluginID, deviceID, entityID, input.Body)
+		opts, err := extractCommandOptions(input.Body)
+		if err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		opts.Headers = input.headers
+		opts.CorrelationID = correlationIDFrom(ctx)
+		wait, err := parseCommandWait(input.Wait)
+		if err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		if input.Confirm && wait == 0 {
+			return nil, badReqErr("confirm requires wait")
+		}
 		payloadBytes, _ := json.Marshal(input.Body)
 		payload := json.RawMessage(payloadBytes)
-		status, err := commandService.Submit(pluginID, deviceID, entityID, payload)
-		if err == nil {
-			return &CommandStatusOutput{Body: status}, nil
+		if input.DryRun {
+			return explainSendCommand(pluginID, deviceID, entityID, payload, opts)
+		}
+
+		if wait > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wait)
+			defer cancel()
+		}
+		keys := commandService.IdempotencyKeys()
+		key := input.IdempotencyKey
+		if key != "" {
+			stored, replay, err := keys.Begin(sendCommandIdempotencyScope, key, fingerprint)
+			if err != nil {
+				return nil, conflictErr(err.Error())
+			}
+			if replay {
+				return replaySendCommand(ctx, stored, payload, wait)
+			}
 		}
-		if code, ok := commandErrCode(err); ok {
-			switch code {
-			case CommandErrNotFound:
-				return nil, notFoundErr("entity not found")
-			case CommandErrInvalidPayload, CommandErrUnsupportedAction:
-				return nil, badReqErr(err.Error())
-			case CommandErrTimeout:
-				return nil, timeoutErr(err.Error())
-			case CommandErrProjectionUnavailable:
-				return nil, upstreamErr(err.Error())
+
+		var events <-chan types.EntityEventEnvelope
+		if input.Confirm {
+			ch, stop, err := watchEntityEvents(pluginID, deviceID, entityID)
+			if err != nil {
+				if key != "" {
+					keys.Abort(sendCommandIdempotencyScope, key)
+				}
+				return nil, sendCommandErr(GatewayCommandStatus{}, err)
 			}
+			defer stop()
+			events = ch
 		}
-		if errors.Is(err, errCommandTargetNotFound) || strings.Contains(strings.ToLower(err.Error()), "not found") {
-			return nil, notFoundErr("entity not found")
+		status, err := commandService.SubmitWithOptions(pluginID, deviceID, entityID, payload, opts)
+		if err != nil {
+			if key != "" {
+				keys.Abort(sendCommandIdempotencyScope, key)
+			}
+			return nil, sendCommandErr(status, err)
 		}
-		if strings.Contains(err.Error(), "payload.type is required") {
-			return nil, badReqErr(err.Error())
+		if key != "" {
+			keys.Complete(sendCommandIdempotencyScope, key, status)
 		}
-		return nil, pluginErr(err.Error())
+		if wait == 0 {
+			return &SendCommandOutput{Status: http.StatusAccepted, Body: CommandWaitResult{GatewayCommandStatus: status}}, nil
+		}
+		return sendCommandWaitOutput(commandService.awaitCommand(ctx, status, payload, events)), nil
 	})
 
 	huma.Register(api, huma.Operation{
@@ -69,11 +163,11 @@ func registerCommandRoutes(api huma.API) {
 		Method:      http.MethodGet,
 		Path:        "/api/plugins/{plugin_id}/commands/{command_id}",
 		Summary:     "Get command status",
-		Description: "Polls the status of a previously issued command. State transitions: pending → succeeded | failed.",
+		Description: "Polls the status of a previously issued command. State transitions: [scheduled →] pending → succeeded | failed | superseded | cancelled. Group commands list their child command IDs and end as succeeded, partially_failed or failed depending on their children. Statuses evicted from memory are read from command history.",
 		Tags:        []string{"commands"},
 	}, func(ctx context.Context, input *GetCommandStatusInput) (*CommandStatusOutput, error) {
 		if commandService != nil && commandService.IsGatewayCommand(input.CommandID) {
-			status, found := commandService.GetStatus(input.CommandID)
+			status, found := commandService.LookupStatus(input.CommandID)
 			if !found {
 				return nil, notFoundErr("command not found")
 			}
@@ -82,12 +176,376 @@ func registerCommandRoutes(api huma.API) {
 			}
 			return &CommandStatusOutput{Body: status}, nil
 		}
-		resp := routeRPC(input.PluginID, "commands/status/get", map[string]string{"command_id": input.CommandID})
+		resp := routeRPCContext(ctx, input.PluginID, "commands/status/get", map[string]string{"command_id": input.CommandID})
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
 		var status types.CommandStatus
 		json.Unmarshal(resp.Result, &status)
+		return &CommandStatusOutput{Body: GatewayCommandStatus{CommandStatus: status}}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "get-command-tree",
+		Method:      http.MethodGet,
+		Path:        "/api/plugins/{plugin_id}/commands/{command_id}/tree",
+		Summary:     "Get command fan-out tree",
+		Description: "Returns a gateway command's status together with the statuses of every command it fanned out to, nested by group.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *GetCommandStatusInput) (*CommandStatusTreeOutput, error) {
+		tree, found := commandService.StatusTree(input.CommandID)
+		if !found {
+			return nil, notFoundErr("command not found")
+		}
+		if tree.Status.PluginID != input.PluginID {
+			return nil, pluginErr("command not owned by plugin")
+		}
+		return &CommandStatusTreeOutput{Body: tree}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "cancel-command",
+		Method:      http.MethodDelete,
+		Path:        "/api/plugins/{plugin_id}/commands/{command_id}",
+		Summary:     "Cancel command",
+		Description: "Cancels a gateway command that has not been dispatched yet. Scheduled and queued commands, and commands waiting out a retry backoff, are withdrawn; a group command stops dispatching its remaining leaves. The command's state becomes cancelled. Returns 409 if the command has finished or its RPC is already in flight.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *CancelCommandInput) (*CommandStatusOutput, error) {
+		status, err := cancelCommand(input.PluginID, input.CommandID)
+		if err != nil {
+			return nil, err
+		}
 		return &CommandStatusOutput{Body: status}, nil
 	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "list-command-queues",
+		Method:      http.MethodGet,
+		Path:        "/api/commands/queues",
+		Summary:     "List command dispatch queues",
+		Description: "Returns depth per priority lane, in-flight count, worker count and accepted/completed/rejected totals for each plugin's dispatch queue.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *struct{}) (*CommandQueuesOutput, error) {
+		return &CommandQueuesOutput{Body: commandService.QueueStats()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "list-scheduled-commands",
+		Method:      http.MethodGet,
+		Path:        "/api/commands/scheduled",
+		Summary:     "List scheduled commands",
+		Description: "Returns commands submitted with execute_at or delay that have not been dispatched yet, ordered by execute_at.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *struct{}) (*ScheduledCommandsOutput, error) {
+		return &ScheduledCommandsOutput{Body: commandService.ScheduledCommands()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "cancel-scheduled-command",
+		Method:      http.MethodDelete,
+		Path:        "/api/commands/scheduled/{command_id}",
+		Summary:     "Cancel scheduled command",
+		Description: "Withdraws a scheduled command before it is dispatched. The command's state becomes cancelled.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *CancelScheduledCommandInput) (*CommandStatusOutput, error) {
+		status, ok := commandService.CancelScheduled(input.CommandID)
+		if !ok {
+			return nil, notFoundErr("scheduled command not found")
+		}
+		return &CommandStatusOutput{Body: status}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "get-command-retry-policies",
+		Method:      http.MethodGet,
+		Path:        "/api/commands/retry-policies",
+		Summary:     "Get command retry policies",
+		Description: "Returns the gateway-wide default retry policy and per-plugin overrides used when dispatching commands.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *struct{}) (*RetryPoliciesOutput, error) {
+		return &RetryPoliciesOutput{Body: commandService.RetryPolicies().Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "set-command-retry-policies",
+		Method:      http.MethodPut,
+		Path:        "/api/commands/retry-policies",
+		Summary:     "Set command retry policies",
+		Description: "Replaces the default and per-plugin retry policies. Changes are persisted in the gateway data dir and apply to commands dispatched afterwards.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *SetRetryPoliciesInput) (*RetryPoliciesOutput, error) {
+		if err := commandService.RetryPolicies().Set(input.Body); err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		return &RetryPoliciesOutput{Body: commandService.RetryPolicies().Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "get-command-policies",
+		Method:      http.MethodGet,
+		Path:        "/api/commands/policies",
+		Summary:     "Get command policies",
+		Description: "Returns the ordered allow/deny/transform rules evaluated before commands are dispatched.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *struct{}) (*CommandPoliciesOutput, error) {
+		return &CommandPoliciesOutput{Body: commandService.Policies().Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "set-command-policies",
+		Method:      http.MethodPut,
+		Path:        "/api/commands/policies",
+		Summary:     "Set command policies",
+		Description: "Replaces the command policy rules. Rules are evaluated in order for every command and fan-out leaf: matching transform rules rewrite the payload, and the first matching allow or deny decides. Changes are persisted in the gateway data dir.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *SetCommandPoliciesInput) (*CommandPoliciesOutput, error) {
+		if err := commandService.Policies().Set(input.Body); err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		return &CommandPoliciesOutput{Body: commandService.Policies().Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "put-command-policy",
+		Method:      http.MethodPut,
+		Path:        "/api/commands/policies/{rule_id}",
+		Summary:     "Create or update command policy rule",
+		Description: "Replaces the rule with the given ID in place, or appends it as the last rule.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *PutCommandPolicyInput) (*CommandPoliciesOutput, error) {
+		rule := input.Body
+		if rule.ID == "" {
+			rule.ID = input.RuleID
+		}
+		if rule.ID != input.RuleID {
+			return nil, badReqErr("rule id does not match path")
+		}
+		if err := commandService.Policies().Put(rule); err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		return &CommandPoliciesOutput{Body: commandService.Policies().Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "delete-command-policy",
+		Method:      http.MethodDelete,
+		Path:        "/api/commands/policies/{rule_id}",
+		Summary:     "Delete command policy rule",
+		Description: "Removes a command policy rule.",
+		Tags:        []string{"commands"},
+	}, func(ctx context.Context, input *CommandPolicyRuleInput) (*CommandPoliciesOutput, error) {
+		found, err := commandService.Policies().Delete(input.RuleID)
+		if err != nil {
+			return nil, upstreamErr(err.Error())
+		}
+		if !found {
+			return nil, notFoundErr("policy rule not found")
+		}
+		return &CommandPoliciesOutput{Body: commandService.Policies().Get()}, nil
+	})
+}
+
+// cancelCommand cancels a gateway command owned by pluginID, mapping command
+// errors to API errors.
+func cancelCommand(pluginID, commandID string) (GatewayCommandStatus, error) {
+	status, found := commandService.GetStatus(commandID)
+	if !found {
+		return GatewayCommandStatus{}, notFoundErr("command not found")
+	}
+	if status.PluginID != pluginID {
+		return GatewayCommandStatus{}, pluginErr("command not owned by plugin")
+	}
+	status, err := commandService.Cancel(commandID)
+	if err == nil {
+		return status, nil
+	}
+	if code, ok := commandErrCode(err); ok {
+		switch code {
+		case CommandErrNotFound:
+			return GatewayCommandStatus{}, notFoundErr(err.Error())
+		case CommandErrNotCancellable:
+			return GatewayCommandStatus{}, conflictErr(err.Error())
+		}
+	}
+	return GatewayCommandStatus{}, err
+}
+
+// extractCommandOptions removes gateway-only option fields from a command body
+// so they are not forwarded to the plugin.
+func extractCommandOptions(body map[string]any) (commandOptions, error) {
+	var opts commandOptions
+	if raw, ok := body["retry_policy"]; ok {
+		delete(body, "retry_policy")
+		data, _ := json.Marshal(raw)
+		var p RetryPolicy
+		if err := json.Unmarshal(data, &p); err != nil {
+			return opts, fmt.Errorf("invalid retry_policy: %w", err)
+		}
+		if err := p.validate(); err != nil {
+			return opts, err
+		}
+		opts.Retry = &p
+	}
+	if raw, ok := body["priority"]; ok {
+		delete(body, "priority")
+		str, _ := raw.(string)
+		p, err := parseCommandPriority(str)
+		if err != nil {
+			return opts, err
+		}
+		opts.Priority = p
+	}
+	if raw, ok := body["coalesce"]; ok {
+		delete(body, "coalesce")
+		b, isBool := raw.(bool)
+		if !isBool {
+			return opts, fmt.Errorf("coalesce must be a boolean")
+		}
+		opts.Coalesce = b
+	}
+	if raw, ok := body["execute_at"]; ok {
+		delete(body, "execute_at")
+		str, _ := raw.(string)
+		at, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return opts, fmt.Errorf("invalid execute_at: want an RFC 3339 timestamp")
+		}
+		opts.ExecuteAt = at
+	}
+	if raw, ok := body["delay"]; ok {
+		delete(body, "delay")
+		if !opts.ExecuteAt.IsZero() {
+			return opts, fmt.Errorf("execute_at and delay are mutually exclusive")
+		}
+		str, _ := raw.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid delay: want a non-negative duration such as \"10m\"")
+		}
+		opts.ExecuteAt = time.Now().Add(d)
+	}
+	return opts, nil
+}
+
+// splitCommandOptions is extractCommandOptions for a raw payload, as carried
+// by batch items. Payloads that are not JSON objects are returned unchanged.
+func splitCommandOptions(payload json.RawMessage) (json.RawMessage, commandOptions, error) {
+	var body map[string]any
+	if err := json.Unmarshal(payload, &body); err != nil || body == nil {
+		return payload, commandOptions{}, nil
+	}
+	opts, err := extractCommandOptions(body)
+	if err != nil {
+		return nil, opts, err
+	}
+	out, _ := json.Marshal(body)
+	return out, opts, nil
+}
+
+const sendCommandIdempotencyScope = "send-command"
+
+// replaySendCommand answers a repeated send-command request from the command
+// its Idempotency-Key first created, reporting the command's current status.
+// With wait, it waits for that command to finish; a replay is never confirmed.
+func replaySendCommand(ctx context.Context, stored json.RawMessage, payload json.RawMessage, wait time.Duration) (*SendCommandOutput, error) {
+	var status GatewayCommandStatus
+	if err := json.Unmarshal(stored, &status); err != nil {
+		return nil, pluginErr("stored idempotent response is unreadable")
+	}
+	if current, ok := commandService.GetStatus(status.CommandID); ok {
+		status = current
+	}
+	out := &SendCommandOutput{Status: http.StatusAccepted, Body: CommandWaitResult{GatewayCommandStatus: status}}
+	if wait > 0 {
+		out = sendCommandWaitOutput(commandService.awaitCommand(ctx, status, payload, nil))
+	}
+	out.Replayed = "true"
+	return out, nil
+}
+
+func sendCommandWaitOutput(res CommandWaitResult) *SendCommandOutput {
+	code := http.StatusOK
+	if res.Outcome == CommandWaitTimeout {
+		code = http.StatusAccepted
+	}
+	return &SendCommandOutput{Status: code, Body: res}
+}
+
+// explainSendCommand answers a send-command dry run.
+func explainSendCommand(pluginID, deviceID, entityID string, payload json.RawMessage, opts commandOptions) (*SendCommandOutput, error) {
+	exp, err := commandService.Explain(pluginID, deviceID, entityID, payload, opts)
+	if err != nil {
+		return nil, sendCommandErr(GatewayCommandStatus{}, err)
+	}
+	res := CommandWaitResult{Outcome: CommandDryRun, Explanation: &exp}
+	res.PluginID, res.DeviceID, res.EntityID = pluginID, deviceID, entityID
+	res.EntityType = exp.Root.Domain
+	return &SendCommandOutput{Status: http.StatusOK, Body: res}, nil
+}
+
+// sendCommandErr maps a submit error to the send-command API error. status is
+// what the submit returned alongside the error, if anything.
+func sendCommandErr(status GatewayCommandStatus, err error) error {
+	if code, ok := commandErrCode(err); ok {
+		switch code {
+		case CommandErrPolicyDenied:
+			return policyDeniedErr(err.Error(), status.CommandID)
+		case CommandErrNotFound:
+			return notFoundErr("entity not found")
+		case CommandErrInvalidPayload:
+			var verr *PayloadValidationError
+			if errors.As(err, &verr) {
+				return validationErr(err.Error(), verr.Fields)
+			}
+			return badReqErr(err.Error())
+		case CommandErrUnsupportedAction:
+			return badReqErr(err.Error())
+		case CommandErrTimeout:
+			return timeoutErr(err.Error())
+		case CommandErrProjectionUnavailable, CommandErrOverloaded:
+			return upstreamErr(err.Error())
+		}
+	}
+	if errors.Is(err, errCommandTargetNotFound) || strings.Contains(strings.ToLower(err.Error()), "not found") {
+		return notFoundErr("entity not found")
+	}
+	if strings.Contains(err.Error(), "payload.type is required") {
+		return badReqErr(err.Error())
+	}
+	return pluginErr(err.Error())
+}
+
+// policyHeaders captures the request headers that command policy rules match
+// on, keyed by lower-cased name. header looks a header up by name.
+func policyHeaders(header func(name string) string) map[string]string {
+	if commandService == nil {
+		return nil
+	}
+	names := commandService.Policies().HeaderNames()
+	if len(names) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(names))
+	for _, name := range names {
+		if v := header(name); v != "" {
+			headers[name] = v
+		}
+	}
+	return headers
+}
+
+// parseCommandWait parses the send-command wait query parameter.
+func parseCommandWait(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("wait must be a positive duration, e.g. \"5s\"")
+	}
+	if d > maxCommandWait {
+		return 0, fmt.Errorf("wait must not exceed %s", maxCommandWait)
+	}
+	return d, nil
 }
@@ -144,7 +144,7 @@ func handleImportDevices(c *gin.Context) {
 
 		if localName != "" {
 			payload := types.Device{ID: deviceID, LocalName: localName}
-			resp := routeRPC(pluginID, "devices/update", payload)
+			resp := routeRPCContext(c.Request.Context(), pluginID, "devices/update", payload)
 			if resp.Error != nil {
 				result.Errors = append(result.Errors, csvImportError{
 					Row: rowNum, PluginID: pluginID, DeviceID: deviceID,
@@ -158,7 +158,7 @@ func handleImportDevices(c *gin.Context) {
 
 		if ok && labelsStr != "" {
 			payload := types.Device{ID: deviceID, Labels: decodeLabels(labelsStr)}
-			resp := routeRPC(pluginID, "devices/update", payload)
+			resp := routeRPCContext(c.Request.Context(), pluginID, "devices/update", payload)
 			if resp.Error != nil {
 				result.Errors = append(result.Errors, csvImportError{
 					Row: rowNum, PluginID: pluginID, DeviceID: deviceID,
@@ -221,7 +221,7 @@ func handleImportEntities(c *gin.Context) {
 			payload.Labels = decodeLabels(labelsStr)
 		}
 
-		resp := routeRPC(pluginID, "entities/update", payload)
+		resp := routeRPCContext(c.Request.Context(), pluginID, "entities/update", payload)
 		if resp.Error != nil {
 			result.Errors = append(result.Errors, csvImportError{
 				Row: rowNum, PluginID: pluginID, DeviceID: deviceID, EntityID: entityID,
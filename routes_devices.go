@@ -101,7 +101,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Returns all devices owned by the given plugin.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *ListDevicesInput) (*ListDevicesOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/list", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/list", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -118,7 +118,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Re-runs discovery for all devices and entities managed by the plugin.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *RefreshDevicesInput) (*ListDevicesOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/refresh", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/refresh", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -135,7 +135,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Forces the plugin runner to persist its in-memory canonical state to disk immediately.",
 		Tags:        []string{"plugins"},
 	}, func(ctx context.Context, input *FlushPluginStorageInput) (*FlushPluginStorageOutput, error) {
-		resp := routeRPC(input.PluginID, "storage/flush", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "storage/flush", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -152,7 +152,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Calls plugin OnReset hook. Default plugin behavior is no-op until implemented.",
 		Tags:        []string{"plugins"},
 	}, func(ctx context.Context, input *ResetPluginInput) (*ResetPluginOutput, error) {
-		resp := routeRPC(input.PluginID, "plugin/reset", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "plugin/reset", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -169,7 +169,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Returns current runtime log level for one plugin process.",
 		Tags:        []string{"plugins"},
 	}, func(ctx context.Context, input *GetPluginLogLevelInput) (*PluginLogLevelOutput, error) {
-		resp := routeRPC(input.PluginID, "logging/get_level", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "logging/get_level", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -194,7 +194,7 @@ func registerDeviceRoutes(api huma.API) {
 		if level == "" {
 			return nil, badReqErr("level is required")
 		}
-		resp := routeRPC(input.PluginID, "logging/set_level", map[string]string{"level": level})
+		resp := routeRPCContext(ctx, input.PluginID, "logging/set_level", map[string]string{"level": level})
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -215,7 +215,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Creates a new device in the given plugin.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *CreateDeviceInput) (*DeviceOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/create", input.Body)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/create", input.Body)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -231,7 +231,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Updates device properties (local_name, labels). The device.id field identifies which device to update.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *UpdateDeviceInput) (*DeviceOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/update", input.Body)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/update", input.Body)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -253,7 +253,7 @@ func registerDeviceRoutes(api huma.API) {
 			return nil, badReqErr("local_name is required")
 		}
 		payload := types.Device{ID: input.DeviceID, LocalName: name}
-		resp := routeRPC(input.PluginID, "devices/update", payload)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/update", payload)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -274,7 +274,7 @@ func registerDeviceRoutes(api huma.API) {
 			return nil, badReqErr("labels is required")
 		}
 		payload := types.Device{ID: input.DeviceID, Labels: input.Body.Labels}
-		resp := routeRPC(input.PluginID, "devices/update", payload)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/update", payload)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -291,7 +291,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Deletes a device from the given plugin.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *DeleteDeviceInput) (*DeleteOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/delete", input.DeviceID)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/delete", input.DeviceID)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -307,7 +307,7 @@ func registerDeviceRoutes(api huma.API) {
 		Description: "Returns one device by ID.",
 		Tags:        []string{"devices"},
 	}, func(ctx context.Context, input *GetDeviceInput) (*GetDeviceOutput, error) {
-		resp := routeRPC(input.PluginID, "devices/list", nil)
+		resp := routeRPCContext(ctx, input.PluginID, "devices/list", nil)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -105,7 +105,7 @@ func registerEntityRoutes(api huma.API) {
 		Description: "Returns all entities for a device. Each entity includes an inline schema describing the domain's available commands and events.",
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *ListEntitiesInput) (*ListEntitiesOutput, error) {
-		resp := routeRPC(input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
+		resp := routeRPCContext(ctx, input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
 		entities, err := parseEntities(resp)
 		if err != nil {
 			// If the device has an EntityQuery, return query results even when the
@@ -126,7 +126,7 @@ func registerEntityRoutes(api huma.API) {
 		Description: "Re-runs discovery for entities of a specific device.",
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *RefreshEntitiesInput) (*ListEntitiesOutput, error) {
-		resp := routeRPC(input.PluginID, "entities/refresh", map[string]string{"device_id": input.DeviceID})
+		resp := routeRPCContext(ctx, input.PluginID, "entities/refresh", map[string]string{"device_id": input.DeviceID})
 		entities, err := parseEntities(resp)
 		if err != nil {
 			return nil, pluginErr(err.Error())
@@ -143,7 +143,7 @@ func registerEntityRoutes(api huma.API) {
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *CreateEntityInput) (*EntityOutput, error) {
 		input.Body.DeviceID = input.DeviceID
-		resp := routeRPC(input.PluginID, "entities/create", input.Body)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/create", input.Body)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -160,7 +160,7 @@ func registerEntityRoutes(api huma.API) {
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *UpdateEntityInput) (*EntityOutput, error) {
 		input.Body.DeviceID = input.DeviceID
-		resp := routeRPC(input.PluginID, "entities/update", input.Body)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/update", input.Body)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -181,7 +181,7 @@ func registerEntityRoutes(api huma.API) {
 			return nil, badReqErr("local_name is required")
 		}
 		payload := types.Entity{ID: input.EntityID, DeviceID: input.DeviceID, LocalName: name}
-		resp := routeRPC(input.PluginID, "entities/update", payload)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/update", payload)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -202,7 +202,7 @@ func registerEntityRoutes(api huma.API) {
 			return nil, badReqErr("labels is required")
 		}
 		payload := types.Entity{ID: input.EntityID, DeviceID: input.DeviceID, Labels: input.Body.Labels}
-		resp := routeRPC(input.PluginID, "entities/update", payload)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/update", payload)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -220,7 +220,7 @@ func registerEntityRoutes(api huma.API) {
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *DeleteEntityInput) (*DeleteOutput, error) {
 		params := map[string]string{"device_id": input.DeviceID, "entity_id": input.EntityID}
-		resp := routeRPC(input.PluginID, "entities/delete", params)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/delete", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -236,7 +236,7 @@ func registerEntityRoutes(api huma.API) {
 		Description: "Returns one entity by ID.",
 		Tags:        []string{"entities"},
 	}, func(ctx context.Context, input *GetEntityInput) (*GetEntityOutput, error) {
-		resp := routeRPC(input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
+		resp := routeRPCContext(ctx, input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
 		entities, _ := parseEntities(resp)
 		for _, e := range entities {
 			if e.ID == input.EntityID {
@@ -268,7 +268,7 @@ func registerEntityRoutes(api huma.API) {
 		Description: "Returns the canonical valid event types and required fields for this entity based on its domain schema and action capabilities.",
 		Tags:        []string{"entities", "schema"},
 	}, func(ctx context.Context, input *GetEntityEventsInput) (*EntityEventsOutput, error) {
-		resp := routeRPC(input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
+		resp := routeRPCContext(ctx, input.PluginID, "entities/list", map[string]string{"device_id": input.DeviceID})
 		entities, err := parseEntities(resp)
 		if err != nil {
 			return nil, pluginErr(err.Error())
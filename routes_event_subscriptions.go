@@ -3,34 +3,57 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
-	"github.com/slidebolt/sdk-types"
 )
 
 // --- Types ---
 
+// EventSubscriptionRequest is an EventFilter plus the lease to hold it with
+// and what to do when its buffer overflows.
+type EventSubscriptionRequest struct {
+	EventFilter
+	TTLSeconds int            `json:"ttl_seconds,omitempty" minimum:"0" maximum:"86400" doc:"Idle time after which the subscription is removed; defaults to GATEWAY_EVENT_SUBSCRIPTION_TTL (5m)"`
+	Overflow   OverflowPolicy `json:"overflow,omitempty" enum:"drop_newest,drop_oldest,disconnect" doc:"What to do with a new event when 256 are already buffered: drop_newest (default) drops it, drop_oldest drops the oldest buffered event, disconnect closes the subscription"`
+}
+
 type CreateEventSubscriptionInput struct {
-	Body EventFilter
+	Body EventSubscriptionRequest
 }
 
 type CreateEventSubscriptionOutput struct {
 	Body struct {
 		ID        string    `json:"id"`
 		CreatedAt time.Time `json:"created_at"`
+		ExpiresAt time.Time `json:"expires_at" doc:"When the lease runs out unless renewed"`
 	}
 }
 
+type ListEventSubscriptionsOutput struct {
+	Body struct {
+		Subscriptions []EventSubscriptionInfo `json:"subscriptions"`
+	}
+}
+
+type EventSubscriptionInput struct {
+	ID string `path:"id" doc:"Subscription ID"`
+}
+
+type EventSubscriptionOutput struct {
+	Body EventSubscriptionInfo
+}
+
 type GetEventSubscriptionEventsInput struct {
 	ID string `path:"id" doc:"Subscription ID"`
 }
 
 type GetEventSubscriptionEventsOutput struct {
 	Body struct {
-		Events []types.EntityEventEnvelope `json:"events"`
+		Events []SubscriptionEvent `json:"events"`
 	}
 }
 
@@ -48,39 +71,101 @@ func registerEventSubscriptionRoutes(api huma.API) {
 		Method:      http.MethodPost,
 		Path:        "/api/events/subscriptions",
 		Summary:     "Create dynamic event subscription",
-		Description: "Registers a dynamic subscription that matches events from entities satisfying entity_query with an optional action filter. Returns a subscription ID. Use the stream or events endpoints to consume matched events.",
+		Description: "Registers a dynamic subscription that matches events from entities satisfying entity_query with an optional action filter. Returns a subscription ID. Use the stream or events endpoints to consume matched events. The subscription is removed once it has gone ttl_seconds without a poll, keepalive or open stream. Every event carries seq, its sequence in the EVENTS stream; set since_seq to the last seq received (or since_time) to replay the stored events missed while disconnected before live delivery continues. Replay requires JetStream. Up to 256 events are buffered; overflow sets what happens beyond that, and lost events are always reported by a gap marker, {\"gap\": {\"dropped\", \"first_seq\", \"last_seq\", \"reason\"}}, delivered in their place so the client knows to resync. Plugin lifecycle events (plugin.registered, plugin.updated, plugin.online, plugin.stale, plugin.offline) are delivered as events of entity_type \"plugin\" whose entity_id is the plugin ID; subscribe to them with an entity_query domain of \"plugin\".",
 		Tags:        []string{"events"},
 	}, func(ctx context.Context, input *CreateEventSubscriptionInput) (*CreateEventSubscriptionOutput, error) {
 		if dynamicEventService == nil {
 			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
 		}
-		id, _ := dynamicEventService.Subscribe(input.Body)
+		id, err := dynamicEventService.Subscribe(input.Body.EventFilter, SubscriptionOptions{
+			TTL:      time.Duration(input.Body.TTLSeconds) * time.Second,
+			Overflow: input.Body.Overflow,
+		})
+		if errors.Is(err, ErrReplayUnavailable) {
+			return nil, upstreamErr(err.Error())
+		}
+		if err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		info, _ := dynamicEventService.Get(id)
 		out := &CreateEventSubscriptionOutput{}
 		out.Body.ID = id
-		out.Body.CreatedAt = time.Now().UTC()
+		out.Body.CreatedAt = info.CreatedAt
+		if info.ExpiresAt != nil {
+			out.Body.ExpiresAt = *info.ExpiresAt
+		}
 		return out, nil
 	})
 
+	huma.Register(api, huma.Operation{
+		OperationID: "list-event-subscriptions",
+		Method:      http.MethodGet,
+		Path:        "/api/events/subscriptions",
+		Summary:     "List dynamic event subscriptions",
+		Description: "Lists active dynamic subscriptions, oldest first, with each one's filter, age, last activity, lease expiry, buffered event count, overflow policy and dropped event count. Listing does not renew leases.",
+		Tags:        []string{"events"},
+	}, func(ctx context.Context, input *struct{}) (*ListEventSubscriptionsOutput, error) {
+		if dynamicEventService == nil {
+			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
+		}
+		out := &ListEventSubscriptionsOutput{}
+		out.Body.Subscriptions = dynamicEventService.List()
+		return out, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "get-event-subscription",
+		Method:      http.MethodGet,
+		Path:        "/api/events/subscriptions/{id}",
+		Summary:     "Inspect dynamic event subscription",
+		Description: "Returns a subscription's filter, age, last activity, lease expiry, buffered event count, overflow policy and dropped event count without renewing its lease or consuming events.",
+		Tags:        []string{"events"},
+	}, func(ctx context.Context, input *EventSubscriptionInput) (*EventSubscriptionOutput, error) {
+		if dynamicEventService == nil {
+			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
+		}
+		info, ok := dynamicEventService.Get(input.ID)
+		if !ok {
+			return nil, notFoundErr(fmt.Sprintf("subscription %q not found", input.ID))
+		}
+		return &EventSubscriptionOutput{Body: info}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "keepalive-event-subscription",
+		Method:      http.MethodPost,
+		Path:        "/api/events/subscriptions/{id}/keepalive",
+		Summary:     "Renew dynamic event subscription lease",
+		Description: "Renews the subscription's lease without consuming events. Polling and open streams renew it too.",
+		Tags:        []string{"events"},
+	}, func(ctx context.Context, input *EventSubscriptionInput) (*EventSubscriptionOutput, error) {
+		if dynamicEventService == nil {
+			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
+		}
+		info, ok := dynamicEventService.KeepAlive(input.ID)
+		if !ok {
+			return nil, notFoundErr(fmt.Sprintf("subscription %q not found", input.ID))
+		}
+		return &EventSubscriptionOutput{Body: info}, nil
+	})
+
 	huma.Register(api, huma.Operation{
 		OperationID: "get-subscription-events",
 		Method:      http.MethodGet,
 		Path:        "/api/events/subscriptions/{id}/events",
 		Summary:     "Poll buffered subscription events",
-		Description: "Returns and drains all events currently buffered for the subscription. Useful for polling clients and testing without SSE.",
+		Description: "Returns and drains all events currently buffered for the subscription, including gap markers for lost events, and renews its lease. Useful for polling clients and testing without SSE. A subscription closed by the disconnect overflow policy is removed once drained.",
 		Tags:        []string{"events"},
 	}, func(ctx context.Context, input *GetEventSubscriptionEventsInput) (*GetEventSubscriptionEventsOutput, error) {
 		if dynamicEventService == nil {
 			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
 		}
-		events := dynamicEventService.Drain(input.ID)
-		if events == nil {
+		events, ok := dynamicEventService.Drain(input.ID)
+		if !ok {
 			return nil, notFoundErr(fmt.Sprintf("subscription %q not found", input.ID))
 		}
 		out := &GetEventSubscriptionEventsOutput{}
 		out.Body.Events = events
-		if out.Body.Events == nil {
-			out.Body.Events = []types.EntityEventEnvelope{}
-		}
 		return out, nil
 	})
 
@@ -89,7 +174,7 @@ func registerEventSubscriptionRoutes(api huma.API) {
 		Method:      http.MethodDelete,
 		Path:        "/api/events/subscriptions/{id}",
 		Summary:     "Delete dynamic event subscription",
-		Description: "Cancels a dynamic event subscription and closes its event channel.",
+		Description: "Cancels a dynamic event subscription and discards its buffered events.",
 		Tags:        []string{"events"},
 	}, func(ctx context.Context, input *DeleteEventSubscriptionInput) (*DeleteOutput, error) {
 		if dynamicEventService == nil {
@@ -102,22 +187,22 @@ func registerEventSubscriptionRoutes(api huma.API) {
 
 	// SSE stream endpoint — Phase 2 delivery mechanism.
 	// Clients open this connection and receive events as server-sent events
-	// in the format: "data: <EntityEventEnvelope JSON>\n\n"
+	// in the format: "data: <EntityEventEnvelope JSON>\n\n". Lost events are
+	// reported as "event: gap" and a disconnect by the overflow policy as
+	// "event: close" with its reason.
 	huma.Register(api, huma.Operation{
 		OperationID: "stream-subscription-events",
 		Method:      http.MethodGet,
 		Path:        "/api/events/subscriptions/{id}/stream",
 		Summary:     "Stream subscription events via SSE",
-		Description: "Opens a Server-Sent Events stream that delivers matched EntityEventEnvelopes in real time. The connection stays open until the subscription is deleted or the client disconnects.",
+		Description: "Opens a Server-Sent Events stream that delivers matched EntityEventEnvelopes, each with its stream seq, in real time. Lost events are reported in their place as a \"gap\" event whose data is the gap marker; resync on receiving one. The connection stays open until the subscription is deleted or the client disconnects, and holds the subscription's lease while open. If the disconnect overflow policy closes the subscription, a final \"close\" event carries the reason.",
 		Tags:        []string{"events"},
 	}, func(ctx context.Context, input *StreamEventSubscriptionInput) (*huma.StreamResponse, error) {
 		if dynamicEventService == nil {
 			return nil, &apiError{status: http.StatusServiceUnavailable, Message: "dynamic event service not available"}
 		}
-		// Locate the subscription channel without consuming it.
-		dynamicEventService.mu.RLock()
-		sub, ok := dynamicEventService.subs[input.ID]
-		dynamicEventService.mu.RUnlock()
+		// Locate the subscription without consuming it.
+		sub, ok := dynamicEventService.lookup(input.ID)
 		if !ok {
 			return nil, notFoundErr(fmt.Sprintf("subscription %q not found", input.ID))
 		}
@@ -131,22 +216,33 @@ func registerEventSubscriptionRoutes(api huma.API) {
 				w := ctx.BodyWriter()
 				flusher, canFlush := w.(http.Flusher)
 				reqCtx := ctx.Context()
+				closeStream := sub.openStream()
+				defer closeStream()
 
 				for {
-					select {
-					case env, open := <-sub.ch:
-						if !open {
-							return
-						}
-						data, err := json.Marshal(env)
+					events, ok := sub.next(reqCtx)
+					for _, ev := range events {
+						data, err := json.Marshal(ev)
 						if err != nil {
 							continue
 						}
-						fmt.Fprintf(w, "data: %s\n\n", data)
-						if canFlush {
-							flusher.Flush()
+						if ev.Gap != nil {
+							fmt.Fprintf(w, "event: gap\ndata: %s\n\n", data)
+						} else {
+							fmt.Fprintf(w, "data: %s\n\n", data)
+						}
+					}
+					if !ok && reqCtx.Err() == nil {
+						dynamicEventService.forget(sub)
+						if reason := sub.reason(); reason != "" {
+							data, _ := json.Marshal(map[string]string{"reason": reason})
+							fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
 						}
-					case <-reqCtx.Done():
+					}
+					if canFlush {
+						flusher.Flush()
+					}
+					if !ok {
 						return
 					}
 				}
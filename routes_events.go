@@ -33,7 +33,7 @@ func registerEventRoutes(api huma.API) {
 		commandID := input.CommandID
 
 		params := map[string]any{"device_id": deviceID, "entity_id": entityID, "payload": payload, "command_id": commandID}
-		resp := routeRPC(pluginID, "entities/events/ingest", params)
+		resp := routeRPCContext(ctx, pluginID, "entities/events/ingest", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
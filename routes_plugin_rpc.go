@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// maxPluginRPCBody caps the params a caller may send through the passthrough.
+const maxPluginRPCBody = 1 << 20
+
+// registerPluginRPCRoutes adds the plugin RPC passthrough. It is a plain Gin
+// route because method names contain slashes, which a huma path parameter
+// cannot match; the OpenAPI operation is added by hand.
+func registerPluginRPCRoutes(r *gin.Engine, api huma.API) {
+	r.POST("/api/plugins/:plugin_id/rpc/*method", handlePluginRPC)
+
+	api.OpenAPI().AddOperation(&huma.Operation{
+		OperationID: "call-plugin-rpc",
+		Method:      http.MethodPost,
+		Path:        "/api/plugins/{plugin_id}/rpc/{method}",
+		Summary:     "Call a plugin RPC method",
+		Description: "Sends the request body as the params of a JSON-RPC call to the plugin and returns its result. " +
+			"Only methods the plugin advertises under rpc_methods in its manifest may be called, and params are " +
+			"validated against the schema it advertised. Each advertised method is also documented as its own operation. " +
+			"Returns 404 for unknown plugins or methods, 400 for invalid params, 503 when the plugin is unavailable " +
+			"and 403 when the plugin answers with an error.",
+		Tags: []string{"Plugin RPC"},
+		Parameters: []*huma.Param{
+			{Name: "plugin_id", In: "path", Required: true, Schema: &huma.Schema{Type: huma.TypeString}},
+			{Name: "method", In: "path", Required: true, Description: "Advertised RPC method; may contain slashes", Schema: &huma.Schema{Type: huma.TypeString}},
+		},
+		RequestBody: &huma.RequestBody{
+			Content: map[string]*huma.MediaType{"application/json": {Schema: &huma.Schema{Type: huma.TypeObject}}},
+		},
+		Responses: map[string]*huma.Response{
+			"200": {Description: "The plugin's result"},
+		},
+	})
+	pluginRPCDocs.attach(api)
+}
+
+func handlePluginRPC(c *gin.Context) {
+	result, err := pluginRPCResult(c)
+	if err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			apiErr = &apiError{status: http.StatusInternalServerError, Message: err.Error()}
+		}
+		c.JSON(apiErr.status, apiErr)
+		return
+	}
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	c.Data(http.StatusOK, "application/json", result)
+}
+
+func pluginRPCResult(c *gin.Context) (json.RawMessage, error) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPluginRPCBody+1))
+	if err != nil {
+		return nil, badReqErr(err.Error())
+	}
+	if len(body) > maxPluginRPCBody {
+		return nil, badReqErr("request body too large")
+	}
+	method := strings.TrimPrefix(c.Param("method"), "/")
+	return callPluginRPC(c.Request.Context(), c.Param("plugin_id"), method, body)
+}
+
+// callPluginRPC calls an advertised method on pluginID with body as params.
+func callPluginRPC(ctx context.Context, pluginID, method string, body []byte) (json.RawMessage, error) {
+	regMu.RLock()
+	rec, ok := registry[pluginID]
+	regMu.RUnlock()
+	if !ok {
+		return nil, notFoundErr("plugin not found")
+	}
+	m, ok := rec.Methods[method]
+	if !ok {
+		return nil, notFoundErr(fmt.Sprintf("plugin %q does not advertise RPC method %q", pluginID, method))
+	}
+
+	var params any
+	var raw json.RawMessage
+	if body = bytes.TrimSpace(body); len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			return nil, badReqErr("invalid JSON body: " + err.Error())
+		}
+		raw = body
+	}
+	if details := m.validateParams(params); len(details) > 0 {
+		return nil, validationErr(fmt.Sprintf("invalid params for RPC method %q", method), details)
+	}
+
+	resp := routeRPCContext(ctx, pluginID, method, raw)
+	if resp.Error != nil {
+		switch resp.Error.Code {
+		case rpcErrPluginUnavailable, rpcErrCircuitOpen, rpcErrCancelled:
+			return nil, upstreamErr(resp.Error.Message)
+		}
+		return nil, pluginErr(resp.Error.Message)
+	}
+	return resp.Result, nil
+}
@@ -67,7 +67,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *GetScriptInput) (*ScriptOutput, error) {
 		params := map[string]string{"device_id": input.DeviceID, "entity_id": input.EntityID}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptsGet, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptsGet, params)
 		if resp.Error != nil {
 			if resp.Error.Code == -32004 || resp.Error.Code == -32005 {
 				return nil, notFoundErr(resp.Error.Message)
@@ -86,7 +86,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *SetScriptInput) (*ScriptOutput, error) {
 		params := map[string]any{"device_id": input.DeviceID, "entity_id": input.EntityID, "source": input.Body.Source}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptsPut, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptsPut, params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -107,7 +107,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *DeleteScriptInput) (*ScriptOutput, error) {
 		params := map[string]any{"device_id": input.DeviceID, "entity_id": input.EntityID, "purge_state": input.PurgeState}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptsDelete, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptsDelete, params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -126,7 +126,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *GetScriptStateInput) (*ScriptStateOutput, error) {
 		params := map[string]string{"device_id": input.DeviceID, "entity_id": input.EntityID}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptStateGet, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptStateGet, params)
 		if resp.Error != nil {
 			if resp.Error.Code == -32005 || strings.Contains(strings.ToLower(resp.Error.Message), "not found") {
 				return nil, notFoundErr(resp.Error.Message)
@@ -145,7 +145,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *SetScriptStateInput) (*ScriptStateOutput, error) {
 		params := map[string]any{"device_id": input.DeviceID, "entity_id": input.EntityID, "state": input.Body.State}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptStatePut, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptStatePut, params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -161,7 +161,7 @@ func registerScriptRoutes(api huma.API) {
 		Tags:        []string{"scripts"},
 	}, func(ctx context.Context, input *DeleteScriptStateInput) (*ScriptStateOutput, error) {
 		params := map[string]string{"device_id": input.DeviceID, "entity_id": input.EntityID}
-		resp := routeRPC(input.PluginID, types.RPCMethodScriptStateDelete, params)
+		resp := routeRPCContext(ctx, input.PluginID, types.RPCMethodScriptStateDelete, params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
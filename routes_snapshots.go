@@ -51,7 +51,7 @@ func registerSnapshotRoutes(api huma.API) {
 			"name":      input.Body.Name,
 			"labels":    input.Body.Labels,
 		}
-		resp := routeRPC(input.PluginID, "entities/snapshots/save", params)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/snapshots/save", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -67,7 +67,7 @@ func registerSnapshotRoutes(api huma.API) {
 		Tags:        []string{"snapshots"},
 	}, func(ctx context.Context, input *GetEntityInput) (*ListSnapshotsOutput, error) {
 		params := map[string]string{"device_id": input.DeviceID, "entity_id": input.EntityID}
-		resp := routeRPC(input.PluginID, "entities/snapshots/list", params)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/snapshots/list", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -87,7 +87,7 @@ func registerSnapshotRoutes(api huma.API) {
 			"entity_id":   input.EntityID,
 			"snapshot_id": input.SnapshotID,
 		}
-		resp := routeRPC(input.PluginID, "entities/snapshots/delete", params)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/snapshots/delete", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -107,7 +107,7 @@ func registerSnapshotRoutes(api huma.API) {
 			"entity_id":   input.EntityID,
 			"snapshot_id": input.SnapshotID,
 		}
-		resp := routeRPC(input.PluginID, "entities/snapshots/restore", params)
+		resp := routeRPCContext(ctx, input.PluginID, "entities/snapshots/restore", params)
 		if resp.Error != nil {
 			return nil, pluginErr(resp.Error.Message)
 		}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -35,7 +36,55 @@ type PruneOutput struct {
 	}
 }
 
-type ListPluginsOutput struct{ Body map[string]types.Registration }
+// GatewayPluginRegistration is a plugin's registration as seen by the gateway,
+// including its liveness and the state of its RPC circuit breaker.
+type GatewayPluginRegistration struct {
+	types.Registration
+	Status      PluginStatus `json:"status" enum:"online,stale,offline"`
+	LastSeen    *time.Time   `json:"last_seen,omitempty" doc:"When the plugin last registered or answered a health check"`
+	StatusSince *time.Time   `json:"status_since,omitempty"`
+	Quarantined bool         `json:"quarantined" doc:"Whether the plugin failed registration validation; quarantined plugins are registered but not routable"`
+	// QuarantineReasons lists the validation failures of a quarantined plugin.
+	QuarantineReasons []string             `json:"quarantine_reasons,omitempty"`
+	Circuit           CircuitBreakerStatus `json:"circuit"`
+	RPCMethods        []string             `json:"rpc_methods,omitempty" doc:"Extra RPC methods the plugin advertised, callable through POST /api/plugins/{plugin_id}/rpc/{method}"`
+}
+
+func gatewayPluginRegistration(pluginID string, rec pluginRecord) GatewayPluginRegistration {
+	out := GatewayPluginRegistration{
+		Registration:      rec.Registration,
+		Status:            rec.Status,
+		Quarantined:       len(rec.Quarantine) > 0,
+		QuarantineReasons: rec.Quarantine,
+		Circuit:           pluginBreakers.Status(pluginID),
+	}
+	if out.Status == "" {
+		out.Status = PluginOnline
+	}
+	for name := range rec.Methods {
+		out.RPCMethods = append(out.RPCMethods, name)
+	}
+	sort.Strings(out.RPCMethods)
+	if !rec.LastSeen.IsZero() {
+		seen := rec.LastSeen.UTC()
+		out.LastSeen = &seen
+	}
+	if !rec.StatusSince.IsZero() {
+		since := rec.StatusSince.UTC()
+		out.StatusSince = &since
+	}
+	return out
+}
+
+type ListPluginsOutput struct {
+	Body map[string]GatewayPluginRegistration
+}
+
+type RPCTimeoutsOutput struct{ Body RPCTimeouts }
+
+type SetRPCTimeoutsInput struct {
+	Body RPCTimeouts
+}
 
 type SystemStatsOutput struct {
 	Body struct {
@@ -50,11 +99,16 @@ func registerSystemRoutes(api huma.API) {
 		Method:      http.MethodGet,
 		Path:        types.RPCMethodHealthCheck,
 		Summary:     "Health check",
-		Description: "Returns gateway health. Pass ?id=plugin_id to check a specific plugin's health.",
+		Description: "Returns gateway health. Pass ?id=plugin_id to check a specific plugin's health. Gateway health is degraded while any plugin's RPC circuit breaker is open.",
 		Tags:        []string{"system"},
 	}, func(ctx context.Context, input *HealthInput) (*HealthOutput, error) {
 		if input.PluginID == "" {
-			return &HealthOutput{Body: map[string]any{"status": "ok"}}, nil
+			body := map[string]any{"status": "ok", "circuits": pluginBreakers.All()}
+			if open := pluginBreakers.Open(); len(open) > 0 {
+				body["status"] = "degraded"
+				body["open_circuits"] = open
+			}
+			return &HealthOutput{Body: body}, nil
 		}
 		regMu.RLock()
 		record, ok := registry[input.PluginID]
@@ -62,12 +116,16 @@ func registerSystemRoutes(api huma.API) {
 		if !ok {
 			return nil, pluginErr("plugin not found")
 		}
-		resp := routeRPC(record.Registration.Manifest.ID, types.RPCMethodHealthCheck, nil)
+		resp := routeRPCContext(ctx, record.Registration.Manifest.ID, types.RPCMethodHealthCheck, nil)
 		if resp.Error != nil {
 			return nil, &apiError{status: http.StatusServiceUnavailable, Message: resp.Error.Message}
 		}
 		var result map[string]any
 		json.Unmarshal(resp.Result, &result)
+		if result == nil {
+			result = map[string]any{}
+		}
+		result["circuit"] = pluginBreakers.Status(input.PluginID)
 		return &HealthOutput{Body: result}, nil
 	})
 
@@ -87,18 +145,43 @@ func registerSystemRoutes(api huma.API) {
 		Method:      http.MethodGet,
 		Path:        "/api/plugins",
 		Summary:     "List registered plugins",
-		Description: "Returns all plugins that have registered with the gateway via NATS, keyed by plugin ID.",
+		Description: "Returns all plugins that have registered with the gateway via NATS, keyed by plugin ID, with each plugin's liveness (online, stale or offline), when it was last seen, whether it is quarantined and why, and the state of its RPC circuit breaker. A plugin is quarantined when its manifest declares an incompatible sdk_version, redefines a core domain schema or conflicts with another plugin's schema for the same domain, or when another RPC subject is registering the same plugin ID.",
 		Tags:        []string{"plugins"},
 	}, func(ctx context.Context, input *struct{}) (*ListPluginsOutput, error) {
 		regMu.RLock()
 		defer regMu.RUnlock()
-		out := make(map[string]types.Registration, len(registry))
+		out := make(map[string]GatewayPluginRegistration, len(registry))
 		for k, v := range registry {
-			out[k] = v.Registration
+			out[k] = gatewayPluginRegistration(k, v)
 		}
 		return &ListPluginsOutput{Body: out}, nil
 	})
 
+	huma.Register(api, huma.Operation{
+		OperationID: "get-rpc-timeouts",
+		Method:      http.MethodGet,
+		Path:        "/api/rpc/timeouts",
+		Summary:     "Get plugin RPC timeouts",
+		Description: "Returns the configured gateway-wide, per-method and per-plugin RPC timeouts. Method-specific timeouts win over plugin-wide ones, and configured values win over those a plugin advertises in its manifest.",
+		Tags:        []string{"plugins"},
+	}, func(ctx context.Context, input *struct{}) (*RPCTimeoutsOutput, error) {
+		return &RPCTimeoutsOutput{Body: rpcTimeouts.Get()}, nil
+	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "set-rpc-timeouts",
+		Method:      http.MethodPut,
+		Path:        "/api/rpc/timeouts",
+		Summary:     "Set plugin RPC timeouts",
+		Description: "Replaces the RPC timeout configuration. Changes are persisted in the gateway data dir and apply to RPCs sent afterwards.",
+		Tags:        []string{"plugins"},
+	}, func(ctx context.Context, input *SetRPCTimeoutsInput) (*RPCTimeoutsOutput, error) {
+		if err := rpcTimeouts.Set(input.Body); err != nil {
+			return nil, badReqErr(err.Error())
+		}
+		return &RPCTimeoutsOutput{Body: rpcTimeouts.Get()}, nil
+	})
+
 	huma.Register(api, huma.Operation{
 		OperationID: "system-backup",
 		Method:      http.MethodGet,
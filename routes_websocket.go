@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// socketPongWait is how long a connection may stay silent, pongs
+	// included, before it is closed; pings go out every socketPingPeriod.
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = 30 * time.Second
+	socketWriteWait  = 10 * time.Second
+	// maxSocketMessage caps the size of one client message.
+	maxSocketMessage = 1 << 20
+	// maxSocketSubscriptions bounds the subscriptions one connection holds.
+	maxSocketSubscriptions = 64
+)
+
+// Socket message types. Clients send subscribe, unsubscribe, command and ping;
+// the gateway answers with the others.
+const (
+	socketSubscribe          = "subscribe"
+	socketUnsubscribe        = "unsubscribe"
+	socketCommand            = "command"
+	socketPing               = "ping"
+	socketSubscribed         = "subscribed"
+	socketUnsubscribed       = "unsubscribed"
+	socketEvent              = "event"
+	socketGap                = "gap"
+	socketSubscriptionClosed = "subscription_closed"
+	socketCommandStatus      = "command_status"
+	socketPong               = "pong"
+	socketError              = "error"
+)
+
+// SocketRequest is a message from a WebSocket client. ID is chosen by the
+// client and echoed on every reply to the request, including each status
+// update of a command.
+type SocketRequest struct {
+	Type           string          `json:"type"`
+	ID             string          `json:"id,omitempty"`
+	Filter         *EventFilter    `json:"filter,omitempty"`
+	Overflow       OverflowPolicy  `json:"overflow,omitempty"`
+	SubscriptionID string          `json:"subscription_id,omitempty"`
+	PluginID       string          `json:"plugin_id,omitempty"`
+	DeviceID       string          `json:"device_id,omitempty"`
+	EntityID       string          `json:"entity_id,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	CorrelationID  string          `json:"correlation_id,omitempty"`
+}
+
+// SocketMessage is a message to a WebSocket client.
+type SocketMessage struct {
+	Type           string                `json:"type"`
+	ID             string                `json:"id,omitempty"`
+	SubscriptionID string                `json:"subscription_id,omitempty"`
+	Event          *SubscriptionEvent    `json:"event,omitempty"`
+	Gap            *EventGap             `json:"gap,omitempty"`
+	Status         *GatewayCommandStatus `json:"status,omitempty"`
+	Reason         string                `json:"reason,omitempty"`
+	Error          string                `json:"error,omitempty"`
+	Code           int                   `json:"code,omitempty"`
+	Details        []PayloadFieldError   `json:"details,omitempty"`
+	CommandID      string                `json:"command_id,omitempty"`
+}
+
+// socketConnections counts open WebSocket connections.
+var socketConnections atomic.Int64
+
+// socketOriginsFromEnv reads the origins, besides the gateway's own, that may
+// open WebSocket connections from a browser: a comma-separated list in
+// GATEWAY_WS_ALLOWED_ORIGINS, or "*" for any.
+func socketOriginsFromEnv() map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(getenv("GATEWAY_WS_ALLOWED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		}
+	}
+	return origins
+}
+
+func newSocketUpgrader() *websocket.Upgrader {
+	allowed := socketOriginsFromEnv()
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || allowed["*"] || allowed[strings.ToLower(origin)] {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+}
+
+// registerWebSocketRoutes adds the WebSocket API. It is a plain Gin route
+// because huma cannot hand over the connection; the OpenAPI operation is
+// added by hand.
+func registerWebSocketRoutes(r *gin.Engine, api huma.API) {
+	upgrader := newSocketUpgrader()
+	r.GET("/api/ws", func(c *gin.Context) {
+		if dynamicEventService == nil || commandService == nil {
+			c.JSON(http.StatusServiceUnavailable, &apiError{Message: "websocket API not available"})
+			return
+		}
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// The upgrader has already answered.
+			return
+		}
+		conn := newSocketConn(c.Request.Context(), ws)
+		conn.headers = policyHeaders(c.Request.Header.Get)
+		conn.serve()
+	})
+
+	api.OpenAPI().AddOperation(&huma.Operation{
+		OperationID: "open-websocket",
+		Method:      http.MethodGet,
+		Path:        "/api/ws",
+		Summary:     "Open WebSocket for realtime events and commands",
+		Description: "Upgrades to a WebSocket carrying JSON messages in both directions, so one connection can both watch events and send commands. " +
+			"Every client message has a type and a client-chosen id, echoed on each reply. " +
+			"{\"type\":\"subscribe\",\"id\",\"filter\":EventFilter,\"overflow\"} creates a dynamic event subscription, as create-event-subscription does, and answers subscribed with its subscription_id; " +
+			"matching events then arrive as {\"type\":\"event\",\"subscription_id\",\"event\"}, lost events as {\"type\":\"gap\",\"subscription_id\",\"gap\"}, and a subscription closed by the disconnect overflow policy as subscription_closed with a reason. " +
+			"{\"type\":\"unsubscribe\",\"id\",\"subscription_id\"} ends one. Subscriptions belong to the connection and end with it. " +
+			"{\"type\":\"command\",\"id\",\"plugin_id\",\"device_id\",\"entity_id\",\"payload\",\"correlation_id\"} submits a command as send-command does, in the order received; " +
+			"each command gets its own correlation ID, correlation_id if given, else a generated one, as each HTTP request does. " +
+			"its status arrives as {\"type\":\"command_status\",\"id\",\"status\"} when accepted and on every change until it is terminal. " +
+			"{\"type\":\"ping\",\"id\"} is answered with pong. Failures are answered with {\"type\":\"error\",\"id\",\"error\",\"code\"}, where code is the HTTP status the REST API would return. " +
+			"Browsers may connect from the gateway's own origin or those listed in GATEWAY_WS_ALLOWED_ORIGINS.",
+		Tags: []string{"events"},
+		Responses: map[string]*huma.Response{
+			"101": {Description: "Switching to the WebSocket protocol"},
+			"503": {Description: "Event subscriptions or commands are not available"},
+		},
+	})
+}
+
+// socketConn is one WebSocket connection and the subscriptions and commands
+// it owns.
+type socketConn struct {
+	ws      *websocket.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	headers map[string]string
+	writeMu sync.Mutex
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	subs     map[string]context.CancelFunc
+	commands map[string]bool
+}
+
+func newSocketConn(ctx context.Context, ws *websocket.Conn) *socketConn {
+	ctx, cancel := context.WithCancel(ctx)
+	return &socketConn{
+		ws:       ws,
+		ctx:      ctx,
+		cancel:   cancel,
+		subs:     make(map[string]context.CancelFunc),
+		commands: make(map[string]bool),
+	}
+}
+
+// serve reads client messages until the connection closes, then removes the
+// connection's subscriptions.
+func (c *socketConn) serve() {
+	socketConnections.Add(1)
+	defer socketConnections.Add(-1)
+	defer c.ws.Close()
+	defer c.wg.Wait()
+	defer c.closeSubscriptions()
+	defer c.cancel()
+
+	c.ws.SetReadLimit(maxSocketMessage)
+	_ = c.ws.SetReadDeadline(time.Now().Add(socketPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+	c.wg.Add(1)
+	go c.keepAlive()
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Info("websocket closed", "error", err)
+			}
+			return
+		}
+		_ = c.ws.SetReadDeadline(time.Now().Add(socketPongWait))
+		var req SocketRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.sendErr("", badReqErr("invalid message: "+err.Error()))
+			continue
+		}
+		c.handle(req)
+	}
+}
+
+func (c *socketConn) handle(req SocketRequest) {
+	switch req.Type {
+	case socketSubscribe:
+		c.subscribe(req)
+	case socketUnsubscribe:
+		c.unsubscribe(req)
+	case socketCommand:
+		c.command(req)
+	case socketPing:
+		c.send(SocketMessage{Type: socketPong, ID: req.ID})
+	default:
+		c.sendErr(req.ID, badReqErr(fmt.Sprintf("unknown message type %q", req.Type)))
+	}
+}
+
+// keepAlive pings the client so dead connections are noticed.
+func (c *socketConn) keepAlive() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(socketPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				c.cancel()
+				return
+			}
+		}
+	}
+}
+
+// send writes msg, closing the connection if the client cannot keep up.
+func (c *socketConn) send(msg SocketMessage) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.ctx.Err() != nil {
+		return false
+	}
+	_ = c.ws.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.cancel()
+		_ = c.ws.Close()
+		return false
+	}
+	return true
+}
+
+func (c *socketConn) sendErr(id string, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = &apiError{status: http.StatusInternalServerError, Message: err.Error()}
+	}
+	c.send(SocketMessage{Type: socketError, ID: id, Error: apiErr.Message, Code: apiErr.status, Details: apiErr.Details, CommandID: apiErr.CommandID})
+}
+
+func (c *socketConn) subscribe(req SocketRequest) {
+	c.mu.Lock()
+	full := len(c.subs) >= maxSocketSubscriptions
+	c.mu.Unlock()
+	if full {
+		c.sendErr(req.ID, conflictErr(fmt.Sprintf("at most %d subscriptions per connection", maxSocketSubscriptions)))
+		return
+	}
+	var filter EventFilter
+	if req.Filter != nil {
+		filter = *req.Filter
+	}
+	id, err := dynamicEventService.Subscribe(filter, SubscriptionOptions{Overflow: req.Overflow})
+	if errors.Is(err, ErrReplayUnavailable) {
+		c.sendErr(req.ID, upstreamErr(err.Error()))
+		return
+	}
+	if err != nil {
+		c.sendErr(req.ID, badReqErr(err.Error()))
+		return
+	}
+	sub, _ := dynamicEventService.lookup(id)
+	ctx, stop := context.WithCancel(c.ctx)
+	c.mu.Lock()
+	c.subs[id] = stop
+	c.mu.Unlock()
+	// Acknowledge before the pump can deliver anything.
+	c.send(SocketMessage{Type: socketSubscribed, ID: req.ID, SubscriptionID: id})
+	c.wg.Add(1)
+	go c.pump(ctx, sub)
+}
+
+// pump forwards a subscription's events until ctx ends or the subscription
+// closes. The open stream holds the subscription's lease.
+func (c *socketConn) pump(ctx context.Context, sub *dynamicSub) {
+	defer c.wg.Done()
+	closeStream := sub.openStream()
+	defer closeStream()
+	for {
+		events, ok := sub.next(ctx)
+		for _, ev := range events {
+			msg := SocketMessage{Type: socketEvent, SubscriptionID: sub.id}
+			if ev.Gap != nil {
+				msg.Type, msg.Gap = socketGap, ev.Gap
+			} else {
+				msg.Event = &ev
+			}
+			if !c.send(msg) {
+				return
+			}
+		}
+		if !ok {
+			if ctx.Err() == nil {
+				c.release(sub.id)
+				dynamicEventService.forget(sub)
+				c.send(SocketMessage{Type: socketSubscriptionClosed, SubscriptionID: sub.id, Reason: sub.reason()})
+			}
+			return
+		}
+	}
+}
+
+func (c *socketConn) unsubscribe(req SocketRequest) {
+	stop, ok := c.release(req.SubscriptionID)
+	if !ok {
+		c.sendErr(req.ID, notFoundErr(fmt.Sprintf("subscription %q not found on this connection", req.SubscriptionID)))
+		return
+	}
+	stop()
+	dynamicEventService.Unsubscribe(req.SubscriptionID)
+	c.send(SocketMessage{Type: socketUnsubscribed, ID: req.ID, SubscriptionID: req.SubscriptionID})
+}
+
+// release removes subscription id from the connection.
+func (c *socketConn) release(id string) (context.CancelFunc, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stop, ok := c.subs[id]
+	delete(c.subs, id)
+	return stop, ok
+}
+
+func (c *socketConn) closeSubscriptions() {
+	c.mu.Lock()
+	ids := make([]string, 0, len(c.subs))
+	for id := range c.subs {
+		ids = append(ids, id)
+	}
+	c.subs = make(map[string]context.CancelFunc)
+	c.mu.Unlock()
+	for _, id := range ids {
+		dynamicEventService.Unsubscribe(id)
+	}
+}
+
+// command submits a command. It runs on the read loop so commands are
+// submitted in the order they arrive; status updates are followed in the
+// background.
+func (c *socketConn) command(req SocketRequest) {
+	if req.ID == "" {
+		c.sendErr("", badReqErr("command requires an id"))
+		return
+	}
+	if req.PluginID == "" || req.DeviceID == "" || req.EntityID == "" {
+		c.sendErr(req.ID, badReqErr("command requires plugin_id, device_id and entity_id"))
+		return
+	}
+	correlationID := strings.TrimSpace(req.CorrelationID)
+	if correlationID == "" {
+		correlationID = newCorrelationID()
+	} else if !validCorrelationID(correlationID) {
+		c.sendErr(req.ID, badReqErr(fmt.Sprintf("correlation_id must be 1-%d printable ASCII characters", maxCorrelationIDLen)))
+		return
+	}
+	c.mu.Lock()
+	inFlight := c.commands[req.ID]
+	if !inFlight {
+		c.commands[req.ID] = true
+	}
+	c.mu.Unlock()
+	if inFlight {
+		c.sendErr(req.ID, conflictErr(fmt.Sprintf("command %q is still in flight", req.ID)))
+		return
+	}
+
+	payload, opts, err := splitCommandOptions(req.Payload)
+	if err != nil {
+		c.endCommand(req.ID)
+		c.sendErr(req.ID, badReqErr(err.Error()))
+		return
+	}
+	opts.Headers = c.headers
+	opts.CorrelationID = correlationID
+	status, err := commandService.SubmitWithOptions(req.PluginID, req.DeviceID, req.EntityID, payload, opts)
+	if err != nil {
+		c.endCommand(req.ID)
+		c.sendErr(req.ID, sendCommandErr(status, err))
+		return
+	}
+	c.send(SocketMessage{Type: socketCommandStatus, ID: req.ID, Status: &status})
+	c.wg.Add(1)
+	go c.followCommand(req.ID, status)
+}
+
+// followCommand sends every change of a command's status until it is
+// terminal or the connection closes.
+func (c *socketConn) followCommand(id string, last GatewayCommandStatus) {
+	defer c.wg.Done()
+	defer c.endCommand(id)
+	updates, stop := commandService.follow(last.CommandID)
+	defer stop()
+	forward := func(status GatewayCommandStatus) bool {
+		if status.State != last.State || status.Attempts != last.Attempts || !status.LastUpdatedAt.Equal(last.LastUpdatedAt) {
+			last = status
+			c.send(SocketMessage{Type: socketCommandStatus, ID: id, Status: &status})
+		}
+		return !isTerminalCommandState(status.State)
+	}
+	// The command may have moved on before the follow was registered.
+	if status, ok := commandService.GetStatus(last.CommandID); ok && !forward(status) {
+		return
+	}
+	for {
+		select {
+		case status, open := <-updates:
+			if !open || !forward(status) {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *socketConn) endCommand(id string) {
+	c.mu.Lock()
+	delete(c.commands, id)
+	c.mu.Unlock()
+}
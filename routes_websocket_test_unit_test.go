@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+func TestWebSocket_SubscribeCommandPing(t *testing.T) {
+	ResetGlobals()
+	svc := newDynamicEventService()
+	dynamicEventService = svc
+	commandService = CommandService()
+	defer func() { dynamicEventService = nil }()
+
+	router, _ := buildRouter()
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	roundTrip := func(req SocketRequest) SocketMessage {
+		t.Helper()
+		if err := ws.WriteJSON(req); err != nil {
+			t.Fatal(err)
+		}
+		var msg SocketMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	if msg := roundTrip(SocketRequest{Type: "ping", ID: "p1"}); msg.Type != socketPong || msg.ID != "p1" {
+		t.Fatalf("expected pong p1, got %+v", msg)
+	}
+	if msg := roundTrip(SocketRequest{Type: "shout", ID: "x1"}); msg.Type != socketError || msg.Code != 400 || msg.ID != "x1" {
+		t.Fatalf("expected a 400 error for an unknown type, got %+v", msg)
+	}
+
+	sub := roundTrip(SocketRequest{Type: "subscribe", ID: "s1", Filter: &EventFilter{Action: "turn_on"}})
+	if sub.Type != socketSubscribed || sub.SubscriptionID == "" {
+		t.Fatalf("expected subscribed, got %+v", sub)
+	}
+	svc.handle(&nats.Msg{Data: []byte(`{"plugin_id":"p","entity_id":"e","payload":{"type":"turn_off"}}`)})
+	svc.handle(&nats.Msg{Data: []byte(`{"plugin_id":"p","entity_id":"e","payload":{"type":"turn_on"}}`)})
+	var ev SocketMessage
+	if err := ws.ReadJSON(&ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != socketEvent || ev.SubscriptionID != sub.SubscriptionID || ev.Event == nil || !strings.Contains(string(ev.Event.Payload), "turn_on") {
+		t.Fatalf("expected the turn_on event, got %+v", ev)
+	}
+
+	cmd := roundTrip(SocketRequest{Type: "command", ID: "c1", PluginID: "p", DeviceID: "d", EntityID: "missing", Payload: []byte(`{"type":"turn_on"}`)})
+	if cmd.Type != socketError || cmd.ID != "c1" || cmd.Code != 404 {
+		t.Fatalf("expected a 404 error for c1, got %+v", cmd)
+	}
+	cmd = roundTrip(SocketRequest{Type: "command", ID: "c2", PluginID: "p", DeviceID: "d", EntityID: "e", Payload: []byte(`{"type":"turn_on"}`), CorrelationID: "bad id"})
+	if cmd.Type != socketError || cmd.ID != "c2" || cmd.Code != 400 {
+		t.Fatalf("expected a 400 error for an invalid correlation_id, got %+v", cmd)
+	}
+
+	if msg := roundTrip(SocketRequest{Type: "unsubscribe", ID: "u1", SubscriptionID: sub.SubscriptionID}); msg.Type != socketUnsubscribed {
+		t.Fatalf("expected unsubscribed, got %+v", msg)
+	}
+	if msg := roundTrip(SocketRequest{Type: "unsubscribe", ID: "u2", SubscriptionID: sub.SubscriptionID}); msg.Code != 404 {
+		t.Fatalf("expected unsubscribing twice to fail, got %+v", msg)
+	}
+
+	// Subscriptions end with the connection.
+	roundTrip(SocketRequest{Type: "subscribe", ID: "s2"})
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if active, _ := svc.Stats(); active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection's subscriptions to be removed when it closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
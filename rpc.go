@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
 	"github.com/slidebolt/sdk-types"
 )
 
+// rpcRequestSeq numbers outgoing JSON-RPC requests so each carries its own ID.
+var rpcRequestSeq atomic.Uint64
+
+// rpcErrCancelled is the JSON-RPC error code routeRPCContext reports when the
+// caller's context ends before the plugin answers.
+const rpcErrCancelled = -32002
+
 func routeRPC(pluginID, method string, params any) types.Response {
+	return routeRPCContext(context.Background(), pluginID, method, params)
+}
+
+// routeRPCContext sends a JSON-RPC request to pluginID and waits for the
+// answer until the method's timeout (see rpcTimeoutStore.Resolve) elapses or
+// ctx ends, whichever comes first.
+func routeRPCContext(ctx context.Context, pluginID, method string, params any) types.Response {
 	started := time.Now()
 	traceRPC := method == "entities/commands/create" || method == "commands/status/get" || method == "entities/list"
 	regMu.RLock()
@@ -19,25 +38,67 @@ func routeRPC(pluginID, method string, params any) types.Response {
 	regMu.RUnlock()
 	if !exists {
 		log.Printf("gateway rpc: plugin not registered plugin=%s method=%s", pluginID, method)
-		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: -32000, Message: "plugin not registered"}}
+		metrics.observeRPCRejected(pluginID, method, rpcErrPluginUnavailable)
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrPluginUnavailable, Message: "plugin not registered"}}
+	}
+	if record.Status == PluginOffline {
+		metrics.observeRPCRejected(pluginID, method, rpcErrPluginUnavailable)
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrPluginUnavailable, Message: "plugin offline"}}
+	}
+	if len(record.Quarantine) > 0 {
+		metrics.observeRPCRejected(pluginID, method, rpcErrPluginUnavailable)
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrPluginUnavailable, Message: "plugin quarantined: " + strings.Join(record.Quarantine, "; ")}}
 	}
 	reg := record.Registration
+	if err := ctx.Err(); err != nil {
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrCancelled, Message: "request cancelled"}}
+	}
+	if !pluginBreakers.Allow(pluginID, started) {
+		log.Printf("gateway rpc: circuit open plugin=%s method=%s", pluginID, method)
+		metrics.observeRPCRejected(pluginID, method, rpcErrCircuitOpen)
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrCircuitOpen, Message: "plugin circuit open"}}
+	}
 	paramsBytes, _ := json.Marshal(params)
 	if traceRPC {
 		log.Printf("gateway virtual-cmd: rpc start plugin=%s method=%s payload=%s", pluginID, method, string(paramsBytes))
 	}
-	id := json.RawMessage(`1`)
+	id := json.RawMessage(strconv.FormatUint(rpcRequestSeq.Add(1), 10))
 	req := types.Request{JSONRPC: types.JSONRPCVersion, ID: &id, Method: method, Params: paramsBytes}
 	data, _ := json.Marshal(req)
-	msg, err := nc.Request(reg.RPCSubject, data, 2*time.Second)
+	timeout := rpcTimeouts.Resolve(pluginID, method, record.Timeouts)
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out := nats.NewMsg(reg.RPCSubject)
+	out.Data = data
+	if corrID := correlationIDFrom(ctx); corrID != "" {
+		out.Header.Set(headerCorrelationID, corrID)
+	}
+	msg, err := nc.RequestMsgWithContext(rctx, out)
 	if err != nil {
-		log.Printf("gateway rpc: timeout plugin=%s method=%s duration_ms=%d err=%v", pluginID, method, time.Since(started).Milliseconds(), err)
-		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: -32000, Message: "plugin timeout"}}
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about the plugin's health.
+			log.Printf("gateway rpc: cancelled plugin=%s method=%s duration_ms=%d err=%v", pluginID, method, time.Since(started).Milliseconds(), ctx.Err())
+			pluginBreakers.Release(pluginID)
+			return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrCancelled, Message: "request cancelled"}}
+		}
+		log.Printf("gateway rpc: timeout plugin=%s method=%s timeout_ms=%d duration_ms=%d err=%v", pluginID, method, timeout.Milliseconds(), time.Since(started).Milliseconds(), err)
+		pluginBreakers.Record(pluginID, err.Error(), time.Now())
+		metrics.observeRPCTimeout(pluginID, method, time.Since(started))
+		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: rpcErrPluginUnavailable, Message: "plugin timeout"}}
 	}
 	var resp types.Response
 	if err := json.Unmarshal(msg.Data, &resp); err != nil {
 		log.Printf("gateway rpc: malformed response plugin=%s method=%s duration_ms=%d err=%v", pluginID, method, time.Since(started).Milliseconds(), err)
-		return types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: -32700, Message: "malformed response from plugin"}}
+		pluginBreakers.Record(pluginID, "malformed response: "+err.Error(), time.Now())
+		resp = types.Response{JSONRPC: types.JSONRPCVersion, Error: &types.RPCError{Code: -32700, Message: "malformed response from plugin"}}
+		metrics.observeRPC(pluginID, method, time.Since(started), resp)
+		return resp
+	}
+	metrics.observeRPC(pluginID, method, time.Since(started), resp)
+	// A JSON-RPC error still means the plugin is up and answering.
+	pluginBreakers.Record(pluginID, "", time.Now())
+	if len(resp.ID) > 0 && string(resp.ID) != "null" && string(resp.ID) != string(id) {
+		log.Printf("gateway rpc: response id mismatch plugin=%s method=%s want=%s got=%s", pluginID, method, id, resp.ID)
 	}
 	if resp.Error != nil {
 		log.Printf("gateway rpc: plugin returned error plugin=%s method=%s duration_ms=%d code=%d msg=%q", pluginID, method, time.Since(started).Milliseconds(), resp.Error.Code, resp.Error.Message)
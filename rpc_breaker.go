@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcErrCircuitOpen is the JSON-RPC error code routeRPC reports when a call is
+// rejected without being sent because the plugin's circuit breaker is open.
+const rpcErrCircuitOpen = -32001
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = 30 * time.Second
+)
+
+// CircuitState is the state of a plugin's RPC circuit breaker.
+type CircuitState string
+
+const (
+	// CircuitClosed: calls go through; consecutive failures are counted.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen: calls fail fast until the cooldown has passed.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen: one probe call is let through; its outcome closes or
+	// re-opens the circuit.
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// breakerConfig controls when a plugin's circuit opens and how long it stays
+// open. Override with GATEWAY_RPC_BREAKER_THRESHOLD and
+// GATEWAY_RPC_BREAKER_COOLDOWN.
+type breakerConfig struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+func breakerConfigFromEnv() breakerConfig {
+	cfg := breakerConfig{FailureThreshold: defaultBreakerFailureThreshold, Cooldown: defaultBreakerCooldown}
+	if v := strings.TrimSpace(getenv("GATEWAY_RPC_BREAKER_THRESHOLD")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.FailureThreshold = n
+		} else {
+			slog.Warn("invalid GATEWAY_RPC_BREAKER_THRESHOLD, using default", "value", v, "default", cfg.FailureThreshold)
+		}
+	}
+	if v := strings.TrimSpace(getenv("GATEWAY_RPC_BREAKER_COOLDOWN")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.Cooldown = d
+		} else {
+			slog.Warn("invalid GATEWAY_RPC_BREAKER_COOLDOWN, using default", "value", v, "default", cfg.Cooldown)
+		}
+	}
+	return cfg
+}
+
+// CircuitBreakerStatus is a snapshot of one plugin's circuit breaker.
+type CircuitBreakerStatus struct {
+	State               CircuitState `json:"state" enum:"closed,open,half_open"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Trips               int          `json:"trips" doc:"Number of times the circuit has opened"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	RetryAt             *time.Time   `json:"retry_at,omitempty" doc:"When an open circuit will let a probe call through"`
+	LastError           string       `json:"last_error,omitempty"`
+}
+
+type circuitBreaker struct {
+	state     CircuitState
+	failures  int
+	trips     int
+	openedAt  time.Time
+	probing   bool
+	lastError string
+}
+
+// pluginBreakerSet holds one circuit breaker per plugin ID.
+type pluginBreakerSet struct {
+	mu       sync.Mutex
+	cfg      breakerConfig
+	breakers map[string]*circuitBreaker
+}
+
+func newPluginBreakerSet(cfg breakerConfig) *pluginBreakerSet {
+	return &pluginBreakerSet{cfg: cfg, breakers: make(map[string]*circuitBreaker)}
+}
+
+func (s *pluginBreakerSet) getLocked(pluginID string) *circuitBreaker {
+	b, ok := s.breakers[pluginID]
+	if !ok {
+		b = &circuitBreaker{state: CircuitClosed}
+		s.breakers[pluginID] = b
+	}
+	return b
+}
+
+// Allow reports whether a call to pluginID may be sent. Once an open
+// circuit's cooldown has passed, a single probe call is allowed through.
+func (s *pluginBreakerSet) Allow(pluginID string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.getLocked(pluginID)
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < s.cfg.Cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		slog.Info("plugin circuit half-open", "plugin_id", pluginID)
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Record notes the outcome of a call allowed by Allow. failure is the
+// transport error, or "" if the plugin answered.
+func (s *pluginBreakerSet) Record(pluginID, failure string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.getLocked(pluginID)
+	b.probing = false
+	if failure == "" {
+		if b.state != CircuitClosed {
+			slog.Info("plugin circuit closed", "plugin_id", pluginID)
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastError = failure
+	if b.state == CircuitHalfOpen || b.failures >= s.cfg.FailureThreshold {
+		if b.state != CircuitOpen {
+			b.trips++
+			slog.Warn("plugin circuit opened", "plugin_id", pluginID, "consecutive_failures", b.failures, "error", failure)
+		}
+		b.state = CircuitOpen
+		b.openedAt = now
+	}
+}
+
+// Release ends a call allowed by Allow without recording an outcome, e.g.
+// when the caller cancelled it.
+func (s *pluginBreakerSet) Release(pluginID string) {
+	s.mu.Lock()
+	s.getLocked(pluginID).probing = false
+	s.mu.Unlock()
+}
+
+// Status returns a snapshot of pluginID's breaker.
+func (s *pluginBreakerSet) Status(pluginID string) CircuitBreakerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[pluginID]
+	if !ok {
+		return CircuitBreakerStatus{State: CircuitClosed}
+	}
+	return s.statusLocked(b)
+}
+
+// All returns a snapshot of every breaker that has seen a call.
+func (s *pluginBreakerSet) All() map[string]CircuitBreakerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]CircuitBreakerStatus, len(s.breakers))
+	for id, b := range s.breakers {
+		out[id] = s.statusLocked(b)
+	}
+	return out
+}
+
+// Open lists the plugin IDs whose circuit is not closed.
+func (s *pluginBreakerSet) Open() []string {
+	var out []string
+	for id, st := range s.All() {
+		if st.State != CircuitClosed {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Reset forgets all breaker state.
+func (s *pluginBreakerSet) Reset() {
+	s.mu.Lock()
+	s.breakers = make(map[string]*circuitBreaker)
+	s.mu.Unlock()
+}
+
+func (s *pluginBreakerSet) statusLocked(b *circuitBreaker) CircuitBreakerStatus {
+	st := CircuitBreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		LastError:           b.lastError,
+	}
+	if b.state != CircuitClosed {
+		opened := b.openedAt.UTC()
+		retry := opened.Add(s.cfg.Cooldown)
+		st.OpenedAt, st.RetryAt = &opened, &retry
+	}
+	return st
+}
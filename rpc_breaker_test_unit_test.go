@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPluginBreakers_OpenHalfOpenClose(t *testing.T) {
+	s := newPluginBreakerSet(breakerConfig{FailureThreshold: 3, Cooldown: 10 * time.Second})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if !s.Allow("p", now) {
+			t.Fatalf("call %d should be allowed while closed", i)
+		}
+		s.Record("p", "nats: timeout", now)
+	}
+	if st := s.Status("p"); st.State != CircuitClosed || st.ConsecutiveFailures != 2 {
+		t.Fatalf("expected closed with 2 failures, got %+v", st)
+	}
+	s.Allow("p", now)
+	s.Record("p", "nats: timeout", now)
+	st := s.Status("p")
+	if st.State != CircuitOpen || st.Trips != 1 || st.RetryAt == nil || !st.RetryAt.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("expected open after threshold, got %+v", st)
+	}
+	if s.Allow("p", now.Add(5*time.Second)) {
+		t.Fatal("expected fast fail during cooldown")
+	}
+	if got := s.Open(); len(got) != 1 || got[0] != "p" {
+		t.Fatalf("unexpected open circuits %v", got)
+	}
+
+	probe := now.Add(11 * time.Second)
+	if !s.Allow("p", probe) {
+		t.Fatal("expected a probe after cooldown")
+	}
+	if s.Status("p").State != CircuitHalfOpen {
+		t.Fatal("expected half-open while probing")
+	}
+	if s.Allow("p", probe) {
+		t.Fatal("expected only one probe in flight")
+	}
+	s.Record("p", "nats: timeout", probe)
+	if st := s.Status("p"); st.State != CircuitOpen || st.Trips != 2 {
+		t.Fatalf("expected failed probe to re-open, got %+v", st)
+	}
+
+	probe = probe.Add(11 * time.Second)
+	s.Allow("p", probe)
+	s.Record("p", "", probe)
+	if st := s.Status("p"); st.State != CircuitClosed || st.ConsecutiveFailures != 0 || st.OpenedAt != nil {
+		t.Fatalf("expected successful probe to close, got %+v", st)
+	}
+}
+
+func TestPluginBreakers_SuccessResetsCount(t *testing.T) {
+	s := newPluginBreakerSet(breakerConfig{FailureThreshold: 2, Cooldown: time.Second})
+	now := time.Now()
+	s.Record("p", "nats: timeout", now)
+	s.Record("p", "", now)
+	s.Record("p", "nats: timeout", now)
+	if st := s.Status("p"); st.State != CircuitClosed || st.ConsecutiveFailures != 1 {
+		t.Fatalf("expected success to reset the failure count, got %+v", st)
+	}
+	if st := s.Status("other"); st.State != CircuitClosed {
+		t.Fatalf("expected unknown plugins to be closed, got %+v", st)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"testing"
@@ -156,6 +157,68 @@ func TestRouteRPC_PluginTimeout(t *testing.T) {
 	}
 }
 
+// TestRouteRPC_ContextCancelled tests that a cancelled caller stops waiting
+// without counting against the plugin's circuit breaker
+func TestRouteRPC_ContextCancelled(t *testing.T) {
+	s, conn := setupTestServer(t)
+	defer teardownTestServer(t, s, conn)
+	nc = conn
+	ResetGlobals()
+
+	plugin := NewMockPlugin(t, conn, "slow-plugin")
+	plugin.Register()
+	defer plugin.Unregister()
+	plugin.Sub.Unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	resp := routeRPCContext(ctx, "slow-plugin", "entities/get", nil)
+
+	if resp.Error == nil || resp.Error.Code != rpcErrCancelled {
+		t.Fatalf("Expected cancelled error, got %+v", resp.Error)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected routeRPCContext to return on cancellation, took %v", elapsed)
+	}
+	if st := pluginBreakers.Status("slow-plugin"); st.ConsecutiveFailures != 0 {
+		t.Errorf("Expected cancellation not to count as a failure, got %+v", st)
+	}
+}
+
+// TestRouteRPC_UniqueRequestIDs tests that each request carries its own ID
+func TestRouteRPC_UniqueRequestIDs(t *testing.T) {
+	s, conn := setupTestServer(t)
+	defer teardownTestServer(t, s, conn)
+	nc = conn
+
+	seen := map[string]bool{}
+	sub, err := conn.Subscribe("plugins.id-plugin.rpc", func(msg *nats.Msg) {
+		var req types.Request
+		_ = json.Unmarshal(msg.Data, &req)
+		seen[string(*req.ID)] = true
+		data, _ := json.Marshal(types.Response{JSONRPC: types.JSONRPCVersion, ID: *req.ID, Result: json.RawMessage(`{}`)})
+		_ = msg.Respond(data)
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	regMu.Lock()
+	registry["id-plugin"] = pluginRecord{Registration: types.Registration{RPCSubject: "plugins.id-plugin.rpc"}, Valid: true}
+	regMu.Unlock()
+	defer ResetGlobals()
+
+	for i := 0; i < 3; i++ {
+		if resp := routeRPC("id-plugin", "entities/get", nil); resp.Error != nil {
+			t.Fatalf("call %d failed: %+v", i, resp.Error)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected 3 distinct request IDs, got %v", seen)
+	}
+}
+
 // TestRouteRPC_PluginError tests when plugin returns RPC error
 func TestRouteRPC_PluginError(t *testing.T) {
 	s, conn := setupTestServer(t)
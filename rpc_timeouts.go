@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const rpcTimeoutsFile = "rpc_timeouts.json"
+
+// defaultRPCTimeout applies when nothing more specific is configured.
+const defaultRPCTimeout = 2 * time.Second
+
+// builtinMethodTimeouts covers plugin operations known to take longer than a
+// plain read or write.
+var builtinMethodTimeouts = map[string]time.Duration{
+	"devices/refresh":  30 * time.Second,
+	"entities/refresh": 30 * time.Second,
+	"storage/flush":    30 * time.Second,
+	"plugin/reset":     30 * time.Second,
+}
+
+// PluginRPCTimeouts sets RPC timeouts for one plugin. Plugins may advertise
+// the same shape as "rpc_timeouts" in their manifest.
+type PluginRPCTimeouts struct {
+	DefaultMS int            `json:"default_ms,omitempty" doc:"Timeout for methods without their own entry, in milliseconds"`
+	Methods   map[string]int `json:"methods,omitempty" doc:"Per-method timeouts in milliseconds, keyed by RPC method"`
+}
+
+// RPCTimeouts is the persisted RPC timeout configuration: a gateway-wide
+// default, per-method timeouts and per-plugin overrides.
+type RPCTimeouts struct {
+	DefaultMS int                          `json:"default_ms,omitempty" doc:"Gateway-wide default timeout in milliseconds (default 2000)"`
+	Methods   map[string]int               `json:"methods,omitempty" doc:"Per-method timeouts in milliseconds, keyed by RPC method"`
+	Plugins   map[string]PluginRPCTimeouts `json:"plugins,omitempty"`
+}
+
+func (p PluginRPCTimeouts) validate() error {
+	if p.DefaultMS < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	for method, ms := range p.Methods {
+		if ms < 0 {
+			return fmt.Errorf("method %q: timeouts must not be negative", method)
+		}
+	}
+	return nil
+}
+
+func (t RPCTimeouts) validate() error {
+	if err := (PluginRPCTimeouts{DefaultMS: t.DefaultMS, Methods: t.Methods}).validate(); err != nil {
+		return err
+	}
+	for pluginID, p := range t.Plugins {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("plugin %q: %w", pluginID, err)
+		}
+	}
+	return nil
+}
+
+// rpcTimeoutStore guards the active RPCTimeouts and persists changes to the
+// gateway data dir.
+type rpcTimeoutStore struct {
+	mu       sync.RWMutex
+	timeouts RPCTimeouts
+	path     string
+}
+
+func newRPCTimeoutStore() *rpcTimeoutStore {
+	return &rpcTimeoutStore{}
+}
+
+// Load reads timeouts from dataDir. A missing file leaves the built-in
+// defaults in place.
+func (s *rpcTimeoutStore) Load(dataDir string) error {
+	path := filepath.Join(dataDir, rpcTimeoutsFile)
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	data, err := diskIO.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var t RPCTimeouts
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	s.mu.Lock()
+	s.timeouts = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *rpcTimeoutStore) Get() RPCTimeouts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.timeouts
+}
+
+// Set replaces the active timeouts and writes them to disk when a data dir
+// has been loaded.
+func (s *rpcTimeoutStore) Set(t RPCTimeouts) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.timeouts = t
+	path := s.path
+	s.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(t, "", "  ")
+	if err := diskIO.WriteFile(path, data, 0o644); err != nil {
+		slog.Warn("failed to persist rpc timeouts", "path", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Resolve returns the timeout for calling method on pluginID. Method-specific
+// settings win over plugin-wide ones; at each level the operator's
+// configuration wins over what the plugin advertises:
+//
+//	configured plugin method > advertised method > configured method > built-in method >
+//	configured plugin default > advertised default > configured default > 2s
+func (s *rpcTimeoutStore) Resolve(pluginID, method string, advertised PluginRPCTimeouts) time.Duration {
+	s.mu.RLock()
+	t := s.timeouts
+	s.mu.RUnlock()
+	plugin := t.Plugins[pluginID]
+
+	if ms := plugin.Methods[method]; ms > 0 {
+		return msDuration(ms)
+	}
+	if ms := advertised.Methods[method]; ms > 0 {
+		return msDuration(ms)
+	}
+	if ms := t.Methods[method]; ms > 0 {
+		return msDuration(ms)
+	}
+	if d, ok := builtinMethodTimeouts[method]; ok {
+		return d
+	}
+	if plugin.DefaultMS > 0 {
+		return msDuration(plugin.DefaultMS)
+	}
+	if advertised.DefaultMS > 0 {
+		return msDuration(advertised.DefaultMS)
+	}
+	if t.DefaultMS > 0 {
+		return msDuration(t.DefaultMS)
+	}
+	return defaultRPCTimeout
+}
+
+func msDuration(ms int) time.Duration { return time.Duration(ms) * time.Millisecond }
+
+// advertisedRPCTimeouts reads the optional "rpc_timeouts" block from a raw
+// registration message's manifest.
+func advertisedRPCTimeouts(data []byte) PluginRPCTimeouts {
+	var probe struct {
+		Manifest struct {
+			RPCTimeouts PluginRPCTimeouts `json:"rpc_timeouts"`
+		} `json:"manifest"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return PluginRPCTimeouts{}
+	}
+	if err := probe.Manifest.RPCTimeouts.validate(); err != nil {
+		return PluginRPCTimeouts{}
+	}
+	return probe.Manifest.RPCTimeouts
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRPCTimeouts_Resolve(t *testing.T) {
+	s := newRPCTimeoutStore()
+	if got := s.Resolve("p", "entities/list", PluginRPCTimeouts{}); got != defaultRPCTimeout {
+		t.Errorf("expected default timeout, got %v", got)
+	}
+	if got := s.Resolve("p", "devices/refresh", PluginRPCTimeouts{}); got != 30*time.Second {
+		t.Errorf("expected built-in refresh timeout, got %v", got)
+	}
+
+	advertised := PluginRPCTimeouts{DefaultMS: 5000, Methods: map[string]int{"storage/flush": 90000}}
+	if got := s.Resolve("p", "entities/list", advertised); got != 5*time.Second {
+		t.Errorf("expected advertised default, got %v", got)
+	}
+	if got := s.Resolve("p", "storage/flush", advertised); got != 90*time.Second {
+		t.Errorf("expected advertised method timeout, got %v", got)
+	}
+
+	err := s.Set(RPCTimeouts{
+		DefaultMS: 3000,
+		Methods:   map[string]int{"entities/list": 4000},
+		Plugins: map[string]PluginRPCTimeouts{
+			"p": {DefaultMS: 7000, Methods: map[string]int{"storage/flush": 1000}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	cases := []struct {
+		plugin, method string
+		want           time.Duration
+	}{
+		{"p", "storage/flush", time.Second},
+		{"p", "entities/list", 4 * time.Second},
+		{"p", "devices/list", 7 * time.Second},
+		{"q", "devices/list", 3 * time.Second},
+		{"q", "devices/refresh", 30 * time.Second},
+	}
+	for _, c := range cases {
+		adv := PluginRPCTimeouts{}
+		if c.plugin == "p" {
+			adv = advertised
+		}
+		if got := s.Resolve(c.plugin, c.method, adv); got != c.want {
+			t.Errorf("%s %s: expected %v, got %v", c.plugin, c.method, c.want, got)
+		}
+	}
+	if err := s.Set(RPCTimeouts{Plugins: map[string]PluginRPCTimeouts{"p": {DefaultMS: -1}}}); err == nil {
+		t.Error("expected negative timeouts to be rejected")
+	}
+}
+
+func TestRPCTimeouts_PersistAndAdvertised(t *testing.T) {
+	dir := t.TempDir()
+	s := newRPCTimeoutStore()
+	if err := s.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := s.Set(RPCTimeouts{Methods: map[string]int{"devices/refresh": 120000}}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	reloaded := newRPCTimeoutStore()
+	if err := reloaded.Load(dir); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := reloaded.Resolve("p", "devices/refresh", PluginRPCTimeouts{}); got != 2*time.Minute {
+		t.Errorf("expected persisted method timeout, got %v", got)
+	}
+
+	reg := []byte(`{"manifest":{"id":"p","rpc_timeouts":{"default_ms":2500,"methods":{"devices/refresh":60000}}},"rpc_subject":"plugins.p.rpc"}`)
+	adv := advertisedRPCTimeouts(reg)
+	if adv.DefaultMS != 2500 || adv.Methods["devices/refresh"] != 60000 {
+		t.Errorf("unexpected advertised timeouts %+v", adv)
+	}
+	if adv := advertisedRPCTimeouts([]byte(`{"manifest":{"id":"p"}}`)); adv.DefaultMS != 0 || adv.Methods != nil {
+		t.Errorf("expected no advertised timeouts, got %+v", adv)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	gwscripting "github.com/slidebolt/gateway/internal/scripting"
@@ -34,7 +36,7 @@ func ensureScriptRuntime() {
 	}
 	scriptRuntime = &scriptManager{
 		svc: gwscripting.Services{
-			Commands: commandService,
+			Commands: scriptCommands{svc: commandService},
 			Finder:   registryService,
 			Bus:      natsEventBus{nc: nc},
 			Logger:   slog.Default(),
@@ -72,6 +74,26 @@ func (m *scriptManager) Stop() {
 	}
 }
 
+// scriptRuntimeStats counts running VMs and their queued handler calls.
+type scriptRuntimeStats struct {
+	EntityVMs int
+	ChildVMs  int
+	Queued    int
+}
+
+func (m *scriptManager) stats() scriptRuntimeStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := scriptRuntimeStats{EntityVMs: len(m.vms), ChildVMs: len(m.children)}
+	for _, vm := range m.vms {
+		st.Queued += vm.QueueDepth()
+	}
+	for _, child := range m.children {
+		st.Queued += child.vm.QueueDepth()
+	}
+	return st
+}
+
 func (m *scriptManager) Install(pluginID, deviceID, entityID, source string) error {
 	if m == nil {
 		return nil
@@ -140,7 +162,7 @@ func (m *scriptManager) Remove(pluginID, deviceID, entityID string) {
 	}
 }
 
-func (m *scriptManager) NotifyCommand(pluginID, deviceID, entityID string, payload json.RawMessage) {
+func (m *scriptManager) NotifyCommand(pluginID, deviceID, entityID string, payload json.RawMessage, correlationID string) {
 	if m == nil {
 		return
 	}
@@ -163,7 +185,8 @@ func (m *scriptManager) NotifyCommand(pluginID, deviceID, entityID string, paylo
 		return
 	}
 
-	if err := vm.This.HandleCommand(action, params); err != nil && !errors.Is(err, gwscripting.ErrNoCommandHandler) {
+	cmd := gwscripting.IncomingCommand{Name: action, Params: params, CorrelationID: correlationID}
+	if err := vm.This.Deliver(cmd); err != nil && !errors.Is(err, gwscripting.ErrNoCommandHandler) {
 		slog.Warn("script OnCommand failed", "plugin_id", pluginID, "device_id", deviceID, "entity_id", entityID, "action", action, "error", err)
 	}
 }
@@ -282,3 +305,40 @@ type natsSub struct {
 func (s natsSub) Unsubscribe() error {
 	return s.sub.Unsubscribe()
 }
+
+// scriptCommands adapts the command service to the scripting runtime.
+type scriptCommands struct {
+	svc *Command
+}
+
+func (c scriptCommands) Submit(pluginID, deviceID, entityID string, payload json.RawMessage) (types.CommandStatus, error) {
+	return c.svc.Submit(pluginID, deviceID, entityID, payload)
+}
+
+// SubmitCorrelated submits a command on behalf of a script handling an event
+// or command with the given correlation ID.
+func (c scriptCommands) SubmitCorrelated(correlationID, pluginID, deviceID, entityID string, payload json.RawMessage) (types.CommandStatus, error) {
+	opts := commandOptions{Priority: CommandPriorityScript, CorrelationID: c.svc.rootCorrelation(correlationID)}
+	status, err := c.svc.SubmitWithOptions(pluginID, deviceID, entityID, payload, opts)
+	return status.CommandStatus, err
+}
+
+// SubmitAndWait waits for at most maxCommandWait, as the REST API does, since
+// the calling VM handles nothing else while it waits.
+func (c scriptCommands) SubmitAndWait(ctx context.Context, correlationID, pluginID, deviceID, entityID string, payload json.RawMessage, timeout time.Duration, confirm bool) (gwscripting.CommandWaitResult, error) {
+	if timeout > maxCommandWait {
+		timeout = maxCommandWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	opts := commandOptions{Priority: CommandPriorityScript, CorrelationID: c.svc.rootCorrelation(correlationID)}
+	res, err := c.svc.SubmitAndWait(ctx, pluginID, deviceID, entityID, payload, opts, confirm)
+	if err != nil {
+		return gwscripting.CommandWaitResult{}, err
+	}
+	return gwscripting.CommandWaitResult{
+		Status:  res.CommandStatus,
+		Outcome: string(res.Outcome),
+		State:   res.ConfirmedState,
+	}, nil
+}
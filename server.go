@@ -13,7 +13,7 @@ import (
 func buildRouter() (*gin.Engine, huma.API) {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(requestLogger(), gin.Recovery())
+	r.Use(correlationID(), requestLogger(), gin.Recovery(), pluginRPCDocs.serveSpec)
 	ensureScriptRuntime()
 
 	config := huma.DefaultConfig("SlideBolt Gateway API", "1.0.0")
@@ -33,6 +33,9 @@ func buildRouter() (*gin.Engine, huma.API) {
 	api := humagin.New(r, config)
 	registerRoutes(api)
 	registerCSVRoutes(r)
+	registerPluginRPCRoutes(r, api)
+	registerWebSocketRoutes(r, api)
+	r.GET("/metrics", metricsHandler)
 	if historyService != nil {
 		historyService.RegisterRoutes(api)
 		r.GET("/api/topics/subscribe", historyService.SSEHandler())
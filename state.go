@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	regsvc "github.com/slidebolt/registry"
@@ -13,6 +15,27 @@ import (
 type pluginRecord struct {
 	Registration types.Registration
 	Valid        bool
+	// Timeouts holds the RPC timeouts the plugin advertised in its manifest.
+	Timeouts PluginRPCTimeouts
+	// Manifest is the raw manifest from the last registration message.
+	Manifest json.RawMessage
+	// LastSeen is when the plugin last registered or answered a health check.
+	LastSeen    time.Time
+	Status      PluginStatus
+	StatusSince time.Time
+	// RPCSubjects records when each RPC subject last registered this plugin
+	// ID, to detect two processes claiming the same ID.
+	RPCSubjects map[string]time.Time
+	// Quarantine lists why the plugin failed validation. A quarantined plugin
+	// stays registered but is not routable.
+	Quarantine []string
+	// Methods are the extra RPC methods the plugin advertised, keyed by name.
+	Methods map[string]pluginRPCMethod
+}
+
+// routable reports whether RPCs and plugin searches may reach the plugin.
+func (r pluginRecord) routable() bool {
+	return r.Status != PluginOffline && len(r.Quarantine) == 0
 }
 
 var (
@@ -28,6 +51,10 @@ var (
 	dynamicEventService *DynamicEventService
 	scriptRuntime       *scriptManager
 	gatewayDataDir      string
+	pluginBreakers      = newPluginBreakerSet(breakerConfigFromEnv())
+	rpcTimeouts         = newRPCTimeoutStore()
+	metrics             = newGatewayMetrics()
+	pluginLiveness      = livenessConfigFromEnv()
 )
 
 type gatewayRuntimeInfo struct {
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/cucumber/godog"
@@ -24,6 +25,8 @@ type dynSubCtxKey struct{}
 
 type dynSubState struct {
 	subID string
+	// lastSeq is the stream sequence of the last event polled.
+	lastSeq uint64
 }
 
 func withDynSubState(ctx context.Context) (context.Context, *dynSubState) {
@@ -117,7 +120,7 @@ func ingestEvent(w *World, entityID, action string) error {
 }
 
 // pollSubEvents calls GET /api/events/subscriptions/{id}/events and decodes the response.
-func pollSubEvents(w *World, subID string) ([]types.EntityEventEnvelope, error) {
+func pollSubEvents(w *World, subID string) ([]SubscriptionEvent, error) {
 	path := fmt.Sprintf("/api/events/subscriptions/%s/events", url.PathEscape(subID))
 	resp, err := w.Harness.Get(path)
 	if err != nil {
@@ -142,7 +145,7 @@ func pollSubEvents(w *World, subID string) ([]types.EntityEventEnvelope, error)
 		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
 	}
 	var out struct {
-		Events []types.EntityEventEnvelope `json:"events"`
+		Events []SubscriptionEvent `json:"events"`
 	}
 	if err := json.Unmarshal(body, &out); err != nil {
 		return nil, fmt.Errorf("decode events: %w", err)
@@ -251,6 +254,9 @@ func stepSubHasNBufferedEvents(ctx context.Context, n int) error {
 			return err
 		}
 		if len(events) == n {
+			if n > 0 {
+				s.lastSeq = events[n-1].Seq
+			}
 			return nil
 		}
 		time.Sleep(20 * time.Millisecond)
@@ -291,6 +297,72 @@ func stepSubIsGone(ctx context.Context) error {
 	return nil
 }
 
+func stepResubscribeSinceLastEvent(ctx context.Context, label string) (context.Context, error) {
+	w := worldFrom(ctx)
+	s := getDynSubState(ctx)
+	k, v, ok := parseLabel(label)
+	if !ok {
+		return ctx, fmt.Errorf("invalid label %q", label)
+	}
+	if s.lastSeq == 0 {
+		return ctx, fmt.Errorf("no event with a stream sequence was received")
+	}
+	filter := EventFilter{
+		EntityQuery: types.SearchQuery{Labels: map[string][]string{k: {v}}},
+		SinceSeq:    s.lastSeq,
+	}
+	if err := w.do(w.Harness.Post("/api/events/subscriptions", filter)); err != nil {
+		return ctx, err
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := w.decodeLastBody(&out); err != nil {
+		return ctx, err
+	}
+	s.subID = out.ID
+	return ctx, nil
+}
+
+// stepSubReceivedInStreamOrder polls until n events have arrived, replayed
+// and live alike, and checks they follow the last one polled before without
+// repeats or reordering.
+func stepSubReceivedInStreamOrder(ctx context.Context, n int, actions string) error {
+	w := worldFrom(ctx)
+	s := getDynSubState(ctx)
+	var got []SubscriptionEvent
+	deadline := time.Now().Add(2 * time.Second)
+	for len(got) < n && time.Now().Before(deadline) {
+		events, err := pollSubEvents(w, s.subID)
+		if err != nil {
+			return err
+		}
+		got = append(got, events...)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(got) != n {
+		return fmt.Errorf("expected %d events, got %d", n, len(got))
+	}
+	var seen []string
+	prev := s.lastSeq
+	for _, ev := range got {
+		if ev.Seq <= prev {
+			return fmt.Errorf("event seq %d does not follow %d", ev.Seq, prev)
+		}
+		prev = ev.Seq
+		var payload struct {
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal(ev.Payload, &payload)
+		seen = append(seen, payload.Type)
+	}
+	if strings.Join(seen, ",") != actions {
+		return fmt.Errorf("expected events %s, got %s", actions, strings.Join(seen, ","))
+	}
+	s.lastSeq = prev
+	return nil
+}
+
 func stepPluginRegistersNewEntityWithLabel(ctx context.Context, pluginID, entityID, label string) (context.Context, error) {
 	w := worldFrom(ctx)
 	return ctx, addEntityToPlugin(w, pluginID, entityID, label, "light")
@@ -321,6 +393,10 @@ func registerEventSubscriptionSteps(sc *godog.ScenarioContext) {
 		stepSubHasNBufferedEvents)
 	sc.Step(`^I delete the subscription$`, stepDeleteSub)
 	sc.Step(`^the subscription is gone$`, stepSubIsGone)
+	sc.Step(`^I resubscribe with label query "([^"]*)" since the last received event$`,
+		stepResubscribeSinceLastEvent)
+	sc.Step(`^the subscription has received (\d+) events in stream order: "([^"]*)"$`,
+		stepSubReceivedInStreamOrder)
 	sc.Step(`^plugin "([^"]*)" registers a new entity "([^"]*)" with label "([^"]*)"$`,
 		stepPluginRegistersNewEntityWithLabel)
 }
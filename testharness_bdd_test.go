@@ -111,7 +111,7 @@ func NewHarness(tmpDir string) (*Harness, error) {
 	subscribeRegistry()
 
 	dynamicEventService = newDynamicEventService()
-	if err := dynamicEventService.Start(conn); err != nil {
+	if err := dynamicEventService.Start(conn, jsCtx); err != nil {
 		return nil, fmt.Errorf("dynamicEventService Start: %w", err)
 	}
 
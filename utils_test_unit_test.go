@@ -233,6 +233,11 @@ func ResetGlobals() {
 	regMu.Lock()
 	registry = make(map[string]pluginRecord)
 	regMu.Unlock()
+	pluginBreakers.Reset()
+	rpcTimeouts = newRPCTimeoutStore()
+	metrics = newGatewayMetrics()
+	diag = &logDiagnostics{diskWrites: make(map[string]*diskWriteState)}
+	pluginRPCDocs = newRPCMethodDocs()
 }
 
 // setupCommandServiceHarness sets up nc, registryService, and commandService for command tests